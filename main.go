@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/rs/zerolog/log"
@@ -23,10 +24,54 @@ var (
 
 	builderConfigFlag       = kingpin.Flag("builder-config", "The Ziplinee server passes in this json structure to parameterize the build, set trusted images and inject credentials.").Envar("BUILDER_CONFIG").String()
 	builderConfigPath       = kingpin.Flag("builder-config-path", "The path to the builder config json stored in a mounted file, to parameterize the build, set trusted images and inject credentials.").Envar("BUILDER_CONFIG_PATH").String()
+	trustedImagesPath       = kingpin.Flag("trusted-images-path", "The path to a yaml or json list of trusted images in a mounted file, like a configmap, merged into the trusted images of the builder config; images in this file replace those with the same path.").Envar("TRUSTED_IMAGES_PATH").String()
 	secretDecryptionKey     = kingpin.Flag("secret-decryption-key", "The AES-256 key used to decrypt secrets that have been encrypted with it.").Envar("SECRET_DECRYPTION_KEY").String()
 	secretDecryptionKeyPath = kingpin.Flag("secret-decryption-key-path", "The path to the AES-256 key used to decrypt secrets that have been encrypted with it.").Default("/secrets/secretDecryptionKey").OverrideDefaultFromEnvar("SECRET_DECRYPTION_KEY_PATH").String()
 	runAsJob                = kingpin.Flag("run-as-job", "To run the builder as a job and prevent build failures to fail the job.").Default("false").OverrideDefaultFromEnvar("RUN_AS_JOB").Bool()
+	jobFatalExitCode        = kingpin.Flag("run-as-job-fatal-exit-code", "The exit code when the builder runs as a job and hits a fatal error; 0 keeps the job from failing, a non-zero code surfaces the failure to kubernetes.").Default("0").OverrideDefaultFromEnvar("RUN_AS_JOB_FATAL_EXIT_CODE").Int()
 	podName                 = kingpin.Flag("pod-name", "The name of the pod.").Envar("POD_NAME").String()
+	releaseLease            = kingpin.Flag("release-lease", "Acquire a lease from the api before running a release, to prevent overlapping releases of the same pipeline to the same target.").Default("false").OverrideDefaultFromEnvar("RELEASE_LEASE").Bool()
+	releaseLeaseWait        = kingpin.Flag("release-lease-wait", "Wait for the release lease if it's held by another job instead of failing right away.").Default("true").OverrideDefaultFromEnvar("RELEASE_LEASE_WAIT").Bool()
+	releaseLeaseTimeout     = kingpin.Flag("release-lease-timeout", "The maximum time to wait for the release lease.").Default("30m").OverrideDefaultFromEnvar("RELEASE_LEASE_TIMEOUT").Duration()
+	admissionWebhookURL     = kingpin.Flag("admission-webhook-url", "The url of a webhook to post the manifest and build metadata to before running any stage; a non-2xx response denies the build.").Envar("ADMISSION_WEBHOOK_URL").String()
+	stageEventsURL          = kingpin.Flag("stage-events-url", "The url to send an event to whenever a stage starts or finishes, for uis to update while the build runs.").Envar("STAGE_EVENTS_URL").String()
+	defaultBranch           = kingpin.Flag("default-branch", "The branch to use in when clauses if the git branch is empty, like for detached head checkouts; defaults to the branch in the builder config.").Envar("DEFAULT_BRANCH").String()
+	incrementalLogsURL      = kingpin.Flag("incremental-logs-url", "The url to send the log lines of running stages to at the incremental logs interval, so partial logs survive the pod getting killed.").Envar("INCREMENTAL_LOGS_URL").String()
+	incrementalLogsInterval = kingpin.Flag("incremental-logs-interval", "The interval at which to send the log lines of running stages to the incremental logs url.").Default("30s").OverrideDefaultFromEnvar("INCREMENTAL_LOGS_INTERVAL").Duration()
+	statusBadgeURL          = kingpin.Flag("status-badge-url", "The url to put a small json document with the final build status to, for rendering a status badge.").Envar("STATUS_BADGE_URL").String()
+	gitCloneDepth           = kingpin.Flag("git-clone-depth", "The depth to clone the repository with, passed to the checkout as ZIPLINEE_GIT_CLONE_DEPTH; 0 clones the full history.").Default("0").OverrideDefaultFromEnvar("GIT_CLONE_DEPTH").Int()
+	gitRemote               = kingpin.Flag("git-remote", "The name of the git remote to read the repository source, owner and name from, for checkouts that don't use origin.").Default("origin").OverrideDefaultFromEnvar("GIT_REMOTE").String()
+	gitLFS                  = kingpin.Flag("git-lfs", "Fetch git lfs files during checkout, passed to the checkout as ZIPLINEE_GIT_LFS.").Default("false").OverrideDefaultFromEnvar("GIT_LFS").Bool()
+	obfuscateIPAddresses    = kingpin.Flag("obfuscate-ip-addresses", "Mask ipv4 and ipv6 addresses in the build logs.").Default("false").OverrideDefaultFromEnvar("OBFUSCATE_IP_ADDRESSES").Bool()
+	obfuscateCredNames      = kingpin.Flag("obfuscate-credential-names", "Mask the names of injected credentials in the build logs as well, for orgs where those are sensitive.").Default("false").OverrideDefaultFromEnvar("OBFUSCATE_CREDENTIAL_NAMES").Bool()
+	multiLineSecretMinLen   = kingpin.Flag("multi-line-secret-min-line-length", "The minimum length of a line of a multi-line secret, like a pem key, to get masked on its own when it shows up in the logs; shorter lines are left alone to avoid masking trivial lines.").Default("4").OverrideDefaultFromEnvar("MULTI_LINE_SECRET_MIN_LINE_LENGTH").Int()
+	streamLogsToStdout      = kingpin.Flag("stream-logs-to-stdout", "When running as a job also write readable log lines to stdout as they arrive, for tailing the pod logs.").Default("false").OverrideDefaultFromEnvar("STREAM_LOGS_TO_STDOUT").Bool()
+	postLogsTimeout         = kingpin.Flag("post-logs-timeout", "The timeout for shipping the build logs to the api.").Default("60s").OverrideDefaultFromEnvar("POST_LOGS_TIMEOUT").Duration()
+	builderEventsTimeout    = kingpin.Flag("builder-events-timeout", "The timeout for sending builder events to the api.").Default("10s").OverrideDefaultFromEnvar("BUILDER_EVENTS_TIMEOUT").Duration()
+	logShippingFailure      = kingpin.Flag("log-shipping-failure-policy", "What to do with the build status when the build logs can't be shipped to the api: ignore keeps it, fail marks the build as failed.").Default("ignore").OverrideDefaultFromEnvar("LOG_SHIPPING_FAILURE_POLICY").String()
+	cleanEventDelay         = kingpin.Flag("clean-event-delay", "The time to wait before sending the clean event that lets the pod get torn down, to give log shipping time to complete.").Default("0s").OverrideDefaultFromEnvar("CLEAN_EVENT_DELAY").Duration()
+	cancelJobTimeout        = kingpin.Flag("cancel-job-timeout", "The timeout for requesting the api to cancel the job.").Default("60s").OverrideDefaultFromEnvar("CANCEL_JOB_TIMEOUT").Duration()
+	hashDNSLabels           = kingpin.Flag("hash-dns-labels", "Append a short hash of the original value to dns safe labels like ZIPLINEE_GIT_BRANCH_DNS_SAFE when they get truncated to 63 characters, to keep long branch names from colliding.").Default("false").OverrideDefaultFromEnvar("HASH_DNS_LABELS").Bool()
+	skipBadCredentials      = kingpin.Flag("skip-undecryptable-credentials", "Skip credentials that fail to decrypt with a warning instead of failing the build, so an unrelated broken credential doesn't block it.").Default("false").OverrideDefaultFromEnvar("SKIP_UNDECRYPTABLE_CREDENTIALS").Bool()
+	validateDecryptionKey   = kingpin.Flag("validate-secret-decryption-key", "Fail fast when the secret decryption key isn't a 32 byte AES-256 key, either raw or base64 encoded, instead of failing on every secret it decrypts.").Default("true").OverrideDefaultFromEnvar("VALIDATE_SECRET_DECRYPTION_KEY").Bool()
+	buildLogFile            = kingpin.Flag("build-log-file", "The path to write the build log to as json after builds run by a gocd agent, which have no api to ship it to.").Envar("BUILD_LOG_FILE").String()
+	compressBuildLogFile    = kingpin.Flag("compress-build-log-file", "Gzip compress the build log file, which also happens when its path ends with .gz.").Default("false").OverrideDefaultFromEnvar("COMPRESS_BUILD_LOG_FILE").Bool()
+	workDirFallback         = kingpin.Flag("workdir-fallback", "Fall back to the current directory as working directory when ZIPLINEE_WORKDIR isn't set, instead of failing the build.").Default("false").OverrideDefaultFromEnvar("WORKDIR_FALLBACK").Bool()
+	parseGitDirectory       = kingpin.Flag("parse-git-directory", "Read the git revision and branch from the .git directory instead of running git, for builder images without git.").Default("false").OverrideDefaultFromEnvar("PARSE_GIT_DIRECTORY").Bool()
+	prefixParallelStageLogs = kingpin.Flag("prefix-parallel-stage-logs", "Prefix log lines of parallel stages with the stage name, to tell interleaved lines apart.").Default("false").OverrideDefaultFromEnvar("PREFIX_PARALLEL_STAGE_LOGS").Bool()
+	reportResourceUsage     = kingpin.Flag("report-resource-usage", "Sample the memory and cpu usage of the builder itself and report the peak values in the build log.").Default("false").OverrideDefaultFromEnvar("REPORT_RESOURCE_USAGE").Bool()
+	resourceUsageInterval   = kingpin.Flag("resource-usage-interval", "The interval at which to sample the resource usage of the builder.").Default("5s").OverrideDefaultFromEnvar("RESOURCE_USAGE_INTERVAL").Duration()
+	infraRetries            = kingpin.Flag("infrastructure-retries", "The number of times to retry the build if it fails due to the infrastructure, like the docker daemon or an unreachable registry, instead of a stage.").Default("0").OverrideDefaultFromEnvar("INFRASTRUCTURE_RETRIES").Int()
+	infraRetryDelay         = kingpin.Flag("infrastructure-retry-delay", "The time to wait before retrying a build that failed due to the infrastructure.").Default("10s").OverrideDefaultFromEnvar("INFRASTRUCTURE_RETRY_DELAY").Duration()
+	maxStages               = kingpin.Flag("max-stages", "The maximum number of stages, including nested ones, a manifest can have before the build fails without running any of them, to guard against runaway generated manifests; 0 doesn't limit them.").Default("0").OverrideDefaultFromEnvar("MAX_STAGES").Int()
+	uninterruptibleTimeout  = kingpin.Flag("uninterruptible-stage-timeout", "The maximum time to wait for stages marked as uninterruptible to finish after the build got canceled, before stopping them anyway.").Default("15m").OverrideDefaultFromEnvar("UNINTERRUPTIBLE_STAGE_TIMEOUT").Duration()
+	serviceReadinessGrace   = kingpin.Flag("service-readiness-grace-period", "The maximum time to wait for the services of a stage to start and pass their readiness probe before the stage fails; single-stage services then have to become ready, regardless of their readinessFailure property. 0 waits indefinitely.").Default("0s").OverrideDefaultFromEnvar("SERVICE_READINESS_GRACE_PERIOD").Duration()
+	cleanupTimeout          = kingpin.Flag("cleanup-timeout", "The maximum time to wait for stopping containers and deleting networks during teardown, after which the builder continues to send its final events; 0 waits indefinitely.").Default("2m").OverrideDefaultFromEnvar("CLEANUP_TIMEOUT").Duration()
+	simulateStageFailures   = kingpin.Flag("allow-simulated-stage-failures", "Let ZIPLINEE_SIMULATE_STAGE_FAILURE name a stage to fail without running it, for chaos testing; only enable this for builders of non-production pipelines.").Default("false").OverrideDefaultFromEnvar("ALLOW_SIMULATED_STAGE_FAILURES").Bool()
+	maxCapturedOutput       = kingpin.Flag("max-captured-output-size", "The maximum number of bytes a stage can capture from its output into an envvar for later stages with the captureOutput property; the rest gets truncated.").Default("65536").OverrideDefaultFromEnvar("MAX_CAPTURED_OUTPUT_SIZE").Int()
+	invalidUTF8Handling     = kingpin.Flag("invalid-utf8-handling", "How to sanitize invalid utf8 bytes in the log output of stages, either replace (with the unicode replacement character) or escape (as hex like \\x80).").Default("replace").OverrideDefaultFromEnvar("INVALID_UTF8_HANDLING").String()
+	keepFailedContainers    = kingpin.Flag("keep-failed-containers", "Keep the containers of failed stages around for debugging, also when the builder config removes stage containers when they exit.").Default("false").OverrideDefaultFromEnvar("KEEP_FAILED_CONTAINERS").Bool()
+	logSkippedWhenClauses   = kingpin.Flag("log-skipped-when-clauses", "Add the when clause and the parameters it got evaluated with to the build log of stages and services it skipped, to tell why without debug logging.").Default("true").OverrideDefaultFromEnvar("LOG_SKIPPED_WHEN_CLAUSES").Bool()
 
 	runAsReadinessProbe     = kingpin.Flag("run-as-readiness-probe", "Indicates whether the builder should run as readiness probe.").Envar("RUN_AS_READINESS_PROBE").Bool()
 	readinessScheme         = kingpin.Flag("readiness-scheme", "The scheme to use for the readiness probe.").Envar("READINESS_SCHEME").String()
@@ -34,6 +79,7 @@ var (
 	readinessPort           = kingpin.Flag("readiness-port", "The port to use for the readiness probe.").Envar("READINESS_PORT").Int()
 	readinessPath           = kingpin.Flag("readiness-path", "The path to use for the readiness probe.").Envar("READINESS_PATH").String()
 	readinessHostname       = kingpin.Flag("readiness-hostname", "The hostname to set as host header for the readiness probe.").Envar("READINESS_HOSTNAME").String()
+	readinessBodyMatch      = kingpin.Flag("readiness-body-match", "A substring the response body of the readiness probe should contain, or a json path like $.status=UP it should match, before the service counts as ready.").Envar("READINESS_BODY_MATCH").String()
 	readinessTimeoutSeconds = kingpin.Flag("readiness-timeout-seconds", "The timeout to use for the readiness probe.").Envar("READINESS_TIMEOUT_SECONDS").Int()
 )
 
@@ -54,35 +100,206 @@ func main() {
 
 	// this builder binary is mounted inside a scratch container to run as a readiness probe against service containers
 	if *runAsReadinessProbe {
-		ciBuilder.RunReadinessProbe(ctx, *readinessScheme, *readinessHost, *readinessPort, *readinessPath, *readinessHostname, *readinessTimeoutSeconds)
+		ciBuilder.RunReadinessProbe(ctx, *readinessScheme, *readinessHost, *readinessPort, *readinessPath, *readinessHostname, *readinessBodyMatch, *readinessTimeoutSeconds)
 	}
 
 	// init secret helper
-	decryptionKey := getDecryptionKey()
-	secretHelper := crypt.NewSecretHelper(decryptionKey, false)
+	decryptionKey, base64EncodedKey := getDecryptionKey()
+	secretHelper := crypt.NewSecretHelper(decryptionKey, base64EncodedKey)
 
 	// bootstrap
 	tailLogsChannel := make(chan contracts.TailLogLine, 10000)
 	obfuscator := builder.NewObfuscator(secretHelper)
-	envvarHelper := builder.NewEnvvarHelper("ZIPLINEE_", secretHelper, obfuscator)
+	if *obfuscateIPAddresses {
+		obfuscator.EnableIPAddressObfuscation()
+	}
+	if *obfuscateCredNames {
+		obfuscator.EnableCredentialNameObfuscation()
+	}
+	obfuscator.SetMultiLineSecretMinLineLength(*multiLineSecretMinLen)
+	envvarHelper, err := builder.NewEnvvarHelper("ZIPLINEE_", secretHelper, obfuscator)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create envvar helper")
+	}
+	if *parseGitDirectory {
+		envvarHelper.EnableGitDirectoryParsing()
+	}
+	if *workDirFallback {
+		envvarHelper.EnableWorkDirFallback()
+	}
+	envvarHelper.SetGitCloneOptions(*gitCloneDepth, *gitLFS)
+	envvarHelper.SetGitRemote(*gitRemote)
+	envvarHelper.SetPodName(*podName)
+	if *hashDNSLabels {
+		envvarHelper.EnableDNSLabelHashing()
+	}
 	whenEvaluator := builder.NewWhenEvaluator(envvarHelper)
-	builderConfig, originalEncryptedCredentials := loadBuilderConfig(secretHelper, envvarHelper)
+	builderConfig, originalEncryptedCredentials, builderConfigExtensions := loadBuilderConfig(secretHelper, envvarHelper)
+	if *defaultBranch != "" {
+		whenEvaluator.SetDefaultBranch(*defaultBranch)
+	} else if builderConfig.Git != nil {
+		whenEvaluator.SetDefaultBranch(builderConfig.Git.RepoBranch)
+	}
+	whenEvaluator.SetParams(builderConfigExtensions.Params)
+	envvarHelper.SetDefaultEnvvars(builderConfigExtensions.DefaultEnvvars)
+	obfuscator.SetObfuscationBypass(builderConfigExtensions.MinSecretLength, builderConfigExtensions.PublicValues)
 	containerRunner := builder.NewDockerRunner(envvarHelper, obfuscator, builderConfig, tailLogsChannel, true)
+	if builderConfigExtensions.PullProgressLogInterval != "" {
+		pullProgressLogInterval, err := time.ParseDuration(builderConfigExtensions.PullProgressLogInterval)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to parse pull progress log interval %v", builderConfigExtensions.PullProgressLogInterval)
+		}
+		containerRunner.EnablePullProgressLogging(pullProgressLogInterval)
+	}
+	if builderConfigExtensions.StageResourceUsageInterval != "" {
+		stageResourceUsageInterval, err := time.ParseDuration(builderConfigExtensions.StageResourceUsageInterval)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to parse stage resource usage interval %v", builderConfigExtensions.StageResourceUsageInterval)
+		}
+		containerRunner.EnableStageResourceUsageSampling(stageResourceUsageInterval)
+	}
+	if builderConfigExtensions.DockerClientKeepAlive != "" || builderConfigExtensions.DockerClientIdleTimeout != "" {
+		var dockerClientKeepAlive, dockerClientIdleTimeout time.Duration
+		var err error
+		if builderConfigExtensions.DockerClientKeepAlive != "" {
+			dockerClientKeepAlive, err = time.ParseDuration(builderConfigExtensions.DockerClientKeepAlive)
+			if err != nil {
+				log.Fatal().Err(err).Msgf("Failed to parse docker client keep-alive %v", builderConfigExtensions.DockerClientKeepAlive)
+			}
+		}
+		if builderConfigExtensions.DockerClientIdleTimeout != "" {
+			dockerClientIdleTimeout, err = time.ParseDuration(builderConfigExtensions.DockerClientIdleTimeout)
+			if err != nil {
+				log.Fatal().Err(err).Msgf("Failed to parse docker client idle timeout %v", builderConfigExtensions.DockerClientIdleTimeout)
+			}
+		}
+		containerRunner.SetDockerClientKeepAlive(dockerClientKeepAlive, dockerClientIdleTimeout)
+	}
+	containerRunner.SetCredentialPrecedence(builderConfigExtensions.CredentialPrecedence)
+	containerRunner.SetMaxCapturedOutputSize(*maxCapturedOutput)
+	containerRunner.SetInvalidUTF8Handling(*invalidUTF8Handling)
+	containerRunner.SetContainerRemoval(builderConfigExtensions.AutoRemoveContainers, *keepFailedContainers)
+	containerRunner.SetWorkDirMountPath(builderConfigExtensions.WorkDirMountPath)
+	if len(builderConfigExtensions.DecryptionKeyImages) > 0 {
+		containerRunner.GrantDecryptionKey(decryptionKey, builderConfigExtensions.DecryptionKeyImages)
+	}
+	if builderConfigExtensions.MaxConcurrentPulls > 0 {
+		containerRunner.EnableConcurrentPullLimit(builderConfigExtensions.MaxConcurrentPulls)
+	}
 	pipelineRunner := builder.NewPipelineRunner(envvarHelper, whenEvaluator, containerRunner, *runAsJob, tailLogsChannel, applicationInfo)
+	pipelineRunner.SetUninterruptibleStageTimeout(*uninterruptibleTimeout)
+	pipelineRunner.SetCleanupTimeout(*cleanupTimeout)
+	pipelineRunner.SetServiceReadinessGracePeriod(*serviceReadinessGrace)
+	pipelineRunner.SetAllowedRegistries(builderConfigExtensions.AllowedRegistries)
+	pipelineRunner.SetTrustedImageMirror(builderConfigExtensions.TrustedImageMirror)
+	if *simulateStageFailures {
+		pipelineRunner.EnableSimulatedStageFailures()
+	}
+	if *logSkippedWhenClauses {
+		pipelineRunner.EnableWhenClauseLogging(obfuscator)
+	}
+	if *streamLogsToStdout {
+		pipelineRunner.EnableLogStreaming(os.Stdout)
+	}
+	if *prefixParallelStageLogs {
+		pipelineRunner.EnableParallelStageLogPrefixing()
+	}
+
+	if *buildLogFile != "" {
+		ciBuilder.EnableBuildLogFile(*buildLogFile)
+		if *compressBuildLogFile {
+			ciBuilder.EnableBuildLogFileCompression()
+		}
+	}
 
 	// detect controlling server
 	ciServer := envvarHelper.GetCiServer()
 	if ciServer == "gocd" {
 		ciBuilder.RunGocdAgentBuild(ctx, pipelineRunner, containerRunner, envvarHelper, obfuscator, builderConfig, originalEncryptedCredentials)
 	} else if ciServer == "ziplinee" {
-		endOfLifeHelper := builder.NewEndOfLifeHelper(*runAsJob, builderConfig, *podName)
+		endOfLifeHelper := builder.NewEndOfLifeHelper(*runAsJob, builderConfig, envvarHelper.GetPodName())
+		endOfLifeHelper.SetBuilderEventTags(builderConfigExtensions.Tags)
+		endOfLifeHelper.SetBuilderVersion(applicationInfo)
+		ciBuilder.SetGlobalWhen(whenEvaluator, builderConfigExtensions.When)
+		ciBuilder.SetManifestAPIVersion(builderConfigExtensions.ManifestAPIVersion)
+		ciBuilder.SetInfrastructureRetries(*infraRetries, *infraRetryDelay)
+		ciBuilder.SetMaxStages(*maxStages)
+		endOfLifeHelper.SetHTTPTimeouts(*postLogsTimeout, *builderEventsTimeout, *cancelJobTimeout)
+		endOfLifeHelper.SetRunAsJobFatalExitCode(*jobFatalExitCode)
+		endOfLifeHelper.SetCleanEventDelay(*cleanEventDelay)
+		endOfLifeHelper.SetLogShippingFailurePolicy(*logShippingFailure)
+		endOfLifeHelper.SetAdditionalAPIEndpoints(builderConfigExtensions.AdditionalAPIEndpoints, builderConfigExtensions.APIEndpointsSuccessPolicy)
+		if *releaseLease {
+			endOfLifeHelper.EnableReleaseLease(*releaseLeaseWait, *releaseLeaseTimeout)
+		}
+		if *admissionWebhookURL != "" {
+			endOfLifeHelper.EnableAdmissionWebhook(*admissionWebhookURL)
+		}
+		if *stageEventsURL != "" {
+			endOfLifeHelper.EnableStageEvents(*stageEventsURL)
+			pipelineRunner.EnableStageEvents(endOfLifeHelper)
+		}
+		if *incrementalLogsURL != "" {
+			endOfLifeHelper.EnableIncrementalLogs(*incrementalLogsURL)
+			pipelineRunner.EnableIncrementalLogFlushing(endOfLifeHelper, *incrementalLogsInterval)
+		}
+		if *statusBadgeURL != "" {
+			endOfLifeHelper.EnableStatusBadge(*statusBadgeURL)
+		}
+		if *reportResourceUsage {
+			ciBuilder.EnableResourceUsageReporting(*resourceUsageInterval)
+		}
 		ciBuilder.RunZiplineeBuildJob(ctx, pipelineRunner, containerRunner, envvarHelper, obfuscator, endOfLifeHelper, builderConfig, originalEncryptedCredentials, *runAsJob)
 	} else {
 		log.Warn().Msgf("The CI Server (\"%s\") is not recognized, exiting.", ciServer)
 	}
 }
 
-func loadBuilderConfig(secretHelper crypt.SecretHelper, envvarHelper builder.EnvvarHelper) (builderConfig contracts.BuilderConfig, credentialsBytes []byte) {
+// builderConfigExtensions holds builder config fields that aren't part of contracts.BuilderConfig
+type builderConfigExtensions struct {
+	// Tags are free-form tags to pass on to the api in builder events
+	Tags map[string]string `json:"tags,omitempty"`
+	// When is the manifest-level when clause deciding whether any stage runs at all
+	When string `json:"when,omitempty"`
+	// ManifestAPIVersion is the api version of the manifest, to fail for manifests newer than the builder supports
+	ManifestAPIVersion int `json:"manifestApiVersion,omitempty"`
+	// PullProgressLogInterval is the duration in between progress log lines while pulling images, like 30s; empty disables them
+	PullProgressLogInterval string `json:"pullProgressLogInterval,omitempty"`
+	// MaxConcurrentPulls is the maximum number of images pulled at the same time; 0 doesn't limit them
+	MaxConcurrentPulls int `json:"maxConcurrentPulls,omitempty"`
+	// StageResourceUsageInterval is the duration in between samples of the resource usage of stage containers, like 5s; empty disables sampling
+	StageResourceUsageInterval string `json:"stageResourceUsageInterval,omitempty"`
+	// CredentialPrecedence decides which credential wins when several apply to a stage, either declaration-order (the default) or most-specific
+	CredentialPrecedence string `json:"credentialPrecedence,omitempty"`
+	// Params holds the release or build parameters, available in when clauses as params.<name>
+	Params map[string]interface{} `json:"params,omitempty"`
+	// DefaultEnvvars holds envvars like proxy settings and mirror urls for every stage and service, overridden by the global and stage envvars of the manifest
+	DefaultEnvvars map[string]string `json:"defaultEnvvars,omitempty"`
+	// DockerClientKeepAlive is the tcp keep-alive period of docker client connections, like 30s; empty keeps the default
+	DockerClientKeepAlive string `json:"dockerClientKeepAlive,omitempty"`
+	// DockerClientIdleTimeout is the time after which idle docker client connections get closed, like 90s; empty keeps the default
+	DockerClientIdleTimeout string `json:"dockerClientIdleTimeout,omitempty"`
+	// AllowedRegistries are the registries, like gcr.io or gcr.io/ziplinee, stage and service images can be pulled from; trusted images are always allowed and an empty list allows any registry
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// TrustedImageMirror is a registry mirror, like mirror.gcr.io, to pull trusted images from when pulling them from their own registry fails; empty fails the stage instead
+	TrustedImageMirror string `json:"trustedImageMirror,omitempty"`
+	// MinSecretLength is the minimum length of a secret value to get masked in the logs, to keep short secrets from masking common words; 0 masks secrets of any length
+	MinSecretLength int `json:"minSecretLength,omitempty"`
+	// PublicValues are known-public values, like true or localhost, never masked in the logs even if a secret holds them
+	PublicValues []string `json:"publicValues,omitempty"`
+	// AdditionalAPIEndpoints are apis, each with their own jwt, to send builder events and logs to next to the ci server api, for instance while migrating to a new api
+	AdditionalAPIEndpoints []builder.APIEndpoint `json:"additionalApiEndpoints,omitempty"`
+	// APIEndpointsSuccessPolicy decides whether sending builder events and logs succeeds if all apis (the default) or any api accepts them
+	APIEndpointsSuccessPolicy string `json:"apiEndpointsSuccessPolicy,omitempty"`
+	// DecryptionKeyImages are the paths of trusted images, like extensions re-encrypting secrets, that get the decryption key as ZIPLINEE_DECRYPTION_KEY; untrusted images never get it
+	DecryptionKeyImages []string `json:"decryptionKeyImages,omitempty"`
+	// AutoRemoveContainers removes stage containers when they exit, to keep stopped containers from piling up on reused agents
+	AutoRemoveContainers bool `json:"autoRemoveContainers,omitempty"`
+	// WorkDirMountPath is the path to mount the work directory at in stage containers using the default working directory, for images whose own content is at /ziplinee-work
+	WorkDirMountPath string `json:"workDirMountPath,omitempty"`
+}
+
+func loadBuilderConfig(secretHelper crypt.SecretHelper, envvarHelper builder.EnvvarHelper) (builderConfig contracts.BuilderConfig, credentialsBytes []byte, extensions builderConfigExtensions) {
 	// read builder config either from file or envvar
 	var builderConfigJSON []byte
 	if *builderConfigPath != "" {
@@ -100,7 +317,6 @@ func loadBuilderConfig(secretHelper crypt.SecretHelper, envvarHelper builder.Env
 		log.Debug().Msg("Reading builder config from envvar BUILDER_CONFIG...")
 
 		builderConfigJSON = []byte(*builderConfigFlag)
-		os.Unsetenv("BUILDER_CONFIG")
 
 	} else {
 
@@ -108,16 +324,30 @@ func loadBuilderConfig(secretHelper crypt.SecretHelper, envvarHelper builder.Env
 
 	}
 
+	// avoid leaking the builder config and secret decryption key into stages, also when the config got read from file
+	err := builder.UnsetSensitiveBuilderEnvvars()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to unset builder config and secret decryption key envvars")
+	}
+
 	// unmarshal builder config
-	err := json.Unmarshal(builderConfigJSON, &builderConfig)
+	err = json.Unmarshal(builderConfigJSON, &builderConfig)
 	if err != nil {
 		log.Fatal().Err(err).Interface("builderConfigJSON", builderConfigJSON).Msg("Failed to unmarshal builder config")
 	}
 
-	// unmarshal a second time to be able to return the original unaltered credentials for the obfuscator to extract secrets from it
-	credentialsBytes, err = json.Marshal(builderConfig.Credentials)
+	// unmarshal the fields that aren't part of contracts.BuilderConfig
+	err = json.Unmarshal(builderConfigJSON, &extensions)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to marshal credentials")
+		log.Fatal().Err(err).Msg("Failed to unmarshal builder config extensions")
+	}
+
+	// merge the centrally managed trusted images
+	if *trustedImagesPath != "" {
+		builderConfig.TrustedImages, err = builder.MergeTrustedImagesFromFile(builderConfig.TrustedImages, *trustedImagesPath)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to merge trusted images from file at %v", *trustedImagesPath)
+		}
 	}
 
 	// ensure GetPipelineName does not fail below
@@ -127,33 +357,24 @@ func loadBuilderConfig(secretHelper crypt.SecretHelper, envvarHelper builder.Env
 	}
 
 	// decrypt all credentials
-	decryptedCredentials := []*contracts.CredentialConfig{}
-	for _, c := range builderConfig.Credentials {
-
-		// loop all additional properties and decrypt
-		decryptedAdditionalProperties := map[string]interface{}{}
-		for key, value := range c.AdditionalProperties {
-			if s, isString := value.(string); isString {
-				decryptedAdditionalProperties[key], err = secretHelper.DecryptAllEnvelopes(s, envvarHelper.GetPipelineName())
-				if err != nil {
-					log.Fatal().Err(err).Msgf("Failed decrypting credential %v property %v", c.Name, key)
-				}
-			} else {
-				decryptedAdditionalProperties[key] = value
-			}
-		}
-		c.AdditionalProperties = decryptedAdditionalProperties
+	decryptedCredentials, keptCredentials, err := builder.DecryptCredentials(secretHelper, builderConfig.Credentials, envvarHelper.GetPipelineName(), *skipBadCredentials)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed decrypting credentials")
+	}
 
-		decryptedCredentials = append(decryptedCredentials, c)
+	// marshal the original unaltered credentials for the obfuscator to extract secrets from it; skipped credentials are left out, since they can't be decrypted
+	credentialsBytes, err = json.Marshal(keptCredentials)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to marshal credentials")
 	}
 	builderConfig.Credentials = decryptedCredentials
 
 	return
 }
 
-func getDecryptionKey() string {
+func getDecryptionKey() (decryptionKey string, base64Encoded bool) {
 	// support both base64 encoded decryption key and non-encoded or mounted as secret
-	decryptionKey := *secretDecryptionKey
+	decryptionKey = *secretDecryptionKey
 	if *secretDecryptionKeyPath != "" && foundation.FileExists(*secretDecryptionKeyPath) {
 		secretDecryptionKeyBytes, err := os.ReadFile(*secretDecryptionKeyPath)
 		if err != nil {
@@ -163,5 +384,14 @@ func getDecryptionKey() string {
 		decryptionKey = string(secretDecryptionKeyBytes)
 	}
 
-	return decryptionKey
+	if !*validateDecryptionKey {
+		return decryptionKey, false
+	}
+
+	base64Encoded, err := builder.ValidateDecryptionKey(decryptionKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid secret decryption key")
+	}
+
+	return decryptionKey, base64Encoded
 }
@@ -0,0 +1,78 @@
+package builder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"strings"
+
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+)
+
+// buildLogFileGzipExtension makes the build log file get gzip compressed without having to enable compression
+const buildLogFileGzipExtension = ".gz"
+
+// writeBuildLogFile writes the build log steps as json to the file at path, for builds without an api to ship the logs to;
+// the secrets in the log lines always get masked first, like in the logs shipped to the api, and the file gets gzip compressed if compress is set or the path ends with .gz
+func writeBuildLogFile(path string, buildLogSteps []*contracts.BuildLogStep, obfuscator Obfuscator, compress bool) (err error) {
+	data, err := json.Marshal(obfuscateBuildLogSteps(buildLogSteps, obfuscator))
+	if err != nil {
+		return err
+	}
+
+	if !compress && !strings.HasSuffix(path, buildLogFileGzipExtension) {
+		return os.WriteFile(path, data, 0644)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	gzipWriter := gzip.NewWriter(file)
+	_, err = gzipWriter.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+// obfuscateBuildLogSteps returns a copy of the build log steps, including their nested steps and services, with the secrets in their log lines and image errors masked
+func obfuscateBuildLogSteps(buildLogSteps []*contracts.BuildLogStep, obfuscator Obfuscator) []*contracts.BuildLogStep {
+	if buildLogSteps == nil {
+		return nil
+	}
+
+	obfuscatedSteps := make([]*contracts.BuildLogStep, 0, len(buildLogSteps))
+	for _, step := range buildLogSteps {
+		if step == nil {
+			continue
+		}
+
+		obfuscatedStep := *step
+		if step.Image != nil {
+			image := *step.Image
+			image.Error = obfuscator.Obfuscate(image.Error)
+			obfuscatedStep.Image = &image
+		}
+		if step.LogLines != nil {
+			obfuscatedStep.LogLines = make([]contracts.BuildLogLine, len(step.LogLines))
+			for i, logLine := range step.LogLines {
+				logLine.Text = obfuscator.Obfuscate(logLine.Text)
+				obfuscatedStep.LogLines[i] = logLine
+			}
+		}
+		obfuscatedStep.NestedSteps = obfuscateBuildLogSteps(step.NestedSteps, obfuscator)
+		obfuscatedStep.Services = obfuscateBuildLogSteps(step.Services, obfuscator)
+
+		obfuscatedSteps = append(obfuscatedSteps, &obfuscatedStep)
+	}
+
+	return obfuscatedSteps
+}
@@ -0,0 +1,170 @@
+package builder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+)
+
+func TestWriteBuildLogFile(t *testing.T) {
+
+	t.Run("MasksSecretsInLogLinesOfStepsNestedStepsAndServices", func(t *testing.T) {
+
+		obfuscator := getBuildLogFileObfuscator(t)
+		path := filepath.Join(t.TempDir(), "build-log.json")
+		buildLogSteps := []*contracts.BuildLogStep{
+			{
+				Step:     "build",
+				LogLines: []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stdout", Text: "echo this is my secret"}},
+				NestedSteps: []*contracts.BuildLogStep{
+					{
+						Step:     "test",
+						LogLines: []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stderr", Text: "this is my secret"}},
+					},
+				},
+				Services: []*contracts.BuildLogStep{
+					{
+						Step:     "database",
+						LogLines: []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stdout", Text: "password: this is my secret"}},
+					},
+				},
+			},
+		}
+
+		// act
+		err := writeBuildLogFile(path, buildLogSteps, obfuscator, false)
+
+		assert.Nil(t, err)
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.NotContains(t, string(data), "this is my secret")
+
+		var writtenSteps []*contracts.BuildLogStep
+		err = json.Unmarshal(data, &writtenSteps)
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(writtenSteps)) {
+			assert.Equal(t, "echo ***", writtenSteps[0].LogLines[0].Text)
+			assert.Equal(t, "***", writtenSteps[0].NestedSteps[0].LogLines[0].Text)
+			assert.Equal(t, "password: ***", writtenSteps[0].Services[0].LogLines[0].Text)
+		}
+	})
+
+	t.Run("LeavesBuildLogStepsUnaltered", func(t *testing.T) {
+
+		obfuscator := getBuildLogFileObfuscator(t)
+		path := filepath.Join(t.TempDir(), "build-log.json")
+		buildLogSteps := []*contracts.BuildLogStep{
+			{
+				Step:     "build",
+				LogLines: []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stdout", Text: "this is my secret"}},
+			},
+		}
+
+		// act
+		err := writeBuildLogFile(path, buildLogSteps, obfuscator, false)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "this is my secret", buildLogSteps[0].LogLines[0].Text)
+	})
+
+	t.Run("WritesGzipCompressedFileForGzExtension", func(t *testing.T) {
+
+		obfuscator := getBuildLogFileObfuscator(t)
+		path := filepath.Join(t.TempDir(), "build-log.json.gz")
+		buildLogSteps := getBuildLogFileSteps()
+
+		// act
+		err := writeBuildLogFile(path, buildLogSteps, obfuscator, false)
+
+		assert.Nil(t, err)
+		assert.Equal(t, buildLogSteps, readGzipBuildLogFile(t, path))
+	})
+
+	t.Run("WritesGzipCompressedFileIfCompressIsSet", func(t *testing.T) {
+
+		obfuscator := getBuildLogFileObfuscator(t)
+		path := filepath.Join(t.TempDir(), "build-log.json")
+		buildLogSteps := getBuildLogFileSteps()
+
+		// act
+		err := writeBuildLogFile(path, buildLogSteps, obfuscator, true)
+
+		assert.Nil(t, err)
+		assert.Equal(t, buildLogSteps, readGzipBuildLogFile(t, path))
+	})
+
+	t.Run("WritesUncompressedJsonIfCompressIsNotSet", func(t *testing.T) {
+
+		obfuscator := getBuildLogFileObfuscator(t)
+		path := filepath.Join(t.TempDir(), "build-log.json")
+		buildLogSteps := getBuildLogFileSteps()
+
+		// act
+		err := writeBuildLogFile(path, buildLogSteps, obfuscator, false)
+
+		assert.Nil(t, err)
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		var writtenSteps []*contracts.BuildLogStep
+		err = json.Unmarshal(data, &writtenSteps)
+		assert.Nil(t, err)
+		assert.Equal(t, buildLogSteps, writtenSteps)
+	})
+}
+
+func getBuildLogFileSteps() []*contracts.BuildLogStep {
+	return []*contracts.BuildLogStep{
+		{
+			Step:     "build",
+			Status:   contracts.LogStatusSucceeded,
+			LogLines: []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stdout", Text: "go build ./..."}},
+			NestedSteps: []*contracts.BuildLogStep{
+				{
+					Step:     "test",
+					Status:   contracts.LogStatusSucceeded,
+					LogLines: []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stdout", Text: "ok"}},
+				},
+			},
+		},
+	}
+}
+
+func readGzipBuildLogFile(t *testing.T, path string) (buildLogSteps []*contracts.BuildLogStep) {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if !assert.Nil(t, err, "build log file should be gzip compressed") {
+		return nil
+	}
+	data, err := io.ReadAll(gzipReader)
+	assert.Nil(t, err)
+
+	err = json.Unmarshal(data, &buildLogSteps)
+	assert.Nil(t, err)
+
+	return
+}
+
+func getBuildLogFileObfuscator(t *testing.T) Obfuscator {
+	_, obfuscator, _, _ := getMocks()
+	manifest := manifest.ZiplineeManifest{
+		GlobalEnvVars: map[string]string{
+			"MY_SECRET": "ziplinee.secret(deFTz5Bdjg6SUe29.oPIkXbze5G9PNEWS2-ZnArl8BCqHnx4MdTdxHg37th9u)",
+		},
+	}
+	credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+	err := obfuscator.CollectSecrets(manifest, credentialsBytes, "github.com/ziplineeci/ziplinee-ci-builder")
+	assert.Nil(t, err)
+
+	return obfuscator
+}
@@ -0,0 +1,82 @@
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+)
+
+const (
+	// warningStreamType marks log lines the builder adds to warn about something that doesn't fail the build, to tell them apart from the stdout and stderr of containers
+	warningStreamType = "warning"
+
+	// largeImageWarningSize is the image size above which pulling the image noticeably slows down the build
+	largeImageWarningSize int64 = 1024 * 1024 * 1024
+)
+
+// BuildWarning is something the builder warns about for a stage or service, or for the build as a whole when it has no step, without failing the build
+type BuildWarning struct {
+	Step        string `json:"step,omitempty"`
+	ParentStage string `json:"parentStage,omitempty"`
+	Text        string `json:"text"`
+}
+
+// GetWarnings returns the warnings for the build, in the order they were raised
+func (pr *pipelineRunner) GetWarnings() []BuildWarning {
+	pr.warningsMutex.Lock()
+	defer pr.warningsMutex.Unlock()
+
+	warnings := make([]BuildWarning, len(pr.warnings))
+	copy(warnings, pr.warnings)
+
+	return warnings
+}
+
+// addWarning records a warning and, if it's about a stage or service, adds it to its logs as a line of the warning stream type
+func (pr *pipelineRunner) addWarning(step, parentStageName string, logType contracts.LogType, depth int, text string) {
+	pr.warningsMutex.Lock()
+	pr.warnings = append(pr.warnings, BuildWarning{
+		Step:        step,
+		ParentStage: parentStageName,
+		Text:        text,
+	})
+	pr.warningsMutex.Unlock()
+
+	if step == "" {
+		log.Warn().Msg(text)
+		return
+	}
+
+	log.Warn().Msgf("%v %v", getLogPrefix(step, parentStageName), text)
+
+	logLineObject := contracts.BuildLogLine{
+		LineNumber: 1,
+		Timestamp:  time.Now().UTC(),
+		StreamType: warningStreamType,
+		Text:       text,
+	}
+	pr.tailLogsChannel <- contracts.TailLogLine{
+		Step:        step,
+		ParentStage: parentStageName,
+		Type:        logType,
+		Depth:       depth,
+		LogLine:     &logLineObject,
+	}
+}
+
+// getImageWarnings returns warnings about the image of a stage or service, like it being large or getting credentials injected while using a mutable tag
+func getImageWarnings(containerImage string, imageSize int64, hasInjectedCredentials bool) (warnings []string) {
+	if imageSize > largeImageWarningSize {
+		warnings = append(warnings, fmt.Sprintf("Image %v is %v MB, pulling large images slows down the build", containerImage, imageSize/1024/1024))
+	}
+
+	if hasInjectedCredentials {
+		if tag := getContainerImageTag(containerImage); tag == "latest" {
+			warnings = append(warnings, fmt.Sprintf("Image %v gets credentials injected while using mutable tag %v, pin it to a version to make sure only the trusted image receives them", containerImage, tag))
+		}
+	}
+
+	return
+}
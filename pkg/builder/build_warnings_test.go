@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+)
+
+func TestGetImageWarnings(t *testing.T) {
+
+	t.Run("ReturnsWarningForImageLargerThanLargeImageWarningSize", func(t *testing.T) {
+
+		// act
+		warnings := getImageWarnings("golang:1.22", 2*largeImageWarningSize, false)
+
+		assert.Equal(t, 1, len(warnings))
+		assert.Contains(t, warnings[0], "golang:1.22")
+	})
+
+	t.Run("ReturnsWarningForImageWithInjectedCredentialsUsingLatestTag", func(t *testing.T) {
+
+		// act
+		warnings := getImageWarnings("ziplinee/ziplinee-extension-docker", 0, true)
+
+		assert.Equal(t, 1, len(warnings))
+		assert.Contains(t, warnings[0], "latest")
+	})
+
+	t.Run("ReturnsNoWarningsForSmallImageWithInjectedCredentialsUsingPinnedTag", func(t *testing.T) {
+
+		// act
+		warnings := getImageWarnings("ziplinee/ziplinee-extension-docker:0.1.2", 10*1024*1024, true)
+
+		assert.Equal(t, 0, len(warnings))
+	})
+
+	t.Run("ReturnsNoWarningsForImageWithoutInjectedCredentialsUsingLatestTag", func(t *testing.T) {
+
+		// act
+		warnings := getImageWarnings("alpine:latest", 10*1024*1024, false)
+
+		assert.Equal(t, 0, len(warnings))
+	})
+}
+
+func TestGetWarnings(t *testing.T) {
+
+	t.Run("ReturnsWarningsRecordedSeparatelyFromNormalLogLines", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "golang:1.22",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), "golang:1.22").Return(2*largeImageWarningSize, nil)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+		assert.Nil(t, err)
+
+		// act
+		warnings := pipelineRunner.GetWarnings()
+
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Equal(t, "stage-a", warnings[0].Step)
+			assert.Contains(t, warnings[0].Text, "golang:1.22")
+		}
+
+		warningLines := []contracts.BuildLogLine{}
+		close(tailLogsChannel)
+		for tailLogLine := range tailLogsChannel {
+			if tailLogLine.LogLine != nil {
+				assert.Equal(t, warningStreamType, tailLogLine.LogLine.StreamType)
+				warningLines = append(warningLines, *tailLogLine.LogLine)
+			}
+		}
+		if assert.Equal(t, 1, len(warningLines)) {
+			assert.Equal(t, warnings[0].Text, warningLines[0].Text)
+		}
+	})
+
+	t.Run("ReturnsWarningsForTheBuildAsAWholeWithoutAddingALogLine", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		runner.(*pipelineRunner).addWarning("", "", contracts.LogTypeStage, 0, "Shallow clone")
+
+		// act
+		warnings := runner.GetWarnings()
+
+		assert.Equal(t, []BuildWarning{{Text: "Shallow clone"}}, warnings)
+		assert.Equal(t, 0, len(tailLogsChannel))
+	})
+
+	t.Run("ReturnsNoWarningsIfNoneWereRaised", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		// act
+		warnings := pipelineRunner.GetWarnings()
+
+		assert.Equal(t, 0, len(warnings))
+	})
+}
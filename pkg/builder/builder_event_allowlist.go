@@ -0,0 +1,138 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// jsonAllowlist lists the fields of a json object to keep, with the allowlist for the fields of their own value; a nil allowlist keeps the value as is
+type jsonAllowlist map[string]jsonAllowlist
+
+// builderEventAllowlist holds the fields of the builder event the api needs; any other field, like a jwt or credentials the contracts structs might grow, never gets sent
+var builderEventAllowlist = jsonAllowlist{
+	"buildEventType": nil,
+	"jobType":        nil,
+	"job_name":       nil,
+	"pod_name":       nil,
+	"build": {
+		"id":                   nil,
+		"repoSource":           nil,
+		"repoOwner":            nil,
+		"repoName":             nil,
+		"repoBranch":           nil,
+		"repoRevision":         nil,
+		"buildVersion":         nil,
+		"buildStatus":          nil,
+		"labels":               nil,
+		"releaseTargets":       nil,
+		"manifest":             nil,
+		"manifestWithDefaults": nil,
+		"commits":              nil,
+		"triggers":             nil,
+		"triggerEvents":        nil,
+		"insertedAt":           nil,
+		"startedAt":            nil,
+		"updatedAt":            nil,
+		"duration":             nil,
+		"pendingDuration":      nil,
+		"groups":               nil,
+		"organizations":        nil,
+	},
+	"release": {
+		"name":            nil,
+		"action":          nil,
+		"id":              nil,
+		"repoSource":      nil,
+		"repoOwner":       nil,
+		"repoName":        nil,
+		"releaseVersion":  nil,
+		"releaseStatus":   nil,
+		"triggerEvents":   nil,
+		"insertedAt":      nil,
+		"startedAt":       nil,
+		"updatedAt":       nil,
+		"duration":        nil,
+		"pendingDuration": nil,
+		"extraInfo":       nil,
+		"groups":          nil,
+		"organizations":   nil,
+	},
+	"bot": {
+		"name":            nil,
+		"id":              nil,
+		"repoSource":      nil,
+		"repoOwner":       nil,
+		"repoName":        nil,
+		"botStatus":       nil,
+		"triggerEvents":   nil,
+		"insertedAt":      nil,
+		"startedAt":       nil,
+		"updatedAt":       nil,
+		"duration":        nil,
+		"pendingDuration": nil,
+		"extraInfo":       nil,
+		"groups":          nil,
+		"organizations":   nil,
+	},
+	"git": {
+		"repoSource":   nil,
+		"repoOwner":    nil,
+		"repoName":     nil,
+		"repoBranch":   nil,
+		"repoRevision": nil,
+	},
+	"tags": nil,
+	"builder": {
+		"version":  nil,
+		"branch":   nil,
+		"revision": nil,
+	},
+}
+
+// marshalAllowlisted marshals value to json, leaving out every field that isn't in the allowlist
+func marshalAllowlisted(value interface{}, allowlist jsonAllowlist) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep numbers like durations in nanoseconds as they are
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var object interface{}
+	err = decoder.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(filterAllowlisted(object, allowlist))
+}
+
+func filterAllowlisted(value interface{}, allowlist jsonAllowlist) interface{} {
+	if allowlist == nil {
+		return value
+	}
+
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		filtered := make(map[string]interface{}, len(allowlist))
+		for key, fieldValue := range typedValue {
+			fieldAllowlist, ok := allowlist[key]
+			if !ok {
+				continue
+			}
+			filtered[key] = filterAllowlisted(fieldValue, fieldAllowlist)
+		}
+		return filtered
+
+	case []interface{}:
+		filtered := make([]interface{}, 0, len(typedValue))
+		for _, item := range typedValue {
+			filtered = append(filtered, filterAllowlisted(item, allowlist))
+		}
+		return filtered
+	}
+
+	return value
+}
@@ -0,0 +1,103 @@
+package builder
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+)
+
+func TestMarshalAllowlisted(t *testing.T) {
+
+	t.Run("KeepsAllowlistedBuilderEventFields", func(t *testing.T) {
+
+		duration := 90 * time.Second
+		event := builderEventWithTags{
+			ZiplineeCiBuilderEvent: contracts.ZiplineeCiBuilderEvent{
+				BuildEventType: contracts.BuildEventTypeUpdateStatus,
+				JobType:        contracts.JobTypeRelease,
+				JobName:        "release-ziplineeci-ziplinee-ci-builder-391855387650326531",
+				PodName:        "pod",
+				Release: &contracts.Release{
+					Name:          "production",
+					Action:        "deploy-canary",
+					ReleaseStatus: contracts.StatusSucceeded,
+					Duration:      &duration,
+				},
+				Git: &contracts.GitConfig{
+					RepoSource: "github.com",
+					RepoOwner:  "ziplineeci",
+					RepoName:   "ziplinee-ci-builder",
+				},
+			},
+			Tags:    map[string]string{"ticket": "ZPL-1445"},
+			Builder: &builderVersion{Version: "1.4.20"},
+		}
+		expected, err := json.Marshal(event)
+		assert.Nil(t, err)
+
+		// act
+		data, err := marshalAllowlisted(event, builderEventAllowlist)
+
+		assert.Nil(t, err)
+		assert.JSONEq(t, string(expected), string(data))
+	})
+
+	t.Run("LeavesOutFieldsThatAreNotAllowlisted", func(t *testing.T) {
+
+		event := struct {
+			builderEventWithTags
+			JWT   string `json:"jwt"`
+			Build *struct {
+				contracts.Build
+				Credentials []*contracts.CredentialConfig `json:"credentials"`
+			} `json:"build"`
+		}{
+			builderEventWithTags: builderEventWithTags{
+				ZiplineeCiBuilderEvent: contracts.ZiplineeCiBuilderEvent{
+					JobType: contracts.JobTypeBuild,
+					JobName: "build-ziplineeci-ziplinee-ci-builder-391855387650326531",
+				},
+			},
+			JWT: "secret-jwt",
+			Build: &struct {
+				contracts.Build
+				Credentials []*contracts.CredentialConfig `json:"credentials"`
+			}{
+				Build: contracts.Build{
+					ID: "391855387650326531",
+				},
+				Credentials: []*contracts.CredentialConfig{{Name: "container-registry", AdditionalProperties: map[string]interface{}{"password": "secret-password"}}},
+			},
+		}
+
+		// act
+		data, err := marshalAllowlisted(event, builderEventAllowlist)
+
+		assert.Nil(t, err)
+		assert.NotContains(t, string(data), "secret-jwt")
+		assert.NotContains(t, string(data), "secret-password")
+		var sentEvent map[string]interface{}
+		err = json.Unmarshal(data, &sentEvent)
+		assert.Nil(t, err)
+		assert.NotContains(t, sentEvent, "jwt")
+		assert.NotContains(t, sentEvent["build"], "credentials")
+		assert.Equal(t, "391855387650326531", sentEvent["build"].(map[string]interface{})["id"])
+	})
+
+	t.Run("FiltersEveryItemOfAnArray", func(t *testing.T) {
+
+		value := []map[string]string{
+			{"name": "a", "token": "secret-a"},
+			{"name": "b", "token": "secret-b"},
+		}
+
+		// act
+		data, err := marshalAllowlisted(value, jsonAllowlist{"name": nil})
+
+		assert.Nil(t, err)
+		assert.JSONEq(t, `[{"name":"a"},{"name":"b"}]`, string(data))
+	})
+}
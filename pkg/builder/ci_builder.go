@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -16,19 +17,46 @@ import (
 	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
 	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
 	foundation "github.com/ziplineeci/ziplinee-foundation"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
+// SupportedManifestAPIVersion is the newest manifest api version this builder knows how to run
+const SupportedManifestAPIVersion = 1
+
 // CIBuilder runs builds for different types of integrations
 type CIBuilder interface {
-	RunReadinessProbe(ctx context.Context, scheme, host string, port int, path, hostname string, timeoutSeconds int)
+	RunReadinessProbe(ctx context.Context, scheme, host string, port int, path, hostname, bodyMatch string, timeoutSeconds int)
 	RunZiplineeBuildJob(ctx context.Context, pipelineRunner PipelineRunner, containerRunner ContainerRunner, envvarHelper EnvvarHelper, obfuscator Obfuscator, endOfLifeHelper EndOfLifeHelper, builderConfig contracts.BuilderConfig, credentialsBytes []byte, runAsJob bool)
 	RunLocalBuild(ctx context.Context, pipelineRunner PipelineRunner, containerRunner ContainerRunner, envvarHelper EnvvarHelper, builderConfig contracts.BuilderConfig, stagesToRun []string) (err error)
 	RunGocdAgentBuild(ctx context.Context, pipelineRunner PipelineRunner, containerRunner ContainerRunner, envvarHelper EnvvarHelper, obfuscator Obfuscator, builderConfig contracts.BuilderConfig, credentialsBytes []byte)
 	RunZiplineeCLIBuild() error
+	EnableResourceUsageReporting(sampleInterval time.Duration)
+	SetGlobalWhen(whenEvaluator WhenEvaluator, when string)
+	SetManifestAPIVersion(apiVersion int)
+	SetInfrastructureRetries(retries int, delay time.Duration)
+	SetMaxStages(maxStages int)
+	EnableBuildLogFile(path string)
+	EnableBuildLogFileCompression()
+	EnableDotEnvFile()
 }
 
 type ciBuilder struct {
-	applicationInfo foundation.ApplicationInfo
+	applicationInfo      foundation.ApplicationInfo
+	resourceUsageTracker ResourceUsageTracker
+	whenEvaluator        WhenEvaluator
+	globalWhen           string
+	manifestAPIVersion   int
+	maxStages            int
+
+	buildLogFilePath     string
+	compressBuildLogFile bool
+	loadDotEnvFile       bool
+
+	infrastructureRetries    int
+	infrastructureRetryDelay time.Duration
 }
 
 // NewCIBuilder returns a new CIBuilder
@@ -38,8 +66,46 @@ func NewCIBuilder(applicationInfo foundation.ApplicationInfo) CIBuilder {
 	}
 }
 
-func (b *ciBuilder) RunReadinessProbe(ctx context.Context, scheme, host string, port int, path, hostname string, timeoutSeconds int) {
-	err := WaitForReadinessHttpGet(ctx, scheme, host, port, path, hostname, timeoutSeconds)
+func (b *ciBuilder) EnableResourceUsageReporting(sampleInterval time.Duration) {
+	b.resourceUsageTracker = NewResourceUsageTracker(sampleInterval)
+}
+
+func (b *ciBuilder) SetGlobalWhen(whenEvaluator WhenEvaluator, when string) {
+	b.whenEvaluator = whenEvaluator
+	b.globalWhen = when
+}
+
+func (b *ciBuilder) SetManifestAPIVersion(apiVersion int) {
+	b.manifestAPIVersion = apiVersion
+}
+
+// SetMaxStages sets the maximum number of stages, including nested ones, a manifest can have before the build fails without running any of them; 0 doesn't limit them
+func (b *ciBuilder) SetMaxStages(maxStages int) {
+	b.maxStages = maxStages
+}
+
+// EnableBuildLogFile writes the build log as json to the file at path after builds run by a gocd agent, which have no api to ship it to; secrets get masked in it like in the logs shipped to the api
+func (b *ciBuilder) EnableBuildLogFile(path string) {
+	b.buildLogFilePath = path
+}
+
+// EnableBuildLogFileCompression gzip compresses the build log file to keep it small for large builds, like a build log file path ending with .gz does
+func (b *ciBuilder) EnableBuildLogFileCompression() {
+	b.compressBuildLogFile = true
+}
+
+// EnableDotEnvFile makes local builds load the envvars in the .env file in the root of the repository, with the lowest precedence after the default envvars, so developers can set local-only envvars
+func (b *ciBuilder) EnableDotEnvFile() {
+	b.loadDotEnvFile = true
+}
+
+func (b *ciBuilder) SetInfrastructureRetries(retries int, delay time.Duration) {
+	b.infrastructureRetries = retries
+	b.infrastructureRetryDelay = delay
+}
+
+func (b *ciBuilder) RunReadinessProbe(ctx context.Context, scheme, host string, port int, path, hostname, bodyMatch string, timeoutSeconds int) {
+	err := WaitForReadinessHttpGet(ctx, scheme, host, port, path, hostname, bodyMatch, timeoutSeconds)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Readiness probe failed")
 	}
@@ -50,7 +116,7 @@ func (b *ciBuilder) RunReadinessProbe(ctx context.Context, scheme, host string,
 
 func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner PipelineRunner, containerRunner ContainerRunner, envvarHelper EnvvarHelper, obfuscator Obfuscator, endOfLifeHelper EndOfLifeHelper, builderConfig contracts.BuilderConfig, credentialsBytes []byte, runAsJob bool) {
 
-	closer := b.initJaeger(b.applicationInfo.App)
+	closer := b.initTracer(b.applicationInfo.App)
 	defer closer.Close()
 
 	buildLog := contracts.BuildLog{
@@ -77,6 +143,10 @@ func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner Pipe
 	// set running state, so a restarted job will show up as running once a new pod runs
 	_ = endOfLifeHelper.SendBuildStartedEvent(ctx)
 
+	if b.resourceUsageTracker != nil {
+		b.resourceUsageTracker.Start(ctx)
+	}
+
 	go func() {
 		// cancel 15 minutes before jwt expires
 		expiryTime := builderConfig.CIServer.JWTExpiry
@@ -98,7 +168,31 @@ func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner Pipe
 	// unset all ZIPLINEE_ envvars so they don't get abused by non-ziplinee components
 	envvarHelper.UnsetZiplineeEnvvars()
 
-	err := envvarHelper.SetZiplineeBuilderConfigEnvvars(builderConfig)
+	// fail fast instead of silently ignoring fields of a manifest written for a newer builder
+	err := validateManifestAPIVersion(b.manifestAPIVersion)
+	if err != nil {
+		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Manifest is not supported by this builder")
+	}
+
+	// guard against runaway generated manifests
+	err = validateStageCount(builderConfig.Stages, b.maxStages)
+	if err != nil {
+		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Manifest has too many stages")
+	}
+
+	// let governance tooling approve or deny the build based on its manifest
+	err = endOfLifeHelper.RequestAdmission(ctx)
+	if err != nil {
+		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Build denied by admission webhook")
+	}
+
+	// prevent overlapping releases of the same pipeline to the same target
+	err = endOfLifeHelper.AcquireReleaseLease(ctx)
+	if err != nil {
+		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Acquiring release lease failed")
+	}
+
+	err = envvarHelper.SetZiplineeBuilderConfigEnvvars(builderConfig)
 	if err != nil {
 		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Error setting ziplinee builder config envvars")
 	}
@@ -111,15 +205,42 @@ func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner Pipe
 			Logger()
 	}
 
+	// skip the entire build without running any stage if the global when clause evaluates to false
+	runStages, err := b.evaluateGlobalWhen(envvarHelper.GetPipelineName())
+	if err != nil {
+		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Evaluating global when clause failed")
+	}
+	if !runStages {
+		log.Info().Msgf("Skipping all stages, because global when clause \"%v\" evaluated to false", b.globalWhen)
+
+		buildLog.Steps = getSkippedBuildLogSteps(builderConfig.Stages)
+		skipReasons := getGlobalWhenSkipReasons(builderConfig.Stages)
+		endOfLifeHelper.AddBuildLogMetadata("skipReasons", skipReasons)
+		endOfLifeHelper.AddBuildLogMetadata("stageDispositions", getStageDispositions(buildLog.Steps, skipReasons))
+		_ = endOfLifeHelper.SendBuildFinishedEvent(ctx, contracts.LogStatusSkipped)
+		_ = endOfLifeHelper.SendBuildJobLogEvent(ctx, buildLog)
+		_ = endOfLifeHelper.SendBuildCleanEvent(ctx, contracts.LogStatusSkipped)
+
+		rootSpan.Finish()
+		closer.Close()
+
+		os.Exit(0)
+	}
+
 	// start docker daemon
 	dockerDaemonStartSpan, _ := opentracing.StartSpanFromContext(ctx, "StartDockerDaemon")
-	err = containerRunner.StartDockerDaemon()
+	err = b.retryOnInfrastructureError("Starting docker daemon", func() error {
+		return newInfrastructureError(containerRunner.StartDockerDaemon())
+	})
 	if err != nil {
 		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Error starting docker daemon")
 	}
 
 	// wait for docker daemon to be ready for usage
-	containerRunner.WaitForDockerDaemon()
+	err = containerRunner.WaitForDockerDaemon()
+	if err != nil {
+		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Error waiting for docker daemon to be ready")
+	}
 	dockerDaemonStartSpan.Finish()
 
 	// listen to cancellation in order to stop any running pipeline or container
@@ -159,7 +280,9 @@ func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner Pipe
 
 	if builderConfig.Manifest != nil || builderConfig.Manifest.Builder.BuilderType != manifest.BuilderTypeKubernetes {
 		// create docker client
-		err = containerRunner.CreateDockerClient()
+		err = b.retryOnInfrastructureError("Creating docker client", func() error {
+			return newInfrastructureError(containerRunner.CreateDockerClient())
+		})
 		if err != nil {
 			endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Failed creating a docker client")
 		}
@@ -177,13 +300,54 @@ func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner Pipe
 
 	// run stages
 	pipelineRunner.EnableBuilderInfoStageInjection()
-	buildLog.Steps, err = pipelineRunner.RunStages(ctx, 0, stages, dir, envvars)
-	if err != nil && buildLog.HasUnknownStatus() {
+	err = b.retryOnError("Running stages", func(runErr error) bool {
+		return isRetryableRunStagesError(runErr, buildLog.Steps)
+	}, func() (runErr error) {
+		// stages update the build status in the envvars, so every attempt starts from a copy
+		buildLog.Steps, runErr = pipelineRunner.RunStages(ctx, 0, stages, dir, envvarHelper.OverrideEnvvars(envvars))
+		if pipelineRunner.IsCanceled() {
+			// a canceled build shouldn't be retried
+			return nil
+		}
+		return runErr
+	})
+	if err != nil && buildLog.HasUnknownStatus() && !pipelineRunner.IsCanceled() {
 		endOfLifeHelper.HandleFatal(ctx, buildLog, err, "Executing stages from manifest failed")
 	}
 
+	// add names of credentials injected into stages to the build log for auditing
+	if credentialsAudit := containerRunner.GetCredentialsAudit(); len(credentialsAudit) > 0 {
+		endOfLifeHelper.AddBuildLogMetadata("credentialsAudit", credentialsAudit)
+	}
+
+	// add peak usage of stage containers, since build log steps have no fields for it
+	if stageResourceUsage := containerRunner.GetStageResourceUsage(); len(stageResourceUsage) > 0 {
+		endOfLifeHelper.AddBuildLogMetadata("stageResourceUsage", stageResourceUsage)
+	}
+
+	// explain why stages and services got skipped, since build log steps have no field for it
+	skipReasons := pipelineRunner.GetSkipReasons()
+	if len(skipReasons) > 0 {
+		endOfLifeHelper.AddBuildLogMetadata("skipReasons", skipReasons)
+	}
+
+	// surface warnings that didn't fail the build separately from the log lines they're in
+	if warnings := pipelineRunner.GetWarnings(); len(warnings) > 0 {
+		endOfLifeHelper.AddBuildLogMetadata("warnings", warnings)
+	}
+
+	// summarize how every stage ended up, to query without going through the log lines
+	endOfLifeHelper.AddBuildLogMetadata("stageDispositions", getStageDispositions(buildLog.Steps, skipReasons))
+
+	// report peak usage of the builder itself to help size builder pods
+	if b.resourceUsageTracker != nil {
+		resourceUsage := b.resourceUsageTracker.Stop()
+		log.Info().Msgf("Builder peak resource usage: memory %v bytes, cgroup memory %v bytes, cpu %.2f cores", resourceUsage.MemoryBytes, resourceUsage.CgroupMemoryBytes, resourceUsage.CPUCores)
+		endOfLifeHelper.AddBuildLogMetadata("resourceUsage", resourceUsage)
+	}
+
 	// send result to ci-api
-	buildStatus := contracts.GetAggregatedStatus(buildLog.Steps)
+	buildStatus := getBuildStatus(buildLog.Steps, pipelineRunner.IsCanceled())
 	_ = endOfLifeHelper.SendBuildFinishedEvent(ctx, buildStatus)
 	_ = endOfLifeHelper.SendBuildJobLogEvent(ctx, buildLog)
 	_ = endOfLifeHelper.SendBuildCleanEvent(ctx, buildStatus)
@@ -199,6 +363,115 @@ func (b *ciBuilder) RunZiplineeBuildJob(ctx context.Context, pipelineRunner Pipe
 	}
 }
 
+// validateManifestAPIVersion returns an error if the manifest api version is newer than the builder supports; an unset version is always supported
+func validateManifestAPIVersion(apiVersion int) error {
+	if apiVersion > SupportedManifestAPIVersion {
+		return fmt.Errorf("Manifest api version %v is newer than api version %v supported by this builder; upgrade the builder or lower the manifest api version", apiVersion, SupportedManifestAPIVersion)
+	}
+
+	return nil
+}
+
+// validateStageCount returns an error if the stages, including nested ones, exceed the maximum number of stages; a maximum of 0 doesn't limit them
+func validateStageCount(stages []*manifest.ZiplineeStage, maxStages int) error {
+	if maxStages <= 0 {
+		return nil
+	}
+
+	stageCount := countStages(stages)
+	if stageCount > maxStages {
+		return fmt.Errorf("Manifest has %v stages, including nested ones, which is more than the maximum of %v stages", stageCount, maxStages)
+	}
+
+	return nil
+}
+
+func countStages(stages []*manifest.ZiplineeStage) (count int) {
+	for _, stage := range stages {
+		count += 1 + countStages(stage.ParallelStages)
+	}
+
+	return
+}
+
+// getBuildStatus returns the aggregated status of all steps, unless the build got canceled; then stages failing due to being stopped shouldn't turn it into a failed build
+func getBuildStatus(buildLogSteps []*contracts.BuildLogStep, canceled bool) contracts.LogStatus {
+	if canceled {
+		return contracts.LogStatusCanceled
+	}
+
+	return contracts.GetAggregatedStatus(buildLogSteps)
+}
+
+// evaluateGlobalWhen returns whether stages should run according to the manifest-level when clause; without a clause they always run
+func (b *ciBuilder) evaluateGlobalWhen(pipelineName string) (bool, error) {
+	if b.globalWhen == "" || b.whenEvaluator == nil {
+		return true, nil
+	}
+
+	return b.whenEvaluator.Evaluate(pipelineName, b.globalWhen, b.whenEvaluator.GetParameters())
+}
+
+// retryOnInfrastructureError runs f and retries it up to the configured number of times while it fails due to the build infrastructure; failures of the pipeline itself are returned right away
+func (b *ciBuilder) retryOnInfrastructureError(description string, f func() error) (err error) {
+	return b.retryOnError(description, isInfrastructureError, f)
+}
+
+// retryOnError runs f and retries it up to the configured number of times while isRetryable returns true for the error it fails with
+func (b *ciBuilder) retryOnError(description string, isRetryable func(error) bool, f func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = f()
+		if err == nil || !isRetryable(err) || attempt >= b.infrastructureRetries {
+			return
+		}
+
+		log.Warn().Err(err).Msgf("%v failed due to an infrastructure error, retrying in %v (retry %v of %v)", description, b.infrastructureRetryDelay, attempt+1, b.infrastructureRetries)
+		time.Sleep(b.infrastructureRetryDelay)
+	}
+}
+
+// isRetryableRunStagesError only allows retrying the stages on infrastructure errors before any stage ran, like failing to create the networks, which RunStages returns without build log steps;
+// stages that already ran, like deploys, mustn't run a second time on top of the work directory they changed
+func isRetryableRunStagesError(err error, buildLogSteps []*contracts.BuildLogStep) bool {
+	return isInfrastructureError(err) && len(buildLogSteps) == 0
+}
+
+// getGlobalWhenSkipReasons returns the skip reason for each stage, to explain a build skipped by the global when clause
+func getGlobalWhenSkipReasons(stages []*manifest.ZiplineeStage) map[string]SkipReason {
+	skipReasons := map[string]SkipReason{}
+	for _, s := range stages {
+		skipReasons[getSkipReasonKey(s.Name, "")] = SkipReasonGlobalWhenClauseFalse
+		for _, ps := range s.ParallelStages {
+			skipReasons[getSkipReasonKey(ps.Name, s.Name)] = SkipReasonGlobalWhenClauseFalse
+		}
+	}
+
+	return skipReasons
+}
+
+// getSkippedBuildLogSteps returns a skipped build log step for each stage, to report a build skipped by the global when clause
+func getSkippedBuildLogSteps(stages []*manifest.ZiplineeStage) []*contracts.BuildLogStep {
+	buildLogSteps := make([]*contracts.BuildLogStep, 0, len(stages))
+	for _, s := range stages {
+		buildLogStep := &contracts.BuildLogStep{
+			Step:     s.Name,
+			LogLines: []contracts.BuildLogLine{},
+			Status:   contracts.LogStatusSkipped,
+		}
+		for _, ps := range s.ParallelStages {
+			buildLogStep.NestedSteps = append(buildLogStep.NestedSteps, &contracts.BuildLogStep{
+				Step:     ps.Name,
+				Depth:    1,
+				LogLines: []contracts.BuildLogLine{},
+				Status:   contracts.LogStatusSkipped,
+			})
+		}
+		buildLogSteps = append(buildLogSteps, buildLogStep)
+	}
+
+	return buildLogSteps
+}
+
 func (b *ciBuilder) RunLocalBuild(ctx context.Context, pipelineRunner PipelineRunner, containerRunner ContainerRunner, envvarHelper EnvvarHelper, builderConfig contracts.BuilderConfig, stagesToRun []string) (err error) {
 
 	// create docker client
@@ -247,17 +520,12 @@ func (b *ciBuilder) RunLocalBuild(ctx context.Context, pipelineRunner PipelineRu
 		return
 	}
 
-	// collect ziplinee and 'global' envvars from manifest
-	ziplineeEnvvars, err := envvarHelper.CollectZiplineeEnvvarsAndLabels(mft)
+	// collect envvars for the stages, including local-only ones from the .env file
+	envvars, err := b.collectLocalBuildEnvvars(envvarHelper, mft, dir)
 	if err != nil {
 		return
 	}
 
-	globalEnvvars := envvarHelper.CollectGlobalEnvvars(mft)
-
-	// merge ziplinee and global envvars
-	envvars := envvarHelper.OverrideEnvvars(ziplineeEnvvars, globalEnvvars)
-
 	// listen to cancellation in order to stop any running pipeline or container
 	go pipelineRunner.StopPipelineOnCancellation(ctx)
 
@@ -274,9 +542,33 @@ func (b *ciBuilder) RunLocalBuild(ctx context.Context, pipelineRunner PipelineRu
 	return nil
 }
 
+// collectLocalBuildEnvvars merges the ziplinee and 'global' envvars from the manifest over the envvars from the .env file in dir, if enabled, with its secrets decrypted
+func (b *ciBuilder) collectLocalBuildEnvvars(envvarHelper EnvvarHelper, mft manifest.ZiplineeManifest, dir string) (envvars map[string]string, err error) {
+
+	dotEnvEnvvars := map[string]string{}
+	if b.loadDotEnvFile {
+		dotEnvEnvvars, err = readDotEnvFile(filepath.Join(dir, dotEnvFileName))
+		if err != nil {
+			return
+		}
+		dotEnvEnvvars = envvarHelper.decryptSecrets(dotEnvEnvvars, envvarHelper.GetPipelineName())
+	}
+
+	// collect ziplinee and 'global' envvars from manifest
+	ziplineeEnvvars, err := envvarHelper.CollectZiplineeEnvvarsAndLabels(mft)
+	if err != nil {
+		return
+	}
+
+	globalEnvvars := envvarHelper.CollectGlobalEnvvars(mft)
+
+	// merge ziplinee and global envvars over the local-only ones
+	return envvarHelper.OverrideEnvvars(dotEnvEnvvars, ziplineeEnvvars, globalEnvvars), nil
+}
+
 func (b *ciBuilder) RunGocdAgentBuild(ctx context.Context, pipelineRunner PipelineRunner, containerRunner ContainerRunner, envvarHelper EnvvarHelper, obfuscator Obfuscator, builderConfig contracts.BuilderConfig, credentialsBytes []byte) {
 
-	fatalHandler := NewLocalFatalHandler()
+	fatalHandler := NewLocalFatalHandler(obfuscator)
 
 	// create docker client
 	err := containerRunner.CreateDockerClient()
@@ -347,7 +639,15 @@ func (b *ciBuilder) RunGocdAgentBuild(ctx context.Context, pipelineRunner Pipeli
 		fatalHandler.HandleFatal(err, "Executing stages from manifest failed")
 	}
 
-	RenderStats(buildLogSteps)
+	// write the build log to a file, since there's no api to ship it to
+	if b.buildLogFilePath != "" {
+		err = writeBuildLogFile(b.buildLogFilePath, buildLogSteps, obfuscator, b.compressBuildLogFile)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed writing build log to file %v", b.buildLogFilePath)
+		}
+	}
+
+	RenderStats(os.Stdout, buildLogSteps, obfuscator)
 
 	HandleExit(buildLogSteps)
 }
@@ -356,6 +656,35 @@ func (b *ciBuilder) RunZiplineeCLIBuild() error {
 	return nil
 }
 
+// initTracer sets up the global tracer for the exporter selected with the OTEL_TRACES_EXPORTER envvar
+func (b *ciBuilder) initTracer(service string) io.Closer {
+	switch getTracingExporter() {
+	case tracingExporterOTLP:
+		return b.initOTLP(service)
+	default:
+		return b.initJaeger(service)
+	}
+}
+
+// initOTLP sets up a global tracer that exports the opentracing spans to an opentelemetry collector; the exporter can be configured with environment variables
+// https://opentelemetry.io/docs/specs/otel/protocol/exporter/
+func (b *ciBuilder) initOTLP(service string) io.Closer {
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Generating OTLP exporter failed")
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+
+	opentracing.SetGlobalTracer(newOtelTracer(tracerProvider.Tracer(service)))
+
+	return &otelCloser{shutdown: tracerProvider.Shutdown}
+}
+
 // initJaeger returns an instance of Jaeger Tracer that can be configured with environment variables
 // https://github.com/jaegertracing/jaeger-client-go#environment-variables
 func (b *ciBuilder) initJaeger(service string) io.Closer {
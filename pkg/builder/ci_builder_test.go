@@ -0,0 +1,451 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+)
+
+func TestValidateManifestAPIVersion(t *testing.T) {
+
+	t.Run("ReturnsNilForUnsetVersion", func(t *testing.T) {
+
+		// act
+		err := validateManifestAPIVersion(0)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsNilForSupportedVersion", func(t *testing.T) {
+
+		// act
+		err := validateManifestAPIVersion(SupportedManifestAPIVersion)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsClearErrorForTooNewVersion", func(t *testing.T) {
+
+		// act
+		err := validateManifestAPIVersion(SupportedManifestAPIVersion + 1)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "newer than api version")
+			assert.Contains(t, err.Error(), "upgrade the builder")
+		}
+	})
+}
+
+func TestValidateStageCount(t *testing.T) {
+
+	stages := []*manifest.ZiplineeStage{
+		{Name: "build"},
+		{
+			Name: "test",
+			ParallelStages: []*manifest.ZiplineeStage{
+				{Name: "unit-test"},
+				{Name: "integration-test"},
+			},
+		},
+		{Name: "push"},
+	}
+
+	t.Run("ReturnsNilWithoutMaximum", func(t *testing.T) {
+
+		// act
+		err := validateStageCount(stages, 0)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsNilForStagesWithinMaximum", func(t *testing.T) {
+
+		// act
+		err := validateStageCount(stages, 5)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsErrorForStagesExceedingMaximumIncludingNestedStages", func(t *testing.T) {
+
+		// act
+		err := validateStageCount(stages, 4)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Manifest has 5 stages")
+			assert.Contains(t, err.Error(), "maximum of 4 stages")
+		}
+	})
+}
+
+func TestGetBuildStatus(t *testing.T) {
+
+	t.Run("ReturnsCanceledForCanceledBuildWithFailedStages", func(t *testing.T) {
+
+		buildLogSteps := []*contracts.BuildLogStep{
+			{Step: "build", Status: contracts.LogStatusSucceeded},
+			{Step: "test", Status: contracts.LogStatusFailed},
+		}
+
+		// act
+		status := getBuildStatus(buildLogSteps, true)
+
+		assert.Equal(t, contracts.LogStatusCanceled, status)
+	})
+
+	t.Run("ReturnsAggregatedStatusForBuildThatIsNotCanceled", func(t *testing.T) {
+
+		buildLogSteps := []*contracts.BuildLogStep{
+			{Step: "build", Status: contracts.LogStatusSucceeded},
+			{Step: "test", Status: contracts.LogStatusFailed},
+		}
+
+		// act
+		status := getBuildStatus(buildLogSteps, false)
+
+		assert.Equal(t, contracts.LogStatusFailed, status)
+	})
+}
+
+func TestEvaluateGlobalWhen(t *testing.T) {
+
+	t.Run("ReturnsTrueWithoutGlobalWhen", func(t *testing.T) {
+
+		_, _, _, whenEvaluator := getMocks()
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetGlobalWhen(whenEvaluator, "")
+
+		// act
+		runStages, err := ciBuilder.evaluateGlobalWhen("github.com/ziplineeci/ziplinee-ci-builder")
+
+		assert.Nil(t, err)
+		assert.True(t, runStages)
+	})
+
+	t.Run("ReturnsTrueIfGlobalWhenEvaluatesToTrue", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_BRANCH", "main")
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetGlobalWhen(whenEvaluator, "branch == 'main'")
+
+		// act
+		runStages, err := ciBuilder.evaluateGlobalWhen("github.com/ziplineeci/ziplinee-ci-builder")
+
+		assert.Nil(t, err)
+		assert.True(t, runStages)
+	})
+
+	t.Run("ReturnsFalseIfGlobalWhenEvaluatesToFalse", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_BRANCH", "feature")
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetGlobalWhen(whenEvaluator, "branch == 'main'")
+
+		// act
+		runStages, err := ciBuilder.evaluateGlobalWhen("github.com/ziplineeci/ziplinee-ci-builder")
+
+		assert.Nil(t, err)
+		assert.False(t, runStages)
+	})
+
+	t.Run("ReturnsErrorIfGlobalWhenIsInvalid", func(t *testing.T) {
+
+		_, _, _, whenEvaluator := getMocks()
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetGlobalWhen(whenEvaluator, "branch ==")
+
+		// act
+		_, err := ciBuilder.evaluateGlobalWhen("github.com/ziplineeci/ziplinee-ci-builder")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetSkippedBuildLogSteps(t *testing.T) {
+
+	t.Run("ReturnsSkippedStepForEveryStageAndParallelStage", func(t *testing.T) {
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "build",
+				ContainerImage: "golang:1.22",
+			},
+			{
+				Name: "test",
+				ParallelStages: []*manifest.ZiplineeStage{
+					{Name: "unit", ContainerImage: "golang:1.22"},
+					{Name: "lint", ContainerImage: "golangci/golangci-lint:latest"},
+				},
+			},
+		}
+
+		// act
+		buildLogSteps := getSkippedBuildLogSteps(stages)
+
+		if assert.Equal(t, 2, len(buildLogSteps)) {
+			assert.Equal(t, "build", buildLogSteps[0].Step)
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[0].Status)
+			assert.Equal(t, "test", buildLogSteps[1].Step)
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[1].Status)
+			if assert.Equal(t, 2, len(buildLogSteps[1].NestedSteps)) {
+				assert.Equal(t, "unit", buildLogSteps[1].NestedSteps[0].Step)
+				assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[1].NestedSteps[0].Status)
+				assert.Equal(t, "lint", buildLogSteps[1].NestedSteps[1].Step)
+			}
+		}
+	})
+}
+
+func TestGetGlobalWhenSkipReasons(t *testing.T) {
+
+	t.Run("ReturnsGlobalWhenClauseFalseForEveryStageAndParallelStage", func(t *testing.T) {
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "build",
+				ContainerImage: "golang:1.22",
+			},
+			{
+				Name: "test",
+				ParallelStages: []*manifest.ZiplineeStage{
+					{Name: "unit", ContainerImage: "golang:1.22"},
+				},
+			},
+		}
+
+		// act
+		skipReasons := getGlobalWhenSkipReasons(stages)
+
+		assert.Equal(t, map[string]SkipReason{
+			"build":     SkipReasonGlobalWhenClauseFalse,
+			"test":      SkipReasonGlobalWhenClauseFalse,
+			"test/unit": SkipReasonGlobalWhenClauseFalse,
+		}, skipReasons)
+	})
+}
+
+func TestIsRetryableRunStagesError(t *testing.T) {
+
+	t.Run("ReturnsTrueForInfrastructureErrorBeforeAnyStageRan", func(t *testing.T) {
+
+		// act
+		retryable := isRetryableRunStagesError(newInfrastructureError(fmt.Errorf("Error response from daemon: network failure")), nil)
+
+		assert.True(t, retryable)
+	})
+
+	t.Run("ReturnsFalseForInfrastructureErrorAfterStagesRan", func(t *testing.T) {
+
+		buildLogSteps := []*contracts.BuildLogStep{
+			{
+				Step:   "deploy",
+				Status: contracts.LogStatusSucceeded,
+			},
+			{
+				Step:   "notify",
+				Status: contracts.LogStatusFailed,
+			},
+		}
+
+		// act
+		retryable := isRetryableRunStagesError(newInfrastructureError(fmt.Errorf("Error response from daemon: pull access denied")), buildLogSteps)
+
+		assert.False(t, retryable)
+	})
+
+	t.Run("ReturnsFalseForPipelineError", func(t *testing.T) {
+
+		// act
+		retryable := isRetryableRunStagesError(fmt.Errorf("Manifest has no stages, failing the build"), nil)
+
+		assert.False(t, retryable)
+	})
+}
+
+func TestRetryOnInfrastructureError(t *testing.T) {
+
+	t.Run("RetriesInfrastructureErrorUpToConfiguredRetries", func(t *testing.T) {
+
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetInfrastructureRetries(2, 0)
+		attempts := 0
+
+		// act
+		err := ciBuilder.retryOnInfrastructureError("Starting docker daemon", func() error {
+			attempts++
+			return newInfrastructureError(fmt.Errorf("Cannot connect to the Docker daemon"))
+		})
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("StopsRetryingOnceItSucceeds", func(t *testing.T) {
+
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetInfrastructureRetries(2, 0)
+		attempts := 0
+
+		// act
+		err := ciBuilder.retryOnInfrastructureError("Running stages", func() error {
+			attempts++
+			if attempts == 1 {
+				return newInfrastructureError(fmt.Errorf("registry unreachable"))
+			}
+			return nil
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("DoesNotRetryPipelineError", func(t *testing.T) {
+
+		ciBuilder := &ciBuilder{}
+		ciBuilder.SetInfrastructureRetries(2, 0)
+		attempts := 0
+
+		// act
+		err := ciBuilder.retryOnInfrastructureError("Running stages", func() error {
+			attempts++
+			return fmt.Errorf("Stage build failed with exit code 1")
+		})
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("DoesNotRetryWithoutConfiguredRetries", func(t *testing.T) {
+
+		ciBuilder := &ciBuilder{}
+		attempts := 0
+
+		// act
+		err := ciBuilder.retryOnInfrastructureError("Starting docker daemon", func() error {
+			attempts++
+			return newInfrastructureError(fmt.Errorf("Cannot connect to the Docker daemon"))
+		})
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, attempts)
+	})
+}
+
+func TestCollectLocalBuildEnvvars(t *testing.T) {
+
+	t.Run("PassesEnvvarsFromDotEnvFileToStages", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, _, envvarHelper, _ := getMocks()
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_SOURCE", "github.com")
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_OWNER", "ziplineeci")
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_NAME", "ziplinee-ci-builder")
+		defer envvarHelper.UnsetZiplineeEnvvars()
+
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, ".env"), []byte("# local-only envvars\nLOCAL_DATABASE_URL=postgres://localhost:5432\nexport MY_SECRET=\"ziplinee.secret(deFTz5Bdjg6SUe29.oPIkXbze5G9PNEWS2-ZnArl8BCqHnx4MdTdxHg37th9u)\"\n"), 0644)
+		assert.Nil(t, err)
+
+		ciBuilder := &ciBuilder{}
+		ciBuilder.EnableDotEnvFile()
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (string, error) {
+				assert.Equal(t, "postgres://localhost:5432", envvars["LOCAL_DATABASE_URL"])
+				assert.Equal(t, "this is my secret", envvars["MY_SECRET"])
+				return "abc", nil
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		envvars, err := ciBuilder.collectLocalBuildEnvvars(envvarHelper, manifest.ZiplineeManifest{Stages: stages}, dir)
+		assert.Nil(t, err)
+
+		// act
+		_, err = pipelineRunner.RunStages(context.Background(), 0, stages, dir, envvars)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("GivesGlobalEnvvarsPrecedenceOverDotEnvFile", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_SOURCE", "github.com")
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_OWNER", "ziplineeci")
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_NAME", "ziplinee-ci-builder")
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		envvarHelper.SetDefaultEnvvars(map[string]string{"HTTP_PROXY": "http://proxy:3128", "LOG_LEVEL": "info"})
+
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, ".env"), []byte("LOG_LEVEL=debug\nGO_VERSION=1.21\n"), 0644)
+		assert.Nil(t, err)
+
+		ciBuilder := &ciBuilder{}
+		ciBuilder.EnableDotEnvFile()
+		mft := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{"GO_VERSION": "1.22"},
+		}
+
+		// act
+		envvars, err := ciBuilder.collectLocalBuildEnvvars(envvarHelper, mft, dir)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "http://proxy:3128", envvars["HTTP_PROXY"])
+		assert.Equal(t, "debug", envvars["LOG_LEVEL"])
+		assert.Equal(t, "1.22", envvars["GO_VERSION"])
+	})
+
+	t.Run("IgnoresDotEnvFileIfNotEnabled", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, ".env"), []byte("LOCAL_DATABASE_URL=postgres://localhost:5432\n"), 0644)
+		assert.Nil(t, err)
+
+		ciBuilder := &ciBuilder{}
+
+		// act
+		envvars, err := ciBuilder.collectLocalBuildEnvvars(envvarHelper, manifest.ZiplineeManifest{}, dir)
+
+		assert.Nil(t, err)
+		assert.NotContains(t, envvars, "LOCAL_DATABASE_URL")
+	})
+
+	t.Run("ReturnsNoErrorIfDotEnvFileDoesNotExist", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_SOURCE", "github.com")
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_OWNER", "ziplineeci")
+		_ = envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_NAME", "ziplinee-ci-builder")
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		ciBuilder := &ciBuilder{}
+		ciBuilder.EnableDotEnvFile()
+
+		// act
+		_, err := ciBuilder.collectLocalBuildEnvvars(envvarHelper, manifest.ZiplineeManifest{}, t.TempDir())
+
+		assert.Nil(t, err)
+	})
+}
@@ -2,6 +2,7 @@ package builder
 
 import (
 	"context"
+	"time"
 
 	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
 	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
@@ -16,17 +17,39 @@ type ContainerRunner interface {
 	HasInjectedCredentials(stageName string, containerImage string) bool
 	PullImage(ctx context.Context, stageName, parentStageName string, containerImage string) error
 	GetImageSize(ctx context.Context, containerImage string) (int64, error)
+	TagImage(ctx context.Context, sourceImage, targetImage string) error
 	StartStageContainer(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (containerID string, err error)
 	StartServiceContainer(ctx context.Context, envvars map[string]string, service manifest.ZiplineeService) (containerID string, err error)
 	RunReadinessProbeContainer(ctx context.Context, parentStage manifest.ZiplineeStage, service manifest.ZiplineeService, readiness manifest.ReadinessProbe) (err error)
+	ExecInServiceContainer(ctx context.Context, serviceName string, cmd []string) (err error)
 	TailContainerLogs(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error)
 	StopSingleStageServiceContainers(ctx context.Context, parentStage manifest.ZiplineeStage)
 	StopMultiStageServiceContainers(ctx context.Context)
 	StartDockerDaemon() error
-	WaitForDockerDaemon()
+	WaitForDockerDaemon() error
 	CreateDockerClient() error
 	CreateNetworks(ctx context.Context) error
 	DeleteNetworks(ctx context.Context) error
 	StopAllContainers(ctx context.Context)
 	Info(ctx context.Context) string
+	GetCredentialsAudit() []CredentialsAuditEntry
+	EnablePullProgressLogging(interval time.Duration)
+	EnableConcurrentPullLimit(maxConcurrentPulls int)
+	EnableStageResourceUsageSampling(interval time.Duration)
+	GetStageResourceUsage() []StageResourceUsage
+	SetCredentialPrecedence(precedence string)
+	SetMaxCapturedOutputSize(maxBytes int)
+	SetInvalidUTF8Handling(handling string)
+	GrantDecryptionKey(decryptionKey string, imagePaths []string)
+	SetContainerRemoval(autoRemove, keepFailed bool)
+	SetWorkDirMountPath(mountPath string)
+	SetDockerClientKeepAlive(keepAlive, idleConnTimeout time.Duration)
+}
+
+// CredentialsAuditEntry records the names of the credentials injected into a stage container and whether it got the decryption key
+type CredentialsAuditEntry struct {
+	Stage         string   `json:"stage"`
+	Image         string   `json:"image"`
+	Credentials   []string `json:"credentials"`
+	DecryptionKey bool     `json:"decryptionKey,omitempty"`
 }
@@ -7,6 +7,7 @@ package builder
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
@@ -78,6 +79,70 @@ func (mr *MockContainerRunnerMockRecorder) DeleteNetworks(ctx interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteNetworks", reflect.TypeOf((*MockContainerRunner)(nil).DeleteNetworks), ctx)
 }
 
+// EnableConcurrentPullLimit mocks base method.
+func (m *MockContainerRunner) EnableConcurrentPullLimit(maxConcurrentPulls int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "EnableConcurrentPullLimit", maxConcurrentPulls)
+}
+
+// EnableConcurrentPullLimit indicates an expected call of EnableConcurrentPullLimit.
+func (mr *MockContainerRunnerMockRecorder) EnableConcurrentPullLimit(maxConcurrentPulls interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnableConcurrentPullLimit", reflect.TypeOf((*MockContainerRunner)(nil).EnableConcurrentPullLimit), maxConcurrentPulls)
+}
+
+// EnablePullProgressLogging mocks base method.
+func (m *MockContainerRunner) EnablePullProgressLogging(interval time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "EnablePullProgressLogging", interval)
+}
+
+// EnablePullProgressLogging indicates an expected call of EnablePullProgressLogging.
+func (mr *MockContainerRunnerMockRecorder) EnablePullProgressLogging(interval interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnablePullProgressLogging", reflect.TypeOf((*MockContainerRunner)(nil).EnablePullProgressLogging), interval)
+}
+
+// EnableStageResourceUsageSampling mocks base method.
+func (m *MockContainerRunner) EnableStageResourceUsageSampling(interval time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "EnableStageResourceUsageSampling", interval)
+}
+
+// EnableStageResourceUsageSampling indicates an expected call of EnableStageResourceUsageSampling.
+func (mr *MockContainerRunnerMockRecorder) EnableStageResourceUsageSampling(interval interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnableStageResourceUsageSampling", reflect.TypeOf((*MockContainerRunner)(nil).EnableStageResourceUsageSampling), interval)
+}
+
+// ExecInServiceContainer mocks base method.
+func (m *MockContainerRunner) ExecInServiceContainer(ctx context.Context, serviceName string, cmd []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExecInServiceContainer", ctx, serviceName, cmd)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExecInServiceContainer indicates an expected call of ExecInServiceContainer.
+func (mr *MockContainerRunnerMockRecorder) ExecInServiceContainer(ctx, serviceName, cmd interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExecInServiceContainer", reflect.TypeOf((*MockContainerRunner)(nil).ExecInServiceContainer), ctx, serviceName, cmd)
+}
+
+// GetCredentialsAudit mocks base method.
+func (m *MockContainerRunner) GetCredentialsAudit() []CredentialsAuditEntry {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCredentialsAudit")
+	ret0, _ := ret[0].([]CredentialsAuditEntry)
+	return ret0
+}
+
+// GetCredentialsAudit indicates an expected call of GetCredentialsAudit.
+func (mr *MockContainerRunnerMockRecorder) GetCredentialsAudit() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCredentialsAudit", reflect.TypeOf((*MockContainerRunner)(nil).GetCredentialsAudit))
+}
+
 // GetImageSize mocks base method.
 func (m *MockContainerRunner) GetImageSize(ctx context.Context, containerImage string) (int64, error) {
 	m.ctrl.T.Helper()
@@ -93,6 +158,32 @@ func (mr *MockContainerRunnerMockRecorder) GetImageSize(ctx, containerImage inte
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImageSize", reflect.TypeOf((*MockContainerRunner)(nil).GetImageSize), ctx, containerImage)
 }
 
+// GetStageResourceUsage mocks base method.
+func (m *MockContainerRunner) GetStageResourceUsage() []StageResourceUsage {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStageResourceUsage")
+	ret0, _ := ret[0].([]StageResourceUsage)
+	return ret0
+}
+
+// GetStageResourceUsage indicates an expected call of GetStageResourceUsage.
+func (mr *MockContainerRunnerMockRecorder) GetStageResourceUsage() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStageResourceUsage", reflect.TypeOf((*MockContainerRunner)(nil).GetStageResourceUsage))
+}
+
+// GrantDecryptionKey mocks base method.
+func (m *MockContainerRunner) GrantDecryptionKey(decryptionKey string, imagePaths []string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "GrantDecryptionKey", decryptionKey, imagePaths)
+}
+
+// GrantDecryptionKey indicates an expected call of GrantDecryptionKey.
+func (mr *MockContainerRunnerMockRecorder) GrantDecryptionKey(decryptionKey, imagePaths interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GrantDecryptionKey", reflect.TypeOf((*MockContainerRunner)(nil).GrantDecryptionKey), decryptionKey, imagePaths)
+}
+
 // HasInjectedCredentials mocks base method.
 func (m *MockContainerRunner) HasInjectedCredentials(stageName, containerImage string) bool {
 	m.ctrl.T.Helper()
@@ -177,6 +268,78 @@ func (mr *MockContainerRunnerMockRecorder) RunReadinessProbeContainer(ctx, paren
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunReadinessProbeContainer", reflect.TypeOf((*MockContainerRunner)(nil).RunReadinessProbeContainer), ctx, parentStage, service, readiness)
 }
 
+// SetContainerRemoval mocks base method.
+func (m *MockContainerRunner) SetContainerRemoval(autoRemove, keepFailed bool) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetContainerRemoval", autoRemove, keepFailed)
+}
+
+// SetContainerRemoval indicates an expected call of SetContainerRemoval.
+func (mr *MockContainerRunnerMockRecorder) SetContainerRemoval(autoRemove, keepFailed interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetContainerRemoval", reflect.TypeOf((*MockContainerRunner)(nil).SetContainerRemoval), autoRemove, keepFailed)
+}
+
+// SetCredentialPrecedence mocks base method.
+func (m *MockContainerRunner) SetCredentialPrecedence(precedence string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetCredentialPrecedence", precedence)
+}
+
+// SetCredentialPrecedence indicates an expected call of SetCredentialPrecedence.
+func (mr *MockContainerRunnerMockRecorder) SetCredentialPrecedence(precedence interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCredentialPrecedence", reflect.TypeOf((*MockContainerRunner)(nil).SetCredentialPrecedence), precedence)
+}
+
+// SetDockerClientKeepAlive mocks base method.
+func (m *MockContainerRunner) SetDockerClientKeepAlive(keepAlive, idleConnTimeout time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetDockerClientKeepAlive", keepAlive, idleConnTimeout)
+}
+
+// SetDockerClientKeepAlive indicates an expected call of SetDockerClientKeepAlive.
+func (mr *MockContainerRunnerMockRecorder) SetDockerClientKeepAlive(keepAlive, idleConnTimeout interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDockerClientKeepAlive", reflect.TypeOf((*MockContainerRunner)(nil).SetDockerClientKeepAlive), keepAlive, idleConnTimeout)
+}
+
+// SetInvalidUTF8Handling mocks base method.
+func (m *MockContainerRunner) SetInvalidUTF8Handling(handling string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetInvalidUTF8Handling", handling)
+}
+
+// SetInvalidUTF8Handling indicates an expected call of SetInvalidUTF8Handling.
+func (mr *MockContainerRunnerMockRecorder) SetInvalidUTF8Handling(handling interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetInvalidUTF8Handling", reflect.TypeOf((*MockContainerRunner)(nil).SetInvalidUTF8Handling), handling)
+}
+
+// SetMaxCapturedOutputSize mocks base method.
+func (m *MockContainerRunner) SetMaxCapturedOutputSize(maxBytes int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetMaxCapturedOutputSize", maxBytes)
+}
+
+// SetMaxCapturedOutputSize indicates an expected call of SetMaxCapturedOutputSize.
+func (mr *MockContainerRunnerMockRecorder) SetMaxCapturedOutputSize(maxBytes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMaxCapturedOutputSize", reflect.TypeOf((*MockContainerRunner)(nil).SetMaxCapturedOutputSize), maxBytes)
+}
+
+// SetWorkDirMountPath mocks base method.
+func (m *MockContainerRunner) SetWorkDirMountPath(mountPath string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetWorkDirMountPath", mountPath)
+}
+
+// SetWorkDirMountPath indicates an expected call of SetWorkDirMountPath.
+func (mr *MockContainerRunnerMockRecorder) SetWorkDirMountPath(mountPath interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetWorkDirMountPath", reflect.TypeOf((*MockContainerRunner)(nil).SetWorkDirMountPath), mountPath)
+}
+
 // StartDockerDaemon mocks base method.
 func (m *MockContainerRunner) StartDockerDaemon() error {
 	m.ctrl.T.Helper()
@@ -257,6 +420,20 @@ func (mr *MockContainerRunnerMockRecorder) StopSingleStageServiceContainers(ctx,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopSingleStageServiceContainers", reflect.TypeOf((*MockContainerRunner)(nil).StopSingleStageServiceContainers), ctx, parentStage)
 }
 
+// TagImage mocks base method.
+func (m *MockContainerRunner) TagImage(ctx context.Context, sourceImage, targetImage string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TagImage", ctx, sourceImage, targetImage)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TagImage indicates an expected call of TagImage.
+func (mr *MockContainerRunnerMockRecorder) TagImage(ctx, sourceImage, targetImage interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TagImage", reflect.TypeOf((*MockContainerRunner)(nil).TagImage), ctx, sourceImage, targetImage)
+}
+
 // TailContainerLogs mocks base method.
 func (m *MockContainerRunner) TailContainerLogs(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) error {
 	m.ctrl.T.Helper()
@@ -272,9 +449,11 @@ func (mr *MockContainerRunnerMockRecorder) TailContainerLogs(ctx, containerID, p
 }
 
 // WaitForDockerDaemon mocks base method.
-func (m *MockContainerRunner) WaitForDockerDaemon() {
+func (m *MockContainerRunner) WaitForDockerDaemon() error {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "WaitForDockerDaemon")
+	ret := m.ctrl.Call(m, "WaitForDockerDaemon")
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // WaitForDockerDaemon indicates an expected call of WaitForDockerDaemon.
@@ -0,0 +1,65 @@
+package builder
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// getEffectiveCPUCount returns the number of cpus available to the builder, taking the cgroup cpu limit of the pod into account since runtime.NumCPU only returns the cpus of the node; fractional limits get rounded up
+func getEffectiveCPUCount(cgroupRoot string) int {
+	cpuCount := runtime.NumCPU()
+
+	if limit, ok := getCgroupCPULimit(cgroupRoot); ok {
+		limitedCPUCount := int(math.Ceil(limit))
+		if limitedCPUCount < 1 {
+			limitedCPUCount = 1
+		}
+		if limitedCPUCount < cpuCount {
+			cpuCount = limitedCPUCount
+		}
+	}
+
+	return cpuCount
+}
+
+// getCgroupCPULimit reads the cpu quota and period of the cgroup, for cgroup v2 and v1 respectively
+func getCgroupCPULimit(cgroupRoot string) (limit float64, ok bool) {
+
+	// cgroup v2 holds both in cpu.max, like 200000 100000, with max as quota if it's unlimited
+	if cpuMax, err := os.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		fields := strings.Fields(string(cpuMax))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return parseCPUQuotaAndPeriod(fields[0], fields[1])
+	}
+
+	// cgroup v1 has them in separate files, with -1 as quota if it's unlimited
+	quota, err := os.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := os.ReadFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+
+	return parseCPUQuotaAndPeriod(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func parseCPUQuotaAndPeriod(quotaValue, periodValue string) (limit float64, ok bool) {
+	quota, err := strconv.ParseFloat(quotaValue, 64)
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := strconv.ParseFloat(periodValue, 64)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+
+	return quota / period, true
+}
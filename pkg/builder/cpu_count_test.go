@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEffectiveCPUCount(t *testing.T) {
+
+	t.Run("ReturnsCgroupV2LimitRoundedUp", func(t *testing.T) {
+
+		cgroupRoot := t.TempDir()
+		err := os.WriteFile(filepath.Join(cgroupRoot, "cpu.max"), []byte("50000 100000\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		cpuCount := getEffectiveCPUCount(cgroupRoot)
+
+		assert.Equal(t, 1, cpuCount)
+	})
+
+	t.Run("ReturnsCgroupV1Limit", func(t *testing.T) {
+
+		cgroupRoot := t.TempDir()
+		err := os.MkdirAll(filepath.Join(cgroupRoot, "cpu"), 0755)
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"), []byte("100000\n"), 0644)
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"), []byte("100000\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		cpuCount := getEffectiveCPUCount(cgroupRoot)
+
+		assert.Equal(t, 1, cpuCount)
+	})
+
+	t.Run("ReturnsNumCPUIfCgroupV2IsUnlimited", func(t *testing.T) {
+
+		cgroupRoot := t.TempDir()
+		err := os.WriteFile(filepath.Join(cgroupRoot, "cpu.max"), []byte("max 100000\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		cpuCount := getEffectiveCPUCount(cgroupRoot)
+
+		assert.Equal(t, runtime.NumCPU(), cpuCount)
+	})
+
+	t.Run("ReturnsNumCPUIfCgroupV1IsUnlimited", func(t *testing.T) {
+
+		cgroupRoot := t.TempDir()
+		err := os.MkdirAll(filepath.Join(cgroupRoot, "cpu"), 0755)
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"), []byte("-1\n"), 0644)
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"), []byte("100000\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		cpuCount := getEffectiveCPUCount(cgroupRoot)
+
+		assert.Equal(t, runtime.NumCPU(), cpuCount)
+	})
+
+	t.Run("ReturnsNumCPUIfLimitExceedsIt", func(t *testing.T) {
+
+		cgroupRoot := t.TempDir()
+		err := os.WriteFile(filepath.Join(cgroupRoot, "cpu.max"), []byte("100000000 100000\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		cpuCount := getEffectiveCPUCount(cgroupRoot)
+
+		assert.Equal(t, runtime.NumCPU(), cpuCount)
+	})
+
+	t.Run("ReturnsNumCPUWithoutCgroupFiles", func(t *testing.T) {
+
+		// act
+		cpuCount := getEffectiveCPUCount(t.TempDir())
+
+		assert.Equal(t, runtime.NumCPU(), cpuCount)
+	})
+}
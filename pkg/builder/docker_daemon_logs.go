@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dockerDaemonLogLines            = 50
+	defaultDockerDaemonReadyTimeout = 5 * time.Minute
+)
+
+// tailLogWriter keeps the last lines written to it, so the output of the docker daemon can be included in an error when it fails to start
+type tailLogWriter struct {
+	maxLines    int
+	lines       []string
+	partialLine []byte
+	mutex       sync.Mutex
+}
+
+// newTailLogWriter returns a writer that keeps the last maxLines lines
+func newTailLogWriter(maxLines int) *tailLogWriter {
+	return &tailLogWriter{
+		maxLines: maxLines,
+		lines:    make([]string, 0, maxLines),
+	}
+}
+
+func (w *tailLogWriter) Write(p []byte) (n int, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.partialLine = append(w.partialLine, p...)
+	for {
+		index := bytes.IndexByte(w.partialLine, '\n')
+		if index < 0 {
+			break
+		}
+		w.addLine(string(w.partialLine[:index]))
+		w.partialLine = w.partialLine[index+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *tailLogWriter) addLine(line string) {
+	if len(w.lines) >= w.maxLines {
+		w.lines = w.lines[1:]
+	}
+	w.lines = append(w.lines, line)
+}
+
+// String returns the kept lines, including a last line without trailing newline
+func (w *tailLogWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	lines := w.lines
+	if len(w.partialLine) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(w.partialLine))
+	}
+
+	return strings.Join(lines, "\n")
+}
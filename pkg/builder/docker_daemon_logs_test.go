@@ -0,0 +1,35 @@
+package builder
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailLogWriter(t *testing.T) {
+
+	t.Run("KeepsOnlyTheLastLines", func(t *testing.T) {
+
+		writer := newTailLogWriter(2)
+
+		// act
+		_, err := writer.Write([]byte("line 1\nline 2\nline 3\n"))
+
+		assert.Nil(t, err)
+		assert.Equal(t, "line 2\nline 3", writer.String())
+	})
+
+	t.Run("JoinsLinesSplitAcrossWrites", func(t *testing.T) {
+
+		writer := newTailLogWriter(5)
+
+		// act
+		for _, chunk := range []string{"failed to ", "start daemon\nerror", " initializing network"} {
+			_, err := fmt.Fprint(writer, chunk)
+			assert.Nil(t, err)
+		}
+
+		assert.Equal(t, "failed to start daemon\nerror initializing network", writer.String())
+	})
+}
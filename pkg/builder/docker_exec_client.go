@@ -0,0 +1,16 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+)
+
+// DockerExecClient has the methods of the docker client to run a command inside a running container
+//
+//go:generate mockgen -package=builder -destination ./docker_exec_client_mock.go -source=docker_exec_client.go
+type DockerExecClient interface {
+	ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error)
+	ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error)
+}
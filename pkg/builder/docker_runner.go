@@ -7,6 +7,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/user"
@@ -15,6 +17,7 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,6 +28,7 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
 	"github.com/logrusorgru/aurora"
 	"github.com/opentracing/opentracing-go"
 	"github.com/rs/zerolog/log"
@@ -48,7 +52,20 @@ func NewDockerRunner(envvarHelper EnvvarHelper, obfuscator Obfuscator, config co
 		runningReadinessProbeContainerIDs:     make([]string, 0),
 		networks:                              map[string]string{},
 		entrypointTemplateDir:                 "/entrypoint-templates",
+		dockerCertsDir:                        "/etc/docker/certs.d",
+		secretFilesBaseDir:                    "/dev/shm",
+		dockerDaemonBinary:                    "dockerd",
+		dockerDaemonSocketPath:                "/var/run/docker.sock",
+		dockerDaemonReadyTimeout:              defaultDockerDaemonReadyTimeout,
 		pulledImagesMutex:                     NewMapMutex(),
+		imageCache:                            NewImageCache(),
+		secretFilesDirs:                       map[string][]string{},
+		outputCaptures:                        map[string]*stageOutputCapture{},
+		capturedEnvvars:                       map[string]string{},
+		maxCapturedOutputBytes:                defaultMaxCapturedOutputBytes,
+		runningServiceContainers:              map[string]runningServiceContainer{},
+		invalidUTF8Handling:                   invalidUTF8HandlingReplace,
+		autoRemovedContainers:                 map[string]autoRemovedContainer{},
 	}
 }
 
@@ -68,8 +85,69 @@ type dockerRunner struct {
 	// networkBridgeID                       string
 	networks              map[string]string
 	entrypointTemplateDir string
+	dockerCertsDir        string
+	secretFilesBaseDir    string
+
+	secretFilesDirs      map[string][]string
+	secretFilesDirsMutex sync.Mutex
+
+	dockerDaemonBinary       string
+	dockerDaemonSocketPath   string
+	dockerDaemonReadyTimeout time.Duration
+	dockerDaemonLogs         *tailLogWriter
+	dockerDaemonExited       chan error
+
+	pullProgressLogInterval time.Duration
+	pullSemaphore           chan struct{}
 
 	pulledImagesMutex *MapMutex
+	imageCache        *ImageCache
+
+	credentialsAudit      []CredentialsAuditEntry
+	credentialsAuditMutex sync.Mutex
+
+	credentialPrecedence credentialPrecedence
+
+	decryptionKey       string
+	decryptionKeyImages []string
+
+	stageResourceUsageInterval time.Duration
+	stageResourceUsage         []StageResourceUsage
+	stageResourceUsageMutex    sync.Mutex
+
+	outputCaptures         map[string]*stageOutputCapture
+	capturedEnvvars        map[string]string
+	outputCapturesMutex    sync.Mutex
+	maxCapturedOutputBytes int
+
+	dockerClientKeepAlive       time.Duration
+	dockerClientIdleConnTimeout time.Duration
+
+	execClient                    DockerExecClient
+	runningServiceContainers      map[string]runningServiceContainer
+	runningServiceContainersMutex sync.Mutex
+
+	invalidUTF8Handling invalidUTF8Handling
+
+	autoRemoveContainers       bool
+	keepFailedContainers       bool
+	autoRemovedContainers      map[string]autoRemovedContainer
+	autoRemovedContainersMutex sync.Mutex
+
+	workDirMountPath string
+}
+
+// autoRemovedContainer holds the output and removal of a stage container that's gone once it exits, both set up before it starts
+type autoRemovedContainer struct {
+	output  types.HijackedResponse
+	resultC <-chan container.ContainerWaitOKBody
+	errC    <-chan error
+}
+
+// runningServiceContainer identifies the container of a running service by the service name, for commands to be run inside it
+type runningServiceContainer struct {
+	containerID     string
+	parentStageName string
 }
 
 func (dr *dockerRunner) IsImagePulled(ctx context.Context, stageName string, containerImage string) bool {
@@ -84,18 +162,20 @@ func (dr *dockerRunner) IsImagePulled(ctx context.Context, stageName string, con
 	dr.pulledImagesMutex.RLock(containerImage)
 	defer dr.pulledImagesMutex.RUnlock(containerImage)
 
-	imageSummaries, err := dr.dockerClient.ImageList(ctx, types.ImageListOptions{})
-	if err != nil {
-		return false
-	}
+	return dr.imageCache.IsPulled(containerImage, func() bool {
+		imageSummaries, err := dr.dockerClient.ImageList(ctx, types.ImageListOptions{})
+		if err != nil {
+			return false
+		}
 
-	for _, summary := range imageSummaries {
-		if contains(summary.RepoTags, containerImage) {
-			return true
+		for _, summary := range imageSummaries {
+			if contains(summary.RepoTags, containerImage) {
+				return true
+			}
 		}
-	}
 
-	return false
+		return false
+	})
 }
 
 func (dr *dockerRunner) PullImage(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
@@ -108,6 +188,21 @@ func (dr *dockerRunner) PullImage(ctx context.Context, stageName, parentStageNam
 	dr.pulledImagesMutex.Lock(containerImage)
 	defer dr.pulledImagesMutex.Unlock(containerImage)
 
+	// the tag might point to another image after pulling, so only mark it as present once the pull succeeded
+	dr.imageCache.Invalidate(containerImage)
+	defer func() {
+		if err == nil {
+			dr.imageCache.Set(containerImage)
+		}
+	}()
+
+	// limit the number of images pulled at the same time to avoid saturating the docker daemon
+	releasePullSlot, err := dr.acquirePullSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer releasePullSlot()
+
 	log.Info().Msgf("%v Pulling docker image '%v'", getLogPrefix(stageName, parentStageName), containerImage)
 
 	rc, err := dr.dockerClient.ImagePull(ctx, containerImage, dr.getImagePullOptions(containerImage))
@@ -116,6 +211,13 @@ func (dr *dockerRunner) PullImage(ctx context.Context, stageName, parentStageNam
 	}
 	defer rc.Close()
 
+	if dr.pullProgressLogInterval > 0 {
+		// wait for image pull to finish while periodically logging its progress
+		return readImagePullProgress(rc, dr.pullProgressLogInterval, time.Now, func(progress imagePullProgress) {
+			log.Info().Msgf("%v Pulling docker image '%v': %v", getLogPrefix(stageName, parentStageName), containerImage, progress)
+		})
+	}
+
 	// wait for image pull to finish
 	_, err = io.ReadAll(rc)
 	if err != nil {
@@ -125,6 +227,55 @@ func (dr *dockerRunner) PullImage(ctx context.Context, stageName, parentStageNam
 	return
 }
 
+// TagImage tags sourceImage as targetImage, for instance to run an image pulled from a mirror under its original name
+func (dr *dockerRunner) TagImage(ctx context.Context, sourceImage, targetImage string) (err error) {
+
+	// get write lock so the tag doesn't change while the same image gets pulled
+	dr.pulledImagesMutex.Lock(targetImage)
+	defer dr.pulledImagesMutex.Unlock(targetImage)
+
+	err = dr.dockerClient.ImageTag(ctx, sourceImage, targetImage)
+	if err != nil {
+		return err
+	}
+
+	dr.imageCache.Set(targetImage)
+
+	return nil
+}
+
+func (dr *dockerRunner) EnablePullProgressLogging(interval time.Duration) {
+	dr.pullProgressLogInterval = interval
+}
+
+// EnableConcurrentPullLimit limits the number of images pulled at the same time across all stages and services
+func (dr *dockerRunner) EnableConcurrentPullLimit(maxConcurrentPulls int) {
+	if maxConcurrentPulls <= 0 {
+		dr.pullSemaphore = nil
+		return
+	}
+	dr.pullSemaphore = make(chan struct{}, maxConcurrentPulls)
+}
+
+// acquirePullSlot waits until fewer than the maximum number of images are being pulled; the returned function frees the slot again
+func (dr *dockerRunner) acquirePullSlot(ctx context.Context) (release func(), err error) {
+	if dr.pullSemaphore == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case dr.pullSemaphore <- struct{}{}:
+		return func() { <-dr.pullSemaphore }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// EnableStageResourceUsageSampling samples the stats of stage containers while their logs are tailed to record their peak resource usage
+func (dr *dockerRunner) EnableStageResourceUsageSampling(interval time.Duration) {
+	dr.stageResourceUsageInterval = interval
+}
+
 func (dr *dockerRunner) GetImageSize(ctx context.Context, containerImage string) (totalSize int64, err error) {
 
 	items, err := dr.dockerClient.ImageHistory(ctx, containerImage)
@@ -153,6 +304,9 @@ func (dr *dockerRunner) StartStageContainer(ctx context.Context, depth int, dir
 		return
 	}
 
+	// keep track of which credentials get injected into this stage
+	dr.auditInjectedCredentials(stage.Name, stage.ContainerImage, trustedImage)
+
 	// add custom properties as ZIPLINEE_EXTENSION_... envvar
 	extensionEnvVars := dr.generateExtensionEnvvars(stage.CustomProperties, stage.EnvVars)
 
@@ -162,6 +316,9 @@ func (dr *dockerRunner) StartStageContainer(ctx context.Context, depth int, dir
 	}
 	stage.EnvVars["ZIPLINEE_STAGE_NAME"] = stage.Name
 
+	// mount the work directory at the configured path instead of the default one
+	stage = dr.applyWorkDirMountPath(stage)
+
 	// get imageID and imageCreatedDate of stage build container
 	imageSHA, imageCreatedDate, err := dr.GetImageInfo(ctx, stage.ContainerImage)
 	if err != nil {
@@ -170,12 +327,47 @@ func (dr *dockerRunner) StartStageContainer(ctx context.Context, depth int, dir
 	stage.EnvVars["ZIPLINEE_STAGE_IMAGE_SHA"] = imageSHA
 	stage.EnvVars["ZIPLINEE_STAGE_IMAGE_CREATED_DATE"] = imageCreatedDate
 
-	// combine and override ziplinee and global envvars with stage envvars
-	combinedEnvVars := dr.envvarHelper.OverrideEnvvars(envvars, stage.EnvVars, extensionEnvVars)
+	// combine and override ziplinee and global envvars with output captured by earlier stages and stage envvars
+	combinedEnvVars := dr.envvarHelper.OverrideEnvvars(envvars, dr.getCapturedEnvvars(), stage.EnvVars, extensionEnvVars)
 
 	// decrypt secrets in all envvars
 	combinedEnvVars = dr.envvarHelper.decryptSecrets(combinedEnvVars, dr.envvarHelper.GetPipelineName())
 
+	// pass the decryption key to trusted images explicitly granted it, like extensions re-encrypting secrets
+	dr.injectDecryptionKey(combinedEnvVars, trustedImage)
+
+	// remove the directories with secret files right away if the container doesn't start, otherwise once it's done
+	secretFilesDirs := []string{}
+	defer func() {
+		if err != nil {
+			removeSecretFilesDirs(secretFilesDirs)
+		}
+	}()
+
+	// move secrets that should be read from files out of the envvars
+	secretFilesDir, secretFilesHostPath, secretFilesMountPath, err := dr.generateSecretFiles(stage.CustomProperties, combinedEnvVars)
+	if err != nil {
+		return
+	}
+	if secretFilesDir != "" {
+		secretFilesDirs = append(secretFilesDirs, secretFilesDir)
+	}
+	if secretFilesHostPath != "" && secretFilesMountPath != "" {
+		binds = append(binds, fmt.Sprintf("%v:%v:ro", secretFilesHostPath, secretFilesMountPath))
+	}
+
+	// make the key of an ssh credential available for git operations, if the trusted image is granted one
+	sshDir, sshHostPath, sshMountPath, err := dr.generateSSHFiles(trustedImage, combinedEnvVars)
+	if err != nil {
+		return
+	}
+	if sshDir != "" {
+		secretFilesDirs = append(secretFilesDirs, sshDir)
+	}
+	if sshHostPath != "" && sshMountPath != "" {
+		binds = append(binds, fmt.Sprintf("%v:%v:ro", sshHostPath, sshMountPath))
+	}
+
 	// define docker envvars and expand ZIPLINEE_ variables
 	dockerEnvVars := make([]string, 0)
 	if len(combinedEnvVars) > 0 {
@@ -207,15 +399,70 @@ func (dr *dockerRunner) StartStageContainer(ctx context.Context, depth int, dir
 	}
 
 	// define config
-	config := container.Config{
+	config, err := dr.getStageContainerConfig(stage, dockerEnvVars, entrypoint, cmds, trustedImage)
+	if err != nil {
+		return
+	}
+
+	hostConfig, err := dr.getStageHostConfig(stage, binds, trustedImage)
+	if err != nil {
+		return
+	}
+
+	endpointSettings, err := dr.getNetworkEndpointSettings(stage.Name, stage.CustomProperties)
+	if err != nil {
+		return
+	}
+
+	// create container
+	resp, err := dr.dockerClient.ContainerCreate(ctx, &config, &hostConfig, &network.NetworkingConfig{}, nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	// connect to any configured networks, unless the stage runs in the host network or without network
+	if hostConfig.NetworkMode == "" || hostConfig.NetworkMode == "bridge" {
+		for networkName, networkID := range dr.networks {
+			err = dr.dockerClient.NetworkConnect(ctx, networkID, resp.ID, endpointSettings)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed connecting container %v to network %v with id %v", resp.ID, networkName, networkID)
+				return
+			}
+		}
+	}
+
+	containerID = resp.ID
+	dr.runningStageContainerIDs = dr.addRunningContainerID(dr.runningStageContainerIDs, containerID)
+	dr.registerOutputCapture(containerID, stage)
+
+	if hostConfig.AutoRemove {
+		err = dr.attachAutoRemovedContainer(ctx, containerID)
+		if err != nil {
+			return
+		}
+	}
+
+	// start container
+	if err = dr.dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return
+	}
+	dr.registerSecretFilesDirs(containerID, secretFilesDirs)
+
+	return
+}
+
+func (dr *dockerRunner) getStageContainerConfig(stage manifest.ZiplineeStage, dockerEnvVars, entrypoint, cmds []string, trustedImage *contracts.TrustedImageConfig) (config container.Config, err error) {
+
+	config = container.Config{
 		AttachStdout: true,
 		AttachStderr: true,
 		Env:          dockerEnvVars,
 		Image:        stage.ContainerImage,
 		WorkingDir:   os.Expand(stage.WorkingDirectory, dr.envvarHelper.getZiplineeEnv),
+		Labels:       dr.getStageContainerLabels(stage),
 	}
 	if len(stage.Commands) > 0 {
-		if trustedImage != nil && !trustedImage.AllowCommands && len(trustedImage.InjectedCredentialTypes) > 0 {
+		if !allowsCommands(trustedImage) {
 			// return stage as failed with error message indicating that this trusted image doesn't allow commands
 			err = fmt.Errorf("This trusted image does not allow for commands to be set as a protection against snooping injected credentials")
 			return
@@ -240,17 +487,80 @@ func (dr *dockerRunner) StartStageContainer(ctx context.Context, depth int, dir
 		}
 	}
 
+	// override the entrypoint when the stage specifies one; generated commands move into cmd so they still get executed
+	if entrypointOverride, ok := getCustomPropertyStringSlice(stage.CustomProperties, "entrypoint"); ok {
+		if !allowsCommands(trustedImage) {
+			// an entrypoint runs arbitrary commands as well, so it gets the same protection
+			err = fmt.Errorf("This trusted image does not allow for the entrypoint to be overridden as a protection against snooping injected credentials")
+			return
+		}
+
+		if len(stage.Commands) > 0 {
+			config.Cmd = append(append([]string{}, config.Entrypoint...), config.Cmd...)
+		}
+		config.Entrypoint = entrypointOverride
+	}
+
+	return
+}
+
+// allowsCommands returns false for trusted images with injected credentials that don't explicitly allow commands, so a manifest can't run commands to read the credentials
+func allowsCommands(trustedImage *contracts.TrustedImageConfig) bool {
+	return trustedImage == nil || trustedImage.AllowCommands || len(trustedImage.InjectedCredentialTypes) == 0
+}
+
+// getStageContainerLabels merges the labels set with the labels property of a stage with the labels identifying the build, which win on conflict so tooling can rely on them
+func (dr *dockerRunner) getStageContainerLabels(stage manifest.ZiplineeStage) map[string]string {
+
+	labels := map[string]string{}
+	if customLabels, ok := getCustomPropertyStringMap(stage.CustomProperties, "labels"); ok {
+		for key, value := range customLabels {
+			labels[key] = value
+		}
+	}
+
+	standardLabels := map[string]string{
+		"io.ziplinee.stage": stage.Name,
+	}
+	if pipeline := dr.envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_FULLNAME"); pipeline != "" {
+		standardLabels["io.ziplinee.pipeline"] = pipeline
+	}
+	if dr.config.JobName != nil && *dr.config.JobName != "" {
+		standardLabels["io.ziplinee.job"] = *dr.config.JobName
+	}
+
+	for key, value := range standardLabels {
+		if customValue, ok := labels[key]; ok && customValue != value {
+			log.Warn().Msgf("[%v] Ignoring label %v=%v, it's set by the builder", stage.Name, key, customValue)
+		}
+		labels[key] = value
+	}
+
+	return labels
+}
+
+func (dr *dockerRunner) getStageHostConfig(stage manifest.ZiplineeStage, binds []string, trustedImage *contracts.TrustedImageConfig) (hostConfig container.HostConfig, err error) {
+
 	// check if this is a trusted image with RunPrivileged or RunDocker set to true
 	privileged := false
 	if trustedImage != nil && runtime.GOOS != "windows" {
 		privileged = trustedImage.RunDocker || trustedImage.RunPrivileged
 	}
 
-	// create container
-	resp, err := dr.dockerClient.ContainerCreate(ctx, &config, &container.HostConfig{
+	// a stage can request privileged mode itself, but only trusted images get it
+	if requestPrivileged, ok := getCustomPropertyBool(stage.CustomProperties, "privileged"); ok && requestPrivileged && !privileged {
+		if trustedImage == nil {
+			log.Warn().Msgf("Denying privileged mode for stage %v, because image %v is not trusted", stage.Name, stage.ContainerImage)
+		} else if runtime.GOOS != "windows" {
+			privileged = true
+		}
+	}
+
+	hostConfig = container.HostConfig{
 		Binds:      binds,
 		Privileged: privileged,
-		AutoRemove: false,
+		// keeping failed containers for debugging takes precedence over removing them
+		AutoRemove: dr.autoRemoveContainers && !dr.keepFailedContainers,
 		LogConfig: container.LogConfig{
 			Type: "local",
 			Config: map[string]string{
@@ -260,27 +570,131 @@ func (dr *dockerRunner) StartStageContainer(ctx context.Context, depth int, dir
 				"mode":     "non-blocking",
 			},
 		},
-	}, &network.NetworkingConfig{}, nil, "")
+	}
+
+	// capabilities are a linux concept
+	if runtime.GOOS != "windows" {
+		capAdd, hasCapAdd := getCustomPropertyStringSlice(stage.CustomProperties, "capAdd")
+		capDrop, hasCapDrop := getCustomPropertyStringSlice(stage.CustomProperties, "capDrop")
+
+		if trustedImage != nil {
+			if hasCapAdd {
+				hostConfig.CapAdd = capAdd
+			}
+			if hasCapDrop {
+				hostConfig.CapDrop = capDrop
+			}
+		} else {
+			// untrusted images run without any capabilities
+			if hasCapAdd || hasCapDrop {
+				log.Warn().Msgf("Ignoring capAdd and capDrop for stage %v, because image %v is not trusted", stage.Name, stage.ContainerImage)
+			}
+			hostConfig.CapDrop = []string{"ALL"}
+		}
+	}
+
+	if networkMode, ok := getCustomPropertyString(stage.CustomProperties, "networkMode"); ok && networkMode != "" {
+		switch networkMode {
+		case "bridge", "none":
+		case "host":
+			if trustedImage == nil {
+				// return stage as failed with error message indicating that untrusted images can't use the host network
+				err = fmt.Errorf("Network mode host is only allowed for trusted images")
+				return
+			}
+		default:
+			err = fmt.Errorf("Network mode %v is not supported, use bridge, host or none", networkMode)
+			return
+		}
+		hostConfig.NetworkMode = container.NetworkMode(networkMode)
+	}
+
+	hostConfig.Ulimits, err = getUlimits(stage.CustomProperties)
 	if err != nil {
-		return "", err
+		return
 	}
 
-	// connect to any configured networks
-	for networkName, networkID := range dr.networks {
-		err = dr.dockerClient.NetworkConnect(ctx, networkID, resp.ID, nil)
+	hostConfig.ExtraHosts, err = getExtraHosts(stage.CustomProperties)
+	if err != nil {
+		return
+	}
+
+	// tmpfs mounts are a linux concept
+	if runtime.GOOS != "windows" {
+		hostConfig.Tmpfs, err = getTmpfsMounts(stage.CustomProperties)
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed connecting container %v to network %v with id %v", resp.ID, networkName, networkID)
 			return
 		}
 	}
 
-	containerID = resp.ID
-	dr.runningStageContainerIDs = dr.addRunningContainerID(dr.runningStageContainerIDs, containerID)
+	return
+}
 
-	// start container
-	if err = dr.dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		return
+// getExtraHosts returns the host:ip entries from the extraHosts custom property to add to /etc/hosts in the container
+func getExtraHosts(customProperties map[string]interface{}) (extraHosts []string, err error) {
+	entries, ok := getCustomPropertyStringSlice(customProperties, "extraHosts")
+	if !ok || len(entries) == 0 {
+		return nil, nil
+	}
+
+	for _, entry := range entries {
+		// ipv6 addresses contain colons as well, so only split on the first one
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			return nil, fmt.Errorf("Extra host %v is invalid, it should have format host:ip", entry)
+		}
+		extraHosts = append(extraHosts, entry)
+	}
+
+	return
+}
+
+// getTmpfsMounts translates the tmpfs custom property, mapping absolute paths to an optional size like 512m, into tmpfs mount options
+func getTmpfsMounts(customProperties map[string]interface{}) (tmpfs map[string]string, err error) {
+	mounts, ok := getCustomPropertyStringMap(customProperties, "tmpfs")
+	if !ok || len(mounts) == 0 {
+		return nil, nil
+	}
+
+	tmpfs = make(map[string]string, len(mounts))
+	for path, size := range mounts {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("Tmpfs mount path %v is invalid, it should be an absolute path", path)
+		}
+		if size == "" {
+			tmpfs[path] = ""
+			continue
+		}
+		if _, err := units.RAMInBytes(size); err != nil {
+			return nil, fmt.Errorf("Tmpfs mount %v with size %v is invalid: %w", path, size, err)
+		}
+		tmpfs[path] = fmt.Sprintf("size=%v", size)
+	}
+
+	return
+}
+
+// getUlimits translates the ulimits custom property, mapping names like nofile or nproc to either a single limit or soft:hard limits
+func getUlimits(customProperties map[string]interface{}) (ulimits []*units.Ulimit, err error) {
+	ulimitValues, ok := getCustomPropertyStringMap(customProperties, "ulimits")
+	if !ok || len(ulimitValues) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(ulimitValues))
+	for name := range ulimitValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ulimit, err := units.ParseUlimit(fmt.Sprintf("%v=%v", name, ulimitValues[name]))
+		if err != nil {
+			return nil, fmt.Errorf("Ulimit %v with value %v is invalid: %w", name, ulimitValues[name], err)
+		}
+		ulimits = append(ulimits, ulimit)
 	}
+
 	return
 }
 
@@ -383,34 +797,25 @@ func (dr *dockerRunner) StartServiceContainer(ctx context.Context, envvars map[s
 		}
 	}
 
-	// check if this is a trusted image with RunPrivileged or RunDocker set to true
-	privileged := false
-	if trustedImage != nil && runtime.GOOS != "windows" {
-		privileged = trustedImage.RunDocker || trustedImage.RunPrivileged
+	hostConfig, err := dr.getServiceHostConfig(service, binds, trustedImage)
+	if err != nil {
+		return
+	}
+
+	endpointSettings, err := dr.getNetworkEndpointSettings(service.Name, service.CustomProperties)
+	if err != nil {
+		return
 	}
 
 	// create container
-	resp, err := dr.dockerClient.ContainerCreate(ctx, &config, &container.HostConfig{
-		Binds:      binds,
-		Privileged: privileged,
-		AutoRemove: false,
-		LogConfig: container.LogConfig{
-			Type: "local",
-			Config: map[string]string{
-				"max-size": "20m",
-				"max-file": "5",
-				"compress": "true",
-				"mode":     "non-blocking",
-			},
-		},
-	}, &network.NetworkingConfig{}, nil, service.Name)
+	resp, err := dr.dockerClient.ContainerCreate(ctx, &config, &hostConfig, &network.NetworkingConfig{}, nil, service.Name)
 	if err != nil {
 		return
 	}
 
 	// connect to any configured networks
 	for networkName, networkID := range dr.networks {
-		err = dr.dockerClient.NetworkConnect(ctx, networkID, resp.ID, nil)
+		err = dr.dockerClient.NetworkConnect(ctx, networkID, resp.ID, endpointSettings)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed connecting container %v to network %v with id %v", resp.ID, networkName, networkID)
 			return
@@ -432,26 +837,112 @@ func (dr *dockerRunner) StartServiceContainer(ctx context.Context, envvars map[s
 	return
 }
 
-func (dr *dockerRunner) RunReadinessProbeContainer(ctx context.Context, parentStage manifest.ZiplineeStage, service manifest.ZiplineeService, readiness manifest.ReadinessProbe) (err error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "RunReadinessProbeContainer")
-	defer span.Finish()
+func (dr *dockerRunner) getServiceHostConfig(service manifest.ZiplineeService, binds []string, trustedImage *contracts.TrustedImageConfig) (hostConfig container.HostConfig, err error) {
 
-	readinessProberImage := "ziplinee/scratch:latest"
-	isPulled := dr.IsImagePulled(ctx, service.Name+"-prober", readinessProberImage)
-	if !isPulled {
-		err = dr.PullImage(ctx, service.Name+"-prober", parentStage.Name, readinessProberImage)
-		if err != nil {
-			return err
-		}
+	// check if this is a trusted image with RunPrivileged or RunDocker set to true
+	privileged := false
+	if trustedImage != nil && runtime.GOOS != "windows" {
+		privileged = trustedImage.RunDocker || trustedImage.RunPrivileged
 	}
 
-	var envvars map[string]string
-	if readiness.HttpGet != nil {
-		envvars = map[string]string{
-			"RUN_AS_READINESS_PROBE":    "true",
-			"READINESS_SCHEME":          readiness.HttpGet.Scheme,
-			"READINESS_HOST":            service.Name,
-			"READINESS_PORT":            strconv.Itoa(readiness.HttpGet.Port),
+	hostConfig = container.HostConfig{
+		Binds:      binds,
+		Privileged: privileged,
+		AutoRemove: false,
+		LogConfig: container.LogConfig{
+			Type: "local",
+			Config: map[string]string{
+				"max-size": "20m",
+				"max-file": "5",
+				"compress": "true",
+				"mode":     "non-blocking",
+			},
+		},
+	}
+
+	// sysctls like vm.max_map_count can affect the host, so only trusted images are allowed to set them
+	if sysctls, ok := getCustomPropertyStringMap(service.CustomProperties, "sysctls"); ok && len(sysctls) > 0 {
+		if trustedImage != nil && runtime.GOOS != "windows" {
+			hostConfig.Sysctls = sysctls
+		} else {
+			log.Warn().Msgf("Ignoring sysctls for service %v, because image %v is not trusted", service.Name, service.ContainerImage)
+		}
+	}
+
+	hostConfig.ExtraHosts, err = getExtraHosts(service.CustomProperties)
+	if err != nil {
+		return
+	}
+
+	hostConfig.RestartPolicy, err = getRestartPolicy(service.CustomProperties)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// getRestartPolicy translates the restartPolicy and restartMaxRetries custom properties of a service into a docker restart policy, defaulting to no restarts
+func getRestartPolicy(customProperties map[string]interface{}) (restartPolicy container.RestartPolicy, err error) {
+	name, ok := getCustomPropertyString(customProperties, "restartPolicy")
+	if !ok || name == "" || name == "no" {
+		return
+	}
+
+	if name != "on-failure" {
+		return restartPolicy, fmt.Errorf("Restart policy %v is invalid, it should be either no or on-failure", name)
+	}
+
+	maxRetries, ok := getCustomPropertyInt(customProperties, "restartMaxRetries")
+	if ok && maxRetries < 0 {
+		return restartPolicy, fmt.Errorf("Restart max retries %v is invalid, it should not be negative", maxRetries)
+	}
+
+	return container.RestartPolicy{
+		Name:              name,
+		MaximumRetryCount: maxRetries,
+	}, nil
+}
+
+// getNetworkEndpointSettings returns the alias a stage or service container is reachable by on the build networks; the dnsAlias custom property overrides the alias derived from its name, but has to be a valid dns label already
+func (dr *dockerRunner) getNetworkEndpointSettings(name string, customProperties map[string]interface{}) (endpointSettings *network.EndpointSettings, err error) {
+	alias, ok := getCustomPropertyString(customProperties, "dnsAlias")
+	if ok {
+		if alias == "" || dr.envvarHelper.makeDNSLabelSafe(alias) != alias {
+			return nil, fmt.Errorf("DNS alias %v is invalid, it should only contain lowercase letters, digits and hyphens, start with a letter and be at most 63 characters long", alias)
+		}
+	} else {
+		alias = dr.envvarHelper.makeDNSLabelSafe(name)
+		if alias == "" {
+			return nil, nil
+		}
+	}
+
+	return &network.EndpointSettings{
+		Aliases: []string{alias},
+	}, nil
+}
+
+func (dr *dockerRunner) RunReadinessProbeContainer(ctx context.Context, parentStage manifest.ZiplineeStage, service manifest.ZiplineeService, readiness manifest.ReadinessProbe) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RunReadinessProbeContainer")
+	defer span.Finish()
+
+	readinessProberImage := "ziplinee/scratch:latest"
+	isPulled := dr.IsImagePulled(ctx, service.Name+"-prober", readinessProberImage)
+	if !isPulled {
+		err = dr.PullImage(ctx, service.Name+"-prober", parentStage.Name, readinessProberImage)
+		if err != nil {
+			return err
+		}
+	}
+
+	var envvars map[string]string
+	if readiness.HttpGet != nil {
+		envvars = map[string]string{
+			"RUN_AS_READINESS_PROBE":    "true",
+			"READINESS_SCHEME":          readiness.HttpGet.Scheme,
+			"READINESS_HOST":            service.Name,
+			"READINESS_PORT":            strconv.Itoa(readiness.HttpGet.Port),
 			"READINESS_PATH":            readiness.HttpGet.Path,
 			"READINESS_HOSTNAME":        readiness.HttpGet.Host,
 			"READINESS_TIMEOUT_SECONDS": strconv.Itoa(readiness.TimeoutSeconds),
@@ -471,6 +962,11 @@ func (dr *dockerRunner) RunReadinessProbeContainer(ctx context.Context, parentSt
 		}
 	}
 
+	// have the probe match the response body as well, for health endpoints that return 200 while degraded
+	if bodyMatch, ok := getCustomPropertyString(service.CustomProperties, "readinessBodyMatch"); ok && bodyMatch != "" {
+		envvars["READINESS_BODY_MATCH"] = bodyMatch
+	}
+
 	// decrypt secrets in all envvars
 	envvars = dr.envvarHelper.decryptSecrets(envvars, dr.envvarHelper.GetPipelineName())
 
@@ -597,14 +1093,21 @@ func (dr *dockerRunner) TailContainerLogs(ctx context.Context, containerID, pare
 
 	lineNumber := 1
 
+	if stageType == contracts.LogTypeStage && dr.stageResourceUsageInterval > 0 {
+		stopSampling := dr.sampleStageResourceUsage(ctx, containerID, parentStageName, stageName)
+		defer stopSampling()
+	}
+
+	if stageType == contracts.LogTypeService {
+		dr.addRunningServiceContainer(stageName, containerID, parentStageName)
+		defer dr.removeRunningServiceContainer(stageName, containerID)
+	}
+
+	// remove the secret files mounted into the container once it's done
+	defer dr.removeContainerSecretFilesDirs(containerID)
+
 	// follow logs
-	rc, err := dr.dockerClient.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Timestamps: false,
-		Follow:     true,
-		Details:    false,
-	})
+	rc, err := dr.followContainerOutput(ctx, containerID)
 	if err != nil {
 		return err
 	}
@@ -649,8 +1152,12 @@ func (dr *dockerRunner) TailContainerLogs(ctx context.Context, containerID, pare
 			break
 		}
 
-		// strip headers and obfuscate secret values
-		logLineString := dr.obfuscator.Obfuscate(string(logLine))
+		if streamType == "stdout" {
+			dr.captureOutputLine(containerID, string(logLine))
+		}
+
+		// strip headers, replace invalid utf8 bytes and obfuscate secret values
+		logLineString := dr.obfuscator.Obfuscate(sanitizeUTF8(string(logLine), dr.invalidUTF8Handling))
 
 		// create object for tailing logs and storing in the db when done
 		logLineObject := contracts.BuildLogLine{
@@ -671,211 +1178,977 @@ func (dr *dockerRunner) TailContainerLogs(ctx context.Context, containerID, pare
 		}
 	}
 
-	if readError != nil && readError != io.EOF {
-		log.Error().Msgf("[%v] Error: %v", stageName, readError)
-		return readError
+	if readError != nil && readError != io.EOF {
+		log.Error().Msgf("[%v] Error: %v", stageName, readError)
+		return readError
+	}
+
+	// wait for container to stop running
+	resultC, errC := dr.waitForContainer(ctx, containerID)
+
+	var exitCode int64
+	select {
+	case result := <-resultC:
+		exitCode = result.StatusCode
+	case err = <-errC:
+		log.Warn().Err(err).Msgf("Container %v exited with error", containerID)
+		return err
+	}
+
+	if stageType == contracts.LogTypeStage && exitCode == 0 {
+		dr.removeSucceededContainer(ctx, containerID)
+	}
+
+	// clear container id
+	if stageType == contracts.LogTypeStage {
+		dr.runningStageContainerIDs = dr.removeRunningContainerID(dr.runningStageContainerIDs, containerID)
+	} else if stageType == contracts.LogTypeService && multiStage != nil {
+		if *multiStage {
+			dr.runningMultiStageServiceContainerIDs = dr.removeRunningContainerID(dr.runningMultiStageServiceContainerIDs, containerID)
+		} else {
+			dr.runningSingleStageServiceContainerIDs = dr.removeRunningContainerID(dr.runningSingleStageServiceContainerIDs, containerID)
+		}
+	}
+
+	if exitCode != 0 {
+		dr.discardOutputCapture(containerID)
+		return &containerExitError{exitCode: exitCode}
+	}
+
+	// pass captured output on to later stages
+	dr.finishOutputCapture(containerID, parentStageName, stageName, depth, lineNumber)
+
+	return err
+}
+
+func (dr *dockerRunner) StopSingleStageServiceContainers(ctx context.Context, parentStage manifest.ZiplineeStage) {
+
+	log.Debug().Msgf("[%v] Stopping single-stage service containers...", parentStage.Name)
+
+	// the service containers should be the only ones running, so just stop all containers
+	dr.stopContainers(ctx, dr.runningSingleStageServiceContainerIDs)
+
+	log.Debug().Msgf("[%v] Stopped single-stage service containers...", parentStage.Name)
+}
+
+// ExecInServiceContainer runs a one-off command like a database migration inside the container of a running service and streams its output to the build log of the service
+func (dr *dockerRunner) ExecInServiceContainer(ctx context.Context, serviceName string, cmd []string) (err error) {
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ExecInServiceContainer")
+	defer span.Finish()
+	span.SetTag("service", serviceName)
+
+	serviceContainer, ok := dr.getRunningServiceContainer(serviceName)
+	if !ok {
+		return fmt.Errorf("Service %v has no running container to run a command in", serviceName)
+	}
+
+	log.Info().Msgf("[%v] [%v] Running command inside service container...", serviceContainer.parentStageName, serviceName)
+
+	execResponse, err := dr.execClient.ContainerExecCreate(ctx, serviceContainer.containerID, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return err
+	}
+
+	attachResponse, err := dr.execClient.ContainerExecAttach(ctx, execResponse.ID, types.ExecStartCheck{})
+	if err != nil {
+		return err
+	}
+	defer attachResponse.Close()
+
+	in := attachResponse.Reader
+	lineNumber := 1
+	for {
+		// strip first 8 bytes, they contain docker control characters, like for container logs
+		headers := make([]byte, 8)
+		_, readError := io.ReadFull(in, headers)
+		if readError != nil {
+			break
+		}
+
+		streamType := ""
+		switch headers[0] {
+		case 1:
+			streamType = "stdout"
+		case 2:
+			streamType = "stderr"
+		default:
+			continue
+		}
+
+		logLine, readError := in.ReadBytes('\n')
+		if readError != nil && len(logLine) == 0 {
+			break
+		}
+
+		logLineObject := contracts.BuildLogLine{
+			LineNumber: lineNumber,
+			Timestamp:  time.Now().UTC(),
+			StreamType: streamType,
+			Text:       dr.obfuscator.Obfuscate(string(logLine)),
+		}
+		lineNumber++
+
+		dr.tailLogsChannel <- contracts.TailLogLine{
+			Step:        serviceName,
+			ParentStage: serviceContainer.parentStageName,
+			Type:        contracts.LogTypeService,
+			Depth:       1,
+			LogLine:     &logLineObject,
+		}
+
+		if readError != nil {
+			break
+		}
+	}
+
+	inspectResponse, err := dr.execClient.ContainerExecInspect(ctx, execResponse.ID)
+	if err != nil {
+		return err
+	}
+	if inspectResponse.ExitCode != 0 {
+		return fmt.Errorf("Command in service container %v failed with exit code: %v", serviceName, inspectResponse.ExitCode)
+	}
+
+	return nil
+}
+
+func (dr *dockerRunner) addRunningServiceContainer(serviceName, containerID, parentStageName string) {
+	dr.runningServiceContainersMutex.Lock()
+	defer dr.runningServiceContainersMutex.Unlock()
+
+	dr.runningServiceContainers[serviceName] = runningServiceContainer{
+		containerID:     containerID,
+		parentStageName: parentStageName,
+	}
+}
+
+func (dr *dockerRunner) removeRunningServiceContainer(serviceName, containerID string) {
+	dr.runningServiceContainersMutex.Lock()
+	defer dr.runningServiceContainersMutex.Unlock()
+
+	// a later service with the same name might have taken its place already
+	if serviceContainer, ok := dr.runningServiceContainers[serviceName]; ok && serviceContainer.containerID == containerID {
+		delete(dr.runningServiceContainers, serviceName)
+	}
+}
+
+func (dr *dockerRunner) getRunningServiceContainer(serviceName string) (serviceContainer runningServiceContainer, ok bool) {
+	dr.runningServiceContainersMutex.Lock()
+	defer dr.runningServiceContainersMutex.Unlock()
+
+	serviceContainer, ok = dr.runningServiceContainers[serviceName]
+
+	return
+}
+
+func (dr *dockerRunner) StopMultiStageServiceContainers(ctx context.Context) {
+
+	log.Debug().Msg("Stopping multi-stage service containers...")
+
+	// the service containers should be the only ones running, so just stop all containers
+	dr.stopContainers(ctx, dr.runningMultiStageServiceContainerIDs)
+
+	log.Debug().Msg("Stopped multi-stage service containers...")
+}
+
+func (dr *dockerRunner) StartDockerDaemon() error {
+	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType != contracts.DockerRunTypeDinD {
+		return nil
+	}
+
+	// make the docker daemon trust private certificate authorities of configured registries
+	err := dr.writeRegistryCACerts()
+	if err != nil {
+		return err
+	}
+
+	// dockerd --host=unix:///var/run/docker.sock --host=tcp://0.0.0.0:2375 --mtu=1500 &
+	log.Debug().Msg("Starting docker daemon...")
+	args := []string{"--host=unix:///var/run/docker.sock", "--config-file=/daemon.json"}
+
+	// if an mtu is configured pass it to the docker daemon
+	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType == contracts.DockerRunTypeDinD && dr.config.DockerConfig.MTU > 0 {
+		args = append(args, fmt.Sprintf("--mtu=%v", dr.config.DockerConfig.MTU))
+	}
+
+	// if a bip is configured pass it to the docker daemon
+	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType == contracts.DockerRunTypeDinD && dr.config.DockerConfig.BIP != "" {
+		args = append(args, fmt.Sprintf("--bip=%v", dr.config.DockerConfig.BIP))
+	}
+
+	// if a registry mirror is configured pass it to the docker daemon
+	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType == contracts.DockerRunTypeDinD && dr.config.DockerConfig.RegistryMirror != "" {
+		args = append(args, fmt.Sprintf("--registry-mirror=%v", dr.config.DockerConfig.RegistryMirror))
+	}
+
+	log.Info().Msgf("> %v %v", dr.dockerDaemonBinary, strings.Join(args, " "))
+	dockerDaemonCommand := exec.Command(dr.dockerDaemonBinary, args...)
+
+	// keep the last lines of the daemon output to include them in the error if it fails to become ready
+	dr.dockerDaemonLogs = newTailLogWriter(dockerDaemonLogLines)
+	dockerDaemonCommand.Stdout = io.MultiWriter(log.Logger, dr.dockerDaemonLogs)
+	dockerDaemonCommand.Stderr = io.MultiWriter(log.Logger, dr.dockerDaemonLogs)
+	err = dockerDaemonCommand.Start()
+	if err != nil {
+		return err
+	}
+
+	dr.dockerDaemonExited = make(chan error, 1)
+	go func() {
+		dr.dockerDaemonExited <- dockerDaemonCommand.Wait()
+	}()
+
+	return nil
+}
+
+// makeSecretFilesDir creates a temporary directory for files holding secrets, on tmpfs if available so secrets never get written to disk
+func (dr *dockerRunner) makeSecretFilesDir(pattern string) (string, error) {
+	baseDir := dr.secretFilesBaseDir
+	if baseDir != "" {
+		if exists, _ := pathExists(baseDir); !exists {
+			baseDir = ""
+		}
+	}
+
+	return os.MkdirTemp(baseDir, pattern)
+}
+
+// registerSecretFilesDirs keeps track of the directories with secret files mounted into a started container, to remove them once it's done
+func (dr *dockerRunner) registerSecretFilesDirs(containerID string, dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+
+	dr.secretFilesDirsMutex.Lock()
+	defer dr.secretFilesDirsMutex.Unlock()
+
+	if dr.secretFilesDirs == nil {
+		dr.secretFilesDirs = map[string][]string{}
+	}
+	dr.secretFilesDirs[containerID] = append(dr.secretFilesDirs[containerID], dirs...)
+}
+
+// removeContainerSecretFilesDirs removes the directories with secret files mounted into a container that's done, so decrypted secrets don't outlive the stage on hosts that get reused, like gocd agents
+func (dr *dockerRunner) removeContainerSecretFilesDirs(containerID string) {
+	dr.secretFilesDirsMutex.Lock()
+	dirs := dr.secretFilesDirs[containerID]
+	delete(dr.secretFilesDirs, containerID)
+	dr.secretFilesDirsMutex.Unlock()
+
+	removeSecretFilesDirs(dirs)
+}
+
+func removeSecretFilesDirs(dirs []string) {
+	for _, dir := range dirs {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed removing secret files directory %v", dir)
+		}
+	}
+}
+
+// generateSSHFiles writes the private key and known hosts of the first ssh credential granted to a trusted image to a tmpfs directory and sets GIT_SSH_COMMAND to use them, so stages can clone private repositories over ssh;
+// like other credentials the key only goes to trusted images granted the ssh credential type; it returns the directory to remove once the container is done next to the path to bind mount
+func (dr *dockerRunner) generateSSHFiles(trustedImage *contracts.TrustedImageConfig, envvars map[string]string) (dir, hostPath, mountPath string, err error) {
+
+	if trustedImage == nil {
+		return
+	}
+	if _, exists := envvars["GIT_SSH_COMMAND"]; exists {
+		return
+	}
+
+	var privateKey, knownHosts string
+	for _, credential := range dr.orderCredentials(dr.config.GetCredentialsForTrustedImage(*trustedImage)["ssh"]) {
+		privateKey, _ = credential.AdditionalProperties["privateKey"].(string)
+		if privateKey == "" {
+			log.Warn().Msgf("Credential '%v' of type ssh has no privateKey, skipping it", credential.Name)
+			continue
+		}
+		knownHosts, _ = credential.AdditionalProperties["knownHosts"].(string)
+		break
+	}
+	if privateKey == "" {
+		return
+	}
+
+	sshDir, err := dr.makeSecretFilesDir("*-ssh")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			removeSecretFilesDirs([]string{sshDir})
+		}
+	}()
+
+	mountPath = "/ziplinee-ssh"
+	if runtime.GOOS == "windows" {
+		mountPath = "C:" + mountPath
+	}
+
+	// ssh fails to load a private key without a trailing newline and refuses to use one that is readable by others
+	if !strings.HasSuffix(privateKey, "\n") {
+		privateKey += "\n"
+	}
+	err = os.WriteFile(filepath.Join(sshDir, "id_ssh"), []byte(privateKey), 0600)
+	if err != nil {
+		return "", "", "", err
+	}
+	err = os.Chmod(filepath.Join(sshDir, "id_ssh"), 0600)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	sshCommand := fmt.Sprintf("ssh -i %v -o IdentitiesOnly=yes", path.Join(mountPath, "id_ssh"))
+	if knownHosts != "" {
+		err = os.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(knownHosts), 0644)
+		if err != nil {
+			return "", "", "", err
+		}
+		sshCommand += fmt.Sprintf(" -o UserKnownHostsFile=%v -o StrictHostKeyChecking=yes", path.Join(mountPath, "known_hosts"))
+	}
+
+	err = os.Chmod(sshDir, 0755)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	envvars["GIT_SSH_COMMAND"] = sshCommand
+
+	dir = sshDir
+	hostPath = sshDir
+	if runtime.GOOS == "windows" {
+		hostPath = filepath.Join(dr.envvarHelper.GetTempDir(), strings.TrimPrefix(hostPath, "C:\\Windows\\TEMP"))
+	}
+
+	return
+}
+
+// writeRegistryCACerts stores the caCert of container-registry credentials in the certs.d directory of the docker daemon
+func (dr *dockerRunner) writeRegistryCACerts() error {
+
+	containerRegistryCredentials := dr.config.GetCredentialsByType("container-registry")
+
+	for _, credential := range containerRegistryCredentials {
+		caCert, ok := credential.AdditionalProperties["caCert"].(string)
+		if !ok || caCert == "" {
+			continue
+		}
+
+		repository, ok := credential.AdditionalProperties["repository"].(string)
+		if !ok || repository == "" {
+			log.Warn().Msgf("Credential '%v' has a caCert but no repository, skipping it", credential.Name)
+			continue
+		}
+
+		// the registry host is the first part of the repository, e.g. registry.example.com:5000 for registry.example.com:5000/team
+		registryHost := strings.Split(repository, "/")[0]
+		registryCertsDir := filepath.Join(dr.dockerCertsDir, registryHost)
+
+		err := os.MkdirAll(registryCertsDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(filepath.Join(registryCertsDir, "ca.crt"), []byte(caCert), 0644)
+		if err != nil {
+			return err
+		}
+
+		log.Debug().Msgf("Stored ca certificate of credential '%v' for registry %v in %v", credential.Name, registryHost, registryCertsDir)
+	}
+
+	return nil
+}
+
+func (dr *dockerRunner) WaitForDockerDaemon() error {
+	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType != contracts.DockerRunTypeDinD {
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if dr.dockerDaemonReadyTimeout > 0 {
+		timeout = time.After(dr.dockerDaemonReadyTimeout)
+	}
+
+	// wait until the docker socket exists
+	log.Debug().Msg("Waiting for docker daemon to be ready for use...")
+	for {
+		if _, err := os.Stat(dr.dockerDaemonSocketPath); !os.IsNotExist(err) {
+			// file exists, break out of for loop
+			break
+		}
+
+		select {
+		case err := <-dr.dockerDaemonExited:
+			return fmt.Errorf("Docker daemon exited before it was ready for use: %v\n%v", err, dr.getDockerDaemonLogs())
+		case <-timeout:
+			return fmt.Errorf("Docker daemon is not ready for use after %v\n%v", dr.dockerDaemonReadyTimeout, dr.getDockerDaemonLogs())
+		case <-time.After(1 * time.Second):
+		}
+	}
+	log.Debug().Msg("Docker daemon is ready for use")
+
+	return nil
+}
+
+// getDockerDaemonLogs returns the last lines of the docker daemon output, if it got started by this builder
+func (dr *dockerRunner) getDockerDaemonLogs() string {
+	if dr.dockerDaemonLogs == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("Last %v lines of docker daemon logs:\n%v", dockerDaemonLogLines, dr.dockerDaemonLogs.String())
+}
+
+func (dr *dockerRunner) CreateDockerClient() error {
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+	dr.dockerClient = dockerClient
+	dr.execClient = dockerClient
+
+	if dr.dockerClientKeepAlive > 0 || dr.dockerClientIdleConnTimeout > 0 {
+		// the client shares its transport with the copy returned by HTTPClient
+		if transport, ok := dockerClient.HTTPClient().Transport.(*http.Transport); ok {
+			dr.configureDockerClientTransport(transport)
+		} else {
+			log.Warn().Msg("Can't configure keep-alive for the docker client, since it doesn't use an http transport")
+		}
+	}
+
+	return err
+}
+
+func (dr *dockerRunner) getImagePullOptions(containerImage string) types.ImagePullOptions {
+
+	containerRegistryCredentials := dr.orderCredentials(dr.config.GetCredentialsByType("container-registry"))
+
+	if len(containerRegistryCredentials) > 0 {
+		for _, credential := range containerRegistryCredentials {
+			containerImageSlice := strings.Split(containerImage, "/")
+			containerRepo := strings.Join(containerImageSlice[:len(containerImageSlice)-1], "/")
+
+			if containerRepo == credential.AdditionalProperties["repository"].(string) {
+				authConfig := types.AuthConfig{
+					Username: credential.AdditionalProperties["username"].(string),
+					Password: credential.AdditionalProperties["password"].(string),
+				}
+				encodedJSON, err := json.Marshal(authConfig)
+				if err == nil {
+					authStr := base64.URLEncoding.EncodeToString(encodedJSON)
+
+					log.Debug().Msgf("Using credential '%v' to authenticate for image '%v'", credential.Name, containerImage)
+
+					return types.ImagePullOptions{
+						RegistryAuth: authStr,
+					}
+				}
+
+				log.Error().Err(err).Msgf("Failed marshaling docker auth config for container image %v", containerImage)
+
+				break
+			}
+		}
+	}
+
+	// when no container-registry credentials apply use container-registry-pull as fallback to avoid docker hub rate limiting issues
+	containerRegistryPullCredentials := dr.config.GetCredentialsByType("container-registry-pull")
+
+	if len(containerRegistryPullCredentials) > 0 {
+		// no real need to loop, since we only need one of these, but works anyway
+		for _, credential := range containerRegistryPullCredentials {
+			authConfig := types.AuthConfig{
+				Username: credential.AdditionalProperties["username"].(string),
+				Password: credential.AdditionalProperties["password"].(string),
+			}
+			encodedJSON, err := json.Marshal(authConfig)
+			if err == nil {
+				authStr := base64.URLEncoding.EncodeToString(encodedJSON)
+
+				log.Debug().Msgf("Using credential '%v' to authenticate for image '%v'", credential.Name, containerImage)
+
+				return types.ImagePullOptions{
+					RegistryAuth: authStr,
+				}
+			} else {
+				log.Error().Err(err).Msgf("Failed marshaling docker auth config for container image %v", containerImage)
+				break
+			}
+		}
+	}
+
+	return types.ImagePullOptions{}
+}
+
+type credentialPrecedence string
+
+const (
+	// credentialPrecedenceDeclarationOrder keeps credentials in the order they're declared in the builder config
+	credentialPrecedenceDeclarationOrder credentialPrecedence = "declaration-order"
+	// credentialPrecedenceMostSpecific puts credentials with the longest repository path first, so a credential for a specific registry path wins over one for the registry as a whole
+	credentialPrecedenceMostSpecific credentialPrecedence = "most-specific"
+)
+
+// SetCredentialPrecedence sets the order in which credentials are injected into stages and tried for pulling images, defaulting to declaration order
+func (dr *dockerRunner) SetCredentialPrecedence(precedence string) {
+	switch credentialPrecedence(strings.ToLower(precedence)) {
+	case "", credentialPrecedenceDeclarationOrder:
+		dr.credentialPrecedence = credentialPrecedenceDeclarationOrder
+	case credentialPrecedenceMostSpecific:
+		dr.credentialPrecedence = credentialPrecedenceMostSpecific
+	default:
+		log.Warn().Msgf("Unknown credential precedence '%v', using '%v' instead", precedence, credentialPrecedenceDeclarationOrder)
+		dr.credentialPrecedence = credentialPrecedenceDeclarationOrder
+	}
+}
+
+// orderCredentials returns a copy of the credentials in order of precedence, the first one taking precedence over the others
+func (dr *dockerRunner) orderCredentials(credentials []*contracts.CredentialConfig) []*contracts.CredentialConfig {
+
+	orderedCredentials := make([]*contracts.CredentialConfig, len(credentials))
+	copy(orderedCredentials, credentials)
+
+	if dr.credentialPrecedence == credentialPrecedenceMostSpecific {
+		// a stable sort keeps declaration order for credentials that are equally specific
+		sort.SliceStable(orderedCredentials, func(i, j int) bool {
+			return getCredentialSpecificity(orderedCredentials[i]) > getCredentialSpecificity(orderedCredentials[j])
+		})
+	}
+
+	return orderedCredentials
+}
+
+// getCredentialSpecificity returns the number of path segments of the repository a credential applies to, or 0 if it isn't tied to a repository
+func getCredentialSpecificity(credential *contracts.CredentialConfig) int {
+	repository, ok := credential.AdditionalProperties["repository"].(string)
+	repository = strings.Trim(repository, "/")
+	if !ok || repository == "" {
+		return 0
+	}
+
+	return len(strings.Split(repository, "/"))
+}
+
+func (dr *dockerRunner) IsTrustedImage(stageName string, containerImage string) bool {
+
+	log.Debug().Msgf("[%v] Checking if docker image '%v' is trusted...", stageName, containerImage)
+
+	// check if image is trusted image
+	trustedImage := dr.config.GetTrustedImage(containerImage)
+
+	return trustedImage != nil
+}
+
+func (dr *dockerRunner) HasInjectedCredentials(stageName string, containerImage string) bool {
+
+	log.Debug().Msgf("[%v] Checking if docker image '%v' has injected credentials...", stageName, containerImage)
+
+	// check if image has injected credentials
+	trustedImage := dr.config.GetTrustedImage(containerImage)
+	if trustedImage == nil {
+		return false
+	}
+
+	credentialMap := dr.config.GetCredentialsForTrustedImage(*trustedImage)
+
+	return len(credentialMap) > 0
+}
+
+func (dr *dockerRunner) auditInjectedCredentials(stageName string, containerImage string, trustedImage *contracts.TrustedImageConfig) {
+	if trustedImage == nil {
+		return
+	}
+
+	credentialMap := dr.config.GetCredentialsForTrustedImage(*trustedImage)
+	decryptionKeyGranted := dr.isDecryptionKeyGranted(trustedImage)
+	if len(credentialMap) == 0 && !decryptionKeyGranted {
+		return
+	}
+
+	// only store the names of the credentials, never their values
+	credentialNames := []string{}
+	for _, credentialsForType := range credentialMap {
+		for _, credential := range credentialsForType {
+			credentialNames = append(credentialNames, credential.Name)
+		}
+	}
+	sort.Strings(credentialNames)
+
+	log.Debug().Msgf("[%v] Injected credentials %v into docker image '%v'", stageName, strings.Join(credentialNames, ", "), containerImage)
+	if decryptionKeyGranted {
+		log.Info().Msgf("[%v] Injected decryption key into trusted docker image '%v'", stageName, containerImage)
+	}
+
+	dr.credentialsAuditMutex.Lock()
+	defer dr.credentialsAuditMutex.Unlock()
+
+	dr.credentialsAudit = append(dr.credentialsAudit, CredentialsAuditEntry{
+		Stage:         stageName,
+		Image:         containerImage,
+		Credentials:   credentialNames,
+		DecryptionKey: decryptionKeyGranted,
+	})
+}
+
+// GrantDecryptionKey passes the decryption key as ZIPLINEE_DECRYPTION_KEY to stages running a trusted image with one of the image paths; untrusted images never get it
+func (dr *dockerRunner) GrantDecryptionKey(decryptionKey string, imagePaths []string) {
+	dr.decryptionKey = decryptionKey
+	dr.decryptionKeyImages = imagePaths
+}
+
+func (dr *dockerRunner) injectDecryptionKey(envvars map[string]string, trustedImage *contracts.TrustedImageConfig) {
+	if !dr.isDecryptionKeyGranted(trustedImage) {
+		return
+	}
+
+	envvars["ZIPLINEE_DECRYPTION_KEY"] = dr.decryptionKey
+}
+
+func (dr *dockerRunner) isDecryptionKeyGranted(trustedImage *contracts.TrustedImageConfig) bool {
+	if trustedImage == nil || dr.decryptionKey == "" {
+		return false
+	}
+
+	return contains(dr.decryptionKeyImages, trustedImage.ImagePath)
+}
+
+func (dr *dockerRunner) GetCredentialsAudit() []CredentialsAuditEntry {
+	dr.credentialsAuditMutex.Lock()
+	defer dr.credentialsAuditMutex.Unlock()
+
+	credentialsAudit := make([]CredentialsAuditEntry, len(dr.credentialsAudit))
+	copy(credentialsAudit, dr.credentialsAudit)
+
+	return credentialsAudit
+}
+
+// SetDockerClientKeepAlive sets the tcp keep-alive period and idle connection timeout of the docker client, to keep its connections from going stale during long builds
+func (dr *dockerRunner) SetDockerClientKeepAlive(keepAlive, idleConnTimeout time.Duration) {
+	dr.dockerClientKeepAlive = keepAlive
+	dr.dockerClientIdleConnTimeout = idleConnTimeout
+}
+
+func (dr *dockerRunner) configureDockerClientTransport(transport *http.Transport) {
+	if dr.dockerClientIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = dr.dockerClientIdleConnTimeout
+	}
+
+	if dr.dockerClientKeepAlive > 0 {
+		// wrap the dialer the docker client configured for its host, since it dials a unix socket by default
+		dialContext := transport.DialContext
+		if dialContext == nil {
+			dialContext = (&net.Dialer{}).DialContext
+		}
+		keepAlive := dr.dockerClientKeepAlive
+
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			// unix socket connections have no tcp keep-alive
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				err = tcpConn.SetKeepAlive(true)
+				if err == nil {
+					err = tcpConn.SetKeepAlivePeriod(keepAlive)
+				}
+				if err != nil {
+					log.Warn().Err(err).Msgf("Failed setting keep-alive for docker client connection to %v", address)
+				}
+			}
+
+			return conn, nil
+		}
+	}
+}
+
+// SetInvalidUTF8Handling sets how invalid utf8 bytes in log lines get sanitized, either replace (the default) or escape
+func (dr *dockerRunner) SetInvalidUTF8Handling(handling string) {
+	switch h := invalidUTF8Handling(strings.ToLower(handling)); h {
+	case invalidUTF8HandlingReplace, invalidUTF8HandlingEscape:
+		dr.invalidUTF8Handling = h
+	default:
+		log.Warn().Msgf("Unknown invalid utf8 handling '%v', using '%v' instead", handling, invalidUTF8HandlingReplace)
+		dr.invalidUTF8Handling = invalidUTF8HandlingReplace
 	}
+}
 
-	// wait for container to stop running
-	resultC, errC := dr.dockerClient.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+// SetContainerRemoval makes stage containers get removed when they exit, to keep stopped containers from piling up on reused agents; keeping failed containers for debugging takes precedence, removing only the succeeded ones
+func (dr *dockerRunner) SetContainerRemoval(autoRemove, keepFailed bool) {
+	dr.autoRemoveContainers = autoRemove
+	dr.keepFailedContainers = keepFailed
+}
 
-	var exitCode int64
-	select {
-	case result := <-resultC:
-		exitCode = result.StatusCode
-	case err = <-errC:
-		log.Warn().Err(err).Msgf("Container %v exited with error", containerID)
-		return err
+const (
+	// defaultWorkingDirectory is the working directory the manifest defaults stages to, and where the work directory gets mounted
+	defaultWorkingDirectory = "/ziplinee-work"
+	// defaultWindowsWorkingDirectory is the default working directory for stages on windows
+	defaultWindowsWorkingDirectory = "C:/ziplinee-work"
+)
+
+// SetWorkDirMountPath mounts the work directory at mountPath in stage containers using the default working directory, for images whose own content is at the default path
+func (dr *dockerRunner) SetWorkDirMountPath(mountPath string) {
+	if mountPath != "" && !filepath.IsAbs(mountPath) {
+		log.Warn().Msgf("Work directory mount path %v is not an absolute path, mounting the work directory at the default path instead", mountPath)
+		return
 	}
+	dr.workDirMountPath = mountPath
+}
 
-	// clear container id
-	if stageType == contracts.LogTypeStage {
-		dr.runningStageContainerIDs = dr.removeRunningContainerID(dr.runningStageContainerIDs, containerID)
-	} else if stageType == contracts.LogTypeService && multiStage != nil {
-		if *multiStage {
-			dr.runningMultiStageServiceContainerIDs = dr.removeRunningContainerID(dr.runningMultiStageServiceContainerIDs, containerID)
-		} else {
-			dr.runningSingleStageServiceContainerIDs = dr.removeRunningContainerID(dr.runningSingleStageServiceContainerIDs, containerID)
-		}
+// applyWorkDirMountPath replaces the default working directory of a stage with the configured mount path and updates ZIPLINEE_WORKDIR to match, so tools resolve paths in the work directory correctly
+func (dr *dockerRunner) applyWorkDirMountPath(stage manifest.ZiplineeStage) manifest.ZiplineeStage {
+	if dr.workDirMountPath == "" {
+		return stage
+	}
+	if stage.WorkingDirectory != "" && stage.WorkingDirectory != defaultWorkingDirectory && stage.WorkingDirectory != defaultWindowsWorkingDirectory {
+		return stage
 	}
 
-	if exitCode != 0 {
-		return fmt.Errorf("Failed with exit code: %v", exitCode)
+	stage.WorkingDirectory = dr.workDirMountPath
+
+	envvars := make(map[string]string, len(stage.EnvVars)+1)
+	for key, value := range stage.EnvVars {
+		envvars[key] = value
 	}
+	envvars["ZIPLINEE_WORKDIR"] = dr.workDirMountPath
+	stage.EnvVars = envvars
 
-	return err
+	return stage
 }
 
-func (dr *dockerRunner) StopSingleStageServiceContainers(ctx context.Context, parentStage manifest.ZiplineeStage) {
+// attachAutoRemovedContainer attaches to the output of a container and waits for its removal before it starts, since both are gone once it exits
+func (dr *dockerRunner) attachAutoRemovedContainer(ctx context.Context, containerID string) error {
+	output, err := dr.dockerClient.ContainerAttach(ctx, containerID, types.ContainerAttachOptions{
+		Stream: true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return err
+	}
 
-	log.Debug().Msgf("[%v] Stopping single-stage service containers...", parentStage.Name)
+	resultC, errC := dr.dockerClient.ContainerWait(ctx, containerID, container.WaitConditionRemoved)
 
-	// the service containers should be the only ones running, so just stop all containers
-	dr.stopContainers(ctx, dr.runningSingleStageServiceContainerIDs)
+	dr.autoRemovedContainersMutex.Lock()
+	defer dr.autoRemovedContainersMutex.Unlock()
 
-	log.Debug().Msgf("[%v] Stopped single-stage service containers...", parentStage.Name)
-}
+	dr.autoRemovedContainers[containerID] = autoRemovedContainer{
+		output:  output,
+		resultC: resultC,
+		errC:    errC,
+	}
 
-func (dr *dockerRunner) StopMultiStageServiceContainers(ctx context.Context) {
+	return nil
+}
 
-	log.Debug().Msg("Stopping multi-stage service containers...")
+func (dr *dockerRunner) getAutoRemovedContainer(containerID string) (autoRemovedContainer, bool) {
+	dr.autoRemovedContainersMutex.Lock()
+	defer dr.autoRemovedContainersMutex.Unlock()
 
-	// the service containers should be the only ones running, so just stop all containers
-	dr.stopContainers(ctx, dr.runningMultiStageServiceContainerIDs)
+	autoRemoved, ok := dr.autoRemovedContainers[containerID]
 
-	log.Debug().Msg("Stopped multi-stage service containers...")
+	return autoRemoved, ok
 }
 
-func (dr *dockerRunner) StartDockerDaemon() error {
-	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType != contracts.DockerRunTypeDinD {
-		return nil
+// followContainerOutput returns the output stream of a container, in the multiplexed format of the docker logs
+func (dr *dockerRunner) followContainerOutput(ctx context.Context, containerID string) (io.ReadCloser, error) {
+	if autoRemoved, ok := dr.getAutoRemovedContainer(containerID); ok {
+		return &hijackedResponseReadCloser{autoRemoved.output}, nil
 	}
 
-	// dockerd --host=unix:///var/run/docker.sock --host=tcp://0.0.0.0:2375 --mtu=1500 &
-	log.Debug().Msg("Starting docker daemon...")
-	args := []string{"--host=unix:///var/run/docker.sock", "--config-file=/daemon.json"}
+	return dr.dockerClient.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: false,
+		Follow:     true,
+		Details:    false,
+	})
+}
 
-	// if an mtu is configured pass it to the docker daemon
-	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType == contracts.DockerRunTypeDinD && dr.config.DockerConfig.MTU > 0 {
-		args = append(args, fmt.Sprintf("--mtu=%v", dr.config.DockerConfig.MTU))
-	}
+func (dr *dockerRunner) waitForContainer(ctx context.Context, containerID string) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	dr.autoRemovedContainersMutex.Lock()
+	autoRemoved, ok := dr.autoRemovedContainers[containerID]
+	delete(dr.autoRemovedContainers, containerID)
+	dr.autoRemovedContainersMutex.Unlock()
 
-	// if a bip is configured pass it to the docker daemon
-	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType == contracts.DockerRunTypeDinD && dr.config.DockerConfig.BIP != "" {
-		args = append(args, fmt.Sprintf("--bip=%v", dr.config.DockerConfig.BIP))
+	if ok {
+		return autoRemoved.resultC, autoRemoved.errC
 	}
 
-	// if a registry mirror is configured pass it to the docker daemon
-	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType == contracts.DockerRunTypeDinD && dr.config.DockerConfig.RegistryMirror != "" {
-		args = append(args, fmt.Sprintf("--registry-mirror=%v", dr.config.DockerConfig.RegistryMirror))
+	return dr.dockerClient.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+}
+
+// removeSucceededContainer removes a container that exited successfully, when containers should be removed but failed ones kept
+func (dr *dockerRunner) removeSucceededContainer(ctx context.Context, containerID string) {
+	if !dr.autoRemoveContainers || !dr.keepFailedContainers {
+		return
 	}
 
-	log.Info().Msgf("> dockerd %v", strings.Join(args, " "))
-	dockerDaemonCommand := exec.Command("dockerd", args...)
-	dockerDaemonCommand.Stdout = log.Logger
-	dockerDaemonCommand.Stderr = log.Logger
-	err := dockerDaemonCommand.Start()
+	err := dr.dockerClient.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{})
 	if err != nil {
-		return err
+		log.Warn().Err(err).Msgf("Failed removing succeeded container %v", containerID)
 	}
+}
+
+// hijackedResponseReadCloser reads the output of an attached container
+type hijackedResponseReadCloser struct {
+	response types.HijackedResponse
+}
+
+func (h *hijackedResponseReadCloser) Read(p []byte) (int, error) {
+	return h.response.Reader.Read(p)
+}
 
+func (h *hijackedResponseReadCloser) Close() error {
+	h.response.Close()
 	return nil
 }
 
-func (dr *dockerRunner) WaitForDockerDaemon() {
-	if dr.config.DockerConfig != nil && dr.config.DockerConfig.RunType != contracts.DockerRunTypeDinD {
+// SetMaxCapturedOutputSize limits the number of bytes a stage can capture into an envvar with the captureOutput property
+func (dr *dockerRunner) SetMaxCapturedOutputSize(maxBytes int) {
+	dr.maxCapturedOutputBytes = maxBytes
+}
+
+func (dr *dockerRunner) registerOutputCapture(containerID string, stage manifest.ZiplineeStage) {
+	capture := getStageOutputCapture(stage.CustomProperties, dr.maxCapturedOutputBytes)
+	if capture == nil {
 		return
 	}
 
-	// wait until /var/run/docker.sock exists
-	log.Debug().Msg("Waiting for docker daemon to be ready for use...")
-	for {
-		if _, err := os.Stat("/var/run/docker.sock"); os.IsNotExist(err) {
-			// does not exist
-			time.Sleep(1 * time.Second)
-		} else {
-			// file exists, break out of for loop
-			break
-		}
-	}
-	log.Debug().Msg("Docker daemon is ready for use")
+	dr.outputCapturesMutex.Lock()
+	defer dr.outputCapturesMutex.Unlock()
+
+	dr.outputCaptures[containerID] = capture
 }
 
-func (dr *dockerRunner) CreateDockerClient() error {
+func (dr *dockerRunner) captureOutputLine(containerID, line string) {
+	dr.outputCapturesMutex.Lock()
+	defer dr.outputCapturesMutex.Unlock()
 
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return err
+	if capture, ok := dr.outputCaptures[containerID]; ok {
+		capture.addLine(line)
 	}
-	dr.dockerClient = dockerClient
-
-	return err
 }
 
-func (dr *dockerRunner) getImagePullOptions(containerImage string) types.ImagePullOptions {
-
-	containerRegistryCredentials := dr.config.GetCredentialsByType("container-registry")
+func (dr *dockerRunner) discardOutputCapture(containerID string) {
+	dr.outputCapturesMutex.Lock()
+	defer dr.outputCapturesMutex.Unlock()
 
-	if len(containerRegistryCredentials) > 0 {
-		for _, credential := range containerRegistryCredentials {
-			containerImageSlice := strings.Split(containerImage, "/")
-			containerRepo := strings.Join(containerImageSlice[:len(containerImageSlice)-1], "/")
+	delete(dr.outputCaptures, containerID)
+}
 
-			if containerRepo == credential.AdditionalProperties["repository"].(string) {
-				authConfig := types.AuthConfig{
-					Username: credential.AdditionalProperties["username"].(string),
-					Password: credential.AdditionalProperties["password"].(string),
-				}
-				encodedJSON, err := json.Marshal(authConfig)
-				if err == nil {
-					authStr := base64.URLEncoding.EncodeToString(encodedJSON)
+// finishOutputCapture stores the output captured from a successful stage as envvar for later stages, warning in the stage's logs if it got truncated
+func (dr *dockerRunner) finishOutputCapture(containerID, parentStageName, stageName string, depth, lineNumber int) {
+	dr.outputCapturesMutex.Lock()
+	capture, ok := dr.outputCaptures[containerID]
+	if ok {
+		delete(dr.outputCaptures, containerID)
+		dr.capturedEnvvars[capture.envvar] = capture.value()
+	}
+	dr.outputCapturesMutex.Unlock()
 
-					log.Debug().Msgf("Using credential '%v' to authenticate for image '%v'", credential.Name, containerImage)
+	if !ok {
+		return
+	}
 
-					return types.ImagePullOptions{
-						RegistryAuth: authStr,
-					}
-				}
+	log.Debug().Msgf("%v Captured %v bytes of output into envvar %v", getLogPrefix(stageName, parentStageName), len(capture.value()), capture.envvar)
 
-				log.Error().Err(err).Msgf("Failed marshaling docker auth config for container image %v", containerImage)
+	if capture.truncated {
+		warning := fmt.Sprintf("Captured output for envvar %v exceeds the maximum of %v bytes and got truncated\n", capture.envvar, dr.maxCapturedOutputBytes)
+		log.Warn().Msgf("%v %v", getLogPrefix(stageName, parentStageName), strings.TrimSpace(warning))
 
-				break
-			}
+		dr.tailLogsChannel <- contracts.TailLogLine{
+			Step:        stageName,
+			ParentStage: parentStageName,
+			Type:        contracts.LogTypeStage,
+			Depth:       depth,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: lineNumber,
+				Timestamp:  time.Now().UTC(),
+				StreamType: "stderr",
+				Text:       warning,
+			},
 		}
 	}
+}
 
-	// when no container-registry credentials apply use container-registry-pull as fallback to avoid docker hub rate limiting issues
-	containerRegistryPullCredentials := dr.config.GetCredentialsByType("container-registry-pull")
+func (dr *dockerRunner) getCapturedEnvvars() map[string]string {
+	dr.outputCapturesMutex.Lock()
+	defer dr.outputCapturesMutex.Unlock()
 
-	if len(containerRegistryPullCredentials) > 0 {
-		// no real need to loop, since we only need one of these, but works anyway
-		for _, credential := range containerRegistryPullCredentials {
-			authConfig := types.AuthConfig{
-				Username: credential.AdditionalProperties["username"].(string),
-				Password: credential.AdditionalProperties["password"].(string),
-			}
-			encodedJSON, err := json.Marshal(authConfig)
-			if err == nil {
-				authStr := base64.URLEncoding.EncodeToString(encodedJSON)
+	capturedEnvvars := map[string]string{}
+	for key, value := range dr.capturedEnvvars {
+		capturedEnvvars[key] = value
+	}
 
-				log.Debug().Msgf("Using credential '%v' to authenticate for image '%v'", credential.Name, containerImage)
+	return capturedEnvvars
+}
 
-				return types.ImagePullOptions{
-					RegistryAuth: authStr,
-				}
-			} else {
-				log.Error().Err(err).Msgf("Failed marshaling docker auth config for container image %v", containerImage)
-				break
-			}
-		}
+// sampleStageResourceUsage reads the stats of a stage container in the background; the returned function stops sampling and waits for the peak usage to be recorded
+func (dr *dockerRunner) sampleStageResourceUsage(ctx context.Context, containerID, parentStageName, stageName string) (stop func()) {
+
+	statsCtx, cancel := context.WithCancel(ctx)
+
+	stats, err := dr.dockerClient.ContainerStats(statsCtx, containerID, true)
+	if err != nil {
+		log.Warn().Err(err).Msgf("%v Failed to sample resource usage of container %v", getLogPrefix(stageName, parentStageName), containerID)
+		cancel()
+		return func() {}
 	}
 
-	return types.ImagePullOptions{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer stats.Body.Close()
+		dr.collectStageResourceUsage(statsCtx, stats.Body, parentStageName, stageName)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
 }
 
-func (dr *dockerRunner) IsTrustedImage(stageName string, containerImage string) bool {
+func (dr *dockerRunner) collectStageResourceUsage(ctx context.Context, stream io.Reader, parentStageName, stageName string) {
 
-	log.Debug().Msgf("[%v] Checking if docker image '%v' is trusted...", stageName, containerImage)
+	usage, err := readContainerStatsPeaks(stream, dr.stageResourceUsageInterval, time.Now)
+	if err != nil && ctx.Err() == nil {
+		// reading the stream fails once sampling is stopped, only log errors before that
+		log.Warn().Err(err).Msgf("%v Failed reading resource usage of stage", getLogPrefix(stageName, parentStageName))
+	}
+	if usage.Samples == 0 {
+		return
+	}
 
-	// check if image is trusted image
-	trustedImage := dr.config.GetTrustedImage(containerImage)
+	usage.Stage = stageName
+	usage.ParentStage = parentStageName
 
-	return trustedImage != nil
-}
+	log.Debug().Msgf("%v Peak resource usage: memory %v bytes, cpu %.2f cores", getLogPrefix(stageName, parentStageName), usage.MemoryBytes, usage.CPUCores)
 
-func (dr *dockerRunner) HasInjectedCredentials(stageName string, containerImage string) bool {
+	dr.stageResourceUsageMutex.Lock()
+	defer dr.stageResourceUsageMutex.Unlock()
 
-	log.Debug().Msgf("[%v] Checking if docker image '%v' has injected credentials...", stageName, containerImage)
+	dr.stageResourceUsage = append(dr.stageResourceUsage, usage)
+}
 
-	// check if image has injected credentials
-	trustedImage := dr.config.GetTrustedImage(containerImage)
-	if trustedImage == nil {
-		return false
-	}
+func (dr *dockerRunner) GetStageResourceUsage() []StageResourceUsage {
+	dr.stageResourceUsageMutex.Lock()
+	defer dr.stageResourceUsageMutex.Unlock()
 
-	credentialMap := dr.config.GetCredentialsForTrustedImage(*trustedImage)
+	stageResourceUsage := make([]StageResourceUsage, len(dr.stageResourceUsage))
+	copy(stageResourceUsage, dr.stageResourceUsage)
 
-	return len(credentialMap) > 0
+	return stageResourceUsage
 }
 
 func (dr *dockerRunner) stopContainer(ctx context.Context, containerID string) error {
@@ -986,20 +2259,10 @@ func (dr *dockerRunner) CreateNetworks(ctx context.Context) error {
 
 		log.Info().Msgf("Creating docker network %v with values %v", nw.Name, nw)
 
-		options := types.NetworkCreate{}
-		if nw.Driver != "" {
-			options.IPAM = &network.IPAM{
-				Driver: nw.Driver,
-			}
-
-			if nw.Subnet != "" && nw.Gateway != "" {
-				options.IPAM.Config = []network.IPAMConfig{
-					{
-						Subnet:  nw.Subnet,
-						Gateway: nw.Gateway,
-					},
-				}
-			}
+		options, err := getNetworkCreateOptions(nw)
+		if err != nil {
+			log.Error().Err(err).Msgf("Invalid configuration for docker network %v", nw.Name)
+			return err
 		}
 
 		resp, err := dr.dockerClient.NetworkCreate(ctx, nw.Name, options)
@@ -1017,6 +2280,46 @@ func (dr *dockerRunner) CreateNetworks(ctx context.Context) error {
 	return nil
 }
 
+// getNetworkCreateOptions uses the configured subnet and gateway for a network, so it doesn't conflict with other address spaces in the cluster; without a subnet docker assigns one itself
+func getNetworkCreateOptions(nw contracts.DockerNetworkConfig) (options types.NetworkCreate, err error) {
+	if nw.Driver == "" && nw.Subnet == "" {
+		return
+	}
+
+	options.IPAM = &network.IPAM{
+		Driver: nw.Driver,
+	}
+
+	if nw.Subnet == "" {
+		return
+	}
+
+	_, subnet, err := net.ParseCIDR(nw.Subnet)
+	if err != nil {
+		return options, fmt.Errorf("Subnet %v is not a valid cidr: %w", nw.Subnet, err)
+	}
+
+	ipamConfig := network.IPAMConfig{
+		Subnet: nw.Subnet,
+	}
+
+	// without a gateway docker uses the first address of the subnet
+	if nw.Gateway != "" {
+		gateway := net.ParseIP(nw.Gateway)
+		if gateway == nil {
+			return options, fmt.Errorf("Gateway %v is not a valid ip address", nw.Gateway)
+		}
+		if !subnet.Contains(gateway) {
+			return options, fmt.Errorf("Gateway %v is not in subnet %v", nw.Gateway, nw.Subnet)
+		}
+		ipamConfig.Gateway = nw.Gateway
+	}
+
+	options.IPAM.Config = []network.IPAMConfig{ipamConfig}
+
+	return
+}
+
 func (dr *dockerRunner) DeleteNetworks(ctx context.Context) error {
 	if dr.config.DockerConfig == nil {
 		return nil
@@ -1287,6 +2590,9 @@ func (dr *dockerRunner) generateCredentialsFiles(trustedImage *contracts.Trusted
 		}
 		for credentialType, credentialsForType := range credentialMap {
 
+			// extensions use the first credential matching their needs, so the one that should win goes first
+			credentialsForType = dr.orderCredentials(credentialsForType)
+
 			filename := fmt.Sprintf("%v.json", foundation.ToLowerSnakeCase(credentialType))
 			filepath := path.Join(credentialsdir, filename)
 
@@ -1326,6 +2632,78 @@ func escapeCharsInCommand(command string) string {
 	return command
 }
 
+// secretFileNameRegex matches the envvar names allowed in the secretFiles custom property
+var secretFileNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// generateSecretFiles writes the envvars listed in the secretFiles custom property to files in a tmpfs directory and replaces each of them with a <NAME>_FILE envvar holding the path inside the container, so secrets don't show up in the container environment;
+// it returns the directory to remove once the container is done next to the path to bind mount, which differs on windows
+func (dr *dockerRunner) generateSecretFiles(customProperties map[string]interface{}, envvars map[string]string) (dir, hostPath, mountPath string, err error) {
+
+	secretFiles, ok := getCustomPropertyStringSlice(customProperties, "secretFiles")
+	if !ok || len(secretFiles) == 0 {
+		return
+	}
+
+	// the names end up in file paths, so only allow envvar names to keep them from pointing outside the secrets directory
+	for _, name := range secretFiles {
+		if !secretFileNameRegex.MatchString(name) {
+			return "", "", "", fmt.Errorf("Secret file %v listed in secretFiles is invalid, it should be an envvar name matching %v", name, secretFileNameRegex.String())
+		}
+	}
+
+	secretsDir, err := dr.makeSecretFilesDir("*-secrets")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			removeSecretFilesDirs([]string{secretsDir})
+		}
+	}()
+
+	mountPath = "/ziplinee-secrets"
+	if runtime.GOOS == "windows" {
+		mountPath = "C:" + mountPath
+	}
+
+	for _, name := range secretFiles {
+		value, exists := envvars[name]
+		if !exists {
+			log.Warn().Msgf("Envvar %v listed in secretFiles is not set, not creating a file for it", name)
+			continue
+		}
+
+		secretFilePath := filepath.Join(secretsDir, name)
+		err = os.WriteFile(secretFilePath, []byte(os.Expand(value, dr.envvarHelper.getZiplineeEnv)), 0444)
+		if err != nil {
+			return "", "", "", err
+		}
+		// make sure the umask doesn't get in the way of non-root containers reading the file
+		err = os.Chmod(secretFilePath, 0444)
+		if err != nil {
+			return "", "", "", err
+		}
+
+		delete(envvars, name)
+		envvars[name+"_FILE"] = path.Join(mountPath, name)
+
+		log.Debug().Msgf("Stored envvar %v in secret file %v", name, secretFilePath)
+	}
+
+	err = os.Chmod(secretsDir, 0755)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	dir = secretsDir
+	hostPath = secretsDir
+	if runtime.GOOS == "windows" {
+		hostPath = filepath.Join(dr.envvarHelper.GetTempDir(), strings.TrimPrefix(hostPath, "C:\\Windows\\TEMP"))
+	}
+
+	return
+}
+
 func (dr *dockerRunner) Info(ctx context.Context) string {
 
 	info, err := dr.dockerClient.Info(ctx)
@@ -0,0 +1,73 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// dotEnvFileName is the name of the file in the root of the repository holding local-only envvars for local builds
+const dotEnvFileName = ".env"
+
+var dotEnvKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// readDotEnvFile reads the KEY=value lines of a dotenv file, skipping empty lines and comments and allowing an export prefix and quoted values;
+// a missing file returns no envvars, since the file is optional
+func readDotEnvFile(path string) (envvars map[string]string, err error) {
+	envvars = map[string]string{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return envvars, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !dotEnvKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("Line %v of %v is invalid, it should be formatted as KEY=value", lineNumber, path)
+		}
+
+		envvars[key] = unquoteDotEnvValue(strings.TrimSpace(value))
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return envvars, nil
+}
+
+// unquoteDotEnvValue strips the quotes around a value, unescaping newlines and quotes in double quoted values, or strips a trailing comment from an unquoted value
+func unquoteDotEnvValue(value string) string {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		case value[0] == '"' && value[len(value)-1] == '"':
+			return strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		}
+	}
+
+	if index := strings.Index(value, " #"); index >= 0 {
+		value = strings.TrimSpace(value[:index])
+	}
+
+	return value
+}
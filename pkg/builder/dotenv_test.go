@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDotEnvFile(t *testing.T) {
+
+	t.Run("ReturnsEnvvarsSkippingCommentsAndEmptyLines", func(t *testing.T) {
+
+		path := filepath.Join(t.TempDir(), ".env")
+		err := os.WriteFile(path, []byte("# local-only envvars\n\nLOCAL_DATABASE_URL=postgres://localhost:5432\nexport GO_VERSION=1.22\nLOG_LEVEL=debug # verbose logs\nEMPTY=\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		envvars, err := readDotEnvFile(path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{
+			"LOCAL_DATABASE_URL": "postgres://localhost:5432",
+			"GO_VERSION":         "1.22",
+			"LOG_LEVEL":          "debug",
+			"EMPTY":              "",
+		}, envvars)
+	})
+
+	t.Run("StripsQuotesAroundValues", func(t *testing.T) {
+
+		path := filepath.Join(t.TempDir(), ".env")
+		err := os.WriteFile(path, []byte("SINGLE='value with # hash'\nDOUBLE=\"line 1\\nline \\\"2\\\"\"\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		envvars, err := readDotEnvFile(path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "value with # hash", envvars["SINGLE"])
+		assert.Equal(t, "line 1\nline \"2\"", envvars["DOUBLE"])
+	})
+
+	t.Run("ReturnsNoEnvvarsIfFileDoesNotExist", func(t *testing.T) {
+
+		// act
+		envvars, err := readDotEnvFile(filepath.Join(t.TempDir(), ".env"))
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(envvars))
+	})
+
+	t.Run("ReturnsErrorForLineWithoutEqualsSign", func(t *testing.T) {
+
+		path := filepath.Join(t.TempDir(), ".env")
+		err := os.WriteFile(path, []byte("GO_VERSION=1.22\nLOCAL_DATABASE_URL\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		_, err = readDotEnvFile(path)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Line 2")
+		}
+	})
+
+	t.Run("ReturnsErrorForInvalidKey", func(t *testing.T) {
+
+		path := filepath.Join(t.TempDir(), ".env")
+		err := os.WriteFile(path, []byte("1INVALID-KEY=value\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		_, err = readDotEnvFile(path)
+
+		assert.NotNil(t, err)
+	})
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
@@ -16,6 +18,8 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/sethgrid/pester"
 	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+	foundation "github.com/ziplineeci/ziplinee-foundation"
 )
 
 // EndOfLifeHelper has methods to shutdown the runner after a fatal or successful run
@@ -26,23 +30,243 @@ type EndOfLifeHelper interface {
 	SendBuildCleanEvent(ctx context.Context, buildStatus contracts.LogStatus) error
 	SendBuildJobLogEvent(ctx context.Context, buildLog contracts.BuildLog) error
 	CancelJob(ctx context.Context) error
+	AddBuildLogMetadata(key string, value interface{})
+	SetBuilderEventTags(tags map[string]string)
+	SetBuilderVersion(applicationInfo foundation.ApplicationInfo)
+	SetHTTPTimeouts(postLogsTimeout, builderEventsTimeout, cancelJobTimeout time.Duration)
+	SetRunAsJobFatalExitCode(exitCode int)
+	SetCleanEventDelay(delay time.Duration)
+	SetLogShippingFailurePolicy(policy string)
+	SetAdditionalAPIEndpoints(endpoints []APIEndpoint, successPolicy string)
+	EnableReleaseLease(wait bool, timeout time.Duration)
+	AcquireReleaseLease(ctx context.Context) error
+	EnableAdmissionWebhook(webhookURL string)
+	RequestAdmission(ctx context.Context) error
+	EnableStageEvents(stageEventsURL string)
+	SendStageEvent(ctx context.Context, stageName, parentStageName string, status contracts.LogStatus, duration *time.Duration) error
+	EnableIncrementalLogs(incrementalLogsURL string)
+	SendIncrementalLog(ctx context.Context, stageName, parentStageName string, logType contracts.LogType, logLines []contracts.BuildLogLine) error
+	EnableStatusBadge(statusBadgeURL string)
 }
 
 type endOfLifeHelper struct {
-	runAsJob bool
-	config   contracts.BuilderConfig
-	podName  string
+	runAsJob         bool
+	config           contracts.BuilderConfig
+	podName          string
+	buildLogMetadata map[string]interface{}
+	builderEventTags map[string]string
+	builderVersion   *builderVersion
+
+	runAsJobFatalExitCode int
+	exit                  func(code int)
+
+	cleanEventDelay time.Duration
+
+	logShippingFailurePolicy logShippingFailurePolicy
+	logShippingFailed        bool
+
+	additionalAPIEndpoints    []APIEndpoint
+	apiEndpointsSuccessPolicy apiEndpointsSuccessPolicy
+
+	postLogsTimeout      time.Duration
+	builderEventsTimeout time.Duration
+	cancelJobTimeout     time.Duration
+
+	releaseLeaseEnabled      bool
+	releaseLeaseWait         bool
+	releaseLeaseTimeout      time.Duration
+	releaseLeasePollInterval time.Duration
+
+	admissionWebhookURL string
+
+	stageEventsURL string
+
+	incrementalLogsURL string
+
+	statusBadgeURL string
+}
+
+type logShippingFailurePolicy string
+
+const (
+	// logShippingFailurePolicyIgnore keeps the status of the build when its logs can't be shipped; this is the default
+	logShippingFailurePolicyIgnore logShippingFailurePolicy = "ignore"
+	// logShippingFailurePolicyFail marks the build as failed when its logs can't be shipped, for compliance setups where a build without logs can't count as succeeded
+	logShippingFailurePolicyFail logShippingFailurePolicy = "fail"
+)
+
+// APIEndpoint is an api to send builder events and logs to next to the one in the builder config, for instance while migrating to a new api
+type APIEndpoint struct {
+	BuilderEventsURL string `json:"builderEventsUrl,omitempty"`
+	PostLogsURL      string `json:"postLogsUrl,omitempty"`
+	JWT              string `json:"jwt,omitempty"`
+}
+
+type apiEndpointsSuccessPolicy string
+
+const (
+	// apiEndpointsSuccessPolicyAll only treats sending builder events and logs as succeeded if every api accepted them; this is the default
+	apiEndpointsSuccessPolicyAll apiEndpointsSuccessPolicy = "all"
+	// apiEndpointsSuccessPolicyAny treats sending builder events and logs as succeeded if at least one api accepted them
+	apiEndpointsSuccessPolicyAny apiEndpointsSuccessPolicy = "any"
+)
+
+// builderEventWithTags adds free-form tags like a ticket id and the version of the builder to the builder event sent to the api
+type builderEventWithTags struct {
+	contracts.ZiplineeCiBuilderEvent
+	Tags    map[string]string `json:"tags,omitempty"`
+	Builder *builderVersion   `json:"builder,omitempty"`
+}
+
+// builderVersion identifies the builder that ran a job, to track which builder version produced a build during rollouts
+type builderVersion struct {
+	Version  string `json:"version,omitempty"`
+	Branch   string `json:"branch,omitempty"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// buildLogWithMetadata adds builder metadata to the build log shipped to the api
+type buildLogWithMetadata struct {
+	contracts.BuildLog
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// releaseLogWithMetadata adds builder metadata to the release log shipped to the api
+type releaseLogWithMetadata struct {
+	contracts.ReleaseLog
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// botLogWithMetadata adds builder metadata to the bot log shipped to the api
+type botLogWithMetadata struct {
+	contracts.BotLog
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // NewEndOfLifeHelper returns a new EndOfLifeHelper
 func NewEndOfLifeHelper(runAsJob bool, config contracts.BuilderConfig, podName string) EndOfLifeHelper {
 	return &endOfLifeHelper{
-		runAsJob: runAsJob,
-		config:   config,
-		podName:  podName,
+		runAsJob:         runAsJob,
+		config:           config,
+		podName:          podName,
+		buildLogMetadata: map[string]interface{}{},
+
+		exit: os.Exit,
+
+		postLogsTimeout:      60 * time.Second,
+		builderEventsTimeout: 10 * time.Second,
+		cancelJobTimeout:     60 * time.Second,
+
+		releaseLeasePollInterval: 10 * time.Second,
+
+		logShippingFailurePolicy: logShippingFailurePolicyIgnore,
+
+		apiEndpointsSuccessPolicy: apiEndpointsSuccessPolicyAll,
+	}
+}
+
+func (elh *endOfLifeHelper) AddBuildLogMetadata(key string, value interface{}) {
+	if elh.buildLogMetadata == nil {
+		elh.buildLogMetadata = map[string]interface{}{}
+	}
+	elh.buildLogMetadata[key] = value
+}
+
+func (elh *endOfLifeHelper) SetBuilderEventTags(tags map[string]string) {
+	elh.builderEventTags = tags
+}
+
+func (elh *endOfLifeHelper) SetBuilderVersion(applicationInfo foundation.ApplicationInfo) {
+	elh.builderVersion = &builderVersion{
+		Version:  applicationInfo.Version,
+		Branch:   applicationInfo.Branch,
+		Revision: applicationInfo.Revision,
 	}
 }
 
+func (elh *endOfLifeHelper) SetHTTPTimeouts(postLogsTimeout, builderEventsTimeout, cancelJobTimeout time.Duration) {
+	elh.postLogsTimeout = postLogsTimeout
+	elh.builderEventsTimeout = builderEventsTimeout
+	elh.cancelJobTimeout = cancelJobTimeout
+}
+
+// SetRunAsJobFatalExitCode sets the exit code for a fatal error when running as job; it defaults to 0 to keep the job from failing and backing off
+func (elh *endOfLifeHelper) SetRunAsJobFatalExitCode(exitCode int) {
+	elh.runAsJobFatalExitCode = exitCode
+}
+
+// SetCleanEventDelay sets the time to wait before sending the clean event, for setups where the pod gets torn down before the logs finish shipping; it defaults to 0
+func (elh *endOfLifeHelper) SetCleanEventDelay(delay time.Duration) {
+	elh.cleanEventDelay = delay
+}
+
+// SetLogShippingFailurePolicy sets whether the build gets marked as failed when its logs can't be shipped, even without the successful steps' log lines; either ignore (the default) or fail
+func (elh *endOfLifeHelper) SetLogShippingFailurePolicy(policy string) {
+	switch p := logShippingFailurePolicy(strings.ToLower(policy)); p {
+	case logShippingFailurePolicyIgnore, logShippingFailurePolicyFail:
+		elh.logShippingFailurePolicy = p
+	default:
+		log.Warn().Msgf("Unknown log shipping failure policy '%v', using '%v' instead", policy, logShippingFailurePolicyIgnore)
+		elh.logShippingFailurePolicy = logShippingFailurePolicyIgnore
+	}
+}
+
+// SetAdditionalAPIEndpoints sets apis to send builder events and logs to as well, with whether sending succeeds if all of them (the default) or any of them accept it
+func (elh *endOfLifeHelper) SetAdditionalAPIEndpoints(endpoints []APIEndpoint, successPolicy string) {
+	elh.additionalAPIEndpoints = endpoints
+
+	switch p := apiEndpointsSuccessPolicy(strings.ToLower(successPolicy)); p {
+	case apiEndpointsSuccessPolicyAll, apiEndpointsSuccessPolicyAny:
+		elh.apiEndpointsSuccessPolicy = p
+	case "":
+		elh.apiEndpointsSuccessPolicy = apiEndpointsSuccessPolicyAll
+	default:
+		log.Warn().Msgf("Unknown api endpoints success policy '%v', using '%v' instead", successPolicy, apiEndpointsSuccessPolicyAll)
+		elh.apiEndpointsSuccessPolicy = apiEndpointsSuccessPolicyAll
+	}
+}
+
+// getAPIEndpoints returns the api from the builder config followed by the additional apis
+func (elh *endOfLifeHelper) getAPIEndpoints() []APIEndpoint {
+	endpoints := []APIEndpoint{}
+	if elh.config.CIServer != nil {
+		endpoints = append(endpoints, APIEndpoint{
+			BuilderEventsURL: elh.config.CIServer.BuilderEventsURL,
+			PostLogsURL:      elh.config.CIServer.PostLogsURL,
+			JWT:              elh.config.CIServer.JWT,
+		})
+	}
+
+	return append(endpoints, elh.additionalAPIEndpoints...)
+}
+
+// sendToAPIEndpoints calls send for every endpoint with a url and jwt and combines the errors according to the success policy
+func (elh *endOfLifeHelper) sendToAPIEndpoints(getURL func(APIEndpoint) string, send func(url, jwt string) error) error {
+	attempts := 0
+	errs := []string{}
+	for _, endpoint := range elh.getAPIEndpoints() {
+		url := getURL(endpoint)
+		if url == "" || endpoint.JWT == "" {
+			continue
+		}
+
+		attempts++
+		err := send(url, endpoint.JWT)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) == 0 || (elh.apiEndpointsSuccessPolicy == apiEndpointsSuccessPolicyAny && len(errs) < attempts) {
+		return nil
+	}
+	if len(errs) == 1 {
+		return fmt.Errorf("%v", errs[0])
+	}
+
+	return fmt.Errorf("Sending to %v of %v apis failed: %v", len(errs), attempts, strings.Join(errs, "; "))
+}
+
 func (elh *endOfLifeHelper) HandleFatal(ctx context.Context, buildLog contracts.BuildLog, err error, message string) {
 
 	// add error messages as step to show in logs
@@ -80,7 +304,7 @@ func (elh *endOfLifeHelper) HandleFatal(ctx context.Context, buildLog contracts.
 
 	if elh.runAsJob {
 		log.Error().Err(err).Msg(message)
-		os.Exit(0)
+		elh.exit(elh.runAsJobFatalExitCode)
 	} else {
 		log.Fatal().Err(err).Msg(message)
 	}
@@ -115,7 +339,24 @@ func (elh *endOfLifeHelper) SendBuildJobLogEvent(ctx context.Context, buildLog c
 		slimBuildLog.Steps = append(slimBuildLog.Steps, slimBuildLogStep)
 	}
 
-	return elh.SendBuildJobLogEventCore(ctx, slimBuildLog)
+	err = elh.SendBuildJobLogEventCore(ctx, slimBuildLog)
+	if err != nil {
+		elh.handleLogShippingFailure(ctx, err)
+	}
+
+	return err
+}
+
+// handleLogShippingFailure marks the build as failed if the logs can't be shipped at all and the policy says so; the clean event sent afterwards carries the failed status as well
+func (elh *endOfLifeHelper) handleLogShippingFailure(ctx context.Context, err error) {
+	if elh.logShippingFailurePolicy != logShippingFailurePolicyFail {
+		log.Warn().Err(err).Msg("Failed shipping logs, keeping the build status")
+		return
+	}
+
+	log.Error().Err(err).Msg("Failed shipping logs, marking the build as failed")
+	elh.logShippingFailed = true
+	_ = elh.sendBuilderEvent(ctx, contracts.LogStatusFailed, contracts.BuildEventTypeUpdateStatus)
 }
 
 func (elh *endOfLifeHelper) SendBuildJobLogEventCore(ctx context.Context, buildLog contracts.BuildLog) (err error) {
@@ -123,15 +364,11 @@ func (elh *endOfLifeHelper) SendBuildJobLogEventCore(ctx context.Context, buildL
 	span, _ := opentracing.StartSpanFromContext(ctx, "SendLog")
 	defer span.Finish()
 
-	ciServerBuilderPostLogsURL := elh.config.CIServer.PostLogsURL
-	jwt := elh.config.CIServer.JWT
 	jobName := *elh.config.JobName
 
-	if ciServerBuilderPostLogsURL != "" && jwt != "" && jobName != "" {
+	if jobName != "" {
 
 		// convert BuildJobLogs to json
-		var requestBody io.Reader
-
 		var data []byte
 		if elh.config.JobType == contracts.JobTypeRelease {
 			// copy buildLog to releaseLog and marshal that
@@ -144,7 +381,7 @@ func (elh *endOfLifeHelper) SendBuildJobLogEventCore(ctx context.Context, buildL
 				Steps:      buildLog.Steps,
 				InsertedAt: buildLog.InsertedAt,
 			}
-			data, err = json.Marshal(releaseLog)
+			data, err = json.Marshal(releaseLogWithMetadata{releaseLog, elh.buildLogMetadata})
 			if err != nil {
 				log.Error().Err(err).Msgf("Failed marshalling ReleaseLog for job %v", jobName)
 				return
@@ -160,56 +397,66 @@ func (elh *endOfLifeHelper) SendBuildJobLogEventCore(ctx context.Context, buildL
 				Steps:      buildLog.Steps,
 				InsertedAt: buildLog.InsertedAt,
 			}
-			data, err = json.Marshal(botLog)
+			data, err = json.Marshal(botLogWithMetadata{botLog, elh.buildLogMetadata})
 			if err != nil {
 				log.Error().Err(err).Msgf("Failed marshalling BotLog for job %v", jobName)
 				return
 			}
 		} else {
-			data, err = json.Marshal(buildLog)
+			data, err = json.Marshal(buildLogWithMetadata{buildLog, elh.buildLogMetadata})
 			if err != nil {
 				log.Error().Err(err).Msgf("Failed marshalling BuildLog for job %v", jobName)
 				return
 			}
 		}
 
-		requestBody = bytes.NewReader(data)
+		return elh.sendToAPIEndpoints(func(endpoint APIEndpoint) string { return endpoint.PostLogsURL }, func(postLogsURL, jwt string) error {
+			return elh.postBuildJobLog(span, postLogsURL, jwt, jobName, data)
+		})
+	}
 
-		// create client, in order to add headers
-		client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}})
-		client.MaxRetries = 1
-		client.Backoff = pester.DefaultBackoff
-		client.KeepLog = true
-		client.Timeout = time.Second * 60
-		request, err := http.NewRequest("POST", ciServerBuilderPostLogsURL, requestBody)
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed creating http client for job %v", jobName)
-			return err
-		}
+	return nil
+}
 
-		// add tracing context
-		request = request.WithContext(opentracing.ContextWithSpan(request.Context(), span))
+func (elh *endOfLifeHelper) postBuildJobLog(span opentracing.Span, ciServerBuilderPostLogsURL, jwt, jobName string, data []byte) error {
 
-		// collect additional information on setting up connections
-		request, ht := nethttp.TraceRequest(span.Tracer(), request)
+	// create client, in order to add headers
+	client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}, Timeout: elh.postLogsTimeout})
+	client.MaxRetries = 1
+	client.Backoff = pester.DefaultBackoff
+	client.KeepLog = true
+	request, err := http.NewRequest("POST", ciServerBuilderPostLogsURL, bytes.NewReader(data))
+	if err != nil {
+		log.Error().Err(redactURLsInError(err)).Msgf("Failed creating http client for job %v", jobName)
+		return redactURLsInError(err)
+	}
 
-		// add headers
-		request.Header.Add("Authorization", fmt.Sprintf("Bearer %v", jwt))
-		request.Header.Add("Content-Type", "application/json")
+	// add tracing context
+	request = request.WithContext(opentracing.ContextWithSpan(request.Context(), span))
 
-		// perform actual request
-		response, err := client.Do(request)
-		if err != nil {
-			log.Error().Err(err).Str("logs", client.LogString()).Msgf("Failed shipping logs to %v for job %v: %v", ciServerBuilderPostLogsURL, jobName, client.LogString())
-			return err
-		}
+	// collect additional information on setting up connections
+	request, ht := nethttp.TraceRequest(span.Tracer(), request)
 
-		defer response.Body.Close()
-		ht.Finish()
+	// add headers
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %v", jwt))
+	request.Header.Add("Content-Type", "application/json")
 
-		log.Debug().Str("logs", client.LogString()).Msgf("Successfully shipped logs to %v for job %v", ciServerBuilderPostLogsURL, jobName)
+	// perform actual request
+	response, err := client.Do(request)
+	if err != nil {
+		log.Error().Err(redactURLsInError(err)).Str("logs", redactURLsInText(client.LogString())).Msgf("Failed shipping logs to %v for job %v: %v", redactURL(ciServerBuilderPostLogsURL), jobName, redactURLsInText(client.LogString()))
+		return redactURLsInError(err)
 	}
 
+	defer response.Body.Close()
+	ht.Finish()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Shipping logs to %v for job %v responded with status code %v", redactURL(ciServerBuilderPostLogsURL), jobName, response.StatusCode)
+	}
+
+	log.Debug().Str("logs", redactURLsInText(client.LogString())).Msgf("Successfully shipped logs to %v for job %v", redactURL(ciServerBuilderPostLogsURL), jobName)
+
 	return nil
 }
 
@@ -219,10 +466,25 @@ func (elh *endOfLifeHelper) SendBuildStartedEvent(ctx context.Context) error {
 }
 
 func (elh *endOfLifeHelper) SendBuildFinishedEvent(ctx context.Context, buildStatus contracts.LogStatus) error {
+	// the badge is a nice-to-have, so failing to update it doesn't fail the build
+	badgeErr := elh.sendStatusBadge(ctx, buildStatus)
+	if badgeErr != nil {
+		log.Warn().Err(redactURLsInError(badgeErr)).Msgf("Failed updating status badge at %v", redactURL(elh.statusBadgeURL))
+	}
+
 	return elh.sendBuilderEvent(ctx, buildStatus, contracts.BuildEventTypeUpdateStatus)
 }
 
 func (elh *endOfLifeHelper) SendBuildCleanEvent(ctx context.Context, buildStatus contracts.LogStatus) error {
+	if elh.logShippingFailed {
+		buildStatus = contracts.LogStatusFailed
+	}
+
+	if elh.cleanEventDelay > 0 {
+		log.Debug().Msgf("Waiting %v before sending the clean event", elh.cleanEventDelay)
+		time.Sleep(elh.cleanEventDelay)
+	}
+
 	return elh.sendBuilderEvent(ctx, buildStatus, contracts.BuildEventTypeClean)
 }
 
@@ -232,14 +494,10 @@ func (elh *endOfLifeHelper) sendBuilderEvent(ctx context.Context, buildStatus co
 	defer span.Finish()
 	span.SetTag("build-status", buildStatus.ToStatus())
 
-	ciServerBuilderEventsURL := elh.config.CIServer.BuilderEventsURL
-	jwt := elh.config.CIServer.JWT
 	jobName := *elh.config.JobName
 
-	if ciServerBuilderEventsURL != "" && jwt != "" && jobName != "" {
+	if jobName != "" {
 		// convert ZiplineeCiBuilderEvent to json
-		var requestBody io.Reader
-
 		ciBuilderEvent := contracts.ZiplineeCiBuilderEvent{
 			BuildEventType: buildEventType,
 			JobType:        elh.config.JobType,
@@ -255,53 +513,427 @@ func (elh *endOfLifeHelper) sendBuilderEvent(ctx context.Context, buildStatus co
 		// update status
 		ciBuilderEvent.SetStatus(buildStatus.ToStatus())
 
-		data, err := json.Marshal(ciBuilderEvent)
+		data, err := marshalAllowlisted(builderEventWithTags{ciBuilderEvent, elh.builderEventTags, elh.builderVersion}, builderEventAllowlist)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed marshalling ZiplineeCiBuilderEvent for job %v", jobName)
 			return err
 		}
-		requestBody = bytes.NewReader(data)
+		return elh.sendToAPIEndpoints(func(endpoint APIEndpoint) string { return endpoint.BuilderEventsURL }, func(builderEventsURL, jwt string) error {
+			return elh.postBuilderEvent(span, builderEventsURL, jwt, jobName, buildEventType, data)
+		})
+	}
 
-		// create client, in order to add headers
-		client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}})
-		client.MaxRetries = 3
-		client.Backoff = pester.ExponentialJitterBackoff
-		client.KeepLog = true
-		client.Timeout = time.Second * 10
-		request, err := http.NewRequest("POST", ciServerBuilderEventsURL, requestBody)
+	return nil
+}
+
+func (elh *endOfLifeHelper) postBuilderEvent(span opentracing.Span, ciServerBuilderEventsURL, jwt, jobName string, buildEventType contracts.BuildEventType, data []byte) error {
+
+	// create client, in order to add headers
+	client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}, Timeout: elh.builderEventsTimeout})
+	client.MaxRetries = 3
+	client.Backoff = pester.ExponentialJitterBackoff
+	client.KeepLog = true
+	request, err := http.NewRequest("POST", ciServerBuilderEventsURL, bytes.NewReader(data))
+	if err != nil {
+		log.Error().Err(redactURLsInError(err)).Msgf("Failed creating http client for job %v", jobName)
+		return redactURLsInError(err)
+	}
+
+	// add tracing context
+	request = request.WithContext(opentracing.ContextWithSpan(request.Context(), span))
+
+	// collect additional information on setting up connections
+	request, ht := nethttp.TraceRequest(span.Tracer(), request)
+
+	// add headers
+	request.Header.Add("X-Ziplinee-Event-Job-Name", jobName)
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %v", jwt))
+
+	// perform actual request
+	response, err := client.Do(request)
+	if err != nil {
+		span.SetTag("error", true)
+		span.LogFields(
+			tracingLog.String("error", redactURLsInError(err).Error()),
+		)
+		log.Error().Err(redactURLsInError(err)).Str("pesterLogs", redactURLsInText(client.LogString())).Msgf("Failed performing http request to %v for job %v: %v", redactURL(ciServerBuilderEventsURL), jobName, redactURLsInText(client.LogString()))
+		return redactURLsInError(err)
+	}
+
+	defer response.Body.Close()
+	ht.Finish()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Sending build event type '%v' to %v for job %v responded with status code %v", buildEventType, redactURL(ciServerBuilderEventsURL), jobName, response.StatusCode)
+	}
+
+	log.Debug().Str("pesterLogs", redactURLsInText(client.LogString())).Str("url", redactURL(ciServerBuilderEventsURL)).Msgf("Succesfully sent build event type '%v' to api", buildEventType)
+
+	return nil
+}
+
+// EnableReleaseLease makes release jobs acquire a lease for their concurrency key before running, either waiting for it up to timeout or failing right away when it's held by another job
+func (elh *endOfLifeHelper) EnableReleaseLease(wait bool, timeout time.Duration) {
+	elh.releaseLeaseEnabled = true
+	elh.releaseLeaseWait = wait
+	elh.releaseLeaseTimeout = timeout
+}
+
+func (elh *endOfLifeHelper) AcquireReleaseLease(ctx context.Context) (err error) {
+
+	if !elh.releaseLeaseEnabled || elh.config.JobType != contracts.JobTypeRelease || elh.config.Release == nil || elh.config.Git == nil {
+		return nil
+	}
+
+	// serialize releases of the same pipeline to the same target
+	concurrencyKey := fmt.Sprintf("%v/%v/%v/%v", elh.config.Git.RepoSource, elh.config.Git.RepoOwner, elh.config.Git.RepoName, elh.config.Release.Name)
+
+	deadline := time.Now().Add(elh.releaseLeaseTimeout)
+	for {
+		granted, err := elh.requestReleaseLease(ctx, concurrencyKey)
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed creating http client for job %v", jobName)
 			return err
 		}
+		if granted {
+			log.Info().Msgf("Acquired release lease for %v", concurrencyKey)
+			return nil
+		}
 
-		// add tracing context
-		request = request.WithContext(opentracing.ContextWithSpan(request.Context(), span))
+		if !elh.releaseLeaseWait {
+			return fmt.Errorf("Release lease for %v is held by another job", concurrencyKey)
+		}
+		if time.Now().Add(elh.releaseLeasePollInterval).After(deadline) {
+			return fmt.Errorf("Timed out after %v waiting for release lease for %v", elh.releaseLeaseTimeout, concurrencyKey)
+		}
 
-		// collect additional information on setting up connections
-		request, ht := nethttp.TraceRequest(span.Tracer(), request)
+		log.Info().Msgf("Release lease for %v is held by another job, waiting %v before retrying...", concurrencyKey, elh.releaseLeasePollInterval)
 
-		// add headers
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(elh.releaseLeasePollInterval):
+		}
+	}
+}
+
+// requestReleaseLease asks the api for the lease; the api releases it once this job sends its clean event
+func (elh *endOfLifeHelper) requestReleaseLease(ctx context.Context, concurrencyKey string) (granted bool, err error) {
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "AcquireReleaseLease")
+	defer span.Finish()
+
+	ciServerBaseURL := elh.config.CIServer.BaseURL
+	jwt := elh.config.CIServer.JWT
+	jobName := *elh.config.JobName
+
+	if ciServerBaseURL == "" || jwt == "" || jobName == "" {
+		return true, nil
+	}
+
+	ciServerLeaseURL := fmt.Sprintf("%v/api/leases/%v", strings.TrimSuffix(ciServerBaseURL, "/"), url.PathEscape(concurrencyKey))
+
+	data, err := json.Marshal(struct {
+		Key     string `json:"key"`
+		JobName string `json:"jobName"`
+		PodName string `json:"podName,omitempty"`
+	}{concurrencyKey, jobName, elh.podName})
+	if err != nil {
+		return false, err
+	}
+
+	statusCode, _, err := postJSON(span, "POST", ciServerLeaseURL, jwt, jobName, data, time.Second*10, 3)
+	if err != nil {
+		return false, err
+	}
+
+	switch statusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict, http.StatusLocked:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Requesting release lease at %v responded with status code %v", redactURL(ciServerLeaseURL), statusCode)
+}
+
+// EnableAdmissionWebhook makes the job ask the webhook at webhookURL for approval of the manifest before running any stage
+func (elh *endOfLifeHelper) EnableAdmissionWebhook(webhookURL string) {
+	elh.admissionWebhookURL = webhookURL
+}
+
+// admissionRequest is the body posted to the admission webhook
+type admissionRequest struct {
+	JobType  contracts.JobType          `json:"jobType,omitempty"`
+	JobName  string                     `json:"jobName,omitempty"`
+	Build    *contracts.Build           `json:"build,omitempty"`
+	Release  *contracts.Release         `json:"release,omitempty"`
+	Bot      *contracts.Bot             `json:"bot,omitempty"`
+	Git      *contracts.GitConfig       `json:"git,omitempty"`
+	Version  *contracts.VersionConfig   `json:"version,omitempty"`
+	Manifest *manifest.ZiplineeManifest `json:"manifest,omitempty"`
+	Stages   []*manifest.ZiplineeStage  `json:"stages,omitempty"`
+}
+
+// RequestAdmission posts the manifest and build metadata to the admission webhook; any non-2xx response denies the build
+func (elh *endOfLifeHelper) RequestAdmission(ctx context.Context) (err error) {
+
+	if elh.admissionWebhookURL == "" {
+		return nil
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "RequestAdmission")
+	defer span.Finish()
+
+	jobName := ""
+	if elh.config.JobName != nil {
+		jobName = *elh.config.JobName
+	}
+
+	data, err := json.Marshal(admissionRequest{
+		JobType:  elh.config.JobType,
+		JobName:  jobName,
+		Build:    elh.config.Build,
+		Release:  elh.config.Release,
+		Bot:      elh.config.Bot,
+		Git:      elh.config.Git,
+		Version:  elh.config.Version,
+		Manifest: elh.config.Manifest,
+		Stages:   elh.config.Stages,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the webhook is external to the ci server, so it doesn't get the job's jwt
+	statusCode, body, err := postJSON(span, "POST", elh.admissionWebhookURL, "", jobName, data, time.Second*30, 3)
+	if err != nil {
+		return err
+	}
+
+	if statusCode >= 200 && statusCode < 300 {
+		log.Info().Msgf("Build admitted by webhook %v", redactURL(elh.admissionWebhookURL))
+		return nil
+	}
+
+	if len(body) == 0 {
+		return fmt.Errorf("Admission webhook %v denied the build with status code %v", redactURL(elh.admissionWebhookURL), statusCode)
+	}
+
+	return fmt.Errorf("Admission webhook %v denied the build with status code %v: %v", redactURL(elh.admissionWebhookURL), statusCode, getAdmissionDeniedMessage(body))
+}
+
+// getAdmissionDeniedMessage returns the message field of a json response body, or otherwise the body as is
+func getAdmissionDeniedMessage(body []byte) string {
+	var admissionResponse struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &admissionResponse); err == nil && admissionResponse.Message != "" {
+		return admissionResponse.Message
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+// EnableStageEvents makes the job send an event to stageEventsURL whenever a stage starts or finishes, so a ui can update incrementally
+func (elh *endOfLifeHelper) EnableStageEvents(stageEventsURL string) {
+	elh.stageEventsURL = stageEventsURL
+}
+
+// stageEvent is the body sent to the stage events url
+type stageEvent struct {
+	JobName     string              `json:"jobName"`
+	PodName     string              `json:"podName,omitempty"`
+	Stage       string              `json:"stage"`
+	ParentStage string              `json:"parentStage,omitempty"`
+	Status      contracts.LogStatus `json:"status"`
+	Duration    *time.Duration      `json:"duration,omitempty"`
+}
+
+func (elh *endOfLifeHelper) SendStageEvent(ctx context.Context, stageName, parentStageName string, status contracts.LogStatus, duration *time.Duration) (err error) {
+
+	if elh.stageEventsURL == "" || elh.config.CIServer == nil || elh.config.JobName == nil {
+		return nil
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "SendStageEvent")
+	defer span.Finish()
+	span.SetTag("stage", stageName)
+	span.SetTag("stage-status", string(status))
+
+	jwt := elh.config.CIServer.JWT
+	jobName := *elh.config.JobName
+
+	data, err := json.Marshal(stageEvent{
+		JobName:     jobName,
+		PodName:     elh.podName,
+		Stage:       stageName,
+		ParentStage: parentStageName,
+		Status:      status,
+		Duration:    duration,
+	})
+	if err != nil {
+		return err
+	}
+
+	statusCode, _, err := postJSON(span, "POST", elh.stageEventsURL, jwt, jobName, data, elh.builderEventsTimeout, 3)
+	if err != nil {
+		return err
+	}
+
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("Sending stage event for stage %v to %v responded with status code %v", stageName, redactURL(elh.stageEventsURL), statusCode)
+	}
+
+	return nil
+}
+
+// EnableIncrementalLogs makes the job send the log lines of running stages to incrementalLogsURL while they run, so partial logs survive the pod getting killed
+func (elh *endOfLifeHelper) EnableIncrementalLogs(incrementalLogsURL string) {
+	elh.incrementalLogsURL = incrementalLogsURL
+}
+
+// incrementalLog is the body sent to the incremental logs url, holding the log lines of a stage since the previous flush
+type incrementalLog struct {
+	JobName     string                   `json:"jobName"`
+	PodName     string                   `json:"podName,omitempty"`
+	Stage       string                   `json:"stage"`
+	ParentStage string                   `json:"parentStage,omitempty"`
+	Type        contracts.LogType        `json:"type"`
+	LogLines    []contracts.BuildLogLine `json:"logLines"`
+}
+
+func (elh *endOfLifeHelper) SendIncrementalLog(ctx context.Context, stageName, parentStageName string, logType contracts.LogType, logLines []contracts.BuildLogLine) (err error) {
+
+	if elh.incrementalLogsURL == "" || elh.config.CIServer == nil || elh.config.JobName == nil || len(logLines) == 0 {
+		return nil
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "SendIncrementalLog")
+	defer span.Finish()
+	span.SetTag("stage", stageName)
+	span.SetTag("log-lines", len(logLines))
+
+	jwt := elh.config.CIServer.JWT
+	jobName := *elh.config.JobName
+
+	data, err := json.Marshal(incrementalLog{
+		JobName:     jobName,
+		PodName:     elh.podName,
+		Stage:       stageName,
+		ParentStage: parentStageName,
+		Type:        logType,
+		LogLines:    logLines,
+	})
+	if err != nil {
+		return err
+	}
+
+	// retry only once, lines that fail to send get sent again with the next flush
+	statusCode, _, err := postJSON(span, "POST", elh.incrementalLogsURL, jwt, jobName, data, elh.postLogsTimeout, 1)
+	if err != nil {
+		return err
+	}
+
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("Sending incremental log for stage %v to %v responded with status code %v", stageName, redactURL(elh.incrementalLogsURL), statusCode)
+	}
+
+	return nil
+}
+
+// EnableStatusBadge makes the job put its final status to statusBadgeURL, so external dashboards can render a badge
+func (elh *endOfLifeHelper) EnableStatusBadge(statusBadgeURL string) {
+	elh.statusBadgeURL = statusBadgeURL
+}
+
+// statusBadge is the body put to the status badge url
+type statusBadge struct {
+	Status    string    `json:"status"`
+	Version   string    `json:"version,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (elh *endOfLifeHelper) sendStatusBadge(ctx context.Context, buildStatus contracts.LogStatus) (err error) {
+
+	if elh.statusBadgeURL == "" {
+		return nil
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "SendStatusBadge")
+	defer span.Finish()
+	span.SetTag("build-status", buildStatus)
+
+	badge := statusBadge{
+		Status:    strings.ToLower(string(buildStatus)),
+		Timestamp: time.Now().UTC(),
+	}
+	if elh.config.Version != nil {
+		badge.Version = elh.config.Version.Version
+	}
+
+	data, err := json.Marshal(badge)
+	if err != nil {
+		return err
+	}
+
+	// the badge url is external to the ci server, so it doesn't get the job's jwt
+	statusCode, _, err := postJSON(span, "PUT", elh.statusBadgeURL, "", "", data, elh.builderEventsTimeout, 3)
+	if err != nil {
+		return err
+	}
+
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("Putting status badge to %v responded with status code %v", redactURL(elh.statusBadgeURL), statusCode)
+	}
+
+	return nil
+}
+
+// postJSON sends json data to requestURL with retries and tracing, authenticated with jwt and identified by jobName when set; besides the status code it returns the body of non-2xx responses, to explain a rejection
+func postJSON(span opentracing.Span, method, requestURL, jwt, jobName string, data []byte, timeout time.Duration, retries int) (statusCode int, body []byte, err error) {
+
+	// create client, in order to add headers
+	client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}, Timeout: timeout})
+	client.MaxRetries = retries
+	client.Backoff = pester.ExponentialJitterBackoff
+	client.KeepLog = true
+	request, err := http.NewRequest(method, requestURL, bytes.NewReader(data))
+	if err != nil {
+		log.Error().Err(redactURLsInError(err)).Msgf("Failed creating http client for job %v", jobName)
+		return 0, nil, redactURLsInError(err)
+	}
+
+	// add tracing context
+	request = request.WithContext(opentracing.ContextWithSpan(request.Context(), span))
+
+	// collect additional information on setting up connections
+	request, ht := nethttp.TraceRequest(span.Tracer(), request)
+
+	// add headers
+	if jobName != "" {
 		request.Header.Add("X-Ziplinee-Event-Job-Name", jobName)
+	}
+	if jwt != "" {
 		request.Header.Add("Authorization", fmt.Sprintf("Bearer %v", jwt))
+	}
+	request.Header.Add("Content-Type", "application/json")
 
-		// perform actual request
-		response, err := client.Do(request)
-		if err != nil {
-			span.SetTag("error", true)
-			span.LogFields(
-				tracingLog.String("error", err.Error()),
-			)
-			log.Error().Err(err).Str("pesterLogs", client.LogString()).Msgf("Failed performing http request to %v for job %v: %v", ciServerBuilderEventsURL, jobName, client.LogString())
-			return err
-		}
+	// perform actual request
+	response, err := client.Do(request)
+	if err != nil {
+		log.Error().Err(redactURLsInError(err)).Str("pesterLogs", redactURLsInText(client.LogString())).Msgf("Failed performing %v request to %v for job %v", method, redactURL(requestURL), jobName)
+		return 0, nil, redactURLsInError(err)
+	}
 
-		defer response.Body.Close()
-		ht.Finish()
+	defer response.Body.Close()
+	ht.Finish()
 
-		log.Debug().Str("pesterLogs", client.LogString()).Str("url", ciServerBuilderEventsURL).Msgf("Succesfully sent build event type '%v' to api", buildEventType)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		// a body that fails to read only leaves the rejection unexplained
+		body, _ = io.ReadAll(response.Body)
 	}
 
-	return nil
+	return response.StatusCode, body, nil
 }
 
 func (elh *endOfLifeHelper) CancelJob(ctx context.Context) error {
@@ -316,15 +948,14 @@ func (elh *endOfLifeHelper) CancelJob(ctx context.Context) error {
 	if ciServerBuilderCancelJobURL != "" && jwt != "" && jobName != "" {
 
 		// create client, in order to add headers
-		client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}})
+		client := pester.NewExtendedClient(&http.Client{Transport: &nethttp.Transport{}, Timeout: elh.cancelJobTimeout})
 		client.MaxRetries = 1
 		client.Backoff = pester.DefaultBackoff
 		client.KeepLog = true
-		client.Timeout = time.Second * 60
 		request, err := http.NewRequest("DELETE", ciServerBuilderCancelJobURL, nil)
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed creating http client for job %v", jobName)
-			return err
+			log.Error().Err(redactURLsInError(err)).Msgf("Failed creating http client for job %v", jobName)
+			return redactURLsInError(err)
 		}
 
 		// add tracing context
@@ -339,14 +970,14 @@ func (elh *endOfLifeHelper) CancelJob(ctx context.Context) error {
 		// perform actual request
 		response, err := client.Do(request)
 		if err != nil {
-			log.Error().Err(err).Str("logs", client.LogString()).Msgf("Failed canceling job at %v for job %v: %v", ciServerBuilderCancelJobURL, jobName, client.LogString())
-			return err
+			log.Error().Err(redactURLsInError(err)).Str("logs", redactURLsInText(client.LogString())).Msgf("Failed canceling job at %v for job %v: %v", redactURL(ciServerBuilderCancelJobURL), jobName, redactURLsInText(client.LogString()))
+			return redactURLsInError(err)
 		}
 
 		defer response.Body.Close()
 		ht.Finish()
 
-		log.Debug().Str("logs", client.LogString()).Msgf("Successfully canceled job at %v for job %v", ciServerBuilderCancelJobURL, jobName)
+		log.Debug().Str("logs", redactURLsInText(client.LogString())).Msgf("Successfully canceled job at %v for job %v", redactURL(ciServerBuilderCancelJobURL), jobName)
 	}
 
 	return nil
@@ -0,0 +1,1010 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+	foundation "github.com/ziplineeci/ziplinee-foundation"
+)
+
+func getEndOfLifeHelperConfig(serverURL string) contracts.BuilderConfig {
+	jobName := "build-ziplineeci-ziplinee-ci-builder-391855387650326531"
+	return contracts.BuilderConfig{
+		JobType: contracts.JobTypeBuild,
+		JobName: &jobName,
+		CIServer: &contracts.CIServerConfig{
+			BuilderEventsURL: serverURL + "/events",
+			PostLogsURL:      serverURL + "/logs",
+			CancelJobURL:     serverURL + "/cancel",
+			JWT:              "jwt",
+		},
+	}
+}
+
+func TestSendBuildJobLogEvent(t *testing.T) {
+
+	t.Run("IncludesBuildLogMetadataInShippedLogs", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.AddBuildLogMetadata("credentialsAudit", []CredentialsAuditEntry{
+			{
+				Stage:       "push",
+				Image:       "extensions/docker:stable",
+				Credentials: []string{"container-registry-ziplinee"},
+			},
+		})
+
+		// act
+		err := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+
+		assert.Nil(t, err)
+		var shippedLog struct {
+			RepoName string `json:"repoName"`
+			Metadata struct {
+				CredentialsAudit []CredentialsAuditEntry `json:"credentialsAudit"`
+			} `json:"metadata"`
+		}
+		err = json.Unmarshal(body, &shippedLog)
+		assert.Nil(t, err)
+		assert.Equal(t, "ziplinee-ci-builder", shippedLog.RepoName)
+		if assert.Equal(t, 1, len(shippedLog.Metadata.CredentialsAudit)) {
+			assert.Equal(t, "push", shippedLog.Metadata.CredentialsAudit[0].Stage)
+			assert.Equal(t, []string{"container-registry-ziplinee"}, shippedLog.Metadata.CredentialsAudit[0].Credentials)
+		}
+	})
+
+	t.Run("OmitsMetadataWhenNoneIsAdded", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+
+		// act
+		err := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+
+		assert.Nil(t, err)
+		assert.NotContains(t, string(body), "metadata")
+	})
+}
+
+func TestSetLogShippingFailurePolicy(t *testing.T) {
+
+	getServerFailingLogs := func(statuses *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/logs" {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			var sentEvent struct {
+				BuildEventType string `json:"buildEventType"`
+				Build          struct {
+					BuildStatus string `json:"buildStatus"`
+				} `json:"build"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&sentEvent)
+			*statuses = append(*statuses, fmt.Sprintf("%v:%v", sentEvent.BuildEventType, sentEvent.Build.BuildStatus))
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	getConfigWithBuild := func(serverURL string) contracts.BuilderConfig {
+		config := getEndOfLifeHelperConfig(serverURL)
+		config.Build = &contracts.Build{ID: "391855387650326531"}
+		return config
+	}
+
+	t.Run("KeepsBuildStatusWhenLogsCannotBeShippedByDefault", func(t *testing.T) {
+
+		statuses := []string{}
+		server := getServerFailingLogs(&statuses)
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getConfigWithBuild(server.URL), "pod")
+		_ = endOfLifeHelper.SendBuildFinishedEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		// act
+		err := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+		_ = endOfLifeHelper.SendBuildCleanEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"updateStatus:succeeded", "clean:succeeded"}, statuses)
+	})
+
+	t.Run("MarksBuildAsFailedWhenLogsCannotBeShippedWithFailPolicy", func(t *testing.T) {
+
+		statuses := []string{}
+		server := getServerFailingLogs(&statuses)
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getConfigWithBuild(server.URL), "pod")
+		endOfLifeHelper.SetLogShippingFailurePolicy("fail")
+		_ = endOfLifeHelper.SendBuildFinishedEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		// act
+		err := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+		_ = endOfLifeHelper.SendBuildCleanEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"updateStatus:succeeded", "updateStatus:failed", "clean:failed"}, statuses)
+	})
+
+	t.Run("KeepsBuildStatusWhenLogsAreShippedWithFailPolicy", func(t *testing.T) {
+
+		statuses := []string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/logs" {
+				statuses = append(statuses, r.URL.Path)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getConfigWithBuild(server.URL), "pod")
+		endOfLifeHelper.SetLogShippingFailurePolicy("fail")
+
+		// act
+		err := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+
+		assert.Nil(t, err)
+		assert.Empty(t, statuses)
+	})
+}
+
+func TestSetAdditionalAPIEndpoints(t *testing.T) {
+
+	getServer := func(statusCode int, requests *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests = append(*requests, fmt.Sprintf("%v %v", r.URL.Path, r.Header.Get("Authorization")))
+			w.WriteHeader(statusCode)
+		}))
+	}
+
+	t.Run("SendsBuilderEventsAndLogsToEveryEndpointWithItsOwnJWT", func(t *testing.T) {
+
+		primaryRequests := []string{}
+		primaryServer := getServer(http.StatusOK, &primaryRequests)
+		defer primaryServer.Close()
+		additionalRequests := []string{}
+		additionalServer := getServer(http.StatusOK, &additionalRequests)
+		defer additionalServer.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(primaryServer.URL), "pod")
+		endOfLifeHelper.SetAdditionalAPIEndpoints([]APIEndpoint{{BuilderEventsURL: additionalServer.URL + "/events", PostLogsURL: additionalServer.URL + "/logs", JWT: "additional-jwt"}}, "")
+
+		// act
+		eventErr := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+		logErr := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+
+		assert.Nil(t, eventErr)
+		assert.Nil(t, logErr)
+		assert.Equal(t, []string{"/events Bearer jwt", "/logs Bearer jwt"}, primaryRequests)
+		assert.Equal(t, []string{"/events Bearer additional-jwt", "/logs Bearer additional-jwt"}, additionalRequests)
+	})
+
+	t.Run("FailsWhenOneEndpointFailsByDefault", func(t *testing.T) {
+
+		primaryRequests := []string{}
+		primaryServer := getServer(http.StatusOK, &primaryRequests)
+		defer primaryServer.Close()
+		additionalRequests := []string{}
+		additionalServer := getServer(http.StatusForbidden, &additionalRequests)
+		defer additionalServer.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(primaryServer.URL), "pod")
+		endOfLifeHelper.SetAdditionalAPIEndpoints([]APIEndpoint{{BuilderEventsURL: additionalServer.URL + "/events", PostLogsURL: additionalServer.URL + "/logs", JWT: "additional-jwt"}}, "all")
+
+		// act
+		eventErr := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+		logErr := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+
+		assert.NotNil(t, eventErr)
+		assert.NotNil(t, logErr)
+		// failing to ship the logs retries them without the log lines of successful steps
+		assert.Equal(t, []string{"/events Bearer jwt", "/logs Bearer jwt", "/logs Bearer jwt"}, primaryRequests)
+		assert.Equal(t, []string{"/events Bearer additional-jwt", "/logs Bearer additional-jwt", "/logs Bearer additional-jwt"}, additionalRequests)
+	})
+
+	t.Run("SucceedsWhenOneEndpointSucceedsWithAnyPolicy", func(t *testing.T) {
+
+		primaryRequests := []string{}
+		primaryServer := getServer(http.StatusForbidden, &primaryRequests)
+		defer primaryServer.Close()
+		additionalRequests := []string{}
+		additionalServer := getServer(http.StatusOK, &additionalRequests)
+		defer additionalServer.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(primaryServer.URL), "pod")
+		endOfLifeHelper.SetAdditionalAPIEndpoints([]APIEndpoint{{BuilderEventsURL: additionalServer.URL + "/events", PostLogsURL: additionalServer.URL + "/logs", JWT: "additional-jwt"}}, "any")
+
+		// act
+		eventErr := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+		logErr := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{RepoName: "ziplinee-ci-builder"})
+
+		assert.Nil(t, eventErr)
+		assert.Nil(t, logErr)
+		assert.Equal(t, 2, len(primaryRequests))
+		assert.Equal(t, 2, len(additionalRequests))
+	})
+
+	t.Run("FailsWhenAllEndpointsFailWithAnyPolicy", func(t *testing.T) {
+
+		primaryRequests := []string{}
+		primaryServer := getServer(http.StatusForbidden, &primaryRequests)
+		defer primaryServer.Close()
+		additionalRequests := []string{}
+		additionalServer := getServer(http.StatusForbidden, &additionalRequests)
+		defer additionalServer.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(primaryServer.URL), "pod")
+		endOfLifeHelper.SetAdditionalAPIEndpoints([]APIEndpoint{{BuilderEventsURL: additionalServer.URL + "/events", PostLogsURL: additionalServer.URL + "/logs", JWT: "additional-jwt"}}, "any")
+
+		// act
+		err := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSendBuildStartedEvent(t *testing.T) {
+
+	t.Run("IncludesTagsInBuilderEvent", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetBuilderEventTags(map[string]string{"ticket": "ZPL-1393"})
+
+		// act
+		err := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+
+		assert.Nil(t, err)
+		var sentEvent struct {
+			JobName string            `json:"job_name"`
+			Tags    map[string]string `json:"tags"`
+		}
+		err = json.Unmarshal(body, &sentEvent)
+		assert.Nil(t, err)
+		assert.Equal(t, "build-ziplineeci-ziplinee-ci-builder-391855387650326531", sentEvent.JobName)
+		assert.Equal(t, map[string]string{"ticket": "ZPL-1393"}, sentEvent.Tags)
+	})
+
+	t.Run("OmitsTagsWhenNoneAreSet", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+
+		// act
+		err := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+
+		assert.Nil(t, err)
+		var sentEvent map[string]interface{}
+		err = json.Unmarshal(body, &sentEvent)
+		assert.Nil(t, err)
+		_, hasTags := sentEvent["tags"]
+		assert.False(t, hasTags)
+	})
+	t.Run("IncludesBuilderVersionInBuilderEvent", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetBuilderVersion(foundation.ApplicationInfo{
+			App:      "ziplinee-ci-builder",
+			Version:  "1.4.20",
+			Branch:   "main",
+			Revision: "a4b9d38",
+		})
+
+		// act
+		err := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+
+		assert.Nil(t, err)
+		var sentEvent struct {
+			Builder struct {
+				Version  string `json:"version"`
+				Branch   string `json:"branch"`
+				Revision string `json:"revision"`
+			} `json:"builder"`
+		}
+		err = json.Unmarshal(body, &sentEvent)
+		assert.Nil(t, err)
+		assert.Equal(t, "1.4.20", sentEvent.Builder.Version)
+		assert.Equal(t, "main", sentEvent.Builder.Branch)
+		assert.Equal(t, "a4b9d38", sentEvent.Builder.Revision)
+	})
+
+	t.Run("OmitsBuilderVersionWhenNotSet", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+
+		// act
+		err := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+
+		assert.Nil(t, err)
+		var sentEvent map[string]interface{}
+		err = json.Unmarshal(body, &sentEvent)
+		assert.Nil(t, err)
+		_, hasBuilder := sentEvent["builder"]
+		assert.False(t, hasBuilder)
+	})
+
+}
+
+func TestHandleFatal(t *testing.T) {
+
+	t.Run("ExitsWithZeroWhenRunningAsJobByDefault", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		exitCode := -1
+		endOfLifeHelper := NewEndOfLifeHelper(true, getEndOfLifeHelperConfig(server.URL), "pod").(*endOfLifeHelper)
+		endOfLifeHelper.exit = func(code int) { exitCode = code }
+
+		// act
+		endOfLifeHelper.HandleFatal(context.Background(), contracts.BuildLog{}, fmt.Errorf("Cannot connect to the Docker daemon"), "Error starting docker daemon")
+
+		assert.Equal(t, 0, exitCode)
+	})
+
+	t.Run("ExitsWithConfiguredExitCodeWhenRunningAsJob", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		exitCode := -1
+		endOfLifeHelper := NewEndOfLifeHelper(true, getEndOfLifeHelperConfig(server.URL), "pod").(*endOfLifeHelper)
+		endOfLifeHelper.exit = func(code int) { exitCode = code }
+		endOfLifeHelper.SetRunAsJobFatalExitCode(3)
+
+		// act
+		endOfLifeHelper.HandleFatal(context.Background(), contracts.BuildLog{}, fmt.Errorf("Cannot connect to the Docker daemon"), "Error starting docker daemon")
+
+		assert.Equal(t, 3, exitCode)
+	})
+}
+
+func TestSetHTTPTimeouts(t *testing.T) {
+
+	t.Run("AppliesPostLogsTimeoutToClient", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetHTTPTimeouts(20*time.Millisecond, 10*time.Second, 10*time.Second)
+
+		// act
+		err := endOfLifeHelper.SendBuildJobLogEvent(context.Background(), contracts.BuildLog{})
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("AppliesBuilderEventsTimeoutToClient", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetHTTPTimeouts(10*time.Second, 20*time.Millisecond, 10*time.Second)
+
+		// act
+		err := endOfLifeHelper.SendBuildStartedEvent(context.Background())
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("AppliesCancelJobTimeoutToClient", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetHTTPTimeouts(10*time.Second, 10*time.Second, 20*time.Millisecond)
+
+		// act
+		err := endOfLifeHelper.CancelJob(context.Background())
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("DefaultsToPreviousHardcodedTimeouts", func(t *testing.T) {
+
+		// act
+		helper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig("http://localhost"), "pod").(*endOfLifeHelper)
+
+		assert.Equal(t, 60*time.Second, helper.postLogsTimeout)
+		assert.Equal(t, 10*time.Second, helper.builderEventsTimeout)
+		assert.Equal(t, 60*time.Second, helper.cancelJobTimeout)
+	})
+}
+
+func TestSetCleanEventDelay(t *testing.T) {
+
+	t.Run("WaitsForDelayBeforeSendingCleanEvent", func(t *testing.T) {
+
+		var receivedAt time.Time
+		var buildEventType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedAt = time.Now()
+			var sentEvent contracts.ZiplineeCiBuilderEvent
+			_ = json.NewDecoder(r.Body).Decode(&sentEvent)
+			buildEventType = string(sentEvent.BuildEventType)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetCleanEventDelay(200 * time.Millisecond)
+		start := time.Now()
+
+		// act
+		err := endOfLifeHelper.SendBuildCleanEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		assert.Nil(t, err)
+		assert.Equal(t, string(contracts.BuildEventTypeClean), buildEventType)
+		assert.GreaterOrEqual(t, receivedAt.Sub(start), 200*time.Millisecond)
+	})
+
+	t.Run("SendsCleanEventRightAwayByDefault", func(t *testing.T) {
+
+		var receivedAt time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedAt = time.Now()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		start := time.Now()
+
+		// act
+		err := endOfLifeHelper.SendBuildCleanEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		assert.Nil(t, err)
+		assert.Less(t, receivedAt.Sub(start), 200*time.Millisecond)
+	})
+
+	t.Run("DoesNotDelayBuildFinishedEvent", func(t *testing.T) {
+
+		var receivedAt time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedAt = time.Now()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.SetCleanEventDelay(time.Second)
+		start := time.Now()
+
+		// act
+		err := endOfLifeHelper.SendBuildFinishedEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		assert.Nil(t, err)
+		assert.Less(t, receivedAt.Sub(start), time.Second)
+	})
+}
+
+func TestAcquireReleaseLease(t *testing.T) {
+
+	getReleaseConfig := func(serverURL string) contracts.BuilderConfig {
+		config := getEndOfLifeHelperConfig(serverURL)
+		config.JobType = contracts.JobTypeRelease
+		config.CIServer.BaseURL = serverURL
+		config.Git = &contracts.GitConfig{
+			RepoSource: "github.com",
+			RepoOwner:  "ziplineeci",
+			RepoName:   "ziplinee-ci-builder",
+		}
+		config.Release = &contracts.Release{
+			Name: "production",
+		}
+		return config
+	}
+
+	t.Run("ReturnsNoErrorWhenLeaseIsGranted", func(t *testing.T) {
+
+		var requestPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestPath = r.URL.EscapedPath()
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getReleaseConfig(server.URL), "pod")
+		endOfLifeHelper.EnableReleaseLease(false, time.Minute)
+
+		// act
+		err := endOfLifeHelper.AcquireReleaseLease(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, "/api/leases/github.com%2Fziplineeci%2Fziplinee-ci-builder%2Fproduction", requestPath)
+	})
+
+	t.Run("ReturnsErrorWhenLeaseIsDeniedAndNotWaiting", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getReleaseConfig(server.URL), "pod")
+		endOfLifeHelper.EnableReleaseLease(false, time.Minute)
+
+		// act
+		err := endOfLifeHelper.AcquireReleaseLease(context.Background())
+
+		assert.NotNil(t, err)
+		assert.Equal(t, "Release lease for github.com/ziplineeci/ziplinee-ci-builder/production is held by another job", err.Error())
+	})
+
+	t.Run("WaitsUntilLeaseIsGranted", func(t *testing.T) {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests < 3 {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := &endOfLifeHelper{
+			config:                   getReleaseConfig(server.URL),
+			releaseLeasePollInterval: 10 * time.Millisecond,
+		}
+		endOfLifeHelper.EnableReleaseLease(true, time.Minute)
+
+		// act
+		err := endOfLifeHelper.AcquireReleaseLease(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3, requests)
+	})
+
+	t.Run("ReturnsErrorWhenWaitingForLeaseTimesOut", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := &endOfLifeHelper{
+			config:                   getReleaseConfig(server.URL),
+			releaseLeasePollInterval: 10 * time.Millisecond,
+		}
+		endOfLifeHelper.EnableReleaseLease(true, 50*time.Millisecond)
+
+		// act
+		err := endOfLifeHelper.AcquireReleaseLease(context.Background())
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("DoesNotRequestLeaseForBuildJobs", func(t *testing.T) {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusConflict)
+		}))
+		defer server.Close()
+
+		config := getReleaseConfig(server.URL)
+		config.JobType = contracts.JobTypeBuild
+		endOfLifeHelper := NewEndOfLifeHelper(false, config, "pod")
+		endOfLifeHelper.EnableReleaseLease(false, time.Minute)
+
+		// act
+		err := endOfLifeHelper.AcquireReleaseLease(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, requests)
+	})
+}
+
+func TestRequestAdmission(t *testing.T) {
+
+	t.Run("ReturnsNoErrorWhenWebhookAdmitsBuild", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		config := getEndOfLifeHelperConfig(server.URL)
+		config.Stages = []*manifest.ZiplineeStage{
+			{Name: "build", ContainerImage: "golang:1.22"},
+		}
+		endOfLifeHelper := NewEndOfLifeHelper(false, config, "pod")
+		endOfLifeHelper.EnableAdmissionWebhook(server.URL + "/admission")
+
+		// act
+		err := endOfLifeHelper.RequestAdmission(context.Background())
+
+		assert.Nil(t, err)
+		assert.Contains(t, string(body), `"jobName":"build-ziplineeci-ziplinee-ci-builder-391855387650326531"`)
+		assert.Contains(t, string(body), `"golang:1.22"`)
+	})
+
+	t.Run("RedactsWebhookURLInErrorWhenWebhookDeniesBuild", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableAdmissionWebhook(server.URL + "/admission?token=abc123")
+
+		// act
+		err := endOfLifeHelper.RequestAdmission(context.Background())
+
+		if assert.NotNil(t, err) {
+			assert.NotContains(t, err.Error(), "abc123")
+			assert.Contains(t, err.Error(), server.URL+"/admission?token=***")
+		}
+	})
+
+	t.Run("ReturnsErrorWithWebhookMessageWhenWebhookDeniesBuild", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"image golang:1.22 is not on the allow list"}`))
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableAdmissionWebhook(server.URL + "/admission")
+
+		// act
+		err := endOfLifeHelper.RequestAdmission(context.Background())
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "status code 403")
+			assert.Contains(t, err.Error(), "image golang:1.22 is not on the allow list")
+		}
+	})
+
+	t.Run("ReturnsPlainTextBodyAsMessageWhenWebhookDeniesBuild", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte("releases to production are frozen\n"))
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableAdmissionWebhook(server.URL + "/admission")
+
+		// act
+		err := endOfLifeHelper.RequestAdmission(context.Background())
+
+		if assert.NotNil(t, err) {
+			assert.True(t, strings.HasSuffix(err.Error(), ": releases to production are frozen"))
+		}
+	})
+
+	t.Run("RedactsTokenQueryParameterOfWebhookURLInLogOutput", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		var output bytes.Buffer
+		originalLogger := log.Logger
+		log.Logger = zerolog.New(&output)
+		defer func() { log.Logger = originalLogger }()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableAdmissionWebhook(server.URL + "/admission?token=webhook-secret-token")
+
+		// act
+		err := endOfLifeHelper.RequestAdmission(context.Background())
+
+		assert.Nil(t, err)
+		assert.Contains(t, output.String(), "/admission?token=***")
+		assert.NotContains(t, output.String(), "webhook-secret-token")
+	})
+
+	t.Run("ReturnsNoErrorWithoutWebhook", func(t *testing.T) {
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig("http://localhost"), "pod")
+
+		// act
+		err := endOfLifeHelper.RequestAdmission(context.Background())
+
+		assert.Nil(t, err)
+	})
+}
+
+func TestSendStageEvent(t *testing.T) {
+
+	t.Run("SendsStageEventWhenEnabled", func(t *testing.T) {
+
+		var body []byte
+		var requestPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestPath = r.URL.Path
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableStageEvents(server.URL + "/stage-events")
+		duration := 3 * time.Second
+
+		// act
+		err := endOfLifeHelper.SendStageEvent(context.Background(), "unit-tests", "test", contracts.LogStatusSucceeded, &duration)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "/stage-events", requestPath)
+
+		var event stageEvent
+		err = json.Unmarshal(body, &event)
+		assert.Nil(t, err)
+		assert.Equal(t, "build-ziplineeci-ziplinee-ci-builder-391855387650326531", event.JobName)
+		assert.Equal(t, "unit-tests", event.Stage)
+		assert.Equal(t, "test", event.ParentStage)
+		assert.Equal(t, contracts.LogStatusSucceeded, event.Status)
+		assert.Equal(t, &duration, event.Duration)
+	})
+
+	t.Run("SendsPodNameResolvedByEnvvarHelper", func(t *testing.T) {
+
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		t.Setenv("POD_NAME", "ziplinee-ci-builder-abc12")
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.SetPodName("ziplinee-ci-builder-def34")
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), envvarHelper.GetPodName())
+		endOfLifeHelper.EnableStageEvents(server.URL + "/stage-events")
+
+		// act
+		err := endOfLifeHelper.SendStageEvent(context.Background(), "build", "", contracts.LogStatusRunning, nil)
+
+		assert.Nil(t, err)
+
+		var event stageEvent
+		err = json.Unmarshal(body, &event)
+		assert.Nil(t, err)
+		assert.Equal(t, envvarHelper.GetPodName(), event.PodName)
+		assert.Equal(t, "ziplinee-ci-builder-def34", event.PodName)
+	})
+
+	t.Run("RedactsStageEventsURLInErrorWhenRequestIsRejected", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableStageEvents(server.URL + "/stage-events?token=abc123")
+
+		// act
+		err := endOfLifeHelper.SendStageEvent(context.Background(), "build", "", contracts.LogStatusRunning, nil)
+
+		if assert.NotNil(t, err) {
+			assert.NotContains(t, err.Error(), "abc123")
+			assert.Contains(t, err.Error(), server.URL+"/stage-events?token=***")
+		}
+	})
+
+	t.Run("SendsNothingWhenNotEnabled", func(t *testing.T) {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+
+		// act
+		err := endOfLifeHelper.SendStageEvent(context.Background(), "build", "", contracts.LogStatusRunning, nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, requests)
+	})
+}
+
+func TestSendIncrementalLog(t *testing.T) {
+
+	t.Run("SendsLogLinesOfStageWhenEnabled", func(t *testing.T) {
+
+		var body []byte
+		var requestPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestPath = r.URL.Path
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableIncrementalLogs(server.URL + "/incremental-logs")
+		logLines := []contracts.BuildLogLine{{LineNumber: 1, StreamType: "stdout", Text: "ok  github.com/ziplineeci/ziplinee-ci-builder"}}
+
+		// act
+		err := endOfLifeHelper.SendIncrementalLog(context.Background(), "unit-tests", "test", contracts.LogTypeStage, logLines)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "/incremental-logs", requestPath)
+
+		var sentLog incrementalLog
+		err = json.Unmarshal(body, &sentLog)
+		assert.Nil(t, err)
+		assert.Equal(t, "build-ziplineeci-ziplinee-ci-builder-391855387650326531", sentLog.JobName)
+		assert.Equal(t, "pod", sentLog.PodName)
+		assert.Equal(t, "unit-tests", sentLog.Stage)
+		assert.Equal(t, "test", sentLog.ParentStage)
+		assert.Equal(t, contracts.LogTypeStage, sentLog.Type)
+		assert.Equal(t, logLines, sentLog.LogLines)
+	})
+
+	t.Run("ReturnsErrorWhenResponseIsNotSuccessful", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableIncrementalLogs(server.URL + "/incremental-logs")
+
+		// act
+		err := endOfLifeHelper.SendIncrementalLog(context.Background(), "build", "", contracts.LogTypeStage, []contracts.BuildLogLine{{LineNumber: 1, Text: "building"}})
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("SendsNothingWhenNotEnabled", func(t *testing.T) {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+
+		// act
+		err := endOfLifeHelper.SendIncrementalLog(context.Background(), "build", "", contracts.LogTypeStage, []contracts.BuildLogLine{{LineNumber: 1, Text: "building"}})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, requests)
+	})
+}
+
+func TestSendStatusBadge(t *testing.T) {
+
+	t.Run("PutsFinalStatusToStatusBadgeURLWhenEnabled", func(t *testing.T) {
+
+		var method string
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/badge" {
+				method = r.Method
+				body, _ = io.ReadAll(r.Body)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		config := getEndOfLifeHelperConfig(server.URL)
+		config.Version = &contracts.VersionConfig{
+			Version: "1.2.3",
+		}
+		endOfLifeHelper := NewEndOfLifeHelper(false, config, "pod")
+		endOfLifeHelper.EnableStatusBadge(server.URL + "/badge")
+
+		// act
+		err := endOfLifeHelper.SendBuildFinishedEvent(context.Background(), contracts.LogStatusFailed)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "PUT", method)
+
+		var badge statusBadge
+		err = json.Unmarshal(body, &badge)
+		assert.Nil(t, err)
+		assert.Equal(t, "failed", badge.Status)
+		assert.Equal(t, "1.2.3", badge.Version)
+		assert.False(t, badge.Timestamp.IsZero())
+	})
+
+	t.Run("DoesNotFailBuildFinishedEventWhenStatusBadgeFails", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/badge" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		endOfLifeHelper := NewEndOfLifeHelper(false, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableStatusBadge(server.URL + "/badge")
+
+		// act
+		err := endOfLifeHelper.SendBuildFinishedEvent(context.Background(), contracts.LogStatusSucceeded)
+
+		assert.Nil(t, err)
+	})
+}
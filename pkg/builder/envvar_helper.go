@@ -1,10 +1,14 @@
 package builder
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -43,19 +47,29 @@ type EnvvarHelper interface {
 	unsetZiplineeEnv(string) error
 	getZiplineeEnvvarName(string) string
 	OverrideEnvvars(...map[string]string) map[string]string
+	SetDefaultEnvvars(defaultEnvvars map[string]string)
 	decryptSecret(string, string) string
 	decryptSecrets(map[string]string, string) map[string]string
 	GetCiServer() string
 	SetPipelineName(builderConfig contracts.BuilderConfig) error
 	GetPipelineName() string
 	GetWorkDir() string
+	EnableWorkDirFallback()
 	GetTempDir() string
 	GetPodName() string
+	SetPodName(podName string)
 	GetPodUID() string
 	GetPodNamespace() string
 	GetPodNodeName() string
 	makeDNSLabelSafe(string) string
 
+	EnableGitDirectoryParsing()
+	SetGitCloneOptions(depth int, lfs bool)
+	SetGitRemote(remote string)
+	EnableDNSLabelHashing()
+	initGitCloneOptions() error
+	initCPUCount() error
+
 	getGitOrigin() (string, error)
 	getSourceFromOrigin(string) string
 	getOwnerFromOrigin(string) string
@@ -69,10 +83,34 @@ type envvarHelper struct {
 	tempDir      string
 	secretHelper crypt.SecretHelper
 	obfuscator   Obfuscator
+
+	parseGitDirectory bool
+	gitDir            string
+	gitRemote         string
+
+	gitCloneDepth int
+	gitLFS        bool
+
+	hashDNSLabels bool
+
+	podName string
+
+	workDirFallback bool
+
+	cgroupRoot string
+
+	defaultEnvvars map[string]string
+
+	runCommand func(name string, arg ...string) ([]byte, error)
 }
 
 // NewEnvvarHelper returns a new EnvvarHelper
-func NewEnvvarHelper(prefix string, secretHelper crypt.SecretHelper, obfuscator Obfuscator) EnvvarHelper {
+func NewEnvvarHelper(prefix string, secretHelper crypt.SecretHelper, obfuscator Obfuscator) (EnvvarHelper, error) {
+	prefix, err := normalizeEnvvarPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
 	return &envvarHelper{
 		prefix:       prefix,
 		ciServer:     os.Getenv("ZIPLINEE_CI_SERVER"),
@@ -80,19 +118,96 @@ func NewEnvvarHelper(prefix string, secretHelper crypt.SecretHelper, obfuscator
 		tempDir:      os.Getenv("ZIPLINEE_TEMPDIR"),
 		secretHelper: secretHelper,
 		obfuscator:   obfuscator,
+		gitDir:       ".git",
+		gitRemote:    "origin",
+		cgroupRoot:   "/sys/fs/cgroup",
+		runCommand:   runCommand,
+	}, nil
+}
+
+var envvarPrefixRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// normalizeEnvvarPrefix checks the prefix replacing ZIPLINEE_ in envvar names only has characters valid in envvar names and adds a trailing underscore if it's missing
+func normalizeEnvvarPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", fmt.Errorf("Envvar prefix can't be empty")
 	}
+	if !envvarPrefixRegex.MatchString(prefix) {
+		return "", fmt.Errorf("Envvar prefix %v is invalid, it should start with a letter or underscore and only contain letters, digits and underscores", prefix)
+	}
+	if !strings.HasSuffix(prefix, "_") {
+		prefix += "_"
+	}
+
+	return prefix, nil
+}
+
+func (h *envvarHelper) EnableGitDirectoryParsing() {
+	h.parseGitDirectory = true
+}
+
+// SetGitCloneOptions sets the clone depth and whether to fetch lfs files, for the checkout to pick up through ZIPLINEE_GIT_CLONE_DEPTH and ZIPLINEE_GIT_LFS
+func (h *envvarHelper) SetGitCloneOptions(depth int, lfs bool) {
+	h.gitCloneDepth = depth
+	h.gitLFS = lfs
+}
+
+// SetGitRemote sets the name of the git remote to read the repository source, owner and name from, for checkouts where it isn't origin; an empty name keeps origin
+func (h *envvarHelper) SetGitRemote(remote string) {
+	if remote == "" {
+		return
+	}
+	h.gitRemote = remote
+}
+
+// EnableDNSLabelHashing makes makeDNSLabelSafe append a short hash of the original value when it has to truncate, so long values sharing the same first 63 characters don't collide
+func (h *envvarHelper) EnableDNSLabelHashing() {
+	h.hashDNSLabels = true
+}
+
+// errGitUnavailable is returned for git commands when git isn't installed or the working directory isn't a git repository, like for builds from a tarball
+var errGitUnavailable = errors.New("git is not available")
+
+func runCommand(name string, arg ...string) ([]byte, error) {
+	return exec.Command(name, arg...).Output()
 }
 
 func (h *envvarHelper) getCommandOutput(name string, arg ...string) (string, error) {
 
-	out, err := exec.Command(name, arg...).Output()
+	out, err := h.runCommand(name, arg...)
 	if err != nil {
+		if name == "git" && isGitUnavailableError(err) {
+			return "", fmt.Errorf("%w: %v", errGitUnavailable, err)
+		}
 		return "", err
 	}
 
 	return strings.TrimSpace(string(out)), nil
 }
 
+func isGitUnavailableError(err error) bool {
+	if errors.Is(err, exec.ErrNotFound) {
+		return true
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && strings.Contains(strings.ToLower(string(exitErr.Stderr)), "not a git repository") {
+		return true
+	}
+
+	return false
+}
+
+// skipIfGitUnavailable treats git being unavailable as a soft condition, leaving the envvar unset with a warning instead of failing the build
+func skipIfGitUnavailable(err error, envvar string) error {
+	if errors.Is(err, errGitUnavailable) {
+		log.Warn().Err(err).Msgf("Leaving %v unset, because git is not available", envvar)
+		return nil
+	}
+
+	return err
+}
+
 func (h *envvarHelper) SetZiplineeGlobalEnvvars() (err error) {
 
 	// initialize build datetime envvar
@@ -107,6 +222,18 @@ func (h *envvarHelper) SetZiplineeGlobalEnvvars() (err error) {
 		return err
 	}
 
+	// initialize git clone options envvars
+	err = h.initGitCloneOptions()
+	if err != nil {
+		return err
+	}
+
+	// initialize cpu count envvar
+	err = h.initCPUCount()
+	if err != nil {
+		return err
+	}
+
 	// remaining envvars are only set for gocd agent runs
 	if h.ciServer != "gocd" {
 		return
@@ -346,14 +473,23 @@ func (h *envvarHelper) setZiplineeEventEnvvars(events []manifest.ZiplineeEvent)
 }
 
 func (h *envvarHelper) getGitOrigin() (string, error) {
-	return h.getCommandOutput("git", "config", "--get", "remote.origin.url")
+	remoteURLKey := fmt.Sprintf("remote.%v.url", h.gitRemote)
+	origin, err := h.getCommandOutput("git", "config", "--get", remoteURLKey)
+
+	// git config exits with 1 without any output if the key isn't set, like outside a git repository
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(exitErr.Stderr) == 0 {
+		return "", fmt.Errorf("%w: %v is not set", errGitUnavailable, remoteURLKey)
+	}
+
+	return origin, err
 }
 
 func (h *envvarHelper) initGitSource() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_GIT_SOURCE") == "" {
 		origin, err := h.getGitOrigin()
 		if err != nil {
-			return err
+			return skipIfGitUnavailable(err, "ZIPLINEE_GIT_SOURCE")
 		}
 		source := h.getSourceFromOrigin(origin)
 		return h.setZiplineeEnv("ZIPLINEE_GIT_SOURCE", source)
@@ -365,7 +501,7 @@ func (h *envvarHelper) initGitOwner() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_GIT_OWNER") == "" {
 		origin, err := h.getGitOrigin()
 		if err != nil {
-			return err
+			return skipIfGitUnavailable(err, "ZIPLINEE_GIT_OWNER")
 		}
 		owner := h.getOwnerFromOrigin(origin)
 		return h.setZiplineeEnv("ZIPLINEE_GIT_OWNER", owner)
@@ -377,7 +513,7 @@ func (h *envvarHelper) initGitName() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_GIT_NAME") == "" {
 		origin, err := h.getGitOrigin()
 		if err != nil {
-			return err
+			return skipIfGitUnavailable(err, "ZIPLINEE_GIT_NAME")
 		}
 		name := h.getNameFromOrigin(origin)
 		return h.setZiplineeEnv("ZIPLINEE_GIT_NAME", name)
@@ -389,7 +525,7 @@ func (h *envvarHelper) initGitFullName() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_GIT_FULLNAME") == "" {
 		origin, err := h.getGitOrigin()
 		if err != nil {
-			return err
+			return skipIfGitUnavailable(err, "ZIPLINEE_GIT_FULLNAME")
 		}
 		owner := h.getOwnerFromOrigin(origin)
 		name := h.getNameFromOrigin(origin)
@@ -488,9 +624,17 @@ func (h *envvarHelper) getNameFromOrigin(origin string) string {
 
 func (h *envvarHelper) initGitRevision() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_GIT_REVISION") == "" {
+		if h.parseGitDirectory {
+			revision, _, err := readGitHead(h.gitDir)
+			if err != nil {
+				return err
+			}
+			return h.setZiplineeEnv("ZIPLINEE_GIT_REVISION", revision)
+		}
+
 		revision, err := h.getCommandOutput("git", "rev-parse", "HEAD")
 		if err != nil {
-			return err
+			return skipIfGitUnavailable(err, "ZIPLINEE_GIT_REVISION")
 		}
 		return h.setZiplineeEnv("ZIPLINEE_GIT_REVISION", revision)
 	}
@@ -499,15 +643,92 @@ func (h *envvarHelper) initGitRevision() (err error) {
 
 func (h *envvarHelper) initGitBranch() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_GIT_BRANCH") == "" {
+		if h.parseGitDirectory {
+			_, branch, err := readGitHead(h.gitDir)
+			if err != nil {
+				return err
+			}
+			return h.setZiplineeEnv("ZIPLINEE_GIT_BRANCH", branch)
+		}
+
 		branch, err := h.getCommandOutput("git", "rev-parse", "--abbrev-ref", "HEAD")
 		if err != nil {
-			return err
+			return skipIfGitUnavailable(err, "ZIPLINEE_GIT_BRANCH")
 		}
 		return h.setZiplineeEnv("ZIPLINEE_GIT_BRANCH", branch)
 	}
 	return
 }
 
+// readGitHead derives the revision and branch from the .git directory the same way as git rev-parse, so the git binary isn't needed; for a detached head the branch is HEAD
+func readGitHead(gitDir string) (revision, branch string, err error) {
+
+	// in worktrees and submodules .git is a file pointing to the actual git directory
+	if info, statErr := os.Stat(gitDir); statErr == nil && !info.IsDir() {
+		data, err := os.ReadFile(gitDir)
+		if err != nil {
+			return "", "", err
+		}
+		pointer := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(pointer, "gitdir:") {
+			return "", "", fmt.Errorf("File %v does not point to a git directory", gitDir)
+		}
+		pointedGitDir := strings.TrimSpace(strings.TrimPrefix(pointer, "gitdir:"))
+		if !filepath.IsAbs(pointedGitDir) {
+			pointedGitDir = filepath.Join(filepath.Dir(gitDir), pointedGitDir)
+		}
+		gitDir = pointedGitDir
+	}
+
+	// a worktree's git directory only holds its own HEAD, the branches and packed-refs live in the common directory of the repository
+	commonDir := gitDir
+	commonDirBytes, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err == nil {
+		commonDir = strings.TrimSpace(string(commonDirBytes))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	headBytes, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	head := strings.TrimSpace(string(headBytes))
+
+	if !strings.HasPrefix(head, "ref:") {
+		// detached head contains the revision itself
+		return head, "HEAD", nil
+	}
+
+	ref := strings.TrimSpace(strings.TrimPrefix(head, "ref:"))
+	branch = strings.TrimPrefix(ref, "refs/heads/")
+
+	refBytes, err := os.ReadFile(filepath.Join(commonDir, filepath.FromSlash(ref)))
+	if err == nil {
+		return strings.TrimSpace(string(refBytes)), branch, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	// after git gc refs are stored in packed-refs instead of a file per ref
+	packedRefsBytes, err := os.ReadFile(filepath.Join(commonDir, "packed-refs"))
+	if err != nil {
+		return "", "", fmt.Errorf("Ref %v not found in %v: %w", ref, commonDir, err)
+	}
+	for _, line := range strings.Split(string(packedRefsBytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], branch, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("Ref %v not found in %v", ref, gitDir)
+}
+
 func (h *envvarHelper) initBuildDatetime() (err error) {
 	if h.getZiplineeEnv("ZIPLINEE_BUILD_DATETIME") == "" {
 		return h.setZiplineeEnv("ZIPLINEE_BUILD_DATETIME", time.Now().UTC().Format(time.RFC3339))
@@ -519,6 +740,30 @@ func (h *envvarHelper) initBuildStatus() (err error) {
 	return h.setZiplineeEnv("ZIPLINEE_BUILD_STATUS", "succeeded")
 }
 
+func (h *envvarHelper) initGitCloneOptions() (err error) {
+	// a depth of 0 means a full clone, so leave it to the checkout's default
+	if h.gitCloneDepth > 0 {
+		err = h.setZiplineeEnv("ZIPLINEE_GIT_CLONE_DEPTH", strconv.Itoa(h.gitCloneDepth))
+		if err != nil {
+			return
+		}
+	}
+
+	if h.gitLFS {
+		err = h.setZiplineeEnv("ZIPLINEE_GIT_LFS", "true")
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// initCPUCount sets ZIPLINEE_CPU_COUNT to the number of cpus available within the cgroup limits of the pod, for tools in stages to size their thread pools
+func (h *envvarHelper) initCPUCount() (err error) {
+	return h.setZiplineeEnv("ZIPLINEE_CPU_COUNT", strconv.Itoa(getEffectiveCPUCount(h.cgroupRoot)))
+}
+
 func (h *envvarHelper) initLabels(m manifest.ZiplineeManifest) (err error) {
 
 	// set labels as envvars
@@ -628,6 +873,9 @@ func (h *envvarHelper) getZiplineeEnvvarName(key string) string {
 func (h *envvarHelper) OverrideEnvvars(envvarMaps ...map[string]string) (envvars map[string]string) {
 
 	envvars = make(map[string]string)
+	for k, v := range h.defaultEnvvars {
+		envvars[k] = v
+	}
 	for _, envvarMap := range envvarMaps {
 		for k, v := range envvarMap {
 			envvars[k] = v
@@ -637,6 +885,11 @@ func (h *envvarHelper) OverrideEnvvars(envvarMaps ...map[string]string) (envvars
 	return
 }
 
+// SetDefaultEnvvars sets envvars like proxy settings and mirror urls for every stage and service, with the lowest precedence so the manifest can override them
+func (h *envvarHelper) SetDefaultEnvvars(defaultEnvvars map[string]string) {
+	h.defaultEnvvars = defaultEnvvars
+}
+
 func (h *envvarHelper) decryptSecret(encryptedValue, pipeline string) (decryptedValue string) {
 
 	decryptedValue, err := h.secretHelper.DecryptAllEnvelopes(encryptedValue, pipeline)
@@ -668,17 +921,41 @@ func (h *envvarHelper) GetCiServer() string {
 }
 
 func (h *envvarHelper) GetWorkDir() string {
+	if h.workDir == "" && h.workDirFallback {
+		workDir, err := os.Getwd()
+		if err != nil {
+			log.Warn().Err(err).Msg("Environment variable ZIPLINEE_WORKDIR is not set and getting the current directory failed")
+			return ""
+		}
+		log.Warn().Msgf("Environment variable ZIPLINEE_WORKDIR is not set, falling back to the current directory %v", workDir)
+		return workDir
+	}
+
 	return h.workDir
 }
 
+// EnableWorkDirFallback makes GetWorkDir fall back to the current directory when ZIPLINEE_WORKDIR isn't set, for integrations that run the builder from within the work directory
+func (h *envvarHelper) EnableWorkDirFallback() {
+	h.workDirFallback = true
+}
+
 func (h *envvarHelper) GetTempDir() string {
 	return h.tempDir
 }
 
+// GetPodName returns the pod name set with SetPodName, falling back to the POD_NAME envvar
 func (h *envvarHelper) GetPodName() string {
+	if h.podName != "" {
+		return h.podName
+	}
 	return os.Getenv("POD_NAME")
 }
 
+// SetPodName overrides the POD_NAME envvar with the pod name passed to the builder with the --pod-name flag
+func (h *envvarHelper) SetPodName(podName string) {
+	h.podName = podName
+}
+
 func (h *envvarHelper) GetPodUID() string {
 	return os.Getenv("POD_UID")
 }
@@ -692,6 +969,8 @@ func (h *envvarHelper) GetPodNodeName() string {
 }
 
 func (h *envvarHelper) makeDNSLabelSafe(value string) string {
+	originalValue := value
+
 	// in order for the label to be used as a dns label (part between dots) it should only use
 	// lowercase letters, digits and hyphens and have a max length of 63 characters;
 	// also it should start with a letter and not end in a hyphen
@@ -714,7 +993,13 @@ func (h *envvarHelper) makeDNSLabelSafe(value string) string {
 	value = reg.ReplaceAllString(value, "")
 
 	if len(value) > 63 {
-		value = value[:63]
+		if h.hashDNSLabels {
+			// keep truncated values unique by replacing their tail with a hash of the original value
+			hash := sha256.Sum256([]byte(originalValue))
+			value = strings.TrimRight(value[:54], "-") + "-" + hex.EncodeToString(hash[:])[:8]
+		} else {
+			value = value[:63]
+		}
 	}
 
 	// trim hyphens from start and end
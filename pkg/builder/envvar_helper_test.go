@@ -1,7 +1,11 @@
 package builder
 
 import (
+	"errors"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -45,6 +49,48 @@ func TestOverrideEnvvars(t *testing.T) {
 		assert.Equal(t, 1, len(envvars))
 		assert.Equal(t, "value2", envvars["ENVVAR1"])
 	})
+
+	t.Run("AppliesDefaultEnvvarsNotSetInPassedMaps", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.SetDefaultEnvvars(map[string]string{
+			"HTTPS_PROXY": "http://proxy:3128",
+		})
+		globalEnvvars := map[string]string{
+			"ENVVAR1": "value1",
+		}
+		stageEnvvars := map[string]string{
+			"ENVVAR2": "value2",
+		}
+
+		// act
+		envvars := envvarHelper.OverrideEnvvars(globalEnvvars, stageEnvvars)
+
+		assert.Equal(t, 3, len(envvars))
+		assert.Equal(t, "http://proxy:3128", envvars["HTTPS_PROXY"])
+	})
+
+	t.Run("OverridesDefaultEnvvarsWithGlobalAndStageEnvvars", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.SetDefaultEnvvars(map[string]string{
+			"HTTPS_PROXY":  "http://proxy:3128",
+			"NPM_REGISTRY": "https://mirror/npm",
+		})
+		globalEnvvars := map[string]string{
+			"HTTPS_PROXY": "http://other-proxy:3128",
+		}
+		stageEnvvars := map[string]string{
+			"NPM_REGISTRY": "https://registry.npmjs.org",
+		}
+
+		// act
+		envvars := envvarHelper.OverrideEnvvars(globalEnvvars, stageEnvvars)
+
+		assert.Equal(t, 2, len(envvars))
+		assert.Equal(t, "http://other-proxy:3128", envvars["HTTPS_PROXY"])
+		assert.Equal(t, "https://registry.npmjs.org", envvars["NPM_REGISTRY"])
+	})
 }
 
 func TestGetZiplineeEnvvarName(t *testing.T) {
@@ -479,6 +525,398 @@ func TestMakeDNSLabelSafe(t *testing.T) {
 
 		assert.Equal(t, "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghij", safeValue)
 	})
+
+	t.Run("ReturnsSameLabelForLongValuesWithSameFirst63CharactersByDefault", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+
+		// act
+		safeValueA := envvarHelper.makeDNSLabelSafe("feature/improve-the-performance-of-the-pipeline-runner-for-parallel-stages")
+		safeValueB := envvarHelper.makeDNSLabelSafe("feature/improve-the-performance-of-the-pipeline-runner-for-parallel-services")
+
+		assert.Equal(t, safeValueA, safeValueB)
+	})
+
+	t.Run("ReturnsDistinctLabelsForLongValuesWithSameFirst63CharactersWhenHashingIsEnabled", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.EnableDNSLabelHashing()
+
+		// act
+		safeValueA := envvarHelper.makeDNSLabelSafe("feature/improve-the-performance-of-the-pipeline-runner-for-parallel-stages")
+		safeValueB := envvarHelper.makeDNSLabelSafe("feature/improve-the-performance-of-the-pipeline-runner-for-parallel-services")
+
+		assert.NotEqual(t, safeValueA, safeValueB)
+		assert.Equal(t, 63, len(safeValueA))
+		assert.Equal(t, 63, len(safeValueB))
+		assert.True(t, strings.HasPrefix(safeValueA, "feature-improve-the-performance-of-the-pipeline-runner-"))
+		assert.Regexp(t, "^[a-z][a-z0-9-]*[a-z0-9]$", safeValueA)
+	})
+
+	t.Run("ReturnsUnhashedLabelForShortValueWhenHashingIsEnabled", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.EnableDNSLabelHashing()
+
+		// act
+		safeValue := envvarHelper.makeDNSLabelSafe("feature/short-branch")
+
+		assert.Equal(t, "feature-short-branch", safeValue)
+	})
+}
+
+func TestReadGitHead(t *testing.T) {
+
+	t.Run("ReturnsRevisionAndBranchForBranchCheckout", func(t *testing.T) {
+
+		gitDir := createGitDirectoryFixture(t, "ref: refs/heads/main\n", map[string]string{
+			"refs/heads/main": "9d41b3d1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6\n",
+		})
+
+		// act
+		revision, branch, err := readGitHead(gitDir)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "9d41b3d1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6", revision)
+		assert.Equal(t, "main", branch)
+	})
+
+	t.Run("ReturnsRevisionAndBranchForBranchWithSlashes", func(t *testing.T) {
+
+		gitDir := createGitDirectoryFixture(t, "ref: refs/heads/feature/git-parsing\n", map[string]string{
+			"refs/heads/feature/git-parsing": "0011f4e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6\n",
+		})
+
+		// act
+		revision, branch, err := readGitHead(gitDir)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "0011f4e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6", revision)
+		assert.Equal(t, "feature/git-parsing", branch)
+	})
+
+	t.Run("ReturnsRevisionFromPackedRefsIfRefFileDoesNotExist", func(t *testing.T) {
+
+		gitDir := createGitDirectoryFixture(t, "ref: refs/heads/main\n", map[string]string{
+			"packed-refs": "# pack-refs with: peeled fully-peeled sorted \n" +
+				"26fba86e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f refs/heads/develop\n" +
+				"7644904e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f refs/heads/main\n",
+		})
+
+		// act
+		revision, branch, err := readGitHead(gitDir)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "7644904e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f", revision)
+		assert.Equal(t, "main", branch)
+	})
+
+	t.Run("ReturnsRevisionAndHeadAsBranchForDetachedHead", func(t *testing.T) {
+
+		gitDir := createGitDirectoryFixture(t, "f4815ab1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6\n", map[string]string{})
+
+		// act
+		revision, branch, err := readGitHead(gitDir)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "f4815ab1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6", revision)
+		assert.Equal(t, "HEAD", branch)
+	})
+
+	t.Run("FollowsGitDirFileOfWorktree", func(t *testing.T) {
+
+		// a worktree has its own HEAD in .git/worktrees/<name>, while the branches are in the main git directory
+		gitDir := createGitDirectoryFixture(t, "ref: refs/heads/main\n", map[string]string{
+			"refs/heads/main":             "0123456789abcdef0123456789abcdef01234567\n",
+			"refs/heads/feature":          "9f44de01b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6\n",
+			"worktrees/feature/HEAD":      "ref: refs/heads/feature\n",
+			"worktrees/feature/commondir": "../..\n",
+		})
+		gitFile := filepath.Join(t.TempDir(), ".git")
+		err := os.WriteFile(gitFile, []byte("gitdir: "+filepath.Join(gitDir, "worktrees", "feature")+"\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		revision, branch, err := readGitHead(gitFile)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "9f44de01b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6", revision)
+		assert.Equal(t, "feature", branch)
+	})
+
+	t.Run("ReadsPackedRefsFromCommonDirOfWorktree", func(t *testing.T) {
+
+		gitDir := createGitDirectoryFixture(t, "ref: refs/heads/main\n", map[string]string{
+			"packed-refs":                 "# pack-refs with: peeled fully-peeled sorted\n9f44de01b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6 refs/heads/feature\n",
+			"worktrees/feature/HEAD":      "ref: refs/heads/feature\n",
+			"worktrees/feature/commondir": "../..\n",
+		})
+		gitFile := filepath.Join(t.TempDir(), ".git")
+		err := os.WriteFile(gitFile, []byte("gitdir: "+filepath.Join(gitDir, "worktrees", "feature")+"\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		revision, branch, err := readGitHead(gitFile)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "9f44de01b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6", revision)
+		assert.Equal(t, "feature", branch)
+	})
+
+	t.Run("ReturnsErrorIfRefDoesNotExist", func(t *testing.T) {
+
+		gitDir := createGitDirectoryFixture(t, "ref: refs/heads/main\n", map[string]string{})
+
+		// act
+		_, _, err := readGitHead(gitDir)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestInitGitRevisionAndBranch(t *testing.T) {
+
+	t.Run("SetsRevisionAndBranchFromGitDirectoryWhenEnabled", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		defer helper.UnsetZiplineeEnvvars()
+		helper.EnableGitDirectoryParsing()
+		helper.(*envvarHelper).gitDir = createGitDirectoryFixture(t, "ref: refs/heads/main\n", map[string]string{
+			"refs/heads/main": "c48f70e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6\n",
+		})
+
+		// act
+		err := helper.initGitRevision()
+		assert.Nil(t, err)
+		err = helper.initGitBranch()
+		assert.Nil(t, err)
+
+		assert.Equal(t, "c48f70e1b1a2f6c3e0a4a9c5e8a0f1b2c3d4e5f6", helper.getZiplineeEnv("ZIPLINEE_GIT_REVISION"))
+		assert.Equal(t, "main", helper.getZiplineeEnv("ZIPLINEE_GIT_BRANCH"))
+	})
+}
+
+// createGitDirectoryFixture creates a minimal .git directory with the HEAD file and any additional files
+func createGitDirectoryFixture(t *testing.T, head string, files map[string]string) string {
+	gitDir := filepath.Join(t.TempDir(), ".git")
+
+	files["HEAD"] = head
+	for name, content := range files {
+		filePath := filepath.Join(gitDir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		assert.Nil(t, err)
+		err = os.WriteFile(filePath, []byte(content), 0644)
+		assert.Nil(t, err)
+	}
+
+	return gitDir
+}
+
+func TestSetZiplineeGlobalEnvvarsWithoutGit(t *testing.T) {
+
+	gitNotFound := func(name string, arg ...string) ([]byte, error) {
+		return nil, &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	notAGitRepository := func(name string, arg ...string) ([]byte, error) {
+		return nil, &exec.ExitError{Stderr: []byte("fatal: not a git repository (or any of the parent directories): .git\n")}
+	}
+
+	t.Run("LeavesGitEnvvarsUnsetIfGitIsNotFound", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		defer helper.UnsetZiplineeEnvvars()
+		helper.(*envvarHelper).ciServer = "gocd"
+		helper.(*envvarHelper).runCommand = gitNotFound
+
+		// act
+		err := helper.SetZiplineeGlobalEnvvars()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_SOURCE"))
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_FULLNAME"))
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_REVISION"))
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_BRANCH"))
+		assert.NotEqual(t, "", helper.getZiplineeEnv("ZIPLINEE_BUILD_DATETIME"))
+	})
+
+	t.Run("LeavesGitEnvvarsUnsetIfNotInAGitRepository", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		defer helper.UnsetZiplineeEnvvars()
+		helper.(*envvarHelper).ciServer = "gocd"
+		helper.(*envvarHelper).runCommand = notAGitRepository
+
+		// act
+		err := helper.SetZiplineeGlobalEnvvars()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_SOURCE"))
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_REVISION"))
+	})
+
+	t.Run("LeavesGitSourceUnsetIfOriginIsNotSet", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		defer helper.UnsetZiplineeEnvvars()
+		helper.(*envvarHelper).runCommand = func(name string, arg ...string) ([]byte, error) {
+			cmd := exec.Command("sh", "-c", "exit 1")
+			return cmd.Output()
+		}
+
+		// act
+		err := helper.initGitSource()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", helper.getZiplineeEnv("ZIPLINEE_GIT_SOURCE"))
+	})
+
+	t.Run("ReturnsOtherGitErrors", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		defer helper.UnsetZiplineeEnvvars()
+		helper.(*envvarHelper).runCommand = func(name string, arg ...string) ([]byte, error) {
+			return nil, &exec.ExitError{Stderr: []byte("fatal: ambiguous argument 'HEAD': unknown revision\n")}
+		}
+
+		// act
+		err := helper.initGitRevision()
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetGitOrigin(t *testing.T) {
+
+	t.Run("QueriesOriginRemoteByDefault", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		var args []string
+		helper.(*envvarHelper).runCommand = func(name string, arg ...string) ([]byte, error) {
+			args = arg
+			return []byte("git@github.com:ziplineeci/ziplinee-ci-builder.git\n"), nil
+		}
+
+		// act
+		origin, err := helper.getGitOrigin()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "git@github.com:ziplineeci/ziplinee-ci-builder.git", origin)
+		assert.Equal(t, []string{"config", "--get", "remote.origin.url"}, args)
+	})
+
+	t.Run("QueriesConfiguredRemote", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		helper.SetGitRemote("upstream")
+		var args []string
+		helper.(*envvarHelper).runCommand = func(name string, arg ...string) ([]byte, error) {
+			args = arg
+			return []byte("https://github.com/ziplineeci/ziplinee-ci-builder.git\n"), nil
+		}
+
+		// act
+		origin, err := helper.getGitOrigin()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "https://github.com/ziplineeci/ziplinee-ci-builder.git", origin)
+		assert.Equal(t, []string{"config", "--get", "remote.upstream.url"}, args)
+	})
+
+	t.Run("KeepsOriginRemoteIfConfiguredRemoteIsEmpty", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		helper.SetGitRemote("")
+		var args []string
+		helper.(*envvarHelper).runCommand = func(name string, arg ...string) ([]byte, error) {
+			args = arg
+			return []byte("git@github.com:ziplineeci/ziplinee-ci-builder.git\n"), nil
+		}
+
+		// act
+		_, err := helper.getGitOrigin()
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"config", "--get", "remote.origin.url"}, args)
+	})
+
+	t.Run("ReturnsGitUnavailableErrorNamingConfiguredRemoteIfItIsNotSet", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		helper.SetGitRemote("upstream")
+		helper.(*envvarHelper).runCommand = func(name string, arg ...string) ([]byte, error) {
+			cmd := exec.Command("sh", "-c", "exit 1")
+			return cmd.Output()
+		}
+
+		// act
+		_, err := helper.getGitOrigin()
+
+		assert.True(t, errors.Is(err, errGitUnavailable))
+		assert.Contains(t, err.Error(), "remote.upstream.url")
+	})
+}
+
+func TestInitGitCloneOptions(t *testing.T) {
+
+	t.Run("SetsCloneDepthAndLFSEnvvars", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		envvarHelper.SetGitCloneOptions(50, true)
+
+		// act
+		err := envvarHelper.initGitCloneOptions()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "50", envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_CLONE_DEPTH"))
+		assert.Equal(t, "true", envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_LFS"))
+	})
+
+	t.Run("DoesNotSetEnvvarsForFullCloneWithoutLFS", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		envvarHelper.SetGitCloneOptions(0, false)
+
+		// act
+		err := envvarHelper.initGitCloneOptions()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_CLONE_DEPTH"))
+		assert.Equal(t, "", envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_LFS"))
+	})
+
+	t.Run("PropagatesCloneDepthToCollectedEnvvars", func(t *testing.T) {
+
+		_, _, envvarHelper, _ := getMocks()
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		envvarHelper.SetGitCloneOptions(1, false)
+
+		// act
+		err := envvarHelper.SetZiplineeGlobalEnvvars()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "1", envvarHelper.collectZiplineeEnvvars()["TESTPREFIX_GIT_CLONE_DEPTH"])
+	})
+}
+
+func TestInitCPUCount(t *testing.T) {
+
+	t.Run("SetsCPUCountEnvvarToCgroupLimit", func(t *testing.T) {
+
+		_, _, helper, _ := getMocks()
+		defer helper.UnsetZiplineeEnvvars()
+		cgroupRoot := t.TempDir()
+		err := os.WriteFile(filepath.Join(cgroupRoot, "cpu.max"), []byte("100000 100000\n"), 0644)
+		assert.Nil(t, err)
+		helper.(*envvarHelper).cgroupRoot = cgroupRoot
+
+		// act
+		err = helper.initCPUCount()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "1", helper.getZiplineeEnv("ZIPLINEE_CPU_COUNT"))
+	})
 }
 
 func TestSetZiplineeEventEnvvars(t *testing.T) {
@@ -638,10 +1076,128 @@ func TestSetZiplineeEventEnvvars(t *testing.T) {
 	})
 }
 
+func TestGetPodName(t *testing.T) {
+
+	t.Run("ReturnsPodNameEnvvarIfNotSet", func(t *testing.T) {
+
+		t.Setenv("POD_NAME", "ziplinee-ci-builder-abc12")
+		_, _, envvarHelper, _ := getMocks()
+
+		// act
+		podName := envvarHelper.GetPodName()
+
+		assert.Equal(t, "ziplinee-ci-builder-abc12", podName)
+	})
+
+	t.Run("ReturnsSetPodNameOverPodNameEnvvar", func(t *testing.T) {
+
+		t.Setenv("POD_NAME", "ziplinee-ci-builder-abc12")
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.SetPodName("ziplinee-ci-builder-def34")
+
+		// act
+		podName := envvarHelper.GetPodName()
+
+		assert.Equal(t, "ziplinee-ci-builder-def34", podName)
+	})
+
+	t.Run("ReturnsPodNameEnvvarIfSetPodNameIsEmpty", func(t *testing.T) {
+
+		t.Setenv("POD_NAME", "ziplinee-ci-builder-abc12")
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.SetPodName("")
+
+		// act
+		podName := envvarHelper.GetPodName()
+
+		assert.Equal(t, "ziplinee-ci-builder-abc12", podName)
+	})
+}
+
+func TestGetWorkDir(t *testing.T) {
+
+	t.Run("ReturnsWorkDirEnvvar", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_WORKDIR", "/ziplinee-work")
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.EnableWorkDirFallback()
+
+		// act
+		workDir := envvarHelper.GetWorkDir()
+
+		assert.Equal(t, "/ziplinee-work", workDir)
+	})
+
+	t.Run("ReturnsEmptyStringIfWorkDirEnvvarIsNotSetAndFallbackIsNotEnabled", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_WORKDIR", "")
+		_, _, envvarHelper, _ := getMocks()
+
+		// act
+		workDir := envvarHelper.GetWorkDir()
+
+		assert.Equal(t, "", workDir)
+	})
+
+	t.Run("ReturnsCurrentDirectoryIfWorkDirEnvvarIsNotSetAndFallbackIsEnabled", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_WORKDIR", "")
+		_, _, envvarHelper, _ := getMocks()
+		envvarHelper.EnableWorkDirFallback()
+		currentDir, err := os.Getwd()
+		assert.Nil(t, err)
+
+		// act
+		workDir := envvarHelper.GetWorkDir()
+
+		assert.Equal(t, currentDir, workDir)
+	})
+}
+
+func TestNewEnvvarHelper(t *testing.T) {
+
+	t.Run("KeepsValidPrefix", func(t *testing.T) {
+
+		// act
+		helper, err := NewEnvvarHelper("ZIPLINEE_", nil, nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "ZIPLINEE_", helper.(*envvarHelper).prefix)
+	})
+
+	t.Run("AddsMissingTrailingUnderscore", func(t *testing.T) {
+
+		// act
+		helper, err := NewEnvvarHelper("TESTPREFIX", nil, nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "TESTPREFIX_", helper.(*envvarHelper).prefix)
+		assert.Equal(t, "TESTPREFIX_GIT_BRANCH", helper.getZiplineeEnvvarName("ZIPLINEE_GIT_BRANCH"))
+	})
+
+	t.Run("ReturnsErrorForEmptyPrefix", func(t *testing.T) {
+
+		// act
+		_, err := NewEnvvarHelper("", nil, nil)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForPrefixWithInvalidCharacters", func(t *testing.T) {
+
+		for _, prefix := range []string{"TEST-PREFIX_", "TEST PREFIX_", "1TEST_", "TEST=_"} {
+			// act
+			_, err := NewEnvvarHelper(prefix, nil, nil)
+
+			assert.NotNil(t, err, prefix)
+		}
+	})
+}
+
 func getMocks() (secretHelper crypt.SecretHelper, obfuscator Obfuscator, envvarHelper EnvvarHelper, whenEvaluator WhenEvaluator) {
 	secretHelper = crypt.NewSecretHelper("SazbwMf3NZxVVbBqQHebPcXCqrVn3DDp", false)
 	obfuscator = NewObfuscator(secretHelper)
-	envvarHelper = NewEnvvarHelper("TESTPREFIX_", secretHelper, obfuscator)
+	envvarHelper, _ = NewEnvvarHelper("TESTPREFIX_", secretHelper, obfuscator)
 	whenEvaluator = NewWhenEvaluator(envvarHelper)
 
 	envvarHelper.UnsetZiplineeEnvvars()
@@ -2,18 +2,30 @@
 package builder
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/logrusorgru/aurora"
+	"github.com/rs/zerolog/log"
 	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	crypt "github.com/ziplineeci/ziplinee-ci-crypt"
 
 	"github.com/olekukonko/tablewriter"
+	"gopkg.in/yaml.v2"
 )
 
+// decryptionKeyLength is the length in bytes of the AES-256 key used to decrypt secrets
+const decryptionKeyLength = 32
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -32,7 +44,8 @@ func HandleExit(buildLogSteps []*contracts.BuildLogStep) {
 	os.Exit(0)
 }
 
-func RenderStats(buildLogSteps []*contracts.BuildLogStep) {
+// RenderStats writes a table with the image size, pull and run duration of every stage, masking secrets in stage and image names
+func RenderStats(w io.Writer, buildLogSteps []*contracts.BuildLogStep, obfuscator Obfuscator) {
 
 	data := make([][]string, 0)
 
@@ -44,7 +57,7 @@ func RenderStats(buildLogSteps []*contracts.BuildLogStep) {
 	for _, s := range buildLogSteps {
 
 		// set column values
-		stage := s.Step
+		stage := obfuscator.Obfuscate(s.Step)
 		image := ""
 		imageSize := ""
 		imagePullDuration := ""
@@ -57,7 +70,7 @@ func RenderStats(buildLogSteps []*contracts.BuildLogStep) {
 
 		if s.Image != nil {
 			// set column values
-			image = s.Image.Name
+			image = obfuscator.Obfuscate(s.Image.Name)
 			imageSize = fmt.Sprintf("%v", s.Image.ImageSize/1024/1024)
 			imagePullDuration = fmt.Sprintf("%.0f", s.Image.PullDuration.Seconds())
 			totalDuration = fmt.Sprintf("%.0f", s.Image.PullDuration.Seconds()+s.Duration.Seconds())
@@ -79,7 +92,7 @@ func RenderStats(buildLogSteps []*contracts.BuildLogStep) {
 
 	}
 
-	table := tablewriter.NewWriter(os.Stdout)
+	table := tablewriter.NewWriter(w)
 	table.SetHeader([]string{"Stage", "Image", "Size (MB)", "Pull (s)", "Run (s)", "Total (s)", "Status"})
 	table.SetFooter([]string{"", "Total", fmt.Sprintf("%v", dockerImageSizeTotal/1024/1024), fmt.Sprintf("%.0f", dockerPullDurationTotal), fmt.Sprintf("%.0f", dockerRunDurationTotal), fmt.Sprintf("%.0f", dockerPullDurationTotal+dockerRunDurationTotal), string(statusTotal), ""})
 	table.SetBorder(false)
@@ -123,6 +136,39 @@ func getContainerImageTag(containerImage string) string {
 	return containerImageTag
 }
 
+// getContainerImageRegistry returns the registry host of an image, which is docker.io for images without one like golang:1.22-alpine or ziplinee/scratch
+func getContainerImageRegistry(containerImage string) string {
+	parts := strings.SplitN(containerImage, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+
+	return "docker.io"
+}
+
+// isAllowedRegistry checks whether the image comes from one of the allowed registries; an entry is either a registry host like gcr.io or a registry host with a path prefix like gcr.io/ziplinee
+func isAllowedRegistry(containerImage string, allowedRegistries []string) bool {
+	registry := getContainerImageRegistry(containerImage)
+
+	// strip the digest and tag, leaving the port of the registry host alone
+	imageName := strings.SplitN(containerImage, "@", 2)[0]
+	if i := strings.LastIndex(imageName, ":"); i > strings.LastIndex(imageName, "/") {
+		imageName = imageName[:i]
+	}
+	if !strings.HasPrefix(imageName, registry+"/") {
+		imageName = registry + "/" + imageName
+	}
+
+	for _, allowedRegistry := range allowedRegistries {
+		allowedRegistry = strings.TrimSuffix(allowedRegistry, "/")
+		if allowedRegistry == registry || strings.HasPrefix(imageName, allowedRegistry+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
 var src = rand.NewSource(time.Now().UnixNano()) //nolint:golint,unused
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyz"
@@ -159,3 +205,335 @@ func getLogPrefix(stageName, parentStageName string) string {
 
 	return prefix
 }
+
+// getCustomPropertyStringSlice returns a list of strings for a custom property that isn't part of the manifest schema; ok is false when the property isn't set or isn't a list of strings
+func getCustomPropertyStringSlice(customProperties map[string]interface{}, key string) (values []string, ok bool) {
+	if customProperties == nil {
+		return nil, false
+	}
+
+	value, exists := customProperties[key]
+	if !exists {
+		return nil, false
+	}
+
+	switch v := value.(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		values = make([]string, 0, len(v))
+		for _, iv := range v {
+			s, isString := iv.(string)
+			if !isString {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	case string:
+		return []string{v}, true
+	}
+
+	return nil, false
+}
+
+// getCustomPropertyString returns the string value for a custom property that isn't part of the manifest schema; ok is false when the property isn't set or isn't a string
+func getCustomPropertyString(customProperties map[string]interface{}, key string) (value string, ok bool) {
+	if customProperties == nil {
+		return "", false
+	}
+
+	value, ok = customProperties[key].(string)
+
+	return
+}
+
+// getCustomPropertyBool returns the value for a custom property holding a boolean that isn't part of the manifest schema
+func getCustomPropertyBool(customProperties map[string]interface{}, key string) (value bool, ok bool) {
+	if customProperties == nil {
+		return false, false
+	}
+
+	value, ok = customProperties[key].(bool)
+
+	return
+}
+
+// getCustomPropertyInt returns the value for a custom property holding a whole number that isn't part of the manifest schema; json numbers get parsed as float64, yaml numbers as int
+func getCustomPropertyInt(customProperties map[string]interface{}, key string) (value int, ok bool) {
+	if customProperties == nil {
+		return 0, false
+	}
+
+	return toInt(customProperties[key])
+}
+
+// getCustomPropertyIntSlice returns the values for a custom property holding a list of whole numbers, or a single one, that isn't part of the manifest schema
+func getCustomPropertyIntSlice(customProperties map[string]interface{}, key string) (values []int64, ok bool) {
+	if customProperties == nil {
+		return nil, false
+	}
+
+	value, exists := customProperties[key]
+	if !exists {
+		return nil, false
+	}
+
+	if v, isInt := toInt(value); isInt {
+		return []int64{int64(v)}, true
+	}
+
+	items, isSlice := value.([]interface{})
+	if !isSlice {
+		return nil, false
+	}
+
+	values = make([]int64, 0, len(items))
+	for _, item := range items {
+		v, isInt := toInt(item)
+		if !isInt {
+			return nil, false
+		}
+		values = append(values, int64(v))
+	}
+
+	return values, true
+}
+
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	}
+
+	return 0, false
+}
+
+// getCustomPropertyStringMap returns the values for a custom property holding a map that isn't part of the manifest schema; non-string values like numbers get formatted as string
+func getCustomPropertyStringMap(customProperties map[string]interface{}, key string) (values map[string]string, ok bool) {
+	if customProperties == nil {
+		return nil, false
+	}
+
+	value, exists := customProperties[key]
+	if !exists {
+		return nil, false
+	}
+
+	switch v := value.(type) {
+	case map[string]string:
+		return v, true
+	case map[string]interface{}:
+		values = make(map[string]string, len(v))
+		for k, iv := range v {
+			values[k] = fmt.Sprint(iv)
+		}
+		return values, true
+	case map[interface{}]interface{}:
+		values = make(map[string]string, len(v))
+		for k, iv := range v {
+			values[fmt.Sprint(k)] = fmt.Sprint(iv)
+		}
+		return values, true
+	}
+
+	return nil, false
+}
+
+// DecryptAllEnvelopesInValue decrypts secret envelopes in a string, or in any string nested at any depth in maps and slices, as found in credential additional properties
+func DecryptAllEnvelopesInValue(secretHelper crypt.SecretHelper, value interface{}, pipeline string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return secretHelper.DecryptAllEnvelopes(v, pipeline)
+	case map[string]interface{}:
+		decrypted := make(map[string]interface{}, len(v))
+		for key, nestedValue := range v {
+			decryptedValue, err := DecryptAllEnvelopesInValue(secretHelper, nestedValue, pipeline)
+			if err != nil {
+				return nil, err
+			}
+			decrypted[key] = decryptedValue
+		}
+		return decrypted, nil
+	case map[interface{}]interface{}:
+		decrypted := make(map[interface{}]interface{}, len(v))
+		for key, nestedValue := range v {
+			decryptedValue, err := DecryptAllEnvelopesInValue(secretHelper, nestedValue, pipeline)
+			if err != nil {
+				return nil, err
+			}
+			decrypted[key] = decryptedValue
+		}
+		return decrypted, nil
+	case []interface{}:
+		decrypted := make([]interface{}, len(v))
+		for i, nestedValue := range v {
+			decryptedValue, err := DecryptAllEnvelopesInValue(secretHelper, nestedValue, pipeline)
+			if err != nil {
+				return nil, err
+			}
+			decrypted[i] = decryptedValue
+		}
+		return decrypted, nil
+	}
+
+	return value, nil
+}
+
+// sensitiveBuilderEnvvars are read by the builder itself, but shouldn't leak into stage containers
+var sensitiveBuilderEnvvars = []string{"BUILDER_CONFIG", "SECRET_DECRYPTION_KEY"}
+
+// UnsetSensitiveBuilderEnvvars unsets the envvars holding the builder config and secret decryption key once they've been read, whichever source they were read from
+func UnsetSensitiveBuilderEnvvars() error {
+	for _, envvar := range sensitiveBuilderEnvvars {
+		err := os.Unsetenv(envvar)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MergeTrustedImagesFromFile merges the yaml or json list of trusted images in the file at path into the trusted images from the builder config, so the list can be managed centrally and mounted from a configmap;
+// images from the file replace those with the same path in the builder config
+func MergeTrustedImagesFromFile(trustedImages []*contracts.TrustedImageConfig, path string) ([]*contracts.TrustedImageConfig, error) {
+
+	trustedImagesBytes, err := os.ReadFile(path)
+	if err != nil {
+		return trustedImages, err
+	}
+
+	var fileTrustedImages []*contracts.TrustedImageConfig
+	err = yaml.Unmarshal(trustedImagesBytes, &fileTrustedImages)
+	if err != nil {
+		return trustedImages, fmt.Errorf("failed to unmarshal trusted images file %v: %w", path, err)
+	}
+
+	mergedTrustedImages := make([]*contracts.TrustedImageConfig, 0, len(trustedImages)+len(fileTrustedImages))
+	for _, trustedImage := range trustedImages {
+		if contracts.GetTrustedImage(fileTrustedImages, trustedImage.ImagePath) == nil {
+			mergedTrustedImages = append(mergedTrustedImages, trustedImage)
+		}
+	}
+
+	return append(mergedTrustedImages, fileTrustedImages...), nil
+}
+
+// DecryptCredentials decrypts the additional properties of all credentials; in lenient mode a credential that fails to decrypt is skipped with a warning instead of failing, so an unrelated broken credential doesn't block the build.
+// Next to the decrypted credentials it returns the original encrypted ones that were kept, for the obfuscator to extract secrets from.
+func DecryptCredentials(secretHelper crypt.SecretHelper, credentials []*contracts.CredentialConfig, pipeline string, lenient bool) (decryptedCredentials, keptCredentials []*contracts.CredentialConfig, err error) {
+
+	decryptedCredentials = []*contracts.CredentialConfig{}
+	keptCredentials = []*contracts.CredentialConfig{}
+
+	for _, c := range credentials {
+		decryptedCredential, err := decryptCredential(secretHelper, c, pipeline)
+		if err != nil {
+			if !lenient {
+				return nil, nil, err
+			}
+			log.Warn().Err(err).Msgf("Skipping credential %v, because it can't be decrypted", c.Name)
+			continue
+		}
+
+		decryptedCredentials = append(decryptedCredentials, decryptedCredential)
+		keptCredentials = append(keptCredentials, c)
+	}
+
+	return decryptedCredentials, keptCredentials, nil
+}
+
+func decryptCredential(secretHelper crypt.SecretHelper, credential *contracts.CredentialConfig, pipeline string) (*contracts.CredentialConfig, error) {
+
+	// loop all additional properties and decrypt, including values nested in maps and slices
+	decryptedAdditionalProperties := map[string]interface{}{}
+	for key, value := range credential.AdditionalProperties {
+		decryptedValue, err := DecryptAllEnvelopesInValue(secretHelper, value, pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("Failed decrypting credential %v property %v: %w", credential.Name, key, err)
+		}
+		decryptedAdditionalProperties[key] = decryptedValue
+	}
+
+	// copy the credential to leave the encrypted original intact
+	decryptedCredential := *credential
+	decryptedCredential.AdditionalProperties = decryptedAdditionalProperties
+
+	return &decryptedCredential, nil
+}
+
+var urlInTextRegex = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// redactURL replaces the values of all query parameters and any password in a url, so tokens passed along with the url don't end up in the logs
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// strip the query if the url can't be parsed, it's the most likely place for a token
+		if i := strings.Index(rawURL, "?"); i >= 0 {
+			return rawURL[:i] + "?***"
+		}
+		return rawURL
+	}
+
+	if u.RawQuery != "" {
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			u.RawQuery = "***"
+		} else {
+			keys := make([]string, 0, len(query))
+			for key := range query {
+				keys = append(keys, url.QueryEscape(key)+"=***")
+			}
+			sort.Strings(keys)
+			u.RawQuery = strings.Join(keys, "&")
+		}
+	}
+
+	return u.Redacted()
+}
+
+// redactURLsInText redacts all urls in a text like the log of an http client
+func redactURLsInText(text string) string {
+	return urlInTextRegex.ReplaceAllStringFunc(text, redactURL)
+}
+
+// redactURLsInError redacts all urls in the message of an error, for logging errors of http clients that include the request url
+func redactURLsInError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return errors.New(redactURLsInText(err.Error()))
+}
+
+// ValidateDecryptionKey checks the secret decryption key is a 32 byte AES-256 key, either raw or base64 encoded, and returns whether it's base64 encoded;
+// it fails fast with a clear error instead of letting every secret fail to decrypt later on; an empty key means no key is configured, like for gocd agent and local builds without secrets, and is left alone
+func ValidateDecryptionKey(key string) (base64Encoded bool, err error) {
+	if key == "" {
+		return false, nil
+	}
+
+	if len(key) == decryptionKeyLength {
+		return false, nil
+	}
+
+	keyBytes, decodeErr := base64.StdEncoding.DecodeString(key)
+	if decodeErr == nil && len(keyBytes) == decryptionKeyLength {
+		return true, nil
+	}
+
+	if decodeErr == nil {
+		return false, fmt.Errorf("Secret decryption key is %v bytes long, or %v bytes after base64 decoding, but should be %v bytes for AES-256", len(key), len(keyBytes), decryptionKeyLength)
+	}
+
+	return false, fmt.Errorf("Secret decryption key is %v bytes long, but should be %v bytes for AES-256, either raw or base64 encoded", len(key), decryptionKeyLength)
+}
@@ -0,0 +1,52 @@
+package builder
+
+import "sync"
+
+// ImageCache keeps track of which images are known to be present on the docker daemon, to avoid listing all images for every stage
+type ImageCache struct {
+	pulledImages map[string]bool
+	mutex        *sync.RWMutex
+}
+
+func NewImageCache() *ImageCache {
+	return &ImageCache{
+		pulledImages: make(map[string]bool),
+		mutex:        &sync.RWMutex{},
+	}
+}
+
+// IsPulled returns whether the image is present, only calling lookup if the image isn't known to be present yet
+func (c *ImageCache) IsPulled(containerImage string, lookup func() bool) bool {
+	c.mutex.RLock()
+	isPulled := c.pulledImages[containerImage]
+	c.mutex.RUnlock()
+
+	if isPulled {
+		return true
+	}
+
+	// images that aren't present don't get cached, because they're about to get pulled
+	if !lookup() {
+		return false
+	}
+
+	c.Set(containerImage)
+
+	return true
+}
+
+// Set marks the image as present, for example after a successful pull
+func (c *ImageCache) Set(containerImage string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pulledImages[containerImage] = true
+}
+
+// Invalidate forgets about the image, for example when it's pulled again and the tag might point to another image afterwards
+func (c *ImageCache) Invalidate(containerImage string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pulledImages, containerImage)
+}
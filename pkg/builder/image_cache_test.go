@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageCacheIsPulled(t *testing.T) {
+
+	t.Run("QueriesDaemonOncePerUniqueImage", func(t *testing.T) {
+
+		imageCache := NewImageCache()
+		lookups := map[string]int{}
+		lookup := func(containerImage string) func() bool {
+			return func() bool {
+				lookups[containerImage]++
+				return true
+			}
+		}
+
+		// act
+		for _, containerImage := range []string{"golang:1.22", "alpine:3.19", "golang:1.22", "golang:1.22", "alpine:3.19"} {
+			assert.True(t, imageCache.IsPulled(containerImage, lookup(containerImage)))
+		}
+
+		assert.Equal(t, map[string]int{"golang:1.22": 1, "alpine:3.19": 1}, lookups)
+	})
+
+	t.Run("QueriesDaemonAgainForImageThatIsNotPresent", func(t *testing.T) {
+
+		imageCache := NewImageCache()
+		lookups := 0
+		lookup := func() bool {
+			lookups++
+			return false
+		}
+
+		// act
+		_ = imageCache.IsPulled("golang:1.22", lookup)
+		isPulled := imageCache.IsPulled("golang:1.22", lookup)
+
+		assert.False(t, isPulled)
+		assert.Equal(t, 2, lookups)
+	})
+
+	t.Run("DoesNotQueryDaemonForImageSetAfterPull", func(t *testing.T) {
+
+		imageCache := NewImageCache()
+		imageCache.Set("golang:1.22")
+		lookups := 0
+
+		// act
+		isPulled := imageCache.IsPulled("golang:1.22", func() bool {
+			lookups++
+			return false
+		})
+
+		assert.True(t, isPulled)
+		assert.Equal(t, 0, lookups)
+	})
+
+	t.Run("QueriesDaemonAgainAfterInvalidate", func(t *testing.T) {
+
+		imageCache := NewImageCache()
+		imageCache.Set("golang:latest")
+		imageCache.Invalidate("golang:latest")
+		lookups := 0
+
+		// act
+		isPulled := imageCache.IsPulled("golang:latest", func() bool {
+			lookups++
+			return true
+		})
+
+		assert.True(t, isPulled)
+		assert.Equal(t, 1, lookups)
+	})
+}
@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+// imagePullMessage is a single json message from the docker image pull response stream
+type imagePullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Error string `json:"error"`
+}
+
+type imagePullLayer struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// imagePullProgress summarizes the progress of all layers of an image pull
+type imagePullProgress struct {
+	LayersDone      int
+	LayersTotal     int
+	DownloadedBytes int64
+	TotalBytes      int64
+}
+
+func (p imagePullProgress) String() string {
+	return fmt.Sprintf("%v/%v layers, %v/%v downloaded", p.LayersDone, p.LayersTotal, units.HumanSize(float64(p.DownloadedBytes)), units.HumanSize(float64(p.TotalBytes)))
+}
+
+// readImagePullProgress reads the image pull response stream until it ends and calls logProgress at most once per interval
+func readImagePullProgress(stream io.Reader, interval time.Duration, now func() time.Time, logProgress func(progress imagePullProgress)) error {
+
+	layers := map[string]*imagePullLayer{}
+	lastLogged := now()
+
+	decoder := json.NewDecoder(stream)
+	for {
+		var message imagePullMessage
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if message.ErrorDetail != nil {
+			return fmt.Errorf("Pulling image failed: %v", message.ErrorDetail.Message)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("Pulling image failed: %v", message.Error)
+		}
+
+		updateImagePullLayers(layers, message)
+
+		if now().Sub(lastLogged) >= interval {
+			logProgress(getImagePullProgress(layers))
+			lastLogged = now()
+		}
+	}
+}
+
+func updateImagePullLayers(layers map[string]*imagePullLayer, message imagePullMessage) {
+	// messages without id or with the tag as id are about the image as a whole, not about a layer
+	if message.ID == "" || strings.HasPrefix(message.Status, "Pulling from") {
+		return
+	}
+
+	layer, ok := layers[message.ID]
+	if !ok {
+		layer = &imagePullLayer{}
+		layers[message.ID] = layer
+	}
+
+	switch message.Status {
+	case "Downloading":
+		layer.current = message.ProgressDetail.Current
+		layer.total = message.ProgressDetail.Total
+	case "Download complete", "Verifying Checksum":
+		layer.current = layer.total
+	case "Pull complete", "Already exists":
+		layer.current = layer.total
+		layer.done = true
+	}
+}
+
+func getImagePullProgress(layers map[string]*imagePullLayer) (progress imagePullProgress) {
+	for _, layer := range layers {
+		progress.LayersTotal++
+		if layer.done {
+			progress.LayersDone++
+		}
+		progress.DownloadedBytes += layer.current
+		progress.TotalBytes += layer.total
+	}
+
+	return
+}
@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadImagePullProgress(t *testing.T) {
+
+	// every call to now advances the clock by a second
+	getFakeClock := func() func() time.Time {
+		clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		return func() time.Time {
+			clock = clock.Add(time.Second)
+			return clock
+		}
+	}
+
+	pullStream := strings.Join([]string{
+		`{"status":"Pulling from library/golang","id":"1.22"}`,
+		`{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}`,
+		`{"status":"Already exists","progressDetail":{},"id":"b2"}`,
+		`{"status":"Downloading","progressDetail":{"current":1000,"total":4000},"id":"a1"}`,
+		`{"status":"Downloading","progressDetail":{"current":2000,"total":4000},"id":"a1"}`,
+		`{"status":"Downloading","progressDetail":{"current":3000,"total":4000},"id":"a1"}`,
+		`{"status":"Download complete","progressDetail":{},"id":"a1"}`,
+		`{"status":"Pull complete","progressDetail":{},"id":"a1"}`,
+		`{"status":"Digest: sha256:0123456789abcdef"}`,
+		`{"status":"Status: Downloaded newer image for golang:1.22"}`,
+	}, "\n")
+
+	t.Run("EmitsProgressOncePerInterval", func(t *testing.T) {
+
+		progressLines := []imagePullProgress{}
+
+		// act
+		err := readImagePullProgress(strings.NewReader(pullStream), 3*time.Second, getFakeClock(), func(progress imagePullProgress) {
+			progressLines = append(progressLines, progress)
+		})
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 3, len(progressLines)) {
+			assert.Equal(t, imagePullProgress{LayersDone: 1, LayersTotal: 2, DownloadedBytes: 0, TotalBytes: 0}, progressLines[0])
+			assert.Equal(t, imagePullProgress{LayersDone: 1, LayersTotal: 2, DownloadedBytes: 3000, TotalBytes: 4000}, progressLines[1])
+			assert.Equal(t, imagePullProgress{LayersDone: 2, LayersTotal: 2, DownloadedBytes: 4000, TotalBytes: 4000}, progressLines[2])
+		}
+	})
+
+	t.Run("EmitsNothingIfPullFinishesWithinInterval", func(t *testing.T) {
+
+		progressLines := []imagePullProgress{}
+
+		// act
+		err := readImagePullProgress(strings.NewReader(pullStream), time.Minute, getFakeClock(), func(progress imagePullProgress) {
+			progressLines = append(progressLines, progress)
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(progressLines))
+	})
+
+	t.Run("ReturnsErrorFromPullStream", func(t *testing.T) {
+
+		pullStream := strings.Join([]string{
+			`{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}`,
+			`{"errorDetail":{"message":"unauthorized: authentication required"},"error":"unauthorized: authentication required"}`,
+		}, "\n")
+
+		// act
+		err := readImagePullProgress(strings.NewReader(pullStream), time.Second, getFakeClock(), func(progress imagePullProgress) {})
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "unauthorized")
+		}
+	})
+}
+
+func TestImagePullProgressString(t *testing.T) {
+
+	t.Run("ReturnsLayersAndHumanReadableSizes", func(t *testing.T) {
+
+		progress := imagePullProgress{LayersDone: 2, LayersTotal: 5, DownloadedBytes: 1500000, TotalBytes: 30000000}
+
+		// act
+		line := progress.String()
+
+		assert.Equal(t, "2/5 layers, 1.5MB/30MB downloaded", line)
+	})
+}
@@ -0,0 +1,33 @@
+package builder
+
+import (
+	"errors"
+)
+
+// infrastructureError marks a failure of the build infrastructure, like the docker daemon or an unreachable registry, as opposed to a failure of the pipeline's own code
+type infrastructureError struct {
+	err error
+}
+
+func (e *infrastructureError) Error() string {
+	return e.err.Error()
+}
+
+func (e *infrastructureError) Unwrap() error {
+	return e.err
+}
+
+// newInfrastructureError classifies err as an infrastructure failure; it returns nil for a nil error
+func newInfrastructureError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &infrastructureError{err: err}
+}
+
+// isInfrastructureError returns true if err or any error it wraps is classified as an infrastructure failure
+func isInfrastructureError(err error) bool {
+	var infraErr *infrastructureError
+	return errors.As(err, &infraErr)
+}
@@ -0,0 +1,52 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsInfrastructureError(t *testing.T) {
+
+	t.Run("ReturnsTrueForInfrastructureError", func(t *testing.T) {
+
+		err := newInfrastructureError(fmt.Errorf("Cannot connect to the Docker daemon"))
+
+		// act
+		result := isInfrastructureError(err)
+
+		assert.True(t, result)
+		assert.Equal(t, "Cannot connect to the Docker daemon", err.Error())
+	})
+
+	t.Run("ReturnsTrueForWrappedInfrastructureError", func(t *testing.T) {
+
+		err := fmt.Errorf("Running stage failed: %w", newInfrastructureError(context.DeadlineExceeded))
+
+		// act
+		result := isInfrastructureError(err)
+
+		assert.True(t, result)
+	})
+
+	t.Run("ReturnsFalseForPipelineError", func(t *testing.T) {
+
+		err := fmt.Errorf("Stage build failed with exit code 1")
+
+		// act
+		result := isInfrastructureError(err)
+
+		assert.False(t, result)
+	})
+
+	t.Run("ReturnsNilWhenClassifyingNil", func(t *testing.T) {
+
+		// act
+		err := newInfrastructureError(nil)
+
+		assert.Nil(t, err)
+		assert.False(t, isInfrastructureError(err))
+	})
+}
@@ -3,6 +3,7 @@ package builder
 import (
 	"os"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -12,14 +13,24 @@ type LocalFatalHandler interface {
 }
 
 type localFatalHandler struct {
+	obfuscator Obfuscator
+	exit       func(code int)
 }
 
-// NewLocalFatalHandler returns a new LocalFatalHandler
-func NewLocalFatalHandler() LocalFatalHandler {
-	return &localFatalHandler{}
+// NewLocalFatalHandler returns a new LocalFatalHandler; the obfuscator masks secrets in the error and message before they get printed
+func NewLocalFatalHandler(obfuscator Obfuscator) LocalFatalHandler {
+	return &localFatalHandler{
+		obfuscator: obfuscator,
+		exit:       os.Exit,
+	}
 }
 
 func (elh *localFatalHandler) HandleFatal(err error, message string) {
-	log.Fatal().Err(err).Msg(message)
-	os.Exit(1)
+	// log at fatal level without letting zerolog exit, so the exit can be stubbed
+	event := log.WithLevel(zerolog.FatalLevel)
+	if err != nil {
+		event = event.Str(zerolog.ErrorFieldName, elh.obfuscator.Obfuscate(err.Error()))
+	}
+	event.Msg(elh.obfuscator.Obfuscate(message))
+	elh.exit(1)
 }
@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+)
+
+func TestLocalFatalHandler(t *testing.T) {
+
+	t.Run("ObfuscatesSecretInErrorAndMessage", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+		err := obfuscator.CollectSecrets(manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_SECRET": "ziplinee.secret(deFTz5Bdjg6SUe29.oPIkXbze5G9PNEWS2-ZnArl8BCqHnx4MdTdxHg37th9u)",
+			},
+		}, credentialsBytes, "github.com/ziplineeci/ziplinee-ci-builder")
+		assert.Nil(t, err)
+
+		var output bytes.Buffer
+		originalLogger := log.Logger
+		log.Logger = zerolog.New(&output)
+		defer func() { log.Logger = originalLogger }()
+
+		exitCode := 0
+		fatalHandler := NewLocalFatalHandler(obfuscator).(*localFatalHandler)
+		fatalHandler.exit = func(code int) {
+			exitCode = code
+		}
+
+		// act
+		fatalHandler.HandleFatal(fmt.Errorf("Login failed with password this is my secret"), "Running stage with this is my secret failed")
+
+		assert.Equal(t, 1, exitCode)
+		assert.NotContains(t, output.String(), "this is my secret")
+		assert.Contains(t, output.String(), "Login failed with password ***")
+		assert.Contains(t, output.String(), "Running stage with *** failed")
+		assert.Contains(t, output.String(), `"level":"fatal"`)
+	})
+}
@@ -0,0 +1,41 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type invalidUTF8Handling string
+
+const (
+	// invalidUTF8HandlingReplace replaces every invalid utf8 byte in a log line with the unicode replacement character; this is the default
+	invalidUTF8HandlingReplace invalidUTF8Handling = "replace"
+	// invalidUTF8HandlingEscape replaces every invalid utf8 byte in a log line with its hex escape like \x80, to keep the original bytes readable
+	invalidUTF8HandlingEscape invalidUTF8Handling = "escape"
+)
+
+// sanitizeUTF8 makes sure a log line of a stage emitting binary output is valid utf8, so it can't corrupt the json log payload or the web ui
+func sanitizeUTF8(line string, handling invalidUTF8Handling) string {
+	if utf8.ValidString(line) {
+		return line
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(line))
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if r == utf8.RuneError && size == 1 {
+			if handling == invalidUTF8HandlingEscape {
+				sb.WriteString(fmt.Sprintf(`\x%02x`, line[i]))
+			} else {
+				sb.WriteRune(utf8.RuneError)
+			}
+		} else {
+			sb.WriteString(line[i : i+size])
+		}
+		i += size
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeUTF8(t *testing.T) {
+
+	t.Run("KeepsValidUTF8AsIs", func(t *testing.T) {
+
+		// act
+		line := sanitizeUTF8("building ziplinee-ci-builder ✓\n", invalidUTF8HandlingReplace)
+
+		assert.Equal(t, "building ziplinee-ci-builder ✓\n", line)
+	})
+
+	t.Run("ReplacesInvalidBytesWithReplacementCharacter", func(t *testing.T) {
+
+		// act
+		line := sanitizeUTF8("binary \x80\xff output ✓\n", invalidUTF8HandlingReplace)
+
+		assert.True(t, utf8.ValidString(line))
+		assert.Equal(t, "binary �� output ✓\n", line)
+	})
+
+	t.Run("HexEscapesInvalidBytesWithEscapeHandling", func(t *testing.T) {
+
+		// act
+		line := sanitizeUTF8("binary \x80\xff output ✓\n", invalidUTF8HandlingEscape)
+
+		assert.True(t, utf8.ValidString(line))
+		assert.Equal(t, "binary \\x80\\xff output ✓\n", line)
+	})
+
+	t.Run("HandlesTruncatedMultiByteCharacter", func(t *testing.T) {
+
+		// act
+		line := sanitizeUTF8("cut off \xe2\x9c", invalidUTF8HandlingEscape)
+
+		assert.True(t, utf8.ValidString(line))
+		assert.Equal(t, "cut off \\xe2\\x9c", line)
+	})
+}
+
+func TestSetInvalidUTF8Handling(t *testing.T) {
+
+	t.Run("DefaultsToReplaceForUnknownHandling", func(t *testing.T) {
+
+		dockerRunner := dockerRunner{}
+
+		// act
+		dockerRunner.SetInvalidUTF8Handling("drop")
+
+		assert.Equal(t, invalidUTF8HandlingReplace, dockerRunner.invalidUTF8Handling)
+	})
+
+	t.Run("SetsEscapeHandling", func(t *testing.T) {
+
+		dockerRunner := dockerRunner{}
+
+		// act
+		dockerRunner.SetInvalidUTF8Handling("Escape")
+
+		assert.Equal(t, invalidUTF8HandlingEscape, dockerRunner.invalidUTF8Handling)
+	})
+}
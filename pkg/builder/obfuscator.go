@@ -3,26 +3,40 @@ package builder
 import (
 	"encoding/base64"
 	"encoding/json"
+	"net"
 	"regexp"
 	"strings"
 
 	"github.com/rs/zerolog/log"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
 	crypt "github.com/ziplineeci/ziplinee-ci-crypt"
 	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
 )
 
 const maxLengthToSkipObfuscation = 3
 
+// ipAddressCandidateRegex matches anything that might be an ip address; candidates get validated with net.ParseIP
+var ipAddressCandidateRegex = regexp.MustCompile(`[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*`)
+
 // Obfuscator hides secret values and other sensitive stuff from the logs
 type Obfuscator interface {
 	CollectSecrets(manifest manifest.ZiplineeManifest, credentialsBytes []byte, pipeline string) (err error)
 	Obfuscate(input string) string
 	ObfuscateSecrets(input string) string
+	EnableIPAddressObfuscation()
+	EnableCredentialNameObfuscation()
+	SetMultiLineSecretMinLineLength(length int)
+	SetObfuscationBypass(minSecretLength int, publicValues []string)
 }
 
 type obfuscator struct {
-	secretHelper crypt.SecretHelper
-	replacer     *strings.Replacer
+	secretHelper                 crypt.SecretHelper
+	replacer                     *strings.Replacer
+	obfuscateIPAddresses         bool
+	obfuscateCredentialNames     bool
+	multiLineSecretMinLineLength int
+	minSecretLength              int
+	publicValues                 map[string]bool
 }
 
 // NewObfuscator returns a new Obfuscator
@@ -63,32 +77,68 @@ func (ob *obfuscator) CollectSecrets(manifest manifest.ZiplineeManifest, credent
 
 	replacerStrings = append(replacerStrings, ob.getReplacerStrings(values)...)
 
+	// collect the names of injected credentials, for orgs where those are sensitive as well
+	if ob.obfuscateCredentialNames {
+		names, err := ob.getCredentialNames(credentialsBytes)
+		if err != nil {
+			return err
+		}
+
+		log.Debug().Msgf("Collected %v credential names for pipeline %v...", len(names), pipeline)
+
+		for _, name := range names {
+			replacerStrings = append(replacerStrings, name, "***")
+		}
+	}
+
 	// replace all secret values with obfuscated string
 	ob.replacer = strings.NewReplacer(replacerStrings...)
 
 	return nil
 }
 
+func (ob *obfuscator) getCredentialNames(credentialsBytes []byte) (names []string, err error) {
+
+	if len(credentialsBytes) == 0 {
+		return nil, nil
+	}
+
+	var credentials []*contracts.CredentialConfig
+	err = json.Unmarshal(credentialsBytes, &credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range credentials {
+		if c == nil || len(c.Name) <= maxLengthToSkipObfuscation || ob.bypassObfuscation(c.Name) {
+			continue
+		}
+		names = append(names, c.Name)
+	}
+
+	return names, nil
+}
+
 func (ob *obfuscator) getReplacerStrings(values []string) (replacerStrings []string) {
 
 	replacerStrings = []string{}
 
 	for _, v := range values {
-		valueLines := strings.Split(v, "\n")
-		for _, l := range valueLines {
-			if len(l) > maxLengthToSkipObfuscation {
-				// obfuscate plain secret value
-				replacerStrings = append(replacerStrings, l, "***")
-
-				// obfuscate secret value in base64 encoding
-				replacerStrings = append(replacerStrings, base64.StdEncoding.EncodeToString([]byte(l)), "***")
-
-				// split further if line contains \n (encoded newline) and obfuscate each line
-				valueLineLines := strings.Split(l, "\\n")
-				for _, ll := range valueLineLines {
-					if len(ll) > maxLengthToSkipObfuscation {
-						replacerStrings = append(replacerStrings, ll, "***")
-					}
+		for _, l := range ob.getSecretLines(v) {
+			if ob.bypassObfuscation(l) {
+				continue
+			}
+
+			// obfuscate plain secret value
+			replacerStrings = append(replacerStrings, l, "***")
+
+			// obfuscate secret value in base64 encoding
+			replacerStrings = append(replacerStrings, base64.StdEncoding.EncodeToString([]byte(l)), "***")
+
+			// split further if line contains \n (encoded newline) and obfuscate each line
+			for _, ll := range ob.getSecretLines(strings.ReplaceAll(l, "\\n", "\n")) {
+				if !ob.bypassObfuscation(ll) {
+					replacerStrings = append(replacerStrings, ll, "***")
 				}
 			}
 		}
@@ -97,18 +147,15 @@ func (ob *obfuscator) getReplacerStrings(values []string) (replacerStrings []str
 		decodedValue, err := base64.StdEncoding.DecodeString(v)
 		if err == nil {
 			// split decoded value on newlines and add individual lines to replacerStrings
-			decodedValueString := string(decodedValue)
-			decodedValueLines := strings.Split(decodedValueString, "\n")
-			for _, l := range decodedValueLines {
-				if len(l) > maxLengthToSkipObfuscation {
+			for _, l := range ob.getSecretLines(string(decodedValue)) {
+				if !ob.bypassObfuscation(l) {
 					replacerStrings = append(replacerStrings, l, "***")
+				}
 
-					// split further if line contains \n (encoded newline)
-					valueLineLines := strings.Split(l, "\\n")
-					for _, ll := range valueLineLines {
-						if len(ll) > maxLengthToSkipObfuscation {
-							replacerStrings = append(replacerStrings, ll, "***")
-						}
+				// split further if line contains \n (encoded newline)
+				for _, ll := range ob.getSecretLines(strings.ReplaceAll(l, "\\n", "\n")) {
+					if !ob.bypassObfuscation(ll) {
+						replacerStrings = append(replacerStrings, ll, "***")
 					}
 				}
 			}
@@ -118,8 +165,119 @@ func (ob *obfuscator) getReplacerStrings(values []string) (replacerStrings []str
 	return replacerStrings
 }
 
+// getSecretLines returns the lines of a secret value to mask individually, since multi-line secrets like pem keys show up in logs line by line; lines shorter than the minimum line length are left alone to avoid masking trivial lines
+func (ob *obfuscator) getSecretLines(value string) (lines []string) {
+
+	valueLines := strings.Split(value, "\n")
+	if len(valueLines) == 1 {
+		if len(value) > maxLengthToSkipObfuscation {
+			lines = append(lines, value)
+		}
+		return
+	}
+
+	for _, l := range valueLines {
+		// secrets with windows line endings would otherwise never match a logged line
+		l = strings.TrimRight(l, "\r")
+		if len(l) <= maxLengthToSkipObfuscation || len(l) < ob.multiLineSecretMinLineLength {
+			continue
+		}
+		lines = append(lines, l)
+
+		// match the line as well when it's logged with different indentation; the untrimmed line comes first so it takes precedence
+		if trimmed := strings.TrimSpace(l); trimmed != l && len(trimmed) > maxLengthToSkipObfuscation && len(trimmed) >= ob.multiLineSecretMinLineLength {
+			lines = append(lines, trimmed)
+		}
+	}
+
+	return
+}
+
+// SetMultiLineSecretMinLineLength sets the minimum length of a line of a multi-line secret to get masked individually
+func (ob *obfuscator) SetMultiLineSecretMinLineLength(length int) {
+	ob.multiLineSecretMinLineLength = length
+}
+
+// SetObfuscationBypass keeps secret values shorter than minSecretLength and the given known-public values from getting masked, since short secrets like "true" would otherwise mask harmless text all over the logs
+func (ob *obfuscator) SetObfuscationBypass(minSecretLength int, publicValues []string) {
+	ob.minSecretLength = minSecretLength
+	ob.publicValues = make(map[string]bool, len(publicValues))
+	for _, v := range publicValues {
+		ob.publicValues[v] = true
+	}
+}
+
+func (ob *obfuscator) bypassObfuscation(value string) bool {
+	return len(value) < ob.minSecretLength || ob.publicValues[value]
+}
+
 func (ob *obfuscator) Obfuscate(input string) string {
-	return ob.replacer.Replace(input)
+	output := ob.replacer.Replace(input)
+
+	if ob.obfuscateIPAddresses {
+		output = ob.obfuscateIPAddressesInString(output)
+	}
+
+	return output
+}
+
+// EnableIPAddressObfuscation makes Obfuscate mask ipv4 and ipv6 addresses as well
+func (ob *obfuscator) EnableIPAddressObfuscation() {
+	ob.obfuscateIPAddresses = true
+}
+
+// EnableCredentialNameObfuscation makes CollectSecrets mask the names of injected credentials as well, for orgs where those are sensitive
+func (ob *obfuscator) EnableCredentialNameObfuscation() {
+	ob.obfuscateCredentialNames = true
+}
+
+func (ob *obfuscator) obfuscateIPAddressesInString(input string) string {
+
+	matches := ipAddressCandidateRegex.FindAllStringIndex(input, -1)
+	if len(matches) == 0 {
+		return input
+	}
+
+	var sb strings.Builder
+	previousEnd := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+
+		// skip candidates that are part of a larger word, like Foo::Bar
+		if (start > 0 && isWordCharacter(input[start-1])) || (end < len(input) && isWordCharacter(input[end])) {
+			continue
+		}
+
+		// allow ip addresses at the end of a sentence
+		candidate := strings.TrimRight(input[start:end], ".")
+		if !isIPAddress(candidate) {
+			// allow ipv4 addresses followed by a port
+			if strings.Count(candidate, ":") != 1 || !isIPAddress(strings.Split(candidate, ":")[0]) {
+				continue
+			}
+			candidate = strings.Split(candidate, ":")[0]
+		}
+
+		sb.WriteString(input[previousEnd:start])
+		sb.WriteString("***")
+		previousEnd = start + len(candidate)
+	}
+	sb.WriteString(input[previousEnd:])
+
+	return sb.String()
+}
+
+func isWordCharacter(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIPAddress(candidate string) bool {
+	if net.ParseIP(candidate) == nil {
+		return false
+	}
+
+	// require a full dotted quad or at least two colons, to avoid masking things like timestamps or versions
+	return strings.Count(candidate, ".") == 3 || strings.Count(candidate, ":") >= 2
 }
 
 func (ob *obfuscator) ObfuscateSecrets(input string) string {
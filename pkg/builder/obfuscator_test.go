@@ -302,4 +302,269 @@ func TestObfuscate(t *testing.T) {
 			}
 		}
 	})
+	t.Run("ObfuscatesEachLineOfMultilinePemWithWindowsLineEndingsWhenLoggedSeparately", func(t *testing.T) {
+
+		secretHelper, obfuscator, _, _ := getMocks()
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		pemLines := []string{
+			"-----BEGIN CERTIFICATE-----",
+			"MIIBszCCAVmgAwIBAgIUQ2hlY2tpbmdNdWx0aUxpbmVTZWNyZXRzMAoGCCqGSM49",
+			"BAMCMBQxEjAQBgNVBAMMCXppcGxpbmVlMB4XDTI0MDEwMTAwMDAwMFoXDTM0MDEw",
+			"-----END CERTIFICATE-----",
+		}
+		encryptedTextInEnvelope, err := secretHelper.EncryptEnvelope(strings.Join(pemLines, "\r\n"), pipeline)
+		assert.Nil(t, err)
+
+		manifest := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_CERT": encryptedTextInEnvelope,
+			},
+		}
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+		err = obfuscator.CollectSecrets(manifest, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		for _, l := range pemLines {
+			// act
+			output := obfuscator.Obfuscate(fmt.Sprintf("cert: %v\n", l))
+
+			assert.Equal(t, "cert: ***\n", output)
+		}
+	})
+
+	t.Run("ObfuscatesIndentedLinesOfMultilineSecretWhenLoggedWithoutIndentation", func(t *testing.T) {
+
+		secretHelper, obfuscator, _, _ := getMocks()
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		encryptedTextInEnvelope, err := secretHelper.EncryptEnvelope("key: |\n    MIIBszCCAVmgAwIBAgIUQ2hlY2tpbmdNdWx0aUxpbmVTZWNyZXRzMAoGCCqGSM49\n    BAMCMBQxEjAQBgNVBAMMCXppcGxpbmVlMB4XDTI0MDEwMTAwMDAwMFoXDTM0MDEw", pipeline)
+		assert.Nil(t, err)
+
+		manifest := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_KEY": encryptedTextInEnvelope,
+			},
+		}
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+		err = obfuscator.CollectSecrets(manifest, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("MIIBszCCAVmgAwIBAgIUQ2hlY2tpbmdNdWx0aUxpbmVTZWNyZXRzMAoGCCqGSM49")
+
+		assert.Equal(t, "***", output)
+	})
+
+	t.Run("DoesNotObfuscateLinesOfMultilineSecretShorterThanMinimumLineLength", func(t *testing.T) {
+
+		secretHelper, obfuscator, _, _ := getMocks()
+		obfuscator.SetMultiLineSecretMinLineLength(16)
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		encryptedTextInEnvelope, err := secretHelper.EncryptEnvelope("-----BEGIN CERTIFICATE-----\nMIIBszCCAVmgAwIBAgIUQ2hlY2tpbmdNdWx0aUxpbmVTZWNyZXRzMAoGCCqGSM49\n=AbCd\n-----END CERTIFICATE-----", pipeline)
+		assert.Nil(t, err)
+
+		manifest := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_CERT": encryptedTextInEnvelope,
+			},
+		}
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+		err = obfuscator.CollectSecrets(manifest, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("MIIBszCCAVmgAwIBAgIUQ2hlY2tpbmdNdWx0aUxpbmVTZWNyZXRzMAoGCCqGSM49\n=AbCd\n")
+
+		assert.Equal(t, "***\n=AbCd\n", output)
+	})
+
+}
+
+func TestSetObfuscationBypass(t *testing.T) {
+
+	t.Run("DoesNotObfuscateSecretsShorterThanMinimumLength", func(t *testing.T) {
+
+		secretHelper, obfuscator, _, _ := getMocks()
+		obfuscator.SetObfuscationBypass(8, nil)
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		shortSecret, err := secretHelper.EncryptEnvelope("admin", pipeline)
+		assert.Nil(t, err)
+		longSecret, err := secretHelper.EncryptEnvelope("s3cr3t-p4ssw0rd", pipeline)
+		assert.Nil(t, err)
+
+		manifest := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_USER":     shortSecret,
+				"MY_PASSWORD": longSecret,
+			},
+		}
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+		err = obfuscator.CollectSecrets(manifest, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("logging in as admin with s3cr3t-p4ssw0rd")
+
+		assert.Equal(t, "logging in as admin with ***", output)
+	})
+
+	t.Run("DoesNotObfuscateAllowlistedPublicValues", func(t *testing.T) {
+
+		secretHelper, obfuscator, _, _ := getMocks()
+		obfuscator.SetObfuscationBypass(0, []string{"true"})
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		publicSecret, err := secretHelper.EncryptEnvelope("true", pipeline)
+		assert.Nil(t, err)
+		realSecret, err := secretHelper.EncryptEnvelope("s3cr3t-p4ssw0rd", pipeline)
+		assert.Nil(t, err)
+
+		manifest := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_FLAG":     publicSecret,
+				"MY_PASSWORD": realSecret,
+			},
+		}
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+		err = obfuscator.CollectSecrets(manifest, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("verbose=true password=s3cr3t-p4ssw0rd base64=dHJ1ZQ==")
+
+		assert.Equal(t, "verbose=true password=*** base64=dHJ1ZQ==", output)
+	})
+
+	t.Run("ObfuscatesShortSecretsByDefault", func(t *testing.T) {
+
+		secretHelper, obfuscator, _, _ := getMocks()
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		shortSecret, err := secretHelper.EncryptEnvelope("true", pipeline)
+		assert.Nil(t, err)
+
+		manifest := manifest.ZiplineeManifest{
+			GlobalEnvVars: map[string]string{
+				"MY_FLAG": shortSecret,
+			},
+		}
+		credentialsBytes, _ := json.Marshal([]*contracts.CredentialConfig{})
+
+		err = obfuscator.CollectSecrets(manifest, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("verbose=true")
+
+		assert.Equal(t, "verbose=***", output)
+	})
+}
+
+func TestEnableCredentialNameObfuscation(t *testing.T) {
+
+	credentials := []*contracts.CredentialConfig{
+		{
+			Name: "gke-acme-production",
+			Type: "kubernetes-engine",
+			AdditionalProperties: map[string]interface{}{
+				"project": "acme-production",
+			},
+		},
+	}
+
+	t.Run("DoesNotObfuscateCredentialNamesByDefault", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		credentialsBytes, _ := json.Marshal(credentials)
+
+		err := obfuscator.CollectSecrets(manifest.ZiplineeManifest{}, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("Using credential gke-acme-production")
+
+		assert.Equal(t, "Using credential gke-acme-production", output)
+	})
+
+	t.Run("ObfuscatesCredentialNamesWhenEnabled", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		obfuscator.EnableCredentialNameObfuscation()
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		credentialsBytes, _ := json.Marshal(credentials)
+
+		err := obfuscator.CollectSecrets(manifest.ZiplineeManifest{}, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("Using credential gke-acme-production of type kubernetes-engine")
+
+		assert.Equal(t, "Using credential *** of type kubernetes-engine", output)
+	})
+
+	t.Run("DoesNotObfuscateAllowlistedCredentialNamesWhenEnabled", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		obfuscator.EnableCredentialNameObfuscation()
+		obfuscator.SetObfuscationBypass(0, []string{"gke-acme-production"})
+		pipeline := "github.com/ziplineeci/ziplinee-ci-builder"
+		credentialsBytes, _ := json.Marshal(credentials)
+
+		err := obfuscator.CollectSecrets(manifest.ZiplineeManifest{}, credentialsBytes, pipeline)
+		assert.Nil(t, err)
+
+		// act
+		output := obfuscator.Obfuscate("Using credential gke-acme-production")
+
+		assert.Equal(t, "Using credential gke-acme-production", output)
+	})
+}
+
+func TestEnableIPAddressObfuscation(t *testing.T) {
+
+	t.Run("DoesNotObfuscateIPAddressesByDefault", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+
+		// act
+		output := obfuscator.Obfuscate("connecting to 10.4.0.12 and fe80::1ff:fe23:4567:890a")
+
+		assert.Equal(t, "connecting to 10.4.0.12 and fe80::1ff:fe23:4567:890a", output)
+	})
+
+	t.Run("ObfuscatesIPv4AddressesWhenEnabled", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		obfuscator.EnableIPAddressObfuscation()
+
+		// act
+		output := obfuscator.Obfuscate("connecting to 10.4.0.12:5432 from 192.168.1.1.")
+
+		assert.Equal(t, "connecting to ***:5432 from ***.", output)
+	})
+
+	t.Run("ObfuscatesIPv6AddressesWhenEnabled", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		obfuscator.EnableIPAddressObfuscation()
+
+		// act
+		output := obfuscator.Obfuscate("listening on fe80::1ff:fe23:4567:890a and ::1")
+
+		assert.Equal(t, "listening on *** and ***", output)
+	})
+
+	t.Run("DoesNotObfuscateTimestampsVersionsOrScopeOperatorsWhenEnabled", func(t *testing.T) {
+
+		_, obfuscator, _, _ := getMocks()
+		obfuscator.EnableIPAddressObfuscation()
+
+		// act
+		output := obfuscator.Obfuscate("12:30:45 installed version 1.22.3 of Foo::Bar")
+
+		assert.Equal(t, "12:30:45 installed version 1.22.3 of Foo::Bar", output)
+	})
 }
@@ -0,0 +1,210 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracingExporter string
+
+const (
+	tracingExporterJaeger tracingExporter = "jaeger"
+	tracingExporterOTLP   tracingExporter = "otlp"
+)
+
+// getTracingExporter reads the exporter to send traces to from the OTEL_TRACES_EXPORTER envvar, defaulting to jaeger
+func getTracingExporter() tracingExporter {
+	value := os.Getenv("OTEL_TRACES_EXPORTER")
+	switch strings.ToLower(value) {
+	case "", string(tracingExporterJaeger):
+		return tracingExporterJaeger
+	case string(tracingExporterOTLP):
+		return tracingExporterOTLP
+	default:
+		log.Warn().Msgf("Unknown tracing exporter '%v', using '%v' instead", value, tracingExporterJaeger)
+		return tracingExporterJaeger
+	}
+}
+
+// otelTracer implements the opentracing tracer on top of an opentelemetry tracer, so spans created with opentracing get exported by opentelemetry
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func newOtelTracer(tracer trace.Tracer) opentracing.Tracer {
+	return &otelTracer{tracer: tracer}
+}
+
+func (t *otelTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	options := opentracing.StartSpanOptions{}
+	for _, opt := range opts {
+		opt.Apply(&options)
+	}
+
+	ctx := context.Background()
+	for _, reference := range options.References {
+		if parent, ok := reference.ReferencedContext.(otelSpanContext); ok {
+			ctx = trace.ContextWithSpanContext(ctx, parent.spanContext)
+			break
+		}
+	}
+
+	startOptions := []trace.SpanStartOption{}
+	if !options.StartTime.IsZero() {
+		startOptions = append(startOptions, trace.WithTimestamp(options.StartTime))
+	}
+
+	_, span := t.tracer.Start(ctx, operationName, startOptions...)
+
+	otelSpan := &otelSpan{span: span, tracer: t}
+	for key, value := range options.Tags {
+		otelSpan.SetTag(key, value)
+	}
+
+	return otelSpan
+}
+
+// Inject isn't supported, the builder doesn't propagate spans across process boundaries
+func (t *otelTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	return opentracing.ErrUnsupportedFormat
+}
+
+// Extract isn't supported, the builder doesn't propagate spans across process boundaries
+func (t *otelTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	return nil, opentracing.ErrUnsupportedFormat
+}
+
+type otelSpanContext struct {
+	spanContext trace.SpanContext
+}
+
+func (c otelSpanContext) ForeachBaggageItem(handler func(k, v string) bool) {}
+
+type otelSpan struct {
+	span   trace.Span
+	tracer *otelTracer
+}
+
+func (s *otelSpan) Finish() {
+	s.span.End()
+}
+
+func (s *otelSpan) FinishWithOptions(opts opentracing.FinishOptions) {
+	for _, record := range opts.LogRecords {
+		s.logFields(record.Timestamp, record.Fields...)
+	}
+	if opts.FinishTime.IsZero() {
+		s.span.End()
+		return
+	}
+	s.span.End(trace.WithTimestamp(opts.FinishTime))
+}
+
+func (s *otelSpan) Context() opentracing.SpanContext {
+	return otelSpanContext{spanContext: s.span.SpanContext()}
+}
+
+func (s *otelSpan) SetOperationName(operationName string) opentracing.Span {
+	s.span.SetName(operationName)
+	return s
+}
+
+func (s *otelSpan) SetTag(key string, value interface{}) opentracing.Span {
+	if key == string(ext.Error) {
+		if isError, ok := value.(bool); ok && isError {
+			s.span.SetStatus(codes.Error, "")
+		}
+	}
+	s.span.SetAttributes(getOtelAttribute(key, value))
+	return s
+}
+
+func (s *otelSpan) LogFields(fields ...otlog.Field) {
+	s.logFields(time.Time{}, fields...)
+}
+
+func (s *otelSpan) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := otlog.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		return
+	}
+	s.LogFields(fields...)
+}
+
+func (s *otelSpan) logFields(timestamp time.Time, fields ...otlog.Field) {
+	attributes := make([]attribute.KeyValue, 0, len(fields))
+	for _, field := range fields {
+		attributes = append(attributes, getOtelAttribute(field.Key(), field.Value()))
+	}
+
+	eventOptions := []trace.EventOption{trace.WithAttributes(attributes...)}
+	if !timestamp.IsZero() {
+		eventOptions = append(eventOptions, trace.WithTimestamp(timestamp))
+	}
+	s.span.AddEvent("log", eventOptions...)
+}
+
+// baggage isn't supported, none of the builder's spans use it
+func (s *otelSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	return s
+}
+
+func (s *otelSpan) BaggageItem(restrictedKey string) string {
+	return ""
+}
+
+func (s *otelSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *otelSpan) LogEvent(event string) {
+	s.LogFields(otlog.String("event", event))
+}
+
+func (s *otelSpan) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(otlog.String("event", event), otlog.Object("payload", payload))
+}
+
+func (s *otelSpan) Log(data opentracing.LogData) {
+	s.logFields(data.Timestamp, otlog.String("event", data.Event), otlog.Object("payload", data.Payload))
+}
+
+func getOtelAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+// otelCloser flushes and stops the opentelemetry tracer provider when the build finishes
+type otelCloser struct {
+	shutdown func(ctx context.Context) error
+}
+
+func (c *otelCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return c.shutdown(ctx)
+}
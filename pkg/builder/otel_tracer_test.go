@@ -0,0 +1,129 @@
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go"
+	foundation "github.com/ziplineeci/ziplinee-foundation"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestGetTracingExporter(t *testing.T) {
+
+	t.Run("ReturnsJaegerIfEnvvarIsNotSet", func(t *testing.T) {
+
+		t.Setenv("OTEL_TRACES_EXPORTER", "")
+
+		// act
+		exporter := getTracingExporter()
+
+		assert.Equal(t, tracingExporterJaeger, exporter)
+	})
+
+	t.Run("ReturnsOTLPIfEnvvarIsSetToOTLP", func(t *testing.T) {
+
+		t.Setenv("OTEL_TRACES_EXPORTER", "OTLP")
+
+		// act
+		exporter := getTracingExporter()
+
+		assert.Equal(t, tracingExporterOTLP, exporter)
+	})
+
+	t.Run("ReturnsJaegerForUnknownExporter", func(t *testing.T) {
+
+		t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+
+		// act
+		exporter := getTracingExporter()
+
+		assert.Equal(t, tracingExporterJaeger, exporter)
+	})
+}
+
+func TestInitTracer(t *testing.T) {
+
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	t.Run("SetsOtelTracerAsGlobalTracerIfExporterIsOTLP", func(t *testing.T) {
+
+		t.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+		ciBuilder := &ciBuilder{applicationInfo: foundation.ApplicationInfo{App: "ziplinee-ci-builder"}}
+
+		// act
+		closer := ciBuilder.initTracer(ciBuilder.applicationInfo.App)
+
+		assert.IsType(t, &otelTracer{}, opentracing.GlobalTracer())
+		assert.IsType(t, &otelCloser{}, closer)
+		assert.Nil(t, closer.Close())
+	})
+
+	t.Run("SetsJaegerTracerAsGlobalTracerIfExporterIsNotSet", func(t *testing.T) {
+
+		t.Setenv("OTEL_TRACES_EXPORTER", "")
+		t.Setenv("JAEGER_SERVICE_NAME", "ziplinee-ci-builder")
+		t.Setenv("JAEGER_SAMPLER_TYPE", "const")
+		t.Setenv("JAEGER_SAMPLER_PARAM", "1")
+		ciBuilder := &ciBuilder{applicationInfo: foundation.ApplicationInfo{App: "ziplinee-ci-builder"}}
+
+		// act
+		closer := ciBuilder.initTracer(ciBuilder.applicationInfo.App)
+
+		assert.IsType(t, &jaeger.Tracer{}, opentracing.GlobalTracer())
+		assert.Nil(t, closer.Close())
+	})
+}
+
+func TestOtelTracer(t *testing.T) {
+
+	getTracerAndRecorder := func() (opentracing.Tracer, *tracetest.SpanRecorder) {
+		recorder := tracetest.NewSpanRecorder()
+		tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		return newOtelTracer(tracerProvider.Tracer("ziplinee-ci-builder")), recorder
+	}
+
+	t.Run("ExportsChildSpanStartedFromContextWithParent", func(t *testing.T) {
+
+		tracer, recorder := getTracerAndRecorder()
+		rootSpan := tracer.StartSpan("RunBuildJob")
+		ctx := opentracing.ContextWithSpan(context.Background(), rootSpan)
+
+		// act
+		span, _ := opentracing.StartSpanFromContextWithTracer(ctx, tracer, "RunStage")
+		span.Finish()
+		rootSpan.Finish()
+
+		endedSpans := recorder.Ended()
+		if assert.Equal(t, 2, len(endedSpans)) {
+			assert.Equal(t, "RunStage", endedSpans[0].Name())
+			assert.Equal(t, "RunBuildJob", endedSpans[1].Name())
+			assert.Equal(t, endedSpans[1].SpanContext().TraceID(), endedSpans[0].SpanContext().TraceID())
+			assert.Equal(t, endedSpans[1].SpanContext().SpanID(), endedSpans[0].Parent().SpanID())
+		}
+	})
+
+	t.Run("ExportsTagsAsAttributesAndErrorTagAsStatus", func(t *testing.T) {
+
+		tracer, recorder := getTracerAndRecorder()
+
+		// act
+		span := tracer.StartSpan("PullImage", opentracing.Tag{Key: "image", Value: "golang:1.22"})
+		span.SetTag("retries", 2)
+		ext.Error.Set(span, true)
+		span.Finish()
+
+		endedSpans := recorder.Ended()
+		if assert.Equal(t, 1, len(endedSpans)) {
+			assert.Contains(t, endedSpans[0].Attributes(), attribute.String("image", "golang:1.22"))
+			assert.Contains(t, endedSpans[0].Attributes(), attribute.Int("retries", 2))
+			assert.Equal(t, codes.Error, endedSpans[0].Status().Code)
+		}
+	})
+}
@@ -3,10 +3,13 @@ package builder
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/logrusorgru/aurora"
@@ -26,7 +29,106 @@ type PipelineRunner interface {
 	RunParallelStages(ctx context.Context, depth int, dir string, envvars map[string]string, parentStage manifest.ZiplineeStage, parallelStages []*manifest.ZiplineeStage) (err error)
 	RunServices(ctx context.Context, envvars map[string]string, parentStage manifest.ZiplineeStage, services []*manifest.ZiplineeService) (err error)
 	StopPipelineOnCancellation(ctx context.Context)
+	IsCanceled() bool
 	EnableBuilderInfoStageInjection()
+	EnableLogStreaming(writer io.Writer)
+	EnableParallelStageLogPrefixing()
+	EnableStageEvents(endOfLifeHelper EndOfLifeHelper)
+	EnableIncrementalLogFlushing(endOfLifeHelper EndOfLifeHelper, interval time.Duration)
+	SetAllowedRegistries(allowedRegistries []string)
+	EnableSimulatedStageFailures()
+	EnableWhenClauseLogging(obfuscator Obfuscator)
+	SetUninterruptibleStageTimeout(timeout time.Duration)
+	SetCleanupTimeout(timeout time.Duration)
+	SetServiceReadinessGracePeriod(gracePeriod time.Duration)
+	SetTrustedImageMirror(mirror string)
+	GetSkipReasons() map[string]SkipReason
+	GetWarnings() []BuildWarning
+}
+
+// SkipReason is a machine-readable explanation why a stage or service got skipped
+type SkipReason string
+
+const (
+	// SkipReasonWhenClauseFalse is for stages and services whose when clause evaluated to false, like after a failed stage
+	SkipReasonWhenClauseFalse SkipReason = "when-clause-false"
+	// SkipReasonGlobalWhenClauseFalse is for all stages of a build whose global when clause evaluated to false
+	SkipReasonGlobalWhenClauseFalse SkipReason = "global-when-clause-false"
+	// SkipReasonResumePoint is for stages before the stage the build resumes from
+	SkipReasonResumePoint SkipReason = "resume-point"
+	// SkipReasonNotRerun is for stages left out when only re-running the failed stages of a previous build, whose results are reused
+	SkipReasonNotRerun SkipReason = "not-rerun"
+)
+
+type imagePullPolicy string
+
+const (
+	// imagePullPolicyAlways pulls the image even if it's already present, useful for mutable tags like latest
+	imagePullPolicyAlways imagePullPolicy = "always"
+	// imagePullPolicyIfNotPresent only pulls the image if it's not present yet; this is the default
+	imagePullPolicyIfNotPresent imagePullPolicy = "if-not-present"
+	// imagePullPolicyNever never pulls the image and fails if it's not present, for air-gapped setups
+	imagePullPolicyNever imagePullPolicy = "never"
+)
+
+// getImagePullPolicy returns the pull policy set with the pullPolicy property on a stage or service
+func getImagePullPolicy(customProperties map[string]interface{}) imagePullPolicy {
+	if value, ok := getCustomPropertyString(customProperties, "pullPolicy"); ok {
+		switch policy := imagePullPolicy(strings.ToLower(value)); policy {
+		case imagePullPolicyAlways, imagePullPolicyIfNotPresent, imagePullPolicyNever:
+			return policy
+		default:
+			log.Warn().Msgf("Unknown pull policy '%v', using '%v' instead", value, imagePullPolicyIfNotPresent)
+		}
+	}
+
+	return imagePullPolicyIfNotPresent
+}
+
+type parallelStagesMode string
+
+const (
+	// parallelStagesModeFailFast cancels the other parallel stages as soon as one of them fails; this is the default
+	parallelStagesModeFailFast parallelStagesMode = "fail-fast"
+	// parallelStagesModeContinue lets the other parallel stages finish when one of them fails
+	parallelStagesModeContinue parallelStagesMode = "continue"
+)
+
+// getParallelStagesMode returns the mode set with the parallelMode property on a stage with parallel stages
+func getParallelStagesMode(customProperties map[string]interface{}) parallelStagesMode {
+	if value, ok := getCustomPropertyString(customProperties, "parallelMode"); ok {
+		switch mode := parallelStagesMode(strings.ToLower(value)); mode {
+		case parallelStagesModeFailFast, parallelStagesModeContinue:
+			return mode
+		default:
+			log.Warn().Msgf("Unknown parallel mode '%v', using '%v' instead", value, parallelStagesModeFailFast)
+		}
+	}
+
+	return parallelStagesModeFailFast
+}
+
+type readinessFailurePolicy string
+
+const (
+	// readinessFailurePolicyAbort fails the stage depending on the service if the service doesn't become ready; this is the default
+	readinessFailurePolicyAbort readinessFailurePolicy = "abort"
+	// readinessFailurePolicyContinue logs a warning and runs the stage anyway, for optional services
+	readinessFailurePolicyContinue readinessFailurePolicy = "continue"
+)
+
+// getReadinessFailurePolicy returns the policy set with the readinessFailure property on a service
+func getReadinessFailurePolicy(customProperties map[string]interface{}) readinessFailurePolicy {
+	if value, ok := getCustomPropertyString(customProperties, "readinessFailure"); ok {
+		switch policy := readinessFailurePolicy(strings.ToLower(value)); policy {
+		case readinessFailurePolicyAbort, readinessFailurePolicyContinue:
+			return policy
+		default:
+			log.Warn().Msgf("Unknown readiness failure policy '%v', using '%v' instead", value, readinessFailurePolicyAbort)
+		}
+	}
+
+	return readinessFailurePolicyAbort
 }
 
 // NewPipelineRunner returns a new PipelineRunner
@@ -39,6 +141,13 @@ func NewPipelineRunner(envvarHelper EnvvarHelper, whenEvaluator WhenEvaluator, c
 		tailLogsChannel: tailLogsChannel,
 		buildLogSteps:   make([]*contracts.BuildLogStep, 0),
 		applicationInfo: applicationInfo,
+		resumeFromStage: os.Getenv("ZIPLINEE_RESUME_FROM_STAGE"),
+		rerunStages:     splitStageNames(os.Getenv("ZIPLINEE_RERUN_STAGES")),
+
+		simulateStageFailure: os.Getenv("ZIPLINEE_SIMULATE_STAGE_FAILURE"),
+
+		uninterruptibleStageTimeout: 15 * time.Minute,
+		cleanupTimeout:              2 * time.Minute,
 	}
 }
 
@@ -51,6 +160,35 @@ type pipelineRunner struct {
 	buildLogSteps          []*contracts.BuildLogStep
 	injectBuilderInfoStage bool
 	applicationInfo        foundation.ApplicationInfo
+	logStreamWriter        io.Writer
+	resumeFromStage        string
+	rerunStages            []string
+	prefixParallelStageLog bool
+	canceled               atomic.Bool
+	stageEventSender       EndOfLifeHelper
+	incrementalLogSender   EndOfLifeHelper
+	incrementalLogInterval time.Duration
+	pendingLogLines        []*pendingLogLines
+	droppedLogLines        int
+	allowedRegistries      []string
+	trustedImageMirror     string
+	skipReasons            map[string]SkipReason
+	skipReasonsMutex       sync.Mutex
+	warnings               []BuildWarning
+	warningsMutex          sync.Mutex
+
+	uninterruptibleStages       sync.WaitGroup
+	uninterruptibleStagesMutex  sync.Mutex
+	uninterruptibleStageTimeout time.Duration
+
+	cleanupTimeout time.Duration
+
+	serviceReadinessGracePeriod time.Duration
+
+	simulateStageFailure         string
+	simulatedStageFailureEnabled bool
+
+	whenClauseObfuscator Obfuscator
 }
 
 func (pr *pipelineRunner) RunStage(ctx context.Context, depth int, dir string, envvars map[string]string, parentStage *manifest.ZiplineeStage, stage manifest.ZiplineeStage, stageIndex int) (err error) {
@@ -59,6 +197,12 @@ func (pr *pipelineRunner) RunStage(ctx context.Context, depth int, dir string, e
 	defer span.Finish()
 	span.SetTag("stage", stage.Name)
 
+	// an uninterruptible stage keeps running on cancellation; stopping the pipeline waits for it to finish
+	if pr.registerUninterruptibleStage(ctx, stage) {
+		defer pr.uninterruptibleStages.Done()
+		ctx = context.WithoutCancel(ctx)
+	}
+
 	// init some variables
 	parentStageName, stagePlaceholder, autoInjected := pr.initStageVariables(ctx, depth, dir, envvars, parentStage, stage)
 	stage.ContainerImage = os.Expand(stage.ContainerImage, pr.envvarHelper.getZiplineeEnv)
@@ -66,12 +210,53 @@ func (pr *pipelineRunner) RunStage(ctx context.Context, depth int, dir string, e
 	log.Debug().Msgf("%v Starting stage", stagePlaceholder)
 
 	// pull image, get size and send pending/running status messages
-	err = pr.pullImageIfNeeded(ctx, stage.Name, parentStageName, stage.ContainerImage, contracts.LogTypeStage, depth, autoInjected)
+	err = pr.pullImageIfNeeded(ctx, stage.Name, parentStageName, stage.ContainerImage, getImagePullPolicy(stage.CustomProperties), contracts.LogTypeStage, depth, autoInjected)
 	defer pr.handleStageFinish(ctx, depth, dir, envvars, parentStage, stage, time.Now(), &err)
 	if pr.isCanceled(ctx) || err != nil {
 		return
 	}
 
+	if pr.isSimulatedStageFailure(stage) {
+		err = fmt.Errorf("Simulated failure of stage %v set in ZIPLINEE_SIMULATE_STAGE_FAILURE", stage.Name)
+		log.Warn().Msgf("%v Failing stage without running it, because it's set in ZIPLINEE_SIMULATE_STAGE_FAILURE", stagePlaceholder)
+
+		logLineObject := contracts.BuildLogLine{
+			LineNumber: 1,
+			Timestamp:  time.Now().UTC(),
+			StreamType: "stderr",
+			Text:       err.Error(),
+		}
+		pr.tailLogsChannel <- contracts.TailLogLine{
+			Step:        stage.Name,
+			ParentStage: parentStageName,
+			Type:        contracts.LogTypeStage,
+			Depth:       depth,
+			LogLine:     &logLineObject,
+		}
+
+		return
+	}
+
+	err = validateStage(stage)
+	if err != nil {
+		// log invalid stage in order to provide helpful message for troubleshooting
+		logLineObject := contracts.BuildLogLine{
+			LineNumber: 1,
+			Timestamp:  time.Now().UTC(),
+			StreamType: "stderr",
+			Text:       err.Error(),
+		}
+		pr.tailLogsChannel <- contracts.TailLogLine{
+			Step:        stage.Name,
+			ParentStage: parentStageName,
+			Type:        contracts.LogTypeStage,
+			Depth:       depth,
+			LogLine:     &logLineObject,
+		}
+
+		return
+	}
+
 	if len(stage.Services) > 0 {
 		// this stage has service containers, start them first
 		err = pr.RunServices(ctx, envvars, stage, stage.Services)
@@ -90,55 +275,97 @@ func (pr *pipelineRunner) RunStage(ctx context.Context, depth int, dir string, e
 			log.Warn().Msgf("%v Can't run parallel stages nested inside nested stages", stagePlaceholder)
 		}
 	} else if stage.ContainerImage != "" {
-		var containerID string
-		containerID, err = pr.containerRunner.StartStageContainer(ctx, depth, dir, envvars, stage, stageIndex)
-		if pr.isCanceled(ctx) || err != nil {
-			if err != nil {
-				// log failure to run stage
-				logLineObject := contracts.BuildLogLine{
-					LineNumber: 10000,
-					Timestamp:  time.Now().UTC(),
-					StreamType: "stderr",
-					Text:       fmt.Sprintf("Failed starting stage: %v", err.Error()),
-				}
-				pr.tailLogsChannel <- contracts.TailLogLine{
-					Step:        stage.Name,
-					ParentStage: parentStageName,
-					Type:        contracts.LogTypeStage,
-					Depth:       depth,
-					LogLine:     &logLineObject,
+		// retry the stage container on the exit codes set in its retries and retryOnExitCodes properties
+		retryPolicy := getStageRetryPolicy(stage.CustomProperties)
+		for attempt := 0; ; attempt++ {
+			var containerID string
+			containerID, err = pr.containerRunner.StartStageContainer(ctx, depth, dir, pr.getStageEnvvars(ctx, envvars, parentStageName, stage), stage, stageIndex)
+			if pr.isCanceled(ctx) || err != nil {
+				if err != nil {
+					// log failure to run stage
+					logLineObject := contracts.BuildLogLine{
+						LineNumber: 10000,
+						Timestamp:  time.Now().UTC(),
+						StreamType: "stderr",
+						Text:       fmt.Sprintf("Failed starting stage: %v", err.Error()),
+					}
+					pr.tailLogsChannel <- contracts.TailLogLine{
+						Step:        stage.Name,
+						ParentStage: parentStageName,
+						Type:        contracts.LogTypeStage,
+						Depth:       depth,
+						LogLine:     &logLineObject,
+					}
 				}
+
+				return
 			}
 
-			return
-		}
+			err = pr.containerRunner.TailContainerLogs(ctx, containerID, parentStageName, stage.Name, contracts.LogTypeStage, depth, nil)
+			if !pr.isCanceled(ctx) && err != nil {
+				if exitCode, retry := retryPolicy.shouldRetry(err, attempt); retry {
+					log.Warn().Err(err).Msgf("%v Retrying stage after exit code %v (retry %v of %v)", stagePlaceholder, exitCode, attempt+1, retryPolicy.retries)
 
-		err = pr.containerRunner.TailContainerLogs(ctx, containerID, parentStageName, stage.Name, contracts.LogTypeStage, depth, nil)
-		if pr.isCanceled(ctx) || err != nil {
-			if err != nil {
-				// log failure to run stage
-				logLineObject := contracts.BuildLogLine{
-					LineNumber: 10000,
-					Timestamp:  time.Now().UTC(),
-					StreamType: "stderr",
-					Text:       fmt.Sprintf("Failed running stage: %v", err.Error()),
+					logLineObject := contracts.BuildLogLine{
+						LineNumber: 10000,
+						Timestamp:  time.Now().UTC(),
+						StreamType: "stderr",
+						Text:       fmt.Sprintf("Retrying stage after exit code %v (retry %v of %v)", exitCode, attempt+1, retryPolicy.retries),
+					}
+					pr.tailLogsChannel <- contracts.TailLogLine{
+						Step:        stage.Name,
+						ParentStage: parentStageName,
+						Type:        contracts.LogTypeStage,
+						Depth:       depth,
+						LogLine:     &logLineObject,
+					}
+
+					continue
 				}
-				pr.tailLogsChannel <- contracts.TailLogLine{
-					Step:        stage.Name,
-					ParentStage: parentStageName,
-					Type:        contracts.LogTypeStage,
-					Depth:       depth,
-					LogLine:     &logLineObject,
+			}
+			if pr.isCanceled(ctx) || err != nil {
+				if err != nil {
+					// log failure to run stage
+					logLineObject := contracts.BuildLogLine{
+						LineNumber: 10000,
+						Timestamp:  time.Now().UTC(),
+						StreamType: "stderr",
+						Text:       fmt.Sprintf("Failed running stage: %v", err.Error()),
+					}
+					pr.tailLogsChannel <- contracts.TailLogLine{
+						Step:        stage.Name,
+						ParentStage: parentStageName,
+						Type:        contracts.LogTypeStage,
+						Depth:       depth,
+						LogLine:     &logLineObject,
+					}
 				}
+
+				return
 			}
 
-			return
+			break
 		}
 	}
 
 	return
 }
 
+// validateStage checks whether a stage has something to run; a stage with an image but without commands runs the image's default command
+func validateStage(stage manifest.ZiplineeStage) error {
+	if stage.ContainerImage != "" || len(stage.ParallelStages) > 0 {
+		return nil
+	}
+	if len(stage.Commands) > 0 {
+		return fmt.Errorf("Stage %v has commands but no image to run them in", stage.Name)
+	}
+	if len(stage.Services) == 0 {
+		return fmt.Errorf("Stage %v has neither an image nor commands", stage.Name)
+	}
+
+	return nil
+}
+
 func (pr *pipelineRunner) initStageVariables(ctx context.Context, depth int, dir string, envvars map[string]string, parentStage *manifest.ZiplineeStage, stage manifest.ZiplineeStage) (parentStageName string, stagePlaceholder string, autoInjected *bool) {
 
 	if parentStage != nil {
@@ -195,7 +422,7 @@ func (pr *pipelineRunner) RunService(ctx context.Context, envvars map[string]str
 	log.Info().Msgf("[%v] [%v] Starting service", parentStage.Name, service.Name)
 
 	// pull image, get size and send pending/running status messages
-	err = pr.pullImageIfNeeded(ctx, service.Name, parentStage.Name, service.ContainerImage, contracts.LogTypeService, depth, nil)
+	err = pr.pullImageIfNeeded(ctx, service.Name, parentStage.Name, service.ContainerImage, getImagePullPolicy(service.CustomProperties), contracts.LogTypeService, depth, nil)
 	dockerRunStart := time.Now()
 	defer pr.handleServiceFinish(ctx, envvars, parentStage, service, true, dockerRunStart, &err)
 	if pr.isCanceled(ctx) || err != nil {
@@ -219,6 +446,10 @@ func (pr *pipelineRunner) RunService(ctx context.Context, envvars map[string]str
 	if service.Readiness != nil {
 		log.Info().Msgf("[%v] Starting readiness probe...", parentStage.Name)
 		err = pr.containerRunner.RunReadinessProbeContainer(ctx, parentStage, service, *service.Readiness)
+		if !pr.isCanceled(ctx) && err != nil && getReadinessFailurePolicy(service.CustomProperties) == readinessFailurePolicyContinue && !pr.requiresServiceReadiness(service) {
+			log.Warn().Err(err).Msgf("[%v] [%v] Service failed to become ready, continuing since its readinessFailure property is set to %v", parentStage.Name, service.Name, readinessFailurePolicyContinue)
+			err = nil
+		}
 		if pr.isCanceled(ctx) || err != nil {
 			return
 		}
@@ -259,17 +490,20 @@ func (pr *pipelineRunner) RunStages(ctx context.Context, depth int, stages []*ma
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RunStages")
 	defer span.Finish()
 
-	// start log tailing
 	pr.buildLogSteps = make([]*contracts.BuildLogStep, 0)
-	tailLogsDone := make(chan struct{}, 1)
-	go pr.tailLogs(ctx, tailLogsDone, stages)
+	pr.pendingLogLines = nil
+	pr.droppedLogLines = 0
+	pr.skipReasons = map[string]SkipReason{}
 
 	err = pr.containerRunner.CreateNetworks(ctx)
 	if err != nil {
+		err = newInfrastructureError(err)
 		return
 	}
 	defer func(ctx context.Context) {
-		_ = pr.containerRunner.DeleteNetworks(ctx)
+		pr.runCleanupWithTimeout("Deleting networks", func() {
+			_ = pr.containerRunner.DeleteNetworks(ctx)
+		})
 	}(ctx)
 
 	// set default build status at the start
@@ -282,6 +516,18 @@ func (pr *pipelineRunner) RunStages(ctx context.Context, depth int, stages []*ma
 		return buildLogSteps, fmt.Errorf("Manifest has no stages, failing the build")
 	}
 
+	if depth == 0 {
+		// fail fast instead of running stages that miss the outputs of the stages they need
+		err = validateStageDependencies(stages)
+		if err != nil {
+			return buildLogSteps, err
+		}
+	}
+
+	// start log tailing once the stages are certain to run, so a failed attempt doesn't leave a tailing goroutine behind
+	tailLogsDone := make(chan struct{}, 1)
+	go pr.tailLogs(ctx, tailLogsDone, stages)
+
 	// creates first injected stage with builder info
 	if pr.injectBuilderInfoStage {
 		pr.logBuilderInfo(ctx, pr.applicationInfo)
@@ -289,9 +535,18 @@ func (pr *pipelineRunner) RunStages(ctx context.Context, depth int, stages []*ma
 
 	log.Debug().Msgf("Running %v stages", len(stages))
 
+	if depth == 0 {
+		if warning := getShallowCloneWarning(pr.envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_CLONE_DEPTH"), stages); warning != "" {
+			pr.addWarning("", "", contracts.LogTypeStage, depth, warning)
+		}
+	}
+
+	resumeFromStageIndex := pr.getResumeFromStageIndex(depth, stages)
+	rerunStageNames := pr.getRerunStageNames(depth, stages)
+
 	var finalErr error
-	for _, s := range stages {
-		func(stage *manifest.ZiplineeStage) {
+	for i, s := range stages {
+		func(stageIndex int, stage *manifest.ZiplineeStage) {
 			defer func(stage *manifest.ZiplineeStage) {
 				// handle cancellation happening in between stages
 				if pr.isCanceled(ctx) {
@@ -300,8 +555,25 @@ func (pr *pipelineRunner) RunStages(ctx context.Context, depth int, stages []*ma
 				}
 			}(stage)
 
+			if stageIndex < resumeFromStageIndex {
+				// the artifacts of stages before the resume point are expected to be present in the work directory already
+				log.Info().Msgf("%v Skipping stage, resuming from stage %v", getLogPrefix(stage.Name, ""), pr.resumeFromStage)
+				pr.setSkipReasonForStage(*stage, SkipReasonResumePoint)
+				pr.forceStatusForStage(*stage, contracts.LogStatusSkipped)
+				return
+			}
+
+			if rerunStageNames != nil && !rerunStageNames[stage.Name] {
+				// the artifacts of stages that aren't re-run are expected to be present in the work directory from the previous build
+				log.Info().Msgf("%v Skipping stage, only re-running stages %v", getLogPrefix(stage.Name, ""), strings.Join(pr.rerunStages, ", "))
+				pr.setSkipReasonForStage(*stage, SkipReasonNotRerun)
+				pr.forceStatusForStage(*stage, contracts.LogStatusSkipped)
+				return
+			}
+
 			var whenEvaluationResult bool
-			whenEvaluationResult, err = pr.whenEvaluator.Evaluate(stage.Name, stage.When, pr.whenEvaluator.GetParameters())
+			whenParameters := pr.whenEvaluator.GetParameters()
+			whenEvaluationResult, err = pr.whenEvaluator.Evaluate(stage.Name, stage.When, whenParameters)
 			if err != nil {
 				// set 'failed' build status
 				envErr := pr.envvarHelper.setZiplineeEnv("ZIPLINEE_BUILD_STATUS", "failed")
@@ -334,9 +606,11 @@ func (pr *pipelineRunner) RunStages(ctx context.Context, depth int, stages []*ma
 				}
 			} else {
 				// if an error has happened in one of the previous steps or the when expression evaluates to false we still want to render the following steps in the result table
+				pr.logSkippingWhenClause(stage.Name, "", contracts.LogTypeStage, depth, stage.When, whenParameters)
+				pr.setSkipReasonForStage(*stage, SkipReasonWhenClauseFalse)
 				pr.forceStatusForStage(*stage, contracts.LogStatusSkipped)
 			}
-		}(s)
+		}(i, s)
 	}
 
 	pr.containerRunner.StopMultiStageServiceContainers(ctx)
@@ -346,6 +620,192 @@ func (pr *pipelineRunner) RunStages(ctx context.Context, depth int, stages []*ma
 	return pr.getLogs(ctx), finalErr
 }
 
+// getShallowCloneWarning returns a warning if the repository gets cloned shallowly while a stage derives a version with git describe, which needs the tags in the history
+func getShallowCloneWarning(cloneDepth string, stages []*manifest.ZiplineeStage) string {
+	depth, err := strconv.Atoi(cloneDepth)
+	if err != nil || depth <= 0 {
+		return ""
+	}
+
+	for _, s := range stages {
+		for _, stage := range append([]*manifest.ZiplineeStage{s}, s.ParallelStages...) {
+			for _, command := range stage.Commands {
+				if strings.Contains(command, "git describe") {
+					return fmt.Sprintf("Stage %v runs git describe, but the repository is cloned with depth %v; tags outside of the cloned history can't be found, so set a larger clone depth or 0 for a full clone", stage.Name, depth)
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// getStageNeeds returns the names of the stages a stage needs the outputs of, as set with the needs property
+func getStageNeeds(stage *manifest.ZiplineeStage) []string {
+	needs, _ := getCustomPropertyStringSlice(stage.CustomProperties, "needs")
+	return needs
+}
+
+// validateStageDependencies checks that the stages set with the needs property exist and don't form a cycle; since stages run in order, needed stages also have to run before the stages that need them
+func validateStageDependencies(stages []*manifest.ZiplineeStage) error {
+	stageIndexes := map[string]int{}
+	for i, s := range stages {
+		stageIndexes[s.Name] = i
+	}
+
+	for _, s := range stages {
+		for _, need := range getStageNeeds(s) {
+			if _, ok := stageIndexes[need]; !ok {
+				return fmt.Errorf("Stage %v needs stage %v, which doesn't exist", s.Name, need)
+			}
+		}
+	}
+
+	if cycle := getStageDependencyCycle(stages); len(cycle) > 0 {
+		return fmt.Errorf("Stage dependencies form a cycle: %v", strings.Join(cycle, " -> "))
+	}
+
+	for i, s := range stages {
+		for _, need := range getStageNeeds(s) {
+			if stageIndexes[need] > i {
+				return fmt.Errorf("Stage %v needs stage %v, which runs after it", s.Name, need)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getStageDependencyCycle returns the path of the first cycle in the stage dependencies, starting and ending with the same stage, or nil if there is none
+func getStageDependencyCycle(stages []*manifest.ZiplineeStage) []string {
+	needs := map[string][]string{}
+	for _, s := range stages {
+		needs[s.Name] = getStageNeeds(s)
+	}
+
+	visited := map[string]bool{}
+	onPath := map[string]bool{}
+	path := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		visited[name] = true
+		onPath[name] = true
+		path = append(path, name)
+
+		for _, need := range needs[name] {
+			if onPath[need] {
+				for i, p := range path {
+					if p == need {
+						return append(append([]string{}, path[i:]...), need)
+					}
+				}
+			}
+			if !visited[need] {
+				if cycle := visit(need); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		onPath[name] = false
+
+		return nil
+	}
+
+	for _, s := range stages {
+		if !visited[s.Name] {
+			if cycle := visit(s.Name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
+
+// getResumeFromStageIndex returns the index of the top-level stage set in ZIPLINEE_RESUME_FROM_STAGE, or 0 to run all stages
+func (pr *pipelineRunner) getResumeFromStageIndex(depth int, stages []*manifest.ZiplineeStage) int {
+	if pr.resumeFromStage == "" || depth > 0 {
+		return 0
+	}
+
+	for i, s := range stages {
+		if s.Name == pr.resumeFromStage {
+			return i
+		}
+	}
+
+	log.Warn().Msgf("Stage %v to resume from does not exist, running all stages", pr.resumeFromStage)
+
+	return 0
+}
+
+// getRerunStageNames returns the names of the top-level stages to run when only re-running the stages set in ZIPLINEE_RERUN_STAGES, like the failed stages of a previous build;
+// next to those it runs the stages they need and auto-injected stages like git-clone, and for a nested stage its parent stage. It returns nil to run all stages.
+func (pr *pipelineRunner) getRerunStageNames(depth int, stages []*manifest.ZiplineeStage) map[string]bool {
+	if len(pr.rerunStages) == 0 || depth > 0 {
+		return nil
+	}
+
+	stagesByName := map[string]*manifest.ZiplineeStage{}
+	parentStageNames := map[string]string{}
+	for _, s := range stages {
+		stagesByName[s.Name] = s
+		for _, ps := range s.ParallelStages {
+			parentStageNames[ps.Name] = s.Name
+		}
+	}
+
+	rerunStageNames := map[string]bool{}
+	var addStage func(name string)
+	addStage = func(name string) {
+		if rerunStageNames[name] {
+			return
+		}
+		rerunStageNames[name] = true
+		for _, need := range getStageNeeds(stagesByName[name]) {
+			addStage(need)
+		}
+	}
+
+	for _, name := range pr.rerunStages {
+		if _, ok := stagesByName[name]; ok {
+			addStage(name)
+		} else if parentStageName, ok := parentStageNames[name]; ok {
+			addStage(parentStageName)
+		} else {
+			log.Warn().Msgf("Stage %v to re-run does not exist", name)
+		}
+	}
+
+	if len(rerunStageNames) == 0 {
+		log.Warn().Msgf("None of the stages %v to re-run exist, running all stages", strings.Join(pr.rerunStages, ", "))
+		return nil
+	}
+
+	for _, s := range stages {
+		if s.AutoInjected {
+			rerunStageNames[s.Name] = true
+		}
+	}
+
+	return rerunStageNames
+}
+
+// splitStageNames returns the stage names in a comma separated list, leaving out empty ones
+func splitStageNames(value string) []string {
+	stageNames := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			stageNames = append(stageNames, name)
+		}
+	}
+
+	return stageNames
+}
+
 func (pr *pipelineRunner) RunParallelStages(ctx context.Context, depth int, dir string, envvars map[string]string, parentStage manifest.ZiplineeStage, parallelStages []*manifest.ZiplineeStage) (err error) {
 
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RunParallelStages")
@@ -355,9 +815,17 @@ func (pr *pipelineRunner) RunParallelStages(ctx context.Context, depth int, dir
 		return fmt.Errorf("Manifest has no stages, failing the build")
 	}
 
-	log.Debug().Msgf("[%v] Running %v parallel stages", parentStage.Name, len(parallelStages))
+	parallelMode := getParallelStagesMode(parentStage.CustomProperties)
 
-	g, ctx := errgroup.WithContext(ctx)
+	log.Debug().Msgf("[%v] Running %v parallel stages in %v mode", parentStage.Name, len(parallelStages), parallelMode)
+
+	var g *errgroup.Group
+	if parallelMode == parallelStagesModeContinue {
+		// without a group context a failing stage doesn't cancel its siblings; the first error is still returned once all finished
+		g = &errgroup.Group{}
+	} else {
+		g, ctx = errgroup.WithContext(ctx)
+	}
 	for i, ps := range parallelStages {
 		stageIndex := i
 		stage := *ps
@@ -368,7 +836,8 @@ func (pr *pipelineRunner) RunParallelStages(ctx context.Context, depth int, dir
 				return nil
 			}
 
-			whenEvaluationResult, err := pr.whenEvaluator.Evaluate(stage.Name, stage.When, pr.whenEvaluator.GetParameters())
+			whenParameters := pr.whenEvaluator.GetParameters()
+			whenEvaluationResult, err := pr.whenEvaluator.Evaluate(stage.Name, stage.When, whenParameters)
 			if pr.isCanceled(ctx) || err != nil {
 				if err != nil {
 					return err
@@ -388,12 +857,13 @@ func (pr *pipelineRunner) RunParallelStages(ctx context.Context, depth int, dir
 			} else {
 
 				// if an error has happened in one of the previous steps or the when expression evaluates to false we still want to render the following steps in the result table
+				pr.setSkipReason(stage.Name, parentStage.Name, SkipReasonWhenClauseFalse)
 				status := contracts.LogStatusSkipped
 				logLineObject := contracts.BuildLogLine{
 					LineNumber: 10000,
 					Timestamp:  time.Now().UTC(),
 					StreamType: "stdout",
-					Text:       pr.whenEvaluator.Describe(stage.When, pr.whenEvaluator.GetParameters()),
+					Text:       pr.describeWhenClause(stage.When, whenParameters),
 				}
 				pr.tailLogsChannel <- contracts.TailLogLine{
 					Step:         stage.Name,
@@ -438,7 +908,8 @@ func (pr *pipelineRunner) RunServices(ctx context.Context, envvars map[string]st
 				service.Shell = "/bin/sh"
 			}
 
-			whenEvaluationResult, err := pr.whenEvaluator.Evaluate(service.Name, service.When, pr.whenEvaluator.GetParameters())
+			whenParameters := pr.whenEvaluator.GetParameters()
+			whenEvaluationResult, err := pr.whenEvaluator.Evaluate(service.Name, service.When, whenParameters)
 
 			if pr.isCanceled(ctx) || err != nil {
 				if err != nil {
@@ -469,12 +940,19 @@ func (pr *pipelineRunner) RunServices(ctx context.Context, envvars map[string]st
 
 					errors <- err
 				}
+			} else {
+				pr.logSkippingWhenClause(service.Name, parentStage.Name, contracts.LogTypeService, 1, service.When, whenParameters)
+				pr.setSkipReason(service.Name, parentStage.Name, SkipReasonWhenClauseFalse)
+				pr.sendStatusMessage(service.Name, parentStage.Name, contracts.LogTypeService, 1, nil, nil, nil, contracts.LogStatusSkipped)
 			}
 		}(ctx, envvars, parentStage, *s)
 	}
 
 	// wait for readiness for all services
-	wg.Wait()
+	err = pr.waitForServices(&wg, parentStage)
+	if err != nil {
+		return
+	}
 
 	close(errors)
 	for e := range errors {
@@ -485,18 +963,230 @@ func (pr *pipelineRunner) RunServices(ctx context.Context, envvars map[string]st
 	return
 }
 
+// waitForServices waits until all services of a stage are started and ready; with a service readiness grace period it gives up once that has passed, failing the stage instead of starting it before its services are listening
+func (pr *pipelineRunner) waitForServices(wg *sync.WaitGroup, parentStage manifest.ZiplineeStage) error {
+	if pr.serviceReadinessGracePeriod <= 0 {
+		wg.Wait()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(pr.serviceReadinessGracePeriod):
+		log.Warn().Msgf("[%v] Services didn't become ready within %v", parentStage.Name, pr.serviceReadinessGracePeriod)
+		return fmt.Errorf("Services of stage %v didn't become ready within %v", parentStage.Name, pr.serviceReadinessGracePeriod)
+	}
+}
+
+// requiresServiceReadiness returns whether a service has to pass its readiness probe before the stage depending on it starts, regardless of its readinessFailure property
+func (pr *pipelineRunner) requiresServiceReadiness(service manifest.ZiplineeService) bool {
+	return pr.serviceReadinessGracePeriod > 0 && (service.MultiStage == nil || !*service.MultiStage)
+}
+
 func (pr *pipelineRunner) StopPipelineOnCancellation(ctx context.Context) {
 
 	// wait for cancellation
 	<-ctx.Done()
 
-	pr.containerRunner.StopAllContainers(ctx)
+	// mark the pipeline as canceled before stopping containers, so failures caused by stopping them don't count as genuine failures
+	pr.uninterruptibleStagesMutex.Lock()
+	pr.canceled.Store(true)
+	pr.uninterruptibleStagesMutex.Unlock()
+
+	pr.waitForUninterruptibleStages()
+
+	pr.runCleanupWithTimeout("Stopping all containers", func() {
+		pr.containerRunner.StopAllContainers(ctx)
+	})
+}
+
+// runCleanupWithTimeout gives up waiting for a cleanup operation after the cleanup timeout, so an unresponsive docker daemon can't keep the build from sending its final events
+func (pr *pipelineRunner) runCleanupWithTimeout(description string, cleanup func()) {
+	if pr.cleanupTimeout <= 0 {
+		cleanup()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cleanup()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(pr.cleanupTimeout):
+		log.Warn().Msgf("%v didn't finish within %v, continuing without waiting for it", description, pr.cleanupTimeout)
+	}
+}
+
+// registerUninterruptibleStage returns true if the stage is marked as uninterruptible and got registered as running; once the pipeline is canceled no stage gets registered anymore
+func (pr *pipelineRunner) registerUninterruptibleStage(ctx context.Context, stage manifest.ZiplineeStage) bool {
+	uninterruptible, ok := getCustomPropertyBool(stage.CustomProperties, "uninterruptible")
+	if !ok || !uninterruptible {
+		return false
+	}
+
+	pr.uninterruptibleStagesMutex.Lock()
+	defer pr.uninterruptibleStagesMutex.Unlock()
+
+	if pr.canceled.Load() || pr.isCanceled(ctx) {
+		return false
+	}
+
+	pr.uninterruptibleStages.Add(1)
+
+	return true
+}
+
+// waitForUninterruptibleStages waits for running uninterruptible stages to finish, but no longer than the uninterruptible stage timeout
+func (pr *pipelineRunner) waitForUninterruptibleStages() {
+	done := make(chan struct{})
+	go func() {
+		pr.uninterruptibleStages.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(pr.uninterruptibleStageTimeout):
+		log.Warn().Msgf("Uninterruptible stages didn't finish within %v after cancellation, stopping them", pr.uninterruptibleStageTimeout)
+	}
+}
+
+func (pr *pipelineRunner) IsCanceled() bool {
+	return pr.canceled.Load()
 }
 
 func (pr *pipelineRunner) EnableBuilderInfoStageInjection() {
 	pr.injectBuilderInfoStage = true
 }
 
+// EnableLogStreaming mirrors every log line to the writer as it arrives, independent of shipping the logs when the build is done
+func (pr *pipelineRunner) EnableLogStreaming(writer io.Writer) {
+	pr.logStreamWriter = writer
+}
+
+func (pr *pipelineRunner) EnableParallelStageLogPrefixing() {
+	pr.prefixParallelStageLog = true
+}
+
+func (pr *pipelineRunner) EnableStageEvents(endOfLifeHelper EndOfLifeHelper) {
+	pr.stageEventSender = endOfLifeHelper
+}
+
+// EnableIncrementalLogFlushing makes the runner send the log lines of running stages and services to the api every interval, instead of only in the build log at the end, so partial logs survive the pod getting killed
+func (pr *pipelineRunner) EnableIncrementalLogFlushing(endOfLifeHelper EndOfLifeHelper, interval time.Duration) {
+	pr.incrementalLogSender = endOfLifeHelper
+	pr.incrementalLogInterval = interval
+}
+
+// SetAllowedRegistries restricts the registries stage and service images can come from, except for trusted images; an empty list allows any registry
+func (pr *pipelineRunner) SetAllowedRegistries(allowedRegistries []string) {
+	pr.allowedRegistries = allowedRegistries
+}
+
+// EnableSimulatedStageFailures makes the stage named in ZIPLINEE_SIMULATE_STAGE_FAILURE fail without running, for chaos testing the ci platform; only enable it for builders of non-production pipelines
+func (pr *pipelineRunner) EnableSimulatedStageFailures() {
+	pr.simulatedStageFailureEnabled = true
+}
+
+// getStageEnvvars returns a copy of envvars with the name of the stage and its parent stage added, so parallel stages sharing envvars don't see each other's names; the trace context of the active span gets added as well, for tools in the stage to emit child spans
+func (pr *pipelineRunner) getStageEnvvars(ctx context.Context, envvars map[string]string, parentStageName string, stage manifest.ZiplineeStage) map[string]string {
+
+	stageEnvvars := make(map[string]string, len(envvars)+4)
+	for key, value := range envvars {
+		stageEnvvars[key] = value
+	}
+
+	stageEnvvars[pr.envvarHelper.getZiplineeEnvvarName("ZIPLINEE_STAGE_NAME")] = stage.Name
+	if parentStageName != "" {
+		stageEnvvars[pr.envvarHelper.getZiplineeEnvvarName("ZIPLINEE_PARENT_STAGE_NAME")] = parentStageName
+	} else {
+		delete(stageEnvvars, pr.envvarHelper.getZiplineeEnvvarName("ZIPLINEE_PARENT_STAGE_NAME"))
+	}
+
+	if traceParent, traceID, ok := getTraceContext(opentracing.SpanFromContext(ctx)); ok {
+		stageEnvvars["TRACEPARENT"] = traceParent
+		stageEnvvars[pr.envvarHelper.getZiplineeEnvvarName("ZIPLINEE_TRACE_ID")] = traceID
+	}
+
+	return stageEnvvars
+}
+
+func (pr *pipelineRunner) isSimulatedStageFailure(stage manifest.ZiplineeStage) bool {
+	if pr.simulateStageFailure == "" || stage.Name != pr.simulateStageFailure {
+		return false
+	}
+	if !pr.simulatedStageFailureEnabled {
+		log.Warn().Msgf("Ignoring ZIPLINEE_SIMULATE_STAGE_FAILURE for stage %v, because simulated stage failures aren't enabled for this builder", stage.Name)
+		return false
+	}
+
+	return true
+}
+
+// EnableWhenClauseLogging adds the when clause and the parameters it got evaluated with to the build log of stages and services skipped because of it, so the reason is persisted regardless of the log level
+func (pr *pipelineRunner) EnableWhenClauseLogging(obfuscator Obfuscator) {
+	pr.whenClauseObfuscator = obfuscator
+}
+
+func (pr *pipelineRunner) describeWhenClause(when string, parameters map[string]interface{}) string {
+	description := pr.whenEvaluator.Describe(when, parameters)
+	if pr.whenClauseObfuscator != nil {
+		return pr.whenClauseObfuscator.Obfuscate(description)
+	}
+
+	return description
+}
+
+func (pr *pipelineRunner) logSkippingWhenClause(step, parentStageName string, logType contracts.LogType, depth int, when string, parameters map[string]interface{}) {
+	if pr.whenClauseObfuscator == nil {
+		return
+	}
+
+	logLineObject := contracts.BuildLogLine{
+		LineNumber: 1,
+		Timestamp:  time.Now().UTC(),
+		StreamType: "stdout",
+		Text:       pr.describeWhenClause(when, parameters),
+	}
+	pr.tailLogsChannel <- contracts.TailLogLine{
+		Step:        step,
+		ParentStage: parentStageName,
+		Type:        logType,
+		Depth:       depth,
+		LogLine:     &logLineObject,
+	}
+}
+
+// SetUninterruptibleStageTimeout bounds how long stopping the pipeline on cancellation waits for uninterruptible stages
+func (pr *pipelineRunner) SetUninterruptibleStageTimeout(timeout time.Duration) {
+	pr.uninterruptibleStageTimeout = timeout
+}
+
+// SetCleanupTimeout bounds how long stopping containers and deleting networks during teardown can take; 0 waits for them indefinitely
+func (pr *pipelineRunner) SetCleanupTimeout(timeout time.Duration) {
+	pr.cleanupTimeout = timeout
+}
+
+// SetServiceReadinessGracePeriod makes single-stage services pass their readiness probe before the stage depending on them starts, and waits at most gracePeriod for all services of a stage; 0 waits indefinitely and lets the readinessFailure property of services decide
+func (pr *pipelineRunner) SetServiceReadinessGracePeriod(gracePeriod time.Duration) {
+	pr.serviceReadinessGracePeriod = gracePeriod
+}
+
+// SetTrustedImageMirror makes a failing pull of a trusted image fall back to pulling the image at the same path from the mirror, like mirror.gcr.io; empty fails the stage instead
+func (pr *pipelineRunner) SetTrustedImageMirror(mirror string) {
+	pr.trustedImageMirror = mirror
+}
+
 func (pr *pipelineRunner) isCanceled(ctx context.Context) bool {
 
 	select {
@@ -508,7 +1198,7 @@ func (pr *pipelineRunner) isCanceled(ctx context.Context) bool {
 	return false
 }
 
-func (pr *pipelineRunner) pullImageIfNeeded(ctx context.Context, stageName, parentStageName, containerImage string, containerType contracts.LogType, depth int, autoInjected *bool) (err error) {
+func (pr *pipelineRunner) pullImageIfNeeded(ctx context.Context, stageName, parentStageName, containerImage string, pullPolicy imagePullPolicy, containerType contracts.LogType, depth int, autoInjected *bool) (err error) {
 
 	var isPulledImage bool
 	var isTrustedImage bool
@@ -531,14 +1221,60 @@ func (pr *pipelineRunner) pullImageIfNeeded(ctx context.Context, stageName, pare
 			IsPulled:               isPulledImage,
 		}
 
-		if !pr.isCanceled(ctx) && (!isPulledImage || runtime.GOOS == "windows") {
+		if !pr.isCanceled(ctx) && len(pr.allowedRegistries) > 0 && !isTrustedImage && !isAllowedRegistry(containerImage, pr.allowedRegistries) {
+			err = fmt.Errorf("Image %v is from registry %v, which is not one of the allowed registries %v", containerImage, getContainerImageRegistry(containerImage), strings.Join(pr.allowedRegistries, ", "))
+
+			// log disallowed registry in order to provide helpful message for troubleshooting
+			logLineObject := contracts.BuildLogLine{
+				LineNumber: 1,
+				Timestamp:  time.Now().UTC(),
+				StreamType: "stderr",
+				Text:       err.Error(),
+			}
+			pr.tailLogsChannel <- contracts.TailLogLine{
+				Step:        stageName,
+				ParentStage: parentStageName,
+				Type:        containerType,
+				Depth:       depth,
+				LogLine:     &logLineObject,
+			}
+
+			return
+		}
+
+		if !pr.isCanceled(ctx) && !isPulledImage && pullPolicy == imagePullPolicyNever {
+			err = fmt.Errorf("Image %v is not present and pull policy is %v", containerImage, pullPolicy)
+
+			// log missing image in order to provide helpful message for troubleshooting
+			logLineObject := contracts.BuildLogLine{
+				LineNumber: 1,
+				Timestamp:  time.Now().UTC(),
+				StreamType: "stderr",
+				Text:       err.Error(),
+			}
+			pr.tailLogsChannel <- contracts.TailLogLine{
+				Step:        stageName,
+				ParentStage: parentStageName,
+				Type:        containerType,
+				Depth:       depth,
+				LogLine:     &logLineObject,
+			}
+
+			return
+		}
+
+		if !pr.isCanceled(ctx) && pullPolicy != imagePullPolicyNever && (!isPulledImage || pullPolicy == imagePullPolicyAlways || runtime.GOOS == "windows") {
 
 			// start pulling stage
 			pr.sendStatusMessage(stageName, parentStageName, containerType, depth, autoInjected, buildLogStepDockerImage, nil, contracts.LogStatusPending)
 
 			// pull docker image
 			dockerPullStart := time.Now()
-			err = pr.containerRunner.PullImage(ctx, stageName, parentStageName, containerImage)
+			if isTrustedImage {
+				err = newInfrastructureError(pr.pullTrustedImage(ctx, stageName, parentStageName, containerImage, containerType, depth))
+			} else {
+				err = newInfrastructureError(pr.containerRunner.PullImage(ctx, stageName, parentStageName, containerImage))
+			}
 			imagePullDuration = time.Since(dockerPullStart)
 
 			if err != nil {
@@ -575,6 +1311,12 @@ func (pr *pipelineRunner) pullImageIfNeeded(ctx context.Context, stageName, pare
 				}
 			}
 		}
+
+		if !pr.isCanceled(ctx) && err == nil {
+			for _, warning := range getImageWarnings(containerImage, imageSize, hasInjectedCredentials) {
+				pr.addWarning(stageName, parentStageName, containerType, depth, warning)
+			}
+		}
 	}
 
 	if !pr.isCanceled(ctx) && err == nil {
@@ -601,6 +1343,44 @@ func (pr *pipelineRunner) sendStatusMessage(step, parentStageName string, contai
 	pr.tailLogsChannel <- tailLogLine
 }
 
+// GetSkipReasons returns why stages and services got skipped, keyed by their name prefixed with the parent stage name like stage/service for nested ones
+func (pr *pipelineRunner) GetSkipReasons() map[string]SkipReason {
+	pr.skipReasonsMutex.Lock()
+	defer pr.skipReasonsMutex.Unlock()
+
+	skipReasons := make(map[string]SkipReason, len(pr.skipReasons))
+	for key, reason := range pr.skipReasons {
+		skipReasons[key] = reason
+	}
+
+	return skipReasons
+}
+
+func (pr *pipelineRunner) setSkipReason(step, parentStageName string, reason SkipReason) {
+	pr.skipReasonsMutex.Lock()
+	defer pr.skipReasonsMutex.Unlock()
+
+	if pr.skipReasons == nil {
+		pr.skipReasons = map[string]SkipReason{}
+	}
+	pr.skipReasons[getSkipReasonKey(step, parentStageName)] = reason
+}
+
+// setSkipReasonForStage sets the reason for a stage and its parallel stages, which get skipped along with it
+func (pr *pipelineRunner) setSkipReasonForStage(stage manifest.ZiplineeStage, reason SkipReason) {
+	pr.setSkipReason(stage.Name, "", reason)
+	for _, ps := range stage.ParallelStages {
+		pr.setSkipReason(ps.Name, stage.Name, reason)
+	}
+}
+
+func getSkipReasonKey(step, parentStageName string) string {
+	if parentStageName == "" {
+		return step
+	}
+	return parentStageName + "/" + step
+}
+
 func (pr *pipelineRunner) forceStatusForStage(stage manifest.ZiplineeStage, status contracts.LogStatus) {
 
 	var autoInjected *bool
@@ -664,10 +1444,29 @@ func (pr *pipelineRunner) tailLogs(ctx context.Context, tailLogsDone chan struct
 
 	allLogsReceived := make(chan struct{}, 1)
 
+	// a nil channel never fires, leaving incremental log flushing off
+	var flushIncrementalLogs <-chan time.Time
+	if pr.incrementalLogSender != nil && pr.incrementalLogInterval > 0 {
+		ticker := time.NewTicker(pr.incrementalLogInterval)
+		defer ticker.Stop()
+		flushIncrementalLogs = ticker.C
+	}
+
+	// stage events are sent from a separate goroutine, so a slow api doesn't hold up tailing the logs
+	var stageEvents chan contracts.TailLogLine
+	stageEventsSent := make(chan struct{}, 1)
+	if pr.stageEventSender != nil {
+		stageEvents = make(chan contracts.TailLogLine, stageEventsQueueSize)
+		go pr.sendStageEvents(ctx, stageEvents, stageEventsSent)
+	}
+
 	for {
 		select {
 		case tailLogLine := <-pr.tailLogsChannel:
 
+			// only the readable output gets prefixed, the stored build log and the json stream keep the stage in their own fields
+			printedTailLogLine := pr.prefixParallelStageLogLine(tailLogLine)
+
 			// this is for go.cd and local builds with ziplinee cli
 			prefix := getLogPrefix(tailLogLine.Step, tailLogLine.ParentStage)
 			newline := "\n"
@@ -678,6 +1477,11 @@ func (pr *pipelineRunner) tailLogs(ctx context.Context, tailLogsDone chan struct
 			if pr.runAsJob {
 				// this provides log streaming capabilities in the web interface
 				log.Info().Interface("tailLogLine", tailLogLine).Msg("")
+
+				// this provides readable live logs when tailing the pod logs
+				if pr.logStreamWriter != nil {
+					pr.streamTailLogLine(printedTailLogLine)
+				}
 			} else if tailLogLine.Status != nil && tailLogLine.Duration != nil {
 				switch *tailLogLine.Status {
 				case contracts.LogStatusSucceeded:
@@ -690,17 +1494,38 @@ func (pr *pipelineRunner) tailLogs(ctx context.Context, tailLogsDone chan struct
 			} else if tailLogLine.Image != nil && tailLogLine.Image.PullDuration.Seconds() > 0 {
 				log.Info().Msgf("%v Pulled in %v", prefix, aurora.BrightGreen(tailLogLine.Image.PullDuration))
 			} else if tailLogLine.LogLine != nil {
-				log.Info().Msgf("%v %v", prefix, strings.TrimSuffix(tailLogLine.LogLine.Text, "\n"))
+				log.Info().Msgf("%v %v", prefix, strings.TrimSuffix(printedTailLogLine.LogLine.Text, "\n"))
 			}
 
 			pr.upsertTailLogLine(tailLogLine)
 
+			if stageEvents != nil && isStageEvent(tailLogLine) {
+				stageEvents <- tailLogLine
+			}
+
+			if flushIncrementalLogs != nil {
+				pr.bufferIncrementalLogLine(tailLogLine)
+			}
+
 			if tailLogLine.Status != nil && pr.isFinalStageComplete(stages) {
 				// signal that running stages have finished so taillogs can stop
 				allLogsReceived <- struct{}{}
 			}
 
+		case <-flushIncrementalLogs:
+			pr.flushIncrementalLogs(ctx)
+
 		case <-allLogsReceived:
+			if flushIncrementalLogs != nil {
+				pr.flushIncrementalLogs(ctx)
+			}
+
+			// wait for the queued stage events to be sent, so none get lost when the builder exits
+			if stageEvents != nil {
+				close(stageEvents)
+				<-stageEventsSent
+			}
+
 			// signal that tailing logs is done
 			tailLogsDone <- struct{}{}
 			return
@@ -708,6 +1533,147 @@ func (pr *pipelineRunner) tailLogs(ctx context.Context, tailLogsDone chan struct
 	}
 }
 
+// stageEventsQueueSize bounds the stage events waiting to be sent; with a handful of events per stage tailing the logs only blocks on it if the api stops responding
+const stageEventsQueueSize = 100
+
+// isStageEvent returns whether the tail log line is a stage starting or finishing, which gets reported as a stage event
+func isStageEvent(tailLogLine contracts.TailLogLine) bool {
+	if tailLogLine.Type != contracts.LogTypeStage || tailLogLine.Status == nil {
+		return false
+	}
+
+	switch *tailLogLine.Status {
+	case contracts.LogStatusRunning, contracts.LogStatusSucceeded, contracts.LogStatusFailed, contracts.LogStatusCanceled, contracts.LogStatusSkipped:
+		return true
+	}
+
+	return false
+}
+
+// sendStageEvents reports stages starting and finishing individually, so a ui doesn't have to wait for the build log at the end; it signals once the stage events channel is closed and all events are sent
+func (pr *pipelineRunner) sendStageEvents(ctx context.Context, stageEvents <-chan contracts.TailLogLine, stageEventsSent chan<- struct{}) {
+	for tailLogLine := range stageEvents {
+		err := pr.stageEventSender.SendStageEvent(ctx, tailLogLine.Step, tailLogLine.ParentStage, *tailLogLine.Status, tailLogLine.Duration)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed sending %v event for stage %v", *tailLogLine.Status, tailLogLine.Step)
+		}
+	}
+
+	stageEventsSent <- struct{}{}
+}
+
+// pendingLogLines holds the log lines of a stage or service that haven't been sent to the api incrementally yet
+type pendingLogLines struct {
+	stage       string
+	parentStage string
+	logType     contracts.LogType
+	logLines    []contracts.BuildLogLine
+}
+
+// maxPendingLogLines bounds the log lines buffered for incremental sending, so an unreachable api doesn't make them pile up for the whole build; the full log still gets shipped at the end
+const maxPendingLogLines = 10000
+
+func (pr *pipelineRunner) bufferIncrementalLogLine(tailLogLine contracts.TailLogLine) {
+	if tailLogLine.LogLine == nil {
+		return
+	}
+
+	if pr.countPendingLogLines() >= maxPendingLogLines {
+		pr.dropOldestPendingLogLine()
+	}
+
+	for _, p := range pr.pendingLogLines {
+		if p.stage == tailLogLine.Step && p.parentStage == tailLogLine.ParentStage && p.logType == tailLogLine.Type {
+			p.logLines = append(p.logLines, *tailLogLine.LogLine)
+			return
+		}
+	}
+
+	pr.pendingLogLines = append(pr.pendingLogLines, &pendingLogLines{
+		stage:       tailLogLine.Step,
+		parentStage: tailLogLine.ParentStage,
+		logType:     tailLogLine.Type,
+		logLines:    []contracts.BuildLogLine{*tailLogLine.LogLine},
+	})
+}
+
+func (pr *pipelineRunner) countPendingLogLines() (count int) {
+	for _, p := range pr.pendingLogLines {
+		count += len(p.logLines)
+	}
+
+	return count
+}
+
+// dropOldestPendingLogLine drops the first line of the stage that has been waiting longest, since the latest lines matter most when following a build
+func (pr *pipelineRunner) dropOldestPendingLogLine() {
+	if len(pr.pendingLogLines) == 0 {
+		return
+	}
+
+	p := pr.pendingLogLines[0]
+	p.logLines = p.logLines[1:]
+	if len(p.logLines) == 0 {
+		pr.pendingLogLines = pr.pendingLogLines[1:]
+	}
+	pr.droppedLogLines++
+}
+
+// flushIncrementalLogs sends the log lines received since the previous flush per stage; lines that fail to send stay buffered and get sent again with the next flush
+func (pr *pipelineRunner) flushIncrementalLogs(ctx context.Context) {
+	if pr.droppedLogLines > 0 {
+		log.Warn().Msgf("Dropped %v incremental log lines after failing to send them, the full log gets shipped at the end of the build", pr.droppedLogLines)
+		pr.droppedLogLines = 0
+	}
+
+	remaining := make([]*pendingLogLines, 0)
+	for _, p := range pr.pendingLogLines {
+		err := pr.incrementalLogSender.SendIncrementalLog(ctx, p.stage, p.parentStage, p.logType, p.logLines)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed sending incremental log for stage %v", p.stage)
+			remaining = append(remaining, p)
+		}
+	}
+	pr.pendingLogLines = remaining
+}
+
+// prefixParallelStageLogLine prefixes the text of log lines from parallel stages with the stage name, so interleaved lines can be told apart in a flat view
+func (pr *pipelineRunner) prefixParallelStageLogLine(tailLogLine contracts.TailLogLine) contracts.TailLogLine {
+	if !pr.prefixParallelStageLog || tailLogLine.Type != contracts.LogTypeStage || tailLogLine.ParentStage == "" || tailLogLine.LogLine == nil {
+		return tailLogLine
+	}
+
+	logLine := *tailLogLine.LogLine
+	logLine.Text = fmt.Sprintf("[%v] %v", tailLogLine.Step, logLine.Text)
+	tailLogLine.LogLine = &logLine
+
+	return tailLogLine
+}
+
+func (pr *pipelineRunner) streamTailLogLine(tailLogLine contracts.TailLogLine) {
+
+	prefix := fmt.Sprintf("[%v]", tailLogLine.Step)
+	if tailLogLine.ParentStage != "" {
+		prefix = fmt.Sprintf("[%v] [%v]", tailLogLine.ParentStage, tailLogLine.Step)
+	}
+
+	var line string
+	if tailLogLine.Status != nil && tailLogLine.Duration != nil {
+		line = fmt.Sprintf("%v %v in %v", prefix, *tailLogLine.Status, *tailLogLine.Duration)
+	} else if tailLogLine.Image != nil && tailLogLine.Image.PullDuration.Seconds() > 0 {
+		line = fmt.Sprintf("%v Pulled in %v", prefix, tailLogLine.Image.PullDuration)
+	} else if tailLogLine.LogLine != nil {
+		line = fmt.Sprintf("%v %v", prefix, strings.TrimSuffix(tailLogLine.LogLine.Text, "\n"))
+	} else {
+		return
+	}
+
+	_, err := fmt.Fprintln(pr.logStreamWriter, line)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed streaming log line")
+	}
+}
+
 func (pr *pipelineRunner) logBuilderInfo(ctx context.Context, applicationInfo foundation.ApplicationInfo) {
 
 	builderVersionMessage := fmt.Sprintf("Starting \x1b[1m%v\x1b[0m version \x1b[1m%v\x1b[0m... \x1b[36mbranch=\x1b[0m%v \x1b[36mbuildDate=\x1b[0m%v \x1b[36mgoVersion=\x1b[0m%v \x1b[36mos=\x1b[0m%v \x1b[36mrevision=\x1b[0m%v", applicationInfo.App, applicationInfo.Version, applicationInfo.Branch, applicationInfo.BuildDate, applicationInfo.GoVersion(), applicationInfo.OperatingSystem(), applicationInfo.Revision)
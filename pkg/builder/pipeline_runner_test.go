@@ -1,14 +1,23 @@
 package builder
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go"
 	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
 	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
 	foundation "github.com/ziplineeci/ziplinee-foundation"
@@ -44,7 +53,7 @@ func TestRunStage(t *testing.T) {
 		assert.Equal(t, "Failed pulling image", err.Error())
 	})
 
-	t.Run("ReturnsErrorWhenGetImageSizeFails", func(t *testing.T) {
+	t.Run("StartsContainerForStageWithImageWithoutCommands", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -56,23 +65,23 @@ func TestRunStage(t *testing.T) {
 		envvars := map[string]string{}
 		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
-			Name:           "stage-a",
-			ContainerImage: "alpine:latest",
+			Name:           "postgres",
+			ContainerImage: "postgres:16-alpine",
 		}
 		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), fmt.Errorf("Failed getting image size"))
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), "postgres", gomock.Any(), "postgres:16-alpine").Return(nil)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), depth, dir, map[string]string{"TESTPREFIX_STAGE_NAME": "postgres"}, stage, stageIndex).Return("abc", nil)
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.NotNil(t, err)
-		assert.Equal(t, "Failed getting image size", err.Error())
+		assert.Nil(t, err)
 	})
 
-	t.Run("ReturnsErrorWhenStartStageContainerFails", func(t *testing.T) {
+	t.Run("ReturnsErrorForStageWithoutImageAndCommands", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -84,23 +93,18 @@ func TestRunStage(t *testing.T) {
 		envvars := map[string]string{}
 		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
-			Name:           "stage-a",
-			ContainerImage: "alpine:latest",
+			Name: "empty",
 		}
 		stageIndex := 0
 
-		// set mock responses
-		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("", fmt.Errorf("Failed starting container"))
-		setDefaultMockExpectancies(containerRunnerMock)
-
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.NotNil(t, err)
-		assert.Equal(t, "Failed starting container", err.Error())
+		assert.Equal(t, "Stage empty has neither an image nor commands", err.Error())
 	})
 
-	t.Run("ReturnsErrorWhenTailContainerLogsFails", func(t *testing.T) {
+	t.Run("ReturnsErrorForStageWithCommandsWithoutImage", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -112,23 +116,19 @@ func TestRunStage(t *testing.T) {
 		envvars := map[string]string{}
 		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
-			Name:           "stage-a",
-			ContainerImage: "alpine:latest",
+			Name:     "build",
+			Commands: []string{"go build"},
 		}
 		stageIndex := 0
 
-		// set mock responses
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed tailing container logs"))
-		setDefaultMockExpectancies(containerRunnerMock)
-
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.NotNil(t, err)
-		assert.Equal(t, "Failed tailing container logs", err.Error())
+		assert.Equal(t, "Stage build has commands but no image to run them in", err.Error())
 	})
 
-	t.Run("ReturnsNoErrorWhenContainerPullsStartsAndLogs", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenGetImageSizeFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -146,25 +146,22 @@ func TestRunStage(t *testing.T) {
 		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(false)
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
-		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), nil)
-		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), fmt.Errorf("Failed getting image size"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.Nil(t, err)
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed getting image size", err.Error())
 	})
 
-	t.Run("SendsSequenceOfRunningAndSucceededMessageToChannelForSuccessfulRunWhenImageIsAlreadyPulled", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenStartStageContainerFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
 		depth := 0
 		dir := "/ziplinee-work"
@@ -177,27 +174,22 @@ func TestRunStage(t *testing.T) {
 		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("", fmt.Errorf("Failed starting container"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.Nil(t, err)
-
-		runningStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
-
-		succeededStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusSucceeded, *succeededStatusMessage.Status)
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed starting container", err.Error())
 	})
 
-	t.Run("SendsSequenceOfPendingAndRunningAndSucceededMessageToChannelForSuccessfulRun", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenTailContainerLogsFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
 		depth := 0
 		dir := "/ziplinee-work"
@@ -210,332 +202,398 @@ func TestRunStage(t *testing.T) {
 		stageIndex := 0
 
 		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed tailing container logs"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.Nil(t, err)
-
-		pendingStatusAndImageInfoMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusPending, *pendingStatusAndImageInfoMessage.Status)
-		assert.NotNil(t, pendingStatusAndImageInfoMessage.Image)
-
-		runningStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
-
-		succeededStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusSucceeded, *succeededStatusMessage.Status)
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed tailing container logs", err.Error())
 	})
 
-	t.Run("SendsSequenceOfPendingAndRunningAndFailedMessageToChannelForFailingRun", func(t *testing.T) {
+	t.Run("ClassifiesPullImageFailureAsInfrastructureError", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
-		envvars := map[string]string{}
-		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
 			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
 		}
-		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed tailing container logs"))
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("registry unreachable"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
 
-		assert.NotNil(t, err)
+		assert.True(t, isInfrastructureError(err))
+	})
 
-		pendingStatusAndImageInfoMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusPending, *pendingStatusAndImageInfoMessage.Status)
-		assert.NotNil(t, pendingStatusAndImageInfoMessage.Image)
+	t.Run("DoesNotClassifyFailingStageAsInfrastructureError", func(t *testing.T) {
 
-		runningStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		failedStageMessage := <-tailLogsChannel
-		assert.Equal(t, "Failed running stage: Failed tailing container logs", failedStageMessage.LogLine.Text)
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+		}
 
-		failedStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusFailed, *failedStatusMessage.Status)
+		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed with exit code: 1"))
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		assert.NotNil(t, err)
+		assert.False(t, isInfrastructureError(err))
 	})
 
-	t.Run("SendsCanceledMessageToChannelForCanceledRun", func(t *testing.T) {
+	t.Run("ReturnsNoErrorWhenImageIsFromAllowedRegistry", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetAllowedRegistries([]string{"docker.io", "gcr.io/ziplinee"})
 
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
 		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
-			Name:           "stage-a",
-			ContainerImage: "alpine:latest",
+			Name:           "build",
+			ContainerImage: "golang:1.22-alpine",
 		}
 		stageIndex := 0
 
 		// set mock responses
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), "build", "", "golang:1.22-alpine").Return(nil).Times(1)
 		setDefaultMockExpectancies(containerRunnerMock)
-		ctx, cancel := context.WithCancel(context.Background())
 
 		// act
-		go pipelineRunner.StopPipelineOnCancellation(ctx)
-		cancel()
-		time.Sleep(10 * time.Millisecond)
-		err := pipelineRunner.RunStage(ctx, depth, dir, envvars, parentStage, stage, stageIndex)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
-
-		canceledStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusCanceled, *canceledStatusMessage.Status)
 	})
 
-	t.Run("SendsCanceledMessageToChannelForCanceledRunEvenWhenRunFails", func(t *testing.T) {
+	t.Run("ReturnsErrorWithoutPullingWhenImageIsFromDisallowedRegistry", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetAllowedRegistries([]string{"gcr.io/ziplinee"})
 
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
 		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
-			Name:           "stage-a",
-			ContainerImage: "alpine:latest",
+			Name:           "build",
+			ContainerImage: "quay.io/somebody/golang:1.22-alpine",
 		}
 		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed tailing container logs")).AnyTimes()
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
 		setDefaultMockExpectancies(containerRunnerMock)
-		ctx, cancel := context.WithCancel(context.Background())
 
 		// act
-		go pipelineRunner.StopPipelineOnCancellation(ctx)
-		cancel()
-		time.Sleep(10 * time.Millisecond)
-		err := pipelineRunner.RunStage(ctx, depth, dir, envvars, parentStage, stage, stageIndex)
-
-		assert.Nil(t, err)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		canceledStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusCanceled, *canceledStatusMessage.Status)
+		assert.NotNil(t, err)
+		assert.Equal(t, "Image quay.io/somebody/golang:1.22-alpine is from registry quay.io, which is not one of the allowed registries gcr.io/ziplinee", err.Error())
 	})
 
-	t.Run("SendsMessagesWithDepthAndParentStageSet", func(t *testing.T) {
+	t.Run("ReturnsNoErrorWhenTrustedImageIsFromDisallowedRegistry", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetAllowedRegistries([]string{"gcr.io/ziplinee"})
 
-		depth := 1
+		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
+		var parentStage *manifest.ZiplineeStage = nil
 		stage := manifest.ZiplineeStage{
-			Name:           "nested-stage-0",
-			ContainerImage: "alpine:latest",
-		}
-		var parentStage *manifest.ZiplineeStage = &manifest.ZiplineeStage{
-			Name: "stage-a",
-			ParallelStages: []*manifest.ZiplineeStage{
-				&stage,
-			},
+			Name:           "git-clone",
+			ContainerImage: "ziplinee/ziplinee-extension-git-clone:stable",
 		}
 		stageIndex := 0
 
 		// set mock responses
+		containerRunnerMock.EXPECT().IsTrustedImage("git-clone", "ziplinee/ziplinee-extension-git-clone:stable").Return(true)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), "git-clone", "", "ziplinee/ziplinee-extension-git-clone:stable").Return(nil).Times(1)
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
 		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
-
-		pendingStatusMessage := <-tailLogsChannel
-		assert.Equal(t, "nested-stage-0", pendingStatusMessage.Step)
-		assert.Equal(t, 1, pendingStatusMessage.Depth)
-		assert.Equal(t, "stage-a", pendingStatusMessage.ParentStage)
-
-		runningStatusMessage := <-tailLogsChannel
-		assert.Equal(t, "nested-stage-0", runningStatusMessage.Step)
-		assert.Equal(t, 1, runningStatusMessage.Depth)
-		assert.Equal(t, "stage-a", runningStatusMessage.ParentStage)
-
-		succeededStatusMessage := <-tailLogsChannel
-		assert.Equal(t, "nested-stage-0", succeededStatusMessage.Step)
-		assert.Equal(t, 1, succeededStatusMessage.Depth)
-		assert.Equal(t, "stage-a", succeededStatusMessage.ParentStage)
 	})
-}
-
-func TestRunService(t *testing.T) {
 
-	t.Run("ReturnsErrorWhenPullImageFails", func(t *testing.T) {
+	t.Run("InjectsStageNameIntoEnvvarsOfTopLevelStage", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
-			ContainerImage: "alpine:latest",
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{"TESTPREFIX_BUILD_STATUS": "succeeded"}
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "build",
+			ContainerImage: "golang:1.22-alpine",
 		}
+		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed pulling image"))
+		var stageEnvvars map[string]string
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), depth, dir, gomock.Any(), stage, stageIndex).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (containerID string, err error) {
+				stageEnvvars = envvars
+				return "abc", nil
+			})
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.NotNil(t, err)
-		assert.Equal(t, "Failed pulling image", err.Error())
+		assert.Nil(t, err)
+		assert.Equal(t, "build", stageEnvvars["TESTPREFIX_STAGE_NAME"])
+		assert.Equal(t, "succeeded", stageEnvvars["TESTPREFIX_BUILD_STATUS"])
+		assert.NotContains(t, stageEnvvars, "TESTPREFIX_PARENT_STAGE_NAME")
+		assert.Equal(t, map[string]string{"TESTPREFIX_BUILD_STATUS": "succeeded"}, envvars)
 	})
 
-	t.Run("ReturnsErrorWhenGetImageSizeFails", func(t *testing.T) {
+	t.Run("InjectsStageAndParentStageNameIntoEnvvarsOfNestedStage", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 1
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
+		parentStage := &manifest.ZiplineeStage{
+			Name: "test",
 		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
-			ContainerImage: "alpine:latest",
+		stage := manifest.ZiplineeStage{
+			Name:           "unit-tests",
+			ContainerImage: "golang:1.22-alpine",
 		}
+		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), fmt.Errorf("Failed getting image size"))
+		var stageEnvvars map[string]string
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), depth, dir, gomock.Any(), stage, stageIndex).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (containerID string, err error) {
+				stageEnvvars = envvars
+				return "abc", nil
+			})
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.NotNil(t, err)
-		assert.Equal(t, "Failed getting image size", err.Error())
+		assert.Nil(t, err)
+		assert.Equal(t, "unit-tests", stageEnvvars["TESTPREFIX_STAGE_NAME"])
+		assert.Equal(t, "test", stageEnvvars["TESTPREFIX_PARENT_STAGE_NAME"])
+		assert.Empty(t, envvars)
 	})
 
-	t.Run("ReturnsErrorWhenStartStageContainerFails", func(t *testing.T) {
+	t.Run("InjectsTraceContextOfActiveSpanIntoEnvvarsOfStage", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		tracer, closer := jaeger.NewTracer("ziplinee-ci-builder", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+		defer closer.Close()
+		opentracing.SetGlobalTracer(tracer)
+		defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+		buildSpan := tracer.StartSpan("RunZiplineeBuildJob")
+		defer buildSpan.Finish()
+		traceID := fmt.Sprintf("%032x", buildSpan.Context().(jaeger.SpanContext).TraceID().Low)
+
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
-			ContainerImage: "alpine:latest",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "build",
+			ContainerImage: "golang:1.22-alpine",
 		}
+		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().StartServiceContainer(gomock.Any(), gomock.Any(), gomock.Any()).Return("", fmt.Errorf("Failed starting container"))
+		var stageEnvvars map[string]string
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), depth, dir, gomock.Any(), stage, stageIndex).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (containerID string, err error) {
+				stageEnvvars = envvars
+				return "abc", nil
+			})
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+		err := pipelineRunner.RunStage(opentracing.ContextWithSpan(context.Background(), buildSpan), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		assert.NotNil(t, err)
-		assert.Equal(t, "Failed starting container", err.Error())
+		assert.Nil(t, err)
+		assert.Equal(t, traceID, stageEnvvars["TESTPREFIX_TRACE_ID"])
+		assert.Regexp(t, "^00-"+traceID+"-[0-9a-f]{16}-01$", stageEnvvars["TRACEPARENT"])
+		buildTraceParent, _, _ := getTraceContext(buildSpan)
+		assert.NotEqual(t, buildTraceParent, stageEnvvars["TRACEPARENT"], "the stage should get the context of its own span, not the one of the build")
 	})
 
-	t.Run("ReturnsNoErrorWhenTailContainerLogsFailsSinceItRunsInTheBackground", func(t *testing.T) {
+	t.Run("DoesNotInjectTraceContextIntoEnvvarsOfStageWithoutActiveSpan", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
-			ContainerImage: "alpine:latest",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "build",
+			ContainerImage: "golang:1.22-alpine",
 		}
+		stageIndex := 0
 
 		// set mock responses
-		var wg sync.WaitGroup
-		wg.Add(1)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				defer wg.Done()
-				return fmt.Errorf("Failed tailing container logs")
+		var stageEnvvars map[string]string
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), depth, dir, gomock.Any(), stage, stageIndex).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (containerID string, err error) {
+				stageEnvvars = envvars
+				return "abc", nil
 			})
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
-
-		// wait for tailContainerLogsFunc to finish
-		wg.Wait()
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
+		assert.NotContains(t, stageEnvvars, "TRACEPARENT")
+		assert.NotContains(t, stageEnvvars, "TESTPREFIX_TRACE_ID")
 	})
 
-	t.Run("ReturnsErrorWhenRunReadinessProbeContainerFails", func(t *testing.T) {
+	t.Run("RetriesStageOnExitCodeSetInRetryOnExitCodes", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "integration-tests",
+			ContainerImage: "golang:1.22-alpine",
+			CustomProperties: map[string]interface{}{
+				"retries":          2,
+				"retryOnExitCodes": []interface{}{124},
+			},
 		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
-			ContainerImage: "alpine:latest",
-			Readiness:      &manifest.ReadinessProbe{},
+		stageIndex := 0
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil).Times(2)
+		gomock.InOrder(
+			containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), "abc", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&containerExitError{exitCode: 124}),
+			containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), "abc", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil),
+		)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("DoesNotRetryStageOnExitCodeNotSetInRetryOnExitCodes", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "integration-tests",
+			ContainerImage: "golang:1.22-alpine",
+			CustomProperties: map[string]interface{}{
+				"retries":          2,
+				"retryOnExitCodes": []interface{}{124},
+			},
 		}
+		stageIndex := 0
 
 		// set mock responses
-		var wg sync.WaitGroup
-		wg.Add(1)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				defer wg.Done()
-				return nil
-			})
-		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed readiness probe"))
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil).Times(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), "abc", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&containerExitError{exitCode: 1}).Times(1)
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		// wait for tailContainerLogsFunc to finish
-		wg.Wait()
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed with exit code: 1", err.Error())
+	})
+
+	t.Run("ReturnsErrorOfLastAttemptWhenRetriesAreExhausted", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "integration-tests",
+			ContainerImage: "golang:1.22-alpine",
+			CustomProperties: map[string]interface{}{
+				"retries":          2,
+				"retryOnExitCodes": []interface{}{124},
+			},
+		}
+		stageIndex := 0
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil).Times(3)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), "abc", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&containerExitError{exitCode: 124}).Times(3)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.NotNil(t, err)
-		assert.Equal(t, "Failed readiness probe", err.Error())
+		assert.Equal(t, "Failed with exit code: 124", err.Error())
 	})
 
 	t.Run("ReturnsNoErrorWhenContainerPullsStartsAndLogs", func(t *testing.T) {
@@ -545,165 +603,198 @@ func TestRunService(t *testing.T) {
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
-			Readiness:      &manifest.ReadinessProbe{},
 		}
+		stageIndex := 0
 
 		// set mock responses
 		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(false)
 		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), nil)
-		containerRunnerMock.EXPECT().StartServiceContainer(gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				defer wg.Done()
-				return nil
-			})
-		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
-
-		// wait for tailContainerLogsFunc to finish
-		wg.Wait()
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
 	})
 
-	t.Run("SendsRunningMessageToChannelForSuccessfulRunWhenImageIsAlreadyPulled", func(t *testing.T) {
+	t.Run("SendsSequenceOfRunningAndSucceededMessageToChannelForSuccessfulRunWhenImageIsAlreadyPulled", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
 		}
+		stageIndex := 0
 
 		// set mock responses
 		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				defer wg.Done()
-				return nil
-			})
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
-
-		// wait for tailContainerLogsFunc to finish
-		wg.Wait()
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
 
 		runningStatusMessage := <-tailLogsChannel
 		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
+
+		succeededStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusSucceeded, *succeededStatusMessage.Status)
 	})
 
-	t.Run("SendsSequenceOfPendingAndRunningMessageToChannelForSuccessfulStartAndReadiness", func(t *testing.T) {
+	t.Run("FailsStageSetInSimulateStageFailureEnvvarWithoutRunningIt", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_SIMULATE_STAGE_FAILURE", "stage-a")
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.EnableSimulatedStageFailures()
 
-		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
 		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
+
+		// set mock responses; no container gets started
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false).AnyTimes()
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false).AnyTimes()
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Simulated failure of stage stage-a")
+		}
+
+		var finalStatusMessage contracts.TailLogLine
+		for len(tailLogsChannel) > 0 {
+			tailLogLine := <-tailLogsChannel
+			if tailLogLine.Status != nil {
+				finalStatusMessage = tailLogLine
+			}
+		}
+		if assert.NotNil(t, finalStatusMessage.Status) {
+			assert.Equal(t, contracts.LogStatusFailed, *finalStatusMessage.Status)
+		}
+	})
+
+	t.Run("RunsStageSetInSimulateStageFailureEnvvarIfSimulatedStageFailuresAreNotEnabled", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_SIMULATE_STAGE_FAILURE", "stage-a")
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
-			Readiness:      &manifest.ReadinessProbe{},
 		}
 
 		// set mock responses
-		var wg sync.WaitGroup
-		wg.Add(1)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				defer wg.Done()
-				return nil
-			})
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil).Times(1)
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
 
-		// wait for tailContainerLogsFunc to finish
-		wg.Wait()
+		assert.Nil(t, err)
+	})
+
+	t.Run("SendsSequenceOfPendingAndRunningAndSucceededMessageToChannelForSuccessfulRun", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+		}
+		stageIndex := 0
+
+		// set mock responses
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
 
-		pendingStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusPending, *pendingStatusMessage.Status)
+		pendingStatusAndImageInfoMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusPending, *pendingStatusAndImageInfoMessage.Status)
+		assert.NotNil(t, pendingStatusAndImageInfoMessage.Image)
 
 		runningStatusMessage := <-tailLogsChannel
 		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
+
+		succeededStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusSucceeded, *succeededStatusMessage.Status)
 	})
 
-	t.Run("SendsSequenceOfPendingAndRunningAndFailedMessageToChannelForFailingReadiness", func(t *testing.T) {
+	t.Run("SendsSequenceOfPendingAndRunningAndFailedMessageToChannelForFailingRun", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
-			Readiness:      &manifest.ReadinessProbe{},
 		}
+		stageIndex := 0
 
 		// set mock responses
-		var wg sync.WaitGroup
-		wg.Add(1)
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				defer wg.Done()
-				// ensure tailing doesn't set status before the main routine does
-				time.Sleep(100 * time.Millisecond)
-				return nil
-			})
-		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed readiness probe"))
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed tailing container logs"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
-
-		// wait for tailContainerLogsFunc to finish
-		wg.Wait()
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.NotNil(t, err)
 
-		pendingStatusMessage := <-tailLogsChannel
-		assert.Equal(t, contracts.LogStatusPending, *pendingStatusMessage.Status)
+		pendingStatusAndImageInfoMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusPending, *pendingStatusAndImageInfoMessage.Status)
+		assert.NotNil(t, pendingStatusAndImageInfoMessage.Image)
 
 		runningStatusMessage := <-tailLogsChannel
 		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
 
+		failedStageMessage := <-tailLogsChannel
+		assert.Equal(t, "Failed running stage: Failed tailing container logs", failedStageMessage.LogLine.Text)
+
 		failedStatusMessage := <-tailLogsChannel
 		assert.Equal(t, contracts.LogStatusFailed, *failedStatusMessage.Status)
 	})
@@ -715,14 +806,15 @@ func TestRunService(t *testing.T) {
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
 		}
+		stageIndex := 0
 
 		// set mock responses
 		setDefaultMockExpectancies(containerRunnerMock)
@@ -732,7 +824,7 @@ func TestRunService(t *testing.T) {
 		go pipelineRunner.StopPipelineOnCancellation(ctx)
 		cancel()
 		time.Sleep(10 * time.Millisecond)
-		err := pipelineRunner.RunService(ctx, envvars, parentStage, service)
+		err := pipelineRunner.RunStage(ctx, depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
 
@@ -740,71 +832,87 @@ func TestRunService(t *testing.T) {
 		assert.Equal(t, contracts.LogStatusCanceled, *canceledStatusMessage.Status)
 	})
 
-	t.Run("SendsCanceledMessageToChannelForCanceledRunEvenWhenReadinessFails", func(t *testing.T) {
+	t.Run("SendsCanceledMessageToChannelForCanceledRunEvenWhenRunFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
+		depth := 0
+		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		parentStage := manifest.ZiplineeStage{
-			Name: "stage-a",
-		}
-		service := manifest.ZiplineeService{
-			Name:           "service-a",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
 			ContainerImage: "alpine:latest",
-			Readiness:      &manifest.ReadinessProbe{},
 		}
+		stageIndex := 0
 
 		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed tailing container logs")).AnyTimes()
 		setDefaultMockExpectancies(containerRunnerMock)
 		ctx, cancel := context.WithCancel(context.Background())
 
 		// act
 		go pipelineRunner.StopPipelineOnCancellation(ctx)
 		cancel()
-
 		time.Sleep(10 * time.Millisecond)
-		err := pipelineRunner.RunService(ctx, envvars, parentStage, service)
+		err := pipelineRunner.RunStage(ctx, depth, dir, envvars, parentStage, stage, stageIndex)
 
 		assert.Nil(t, err)
 
 		canceledStatusMessage := <-tailLogsChannel
 		assert.Equal(t, contracts.LogStatusCanceled, *canceledStatusMessage.Status)
 	})
-}
-
-func TestRunStages(t *testing.T) {
 
-	t.Run("CallsCreateBridgeNetwork", func(t *testing.T) {
+	t.Run("SendsMessagesWithDepthAndParentStageSet", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
+		depth := 1
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
+		stage := manifest.ZiplineeStage{
+			Name:           "nested-stage-0",
+			ContainerImage: "alpine:latest",
+		}
+		var parentStage *manifest.ZiplineeStage = &manifest.ZiplineeStage{
+			Name: "stage-a",
+			ParallelStages: []*manifest.ZiplineeStage{
+				&stage,
 			},
 		}
+		stageIndex := 0
 
 		// set mock responses
-
-		containerRunnerMock.EXPECT().CreateNetworks(gomock.Any()).Return(nil)
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
+
+		assert.Nil(t, err)
+
+		pendingStatusMessage := <-tailLogsChannel
+		assert.Equal(t, "nested-stage-0", pendingStatusMessage.Step)
+		assert.Equal(t, 1, pendingStatusMessage.Depth)
+		assert.Equal(t, "stage-a", pendingStatusMessage.ParentStage)
+
+		runningStatusMessage := <-tailLogsChannel
+		assert.Equal(t, "nested-stage-0", runningStatusMessage.Step)
+		assert.Equal(t, 1, runningStatusMessage.Depth)
+		assert.Equal(t, "stage-a", runningStatusMessage.ParentStage)
+
+		succeededStatusMessage := <-tailLogsChannel
+		assert.Equal(t, "nested-stage-0", succeededStatusMessage.Step)
+		assert.Equal(t, 1, succeededStatusMessage.Depth)
+		assert.Equal(t, "stage-a", succeededStatusMessage.ParentStage)
 	})
 
-	t.Run("CallsDeleteBridgeNetwork", func(t *testing.T) {
+	t.Run("PullsImageWhenPullPolicyIsAlwaysAndImageIsAlreadyPulled", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -814,23 +922,32 @@ func TestRunStages(t *testing.T) {
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			CustomProperties: map[string]interface{}{
+				"pullPolicy": "always",
 			},
 		}
+		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().DeleteNetworks(gomock.Any()).Return(nil)
-		setDefaultMockExpectancies(containerRunnerMock)
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), nil)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 
 		// act
-		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
+
+		assert.Nil(t, err)
 	})
 
-	t.Run("CallsStopMultiStageServiceContainers", func(t *testing.T) {
+	t.Run("PullsImageWhenPullPolicyIsIfNotPresentAndImageIsNotPulled", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -840,23 +957,36 @@ func TestRunStages(t *testing.T) {
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			CustomProperties: map[string]interface{}{
+				"pullPolicy": "if-not-present",
 			},
 		}
+		stageIndex := 0
 
 		// set mock responses
-		containerRunnerMock.EXPECT().StopMultiStageServiceContainers(gomock.Any())
-		setDefaultMockExpectancies(containerRunnerMock)
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), nil)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 
 		// act
-		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
+
+		assert.Nil(t, err)
 	})
 
-	t.Run("ReturnsErrorWhenFirstStageFails", func(t *testing.T) {
+	t.Run("DoesNotPullImageWhenPullPolicyIsIfNotPresentAndImageIsAlreadyPulled", func(t *testing.T) {
+
+		if runtime.GOOS == "windows" {
+			t.Skip("images are always pulled on windows")
+		}
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -866,27 +996,30 @@ func TestRunStages(t *testing.T) {
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			CustomProperties: map[string]interface{}{
+				"pullPolicy": "if-not-present",
 			},
 		}
+		stageIndex := 0
 
-		// set mock responses
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed pulling image"))
-		setDefaultMockExpectancies(containerRunnerMock)
+		// set mock responses, without PullImage so any pull fails the test
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 
 		// act
-		_, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		if assert.NotNil(t, err) {
-			assert.Equal(t, "Failed pulling image", err.Error())
-		}
+		assert.Nil(t, err)
 	})
 
-	t.Run("ReturnsErrorWhenFirstStageFailsButSecondRunsSuccessfully", func(t *testing.T) {
+	t.Run("DoesNotPullImageWhenPullPolicyIsNeverAndImageIsAlreadyPulled", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -896,45 +1029,30 @@ func TestRunStages(t *testing.T) {
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-b",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded' || status == 'failed'",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			CustomProperties: map[string]interface{}{
+				"pullPolicy": "never",
 			},
 		}
+		stageIndex := 0
 
-		// set mock responses
-		iteration := 0
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
-				defer func() { iteration++ }()
-
-				switch iteration {
-				case 0:
-					return fmt.Errorf("Failed pulling image")
-				case 1:
-					return nil
-				}
-
-				return fmt.Errorf("Shouldn't call it this often")
-			}).Times(2)
-		setDefaultMockExpectancies(containerRunnerMock)
+		// set mock responses, without PullImage so any pull fails the test
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 
 		// act
-		_, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
 
-		if assert.NotNil(t, err) {
-			assert.Equal(t, "Failed pulling image", err.Error())
-		}
+		assert.Nil(t, err)
 	})
 
-	t.Run("SkipsStagesWhichWhenClauseEvaluatesToFalse", func(t *testing.T) {
+	t.Run("ReturnsErrorWithoutPullingWhenPullPolicyIsNeverAndImageIsNotPulled", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
@@ -944,1408 +1062,3622 @@ func TestRunStages(t *testing.T) {
 		depth := 0
 		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-b",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-c",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded' || status == 'failed'",
+		var parentStage *manifest.ZiplineeStage = nil
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			CustomProperties: map[string]interface{}{
+				"pullPolicy": "never",
 			},
 		}
+		stageIndex := 0
 
-		// set mock responses
-		iteration := 0
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
-				defer func() { iteration++ }()
-
-				switch iteration {
-				case 0:
-					return fmt.Errorf("Failed pulling image")
-				case 1:
-					return nil
-				}
-
-				return fmt.Errorf("Shouldn't call it this often")
-			}).Times(2)
-		setDefaultMockExpectancies(containerRunnerMock)
+		// set mock responses, without PullImage and StartStageContainer so calling them fails the test
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false)
 
 		// act
-		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunStage(context.Background(), depth, dir, envvars, parentStage, stage, stageIndex)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, "Image alpine:latest is not present and pull policy is never", err.Error())
 	})
+}
 
-	t.Run("SendsSkippedStatusMessageForSkippedStage", func(t *testing.T) {
+func TestRunService(t *testing.T) {
+
+	t.Run("LogsMissingImageToServiceWhenPullPolicyIsNeverAndImageIsNotPulled", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-b",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-c",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded' || status == 'failed'",
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			CustomProperties: map[string]interface{}{
+				"pullPolicy": "never",
 			},
 		}
 
-		// set mock responses
-		iteration := 0
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
-				defer func() { iteration++ }()
-
-				switch iteration {
-				case 0:
-					return fmt.Errorf("Failed pulling image")
-				case 1:
-					return nil
-				}
-
-				return fmt.Errorf("Shouldn't call it this often")
-			}).Times(2)
-		setDefaultMockExpectancies(containerRunnerMock)
+		// set mock responses, without PullImage and StartServiceContainer so calling them fails the test
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().HasInjectedCredentials(gomock.Any(), gomock.Any()).Return(false)
 
 		// act
-		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
 
-		if assert.Equal(t, 3, len(buildLogSteps)) {
-			assert.Equal(t, contracts.LogStatusFailed, buildLogSteps[0].Status)
-			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[1].Status)
-			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[2].Status)
+		assert.NotNil(t, err)
+		close(tailLogsChannel)
+		logLines := 0
+		for tailLogLine := range tailLogsChannel {
+			if tailLogLine.LogLine != nil {
+				logLines++
+				assert.Equal(t, "service-a", tailLogLine.Step)
+				assert.Equal(t, contracts.LogTypeService, tailLogLine.Type)
+			}
 		}
-
-		assert.Equal(t, contracts.LogStatusFailed, contracts.GetAggregatedStatus(buildLogSteps))
+		assert.Equal(t, 1, logLines)
 	})
 
-	t.Run("SetsPullDurationAndRunDurationForStage", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenPullImageFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
 		}
 
 		// set mock responses
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
-				time.Sleep(50 * time.Millisecond)
-				return nil
-			})
-		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				time.Sleep(100 * time.Millisecond)
-				return nil
-			})
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed pulling image"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
 
-		if assert.Equal(t, 1, len(buildLogSteps)) {
-			assert.GreaterOrEqual(t, buildLogSteps[0].Image.PullDuration.Milliseconds(), int64(50))
-			assert.GreaterOrEqual(t, buildLogSteps[0].Duration.Milliseconds(), int64(100))
-		}
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed pulling image", err.Error())
 	})
 
-	t.Run("InjectsBuilderInfoStageWhenEnableBuilderInfoStageInjectionIsCalledBeforeRunStages", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenGetImageSizeFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
-
-		containerRunnerMock.EXPECT().Info(gomock.Any()).Return("docker info").Times(1)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
 		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), fmt.Errorf("Failed getting image size"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		pipelineRunner.EnableBuilderInfoStageInjection()
-		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
 
-		if assert.Equal(t, 2, len(buildLogSteps)) {
-			assert.Equal(t, "builder-info", buildLogSteps[0].Step)
-			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
-			assert.True(t, buildLogSteps[0].AutoInjected)
-			assert.Equal(t, 2, len(buildLogSteps[0].LogLines))
-		}
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed getting image size", err.Error())
 	})
 
-	t.Run("SendsCanceledStageForAllStagesWhenFirstStageGetsCanceled", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenStartStageContainerFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-b",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-			},
-			&manifest.ZiplineeStage{
-				Name:           "stage-c",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded' || status == 'failed'",
-			},
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
 		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartServiceContainer(gomock.Any(), gomock.Any(), gomock.Any()).Return("", fmt.Errorf("Failed starting container"))
 		setDefaultMockExpectancies(containerRunnerMock)
-		ctx, cancel := context.WithCancel(context.Background())
 
 		// act
-		go pipelineRunner.StopPipelineOnCancellation(ctx)
-		cancel()
-		time.Sleep(10 * time.Millisecond)
-		buildLogSteps, _ := pipelineRunner.RunStages(ctx, depth, stages, dir, envvars)
-
-		if assert.Equal(t, 3, len(buildLogSteps)) {
-			assert.Equal(t, contracts.LogStatusCanceled, buildLogSteps[0].Status)
-			assert.Equal(t, contracts.LogStatusCanceled, buildLogSteps[1].Status)
-			assert.Equal(t, contracts.LogStatusCanceled, buildLogSteps[2].Status)
-		}
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
 
-		assert.Equal(t, contracts.LogStatusCanceled, contracts.GetAggregatedStatus(buildLogSteps))
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed starting container", err.Error())
 	})
-}
-
-func TestRunStagesWithParallelStages(t *testing.T) {
 
-	t.Run("RunsParallelStagesReturnsBuildLogStepsWithNestedSteps", func(t *testing.T) {
+	t.Run("ReturnsNoErrorWhenTailContainerLogsFailsSinceItRunsInTheBackground", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "stage-a",
-				When: "status == 'succeeded'",
-				ParallelStages: []*manifest.ZiplineeStage{
-					&manifest.ZiplineeStage{
-						Name:           "nested-stage-0",
-						ContainerImage: "alpine:latest",
-						When:           "status == 'succeeded'",
-					},
-					&manifest.ZiplineeStage{
-						Name:           "nested-stage-1",
-						ContainerImage: "alpine:latest",
-						When:           "status == 'succeeded'",
-					},
-				},
-			},
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
 		}
 
 		// set mock responses
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(2)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				return fmt.Errorf("Failed tailing container logs")
+			})
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
 
-		if assert.Equal(t, 1, len(buildLogSteps)) {
-			assert.Equal(t, "stage-a", buildLogSteps[0].Step)
-			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
-			assert.Equal(t, 0, buildLogSteps[0].Depth)
-			if assert.Equal(t, 2, len(buildLogSteps[0].NestedSteps)) {
-				assert.Contains(t, []string{"nested-stage-0", "nested-stage-1"}, buildLogSteps[0].NestedSteps[0].Step)
-				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].NestedSteps[0].Status)
-				assert.Equal(t, 1, buildLogSteps[0].NestedSteps[0].Depth)
-				assert.Contains(t, []string{"nested-stage-0", "nested-stage-1"}, buildLogSteps[0].NestedSteps[1].Step)
-				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].NestedSteps[1].Status)
-				assert.Equal(t, 1, buildLogSteps[0].NestedSteps[1].Depth)
-			}
-		}
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
 
-		assert.Equal(t, contracts.LogStatusSucceeded, contracts.GetAggregatedStatus(buildLogSteps))
+		assert.Nil(t, err)
 	})
-}
 
-func TestRunStagesWithServices(t *testing.T) {
-
-	t.Run("RunsServicesReturnsBuildLogStepsWithServices", func(t *testing.T) {
+	t.Run("ReturnsErrorWhenRunReadinessProbeContainerFails", func(t *testing.T) {
 
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		containerRunnerMock := NewMockContainerRunner(ctrl)
 		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		depth := 0
-		dir := "/ziplinee-work"
 		envvars := map[string]string{}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name:           "stage-a",
-				ContainerImage: "alpine:latest",
-				When:           "status == 'succeeded'",
-				Services: []*manifest.ZiplineeService{
-					&manifest.ZiplineeService{
-						Name:           "nested-service-0",
-						ContainerImage: "alpine:latest",
-						When:           "status == 'succeeded'",
-					},
-					&manifest.ZiplineeService{
-						Name:           "nested-service-1",
-						ContainerImage: "alpine:latest",
-						When:           "status == 'succeeded'",
-					},
-				},
-			},
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
 		}
 
 		// set mock responses
-		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(3)
-
 		var wg sync.WaitGroup
 		wg.Add(1)
 		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
 			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
-				if stageType == contracts.LogTypeService {
-					wg.Wait()
-				}
+				defer wg.Done()
 				return nil
 			})
-		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).DoAndReturn(
-			func(ctx context.Context, parentStage manifest.ZiplineeStage) {
-				wg.Done()
-			})
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed readiness probe"))
 		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
 
-		if assert.Equal(t, 1, len(buildLogSteps)) {
-			assert.Equal(t, "stage-a", buildLogSteps[0].Step)
-			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
-			assert.Equal(t, 0, buildLogSteps[0].Depth)
-			if assert.Equal(t, 2, len(buildLogSteps[0].Services)) {
-				assert.Contains(t, []string{"nested-service-0", "nested-service-1"}, buildLogSteps[0].Services[0].Step)
-				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Services[0].Status)
-				assert.Equal(t, 1, buildLogSteps[0].Services[0].Depth)
-				assert.Contains(t, []string{"nested-service-0", "nested-service-1"}, buildLogSteps[0].Services[1].Step)
-				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Services[1].Status)
-				assert.Equal(t, 1, buildLogSteps[0].Services[1].Depth)
-			}
-		}
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
 
-		assert.Equal(t, contracts.LogStatusSucceeded, contracts.GetAggregatedStatus(buildLogSteps))
+		assert.NotNil(t, err)
+		assert.Equal(t, "Failed readiness probe", err.Error())
 	})
-}
 
-func TestGetNestedBuildLogService(t *testing.T) {
+	t.Run("ReturnsErrorWhenRunReadinessProbeContainerFailsForServiceWithReadinessFailureAbort", func(t *testing.T) {
 
-	t.Run("ReturnsNilIfBuildLogsStepsIsEmpty", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeService,
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
+			CustomProperties: map[string]interface{}{
+				"readinessFailure": "abort",
+			},
 		}
 
-		// act
-		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
-
-		assert.Nil(t, buildLogStep)
+		// set mock responses
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				return nil
+			})
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Readiness probe timed out"))
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
+
+		assert.NotNil(t, err)
+		assert.Equal(t, "Readiness probe timed out", err.Error())
+	})
+
+	t.Run("ReturnsNoErrorWhenRunReadinessProbeContainerFailsForServiceWithReadinessFailureContinue", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
+			CustomProperties: map[string]interface{}{
+				"readinessFailure": "continue",
+			},
+		}
+
+		// set mock responses
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				return nil
+			})
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Readiness probe timed out"))
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsNoErrorWhenContainerPullsStartsAndLogs", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(false)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+		containerRunnerMock.EXPECT().GetImageSize(gomock.Any(), gomock.Any()).Return(int64(0), nil)
+		containerRunnerMock.EXPECT().StartServiceContainer(gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				return nil
+			})
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("SendsRunningMessageToChannelForSuccessfulRunWhenImageIsAlreadyPulled", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().IsImagePulled(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				return nil
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
+
+		assert.Nil(t, err)
+
+		runningStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
+	})
+
+	t.Run("SendsSequenceOfPendingAndRunningMessageToChannelForSuccessfulStartAndReadiness", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
+		}
+
+		// set mock responses
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				return nil
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
+
+		assert.Nil(t, err)
+
+		pendingStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusPending, *pendingStatusMessage.Status)
+
+		runningStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
+	})
+
+	t.Run("SendsSequenceOfPendingAndRunningAndFailedMessageToChannelForFailingReadiness", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
+		}
+
+		// set mock responses
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				defer wg.Done()
+				// ensure tailing doesn't set status before the main routine does
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			})
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed readiness probe"))
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunService(context.Background(), envvars, parentStage, service)
+
+		// wait for tailContainerLogsFunc to finish
+		wg.Wait()
+
+		assert.NotNil(t, err)
+
+		pendingStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusPending, *pendingStatusMessage.Status)
+
+		runningStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusRunning, *runningStatusMessage.Status)
+
+		failedStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusFailed, *failedStatusMessage.Status)
+	})
+
+	t.Run("SendsCanceledMessageToChannelForCanceledRun", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+		}
+
+		// set mock responses
+		setDefaultMockExpectancies(containerRunnerMock)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// act
+		go pipelineRunner.StopPipelineOnCancellation(ctx)
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		err := pipelineRunner.RunService(ctx, envvars, parentStage, service)
+
+		assert.Nil(t, err)
+
+		canceledStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusCanceled, *canceledStatusMessage.Status)
+	})
+
+	t.Run("SendsCanceledMessageToChannelForCanceledRunEvenWhenReadinessFails", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		envvars := map[string]string{}
+		parentStage := manifest.ZiplineeStage{
+			Name: "stage-a",
+		}
+		service := manifest.ZiplineeService{
+			Name:           "service-a",
+			ContainerImage: "alpine:latest",
+			Readiness:      &manifest.ReadinessProbe{},
+		}
+
+		// set mock responses
+		setDefaultMockExpectancies(containerRunnerMock)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// act
+		go pipelineRunner.StopPipelineOnCancellation(ctx)
+		cancel()
+
+		time.Sleep(10 * time.Millisecond)
+		err := pipelineRunner.RunService(ctx, envvars, parentStage, service)
+
+		assert.Nil(t, err)
+
+		canceledStatusMessage := <-tailLogsChannel
+		assert.Equal(t, contracts.LogStatusCanceled, *canceledStatusMessage.Status)
+	})
+}
+
+func TestRunStages(t *testing.T) {
+
+	t.Run("CallsCreateBridgeNetwork", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+
+		containerRunnerMock.EXPECT().CreateNetworks(gomock.Any()).Return(nil)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+	})
+
+	t.Run("ReturnsInfrastructureErrorWithoutStepsIfCreateBridgeNetworkFails", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// only fail creating the networks, so starting any stage fails the test
+		containerRunnerMock.EXPECT().CreateNetworks(gomock.Any()).Return(fmt.Errorf("Error response from daemon: network failure"))
+
+		// act
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
+
+		assert.True(t, isInfrastructureError(err))
+		assert.Equal(t, 0, len(buildLogSteps))
+	})
+
+	t.Run("CallsDeleteBridgeNetwork", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().DeleteNetworks(gomock.Any()).Return(nil)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+	})
+
+	t.Run("GivesUpDeletingNetworksAfterCleanupTimeout", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetCleanupTimeout(50 * time.Millisecond)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		unresponsiveDaemon := make(chan struct{})
+		defer close(unresponsiveDaemon)
+
+		// set mock responses
+		containerRunnerMock.EXPECT().DeleteNetworks(gomock.Any()).DoAndReturn(func(ctx context.Context) error {
+			<-unresponsiveDaemon
+			return nil
+		})
+		setDefaultMockExpectancies(containerRunnerMock)
+		start := time.Now()
+
+		// act
+		_, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		assert.Nil(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("CallsStopMultiStageServiceContainers", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StopMultiStageServiceContainers(gomock.Any())
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+	})
+
+	t.Run("ReturnsErrorWhenFirstStageFails", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Failed pulling image"))
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		_, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Failed pulling image", err.Error())
+		}
+	})
+
+	t.Run("ReturnsErrorWhenFirstStageFailsButSecondRunsSuccessfully", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded' || status == 'failed'",
+			},
+		}
+
+		// set mock responses
+		iteration := 0
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
+				defer func() { iteration++ }()
+
+				switch iteration {
+				case 0:
+					return fmt.Errorf("Failed pulling image")
+				case 1:
+					return nil
+				}
+
+				return fmt.Errorf("Shouldn't call it this often")
+			}).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		_, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Failed pulling image", err.Error())
+		}
+	})
+
+	t.Run("SkipsStagesWhichWhenClauseEvaluatesToFalse", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-c",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded' || status == 'failed'",
+			},
+		}
+
+		// set mock responses
+		iteration := 0
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
+				defer func() { iteration++ }()
+
+				switch iteration {
+				case 0:
+					return fmt.Errorf("Failed pulling image")
+				case 1:
+					return nil
+				}
+
+				return fmt.Errorf("Shouldn't call it this often")
+			}).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		_, _ = pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+	})
+
+	t.Run("SendsSkippedStatusMessageForSkippedStage", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-c",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded' || status == 'failed'",
+			},
+		}
+
+		// set mock responses
+		iteration := 0
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
+				defer func() { iteration++ }()
+
+				switch iteration {
+				case 0:
+					return fmt.Errorf("Failed pulling image")
+				case 1:
+					return nil
+				}
+
+				return fmt.Errorf("Shouldn't call it this often")
+			}).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.Equal(t, 3, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusFailed, buildLogSteps[0].Status)
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[1].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[2].Status)
+		}
+
+		assert.Equal(t, contracts.LogStatusFailed, contracts.GetAggregatedStatus(buildLogSteps))
+	})
+
+	t.Run("FailsFastWithoutRunningAnyStageForCyclicStageDependencies", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:             "stage-a",
+				ContainerImage:   "alpine:latest",
+				When:             "status == 'succeeded'",
+				CustomProperties: map[string]interface{}{"needs": []interface{}{"stage-b"}},
+			},
+			{
+				Name:             "stage-b",
+				ContainerImage:   "alpine:latest",
+				When:             "status == 'succeeded'",
+				CustomProperties: map[string]interface{}{"needs": []interface{}{"stage-a"}},
+			},
+		}
+
+		// only set up networking, so starting any stage fails the test
+		containerRunnerMock.EXPECT().CreateNetworks(gomock.Any()).Return(nil)
+		containerRunnerMock.EXPECT().DeleteNetworks(gomock.Any()).Return(nil)
+
+		// act
+		_, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Stage dependencies form a cycle: stage-a -> stage-b -> stage-a", err.Error())
+		}
+	})
+
+	t.Run("SkipsStagesBeforeStageToResumeFrom", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_RESUME_FROM_STAGE", "stage-b")
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-c",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (string, error) {
+				assert.NotEqual(t, "stage-a", stage.Name)
+				return "abc", nil
+			}).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 3, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[0].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[1].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[2].Status)
+		}
+	})
+
+	t.Run("RunsAllStagesWhenStageToResumeFromDoesNotExist", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_RESUME_FROM_STAGE", "stage-x")
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 2, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[1].Status)
+		}
+	})
+
+	t.Run("RunsOnlyStagesToRerunAndTheStagesTheyNeed", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_RERUN_STAGES", "stage-c")
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "git-clone",
+				ContainerImage: "extensions/git-clone:stable",
+				When:           "status == 'succeeded'",
+				AutoInjected:   true,
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:             "stage-c",
+				ContainerImage:   "alpine:latest",
+				When:             "status == 'succeeded'",
+				CustomProperties: map[string]interface{}{"needs": []interface{}{"stage-a"}},
+			},
+		}
+
+		// set mock responses
+		startedStages := []string{}
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (string, error) {
+				startedStages = append(startedStages, stage.Name)
+				return "abc", nil
+			}).Times(3)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"git-clone", "stage-a", "stage-c"}, startedStages)
+		if assert.Equal(t, 4, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[1].Status)
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[2].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[3].Status)
+		}
+		assert.Equal(t, map[string]SkipReason{"stage-b": SkipReasonNotRerun}, pipelineRunner.GetSkipReasons())
+	})
+
+	t.Run("RunsAllStagesWhenNoneOfTheStagesToRerunExist", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_RERUN_STAGES", "stage-x, stage-y")
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 2, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[1].Status)
+		}
+	})
+
+	t.Run("SetsPullDurationAndRunDurationForStage", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, stageName, parentStageName string, containerImage string) (err error) {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			})
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.Equal(t, 1, len(buildLogSteps)) {
+			assert.GreaterOrEqual(t, buildLogSteps[0].Image.PullDuration.Milliseconds(), int64(50))
+			assert.GreaterOrEqual(t, buildLogSteps[0].Duration.Milliseconds(), int64(100))
+		}
+	})
+
+	t.Run("InjectsBuilderInfoStageWhenEnableBuilderInfoStageInjectionIsCalledBeforeRunStages", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+
+		containerRunnerMock.EXPECT().Info(gomock.Any()).Return("docker info").Times(1)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+		}
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		pipelineRunner.EnableBuilderInfoStageInjection()
+		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.Equal(t, 2, len(buildLogSteps)) {
+			assert.Equal(t, "builder-info", buildLogSteps[0].Step)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
+			assert.True(t, buildLogSteps[0].AutoInjected)
+			assert.Equal(t, 2, len(buildLogSteps[0].LogLines))
+		}
+	})
+
+	t.Run("SendsCanceledStageForAllStagesWhenFirstStageGetsCanceled", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			&manifest.ZiplineeStage{
+				Name:           "stage-c",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded' || status == 'failed'",
+			},
+		}
+		setDefaultMockExpectancies(containerRunnerMock)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// act
+		go pipelineRunner.StopPipelineOnCancellation(ctx)
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		buildLogSteps, _ := pipelineRunner.RunStages(ctx, depth, stages, dir, envvars)
+
+		if assert.Equal(t, 3, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusCanceled, buildLogSteps[0].Status)
+			assert.Equal(t, contracts.LogStatusCanceled, buildLogSteps[1].Status)
+			assert.Equal(t, contracts.LogStatusCanceled, buildLogSteps[2].Status)
+		}
+
+		assert.Equal(t, contracts.LogStatusCanceled, contracts.GetAggregatedStatus(buildLogSteps))
+	})
+}
+
+func TestRunStagesWithParallelStages(t *testing.T) {
+
+	t.Run("RunsParallelStagesReturnsBuildLogStepsWithNestedSteps", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "stage-a",
+				When: "status == 'succeeded'",
+				ParallelStages: []*manifest.ZiplineeStage{
+					&manifest.ZiplineeStage{
+						Name:           "nested-stage-0",
+						ContainerImage: "alpine:latest",
+						When:           "status == 'succeeded'",
+					},
+					&manifest.ZiplineeStage{
+						Name:           "nested-stage-1",
+						ContainerImage: "alpine:latest",
+						When:           "status == 'succeeded'",
+					},
+				},
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.Equal(t, 1, len(buildLogSteps)) {
+			assert.Equal(t, "stage-a", buildLogSteps[0].Step)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
+			assert.Equal(t, 0, buildLogSteps[0].Depth)
+			if assert.Equal(t, 2, len(buildLogSteps[0].NestedSteps)) {
+				assert.Contains(t, []string{"nested-stage-0", "nested-stage-1"}, buildLogSteps[0].NestedSteps[0].Step)
+				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].NestedSteps[0].Status)
+				assert.Equal(t, 1, buildLogSteps[0].NestedSteps[0].Depth)
+				assert.Contains(t, []string{"nested-stage-0", "nested-stage-1"}, buildLogSteps[0].NestedSteps[1].Step)
+				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].NestedSteps[1].Status)
+				assert.Equal(t, 1, buildLogSteps[0].NestedSteps[1].Depth)
+			}
+		}
+
+		assert.Equal(t, contracts.LogStatusSucceeded, contracts.GetAggregatedStatus(buildLogSteps))
+	})
+}
+
+func TestRunParallelStages(t *testing.T) {
+
+	// runParallelStages runs a failing and a slow parallel stage and returns whether the slow stage got canceled by its failing sibling
+	runParallelStages := func(t *testing.T, customProperties map[string]interface{}) (siblingCanceled bool, err error) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		parentStage := manifest.ZiplineeStage{
+			Name:             "stage-a",
+			CustomProperties: customProperties,
+		}
+		parallelStages := []*manifest.ZiplineeStage{
+			{
+				Name:           "failing-stage",
+				ContainerImage: "alpine:latest",
+				When:           "true",
+			},
+			{
+				Name:           "slow-stage",
+				ContainerImage: "alpine:latest",
+				When:           "true",
+			},
+		}
+
+		failingStageDone := make(chan struct{})
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				if stageName == "failing-stage" {
+					close(failingStageDone)
+					return fmt.Errorf("Failed with exit code: 1")
+				}
+
+				<-failingStageDone
+				select {
+				case <-ctx.Done():
+					siblingCanceled = true
+				case <-time.After(500 * time.Millisecond):
+				}
+				return nil
+			}).Times(2)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err = pipelineRunner.RunParallelStages(context.Background(), 1, "/ziplinee-work", map[string]string{}, parentStage, parallelStages)
+
+		return
+	}
+
+	t.Run("CancelsSiblingsOfFailingStageByDefault", func(t *testing.T) {
+
+		siblingCanceled, err := runParallelStages(t, nil)
+
+		assert.NotNil(t, err)
+		assert.True(t, siblingCanceled)
+	})
+
+	t.Run("CancelsSiblingsOfFailingStageInFailFastMode", func(t *testing.T) {
+
+		siblingCanceled, err := runParallelStages(t, map[string]interface{}{"parallelMode": "fail-fast"})
+
+		assert.NotNil(t, err)
+		assert.True(t, siblingCanceled)
+	})
+
+	t.Run("LetsSiblingsOfFailingStageFinishInContinueMode", func(t *testing.T) {
+
+		siblingCanceled, err := runParallelStages(t, map[string]interface{}{"parallelMode": "continue"})
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Failed with exit code: 1", err.Error())
+		}
+		assert.False(t, siblingCanceled)
+	})
+}
+
+func TestRunStagesWithServices(t *testing.T) {
+
+	t.Run("RunsServicesReturnsBuildLogStepsWithServices", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		depth := 0
+		dir := "/ziplinee-work"
+		envvars := map[string]string{}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+				Services: []*manifest.ZiplineeService{
+					&manifest.ZiplineeService{
+						Name:           "nested-service-0",
+						ContainerImage: "alpine:latest",
+						When:           "status == 'succeeded'",
+					},
+					&manifest.ZiplineeService{
+						Name:           "nested-service-1",
+						ContainerImage: "alpine:latest",
+						When:           "status == 'succeeded'",
+					},
+				},
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(3)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				if stageType == contracts.LogTypeService {
+					wg.Wait()
+				}
+				return nil
+			})
+		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, parentStage manifest.ZiplineeStage) {
+				wg.Done()
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		buildLogSteps, _ := pipelineRunner.RunStages(context.Background(), depth, stages, dir, envvars)
+
+		if assert.Equal(t, 1, len(buildLogSteps)) {
+			assert.Equal(t, "stage-a", buildLogSteps[0].Step)
+			assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Status)
+			assert.Equal(t, 0, buildLogSteps[0].Depth)
+			if assert.Equal(t, 2, len(buildLogSteps[0].Services)) {
+				assert.Contains(t, []string{"nested-service-0", "nested-service-1"}, buildLogSteps[0].Services[0].Step)
+				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Services[0].Status)
+				assert.Equal(t, 1, buildLogSteps[0].Services[0].Depth)
+				assert.Contains(t, []string{"nested-service-0", "nested-service-1"}, buildLogSteps[0].Services[1].Step)
+				assert.Equal(t, contracts.LogStatusSucceeded, buildLogSteps[0].Services[1].Status)
+				assert.Equal(t, 1, buildLogSteps[0].Services[1].Depth)
+			}
+		}
+
+		assert.Equal(t, contracts.LogStatusSucceeded, contracts.GetAggregatedStatus(buildLogSteps))
+	})
+
+	t.Run("StartsStageAfterServicesPassReadinessWithinGracePeriod", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetServiceReadinessGracePeriod(5 * time.Second)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			Services: []*manifest.ZiplineeService{
+				{
+					Name:           "database",
+					ContainerImage: "postgres:16",
+					When:           "true",
+					Readiness:      &manifest.ReadinessProbe{},
+				},
+			},
+		}
+
+		// set mock responses
+		var serviceReady atomic.Bool
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, parentStage manifest.ZiplineeStage, service manifest.ZiplineeService, readiness manifest.ReadinessProbe) error {
+				time.Sleep(50 * time.Millisecond)
+				serviceReady.Store(true)
+				return nil
+			})
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, depth int, dir string, envvars map[string]string, stage manifest.ZiplineeStage, stageIndex int) (string, error) {
+				assert.True(t, serviceReady.Load())
+				return "abc", nil
+			})
+		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).AnyTimes()
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("FailsStageWithoutStartingItIfServicesDontBecomeReadyWithinGracePeriod", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetServiceReadinessGracePeriod(50 * time.Millisecond)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			Services: []*manifest.ZiplineeService{
+				{
+					Name:           "database",
+					ContainerImage: "postgres:16",
+					When:           "true",
+					Readiness:      &manifest.ReadinessProbe{},
+				},
+			},
+		}
+
+		// set mock responses
+		slowService := make(chan struct{})
+		defer close(slowService)
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, parentStage manifest.ZiplineeStage, service manifest.ZiplineeService, readiness manifest.ReadinessProbe) error {
+				<-slowService
+				return nil
+			})
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).AnyTimes()
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Services of stage stage-a didn't become ready within 50ms", err.Error())
+		}
+	})
+
+	t.Run("FailsStageIfSingleStageServiceWithReadinessFailureContinueFailsReadinessWithGracePeriod", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetServiceReadinessGracePeriod(5 * time.Second)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+			Services: []*manifest.ZiplineeService{
+				{
+					Name:           "database",
+					ContainerImage: "postgres:16",
+					When:           "true",
+					Readiness:      &manifest.ReadinessProbe{},
+					CustomProperties: map[string]interface{}{
+						"readinessFailure": "continue",
+					},
+				},
+			},
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().RunReadinessProbeContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Readiness probe timed out"))
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).AnyTimes()
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Readiness probe timed out", err.Error())
+		}
+	})
+}
+
+func TestGetNestedBuildLogService(t *testing.T) {
+
+	t.Run("ReturnsNilIfBuildLogsStepsIsEmpty", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+
+		assert.Nil(t, buildLogStep)
+	})
+
+	t.Run("ReturnsNilIfDepthIsZero", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Depth:       0,
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+
+		assert.Nil(t, buildLogStep)
+	})
+
+	t.Run("ReturnsNilIfParentStageExistsButNestedStageDoesNot", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					Services: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-service-1",
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+
+		assert.Nil(t, buildLogStep)
+	})
+
+	t.Run("ReturnsNilIfParentStageExistsButNestedStageDoesNotAndServiceWithSameNameExists", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					NestedSteps: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-service-0",
+						},
+					},
+					Services: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-service-1",
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+
+		assert.Nil(t, buildLogStep)
+	})
+
+	t.Run("ReturnsNestedStepIfParentStageAndNestedStageExist", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					Services: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-service-0",
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+
+		assert.NotNil(t, buildLogStep)
+		assert.Equal(t, "nested-service-0", buildLogStep.Step)
+	})
+}
+
+func TestUpsertTailLogLine(t *testing.T) {
+
+	t.Run("AddsMainStageIfDoesNotExist", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step: "stage-a",
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+	})
+
+	t.Run("DoesNotReaddMainStageIfAlreadyExists", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step: "stage-a",
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+	})
+
+	t.Run("AddsMainStageIfDoesNotExistWithRunIndex", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:     "stage-a",
+					RunIndex: 0,
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:     "stage-a",
+			RunIndex: 1,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Equal(t, 0, pipelineRunner.buildLogSteps[0].RunIndex)
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[1].Step)
+		assert.Equal(t, 1, pipelineRunner.buildLogSteps[1].RunIndex)
+	})
+
+	t.Run("AddsMainStageIfDoesNotExistForNestedStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeStage,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+	})
+
+	t.Run("AddsMainStageIfDoesNotExistForNestedService", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+	})
+
+	t.Run("AddsMainStageWithDepth0IfServiceContainerStatusComesInFirst", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+			Depth:       1,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Equal(t, 0, pipelineRunner.buildLogSteps[0].Depth)
+	})
+
+	t.Run("AddsNestedStageIfDoesNotExist", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeStage,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].NestedSteps))
+		assert.Equal(t, "nested-stage-0", pipelineRunner.buildLogSteps[0].NestedSteps[0].Step)
+	})
+
+	t.Run("DoesNotReaddNestedStageIfAlreadyExists", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					NestedSteps: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-stage-0",
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeStage,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].NestedSteps))
+		assert.Equal(t, "nested-stage-0", pipelineRunner.buildLogSteps[0].NestedSteps[0].Step)
+	})
+
+	t.Run("AddsNestedServiceIfDoesNotExist", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].Services))
+		assert.Equal(t, "nested-service-0", pipelineRunner.buildLogSteps[0].Services[0].Step)
+	})
+
+	t.Run("DoesNotReaddNestedServiceIfAlreadyExists", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					Services: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-service-0",
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
+		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].Services))
+		assert.Equal(t, "nested-service-0", pipelineRunner.buildLogSteps[0].Services[0].Step)
+	})
+
+	t.Run("AddLogLineToMainStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					LogLines: []contracts.BuildLogLine{
+						contracts.BuildLogLine{
+							LineNumber: 1,
+							Text:       "Hi this is the first line",
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step: "stage-a",
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 2,
+				Text:       "Hey I'd like to add a second line",
+			},
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].LogLines))
+		assert.Equal(t, 1, pipelineRunner.buildLogSteps[0].LogLines[0].LineNumber)
+		assert.Equal(t, 2, pipelineRunner.buildLogSteps[0].LogLines[1].LineNumber)
+	})
+
+	t.Run("AddLogLineToNestedStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					NestedSteps: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-stage-0",
+							LogLines: []contracts.BuildLogLine{
+								contracts.BuildLogLine{
+									LineNumber: 1,
+									Text:       "Hi this is the first line",
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeStage,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 2,
+				Text:       "Hey I'd like to add a second line",
+			},
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].NestedSteps[0].LogLines))
+		assert.Equal(t, 1, pipelineRunner.buildLogSteps[0].NestedSteps[0].LogLines[0].LineNumber)
+		assert.Equal(t, 2, pipelineRunner.buildLogSteps[0].NestedSteps[0].LogLines[1].LineNumber)
+	})
+
+	t.Run("AddLogLineToNestedService", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					Services: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step: "nested-service-0",
+							LogLines: []contracts.BuildLogLine{
+								contracts.BuildLogLine{
+									LineNumber: 1,
+									Text:       "Hi this is the first line",
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 2,
+				Text:       "Hey I'd like to add a second line",
+			},
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].Services[0].LogLines))
+		assert.Equal(t, 1, pipelineRunner.buildLogSteps[0].Services[0].LogLines[0].LineNumber)
+		assert.Equal(t, 2, pipelineRunner.buildLogSteps[0].Services[0].LogLines[1].LineNumber)
+	})
+
+	t.Run("SetStatusForMainStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "stage-a",
+					Status: contracts.LogStatusPending,
+				},
+			},
+		}
+		status := contracts.LogStatusRunning
+		tailLogLine := contracts.TailLogLine{
+			Step:   "stage-a",
+			Status: &status,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, contracts.LogStatusRunning, pipelineRunner.buildLogSteps[0].Status)
+	})
+
+	t.Run("SetStatusForNestedStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					NestedSteps: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step:   "nested-stage-0",
+							Status: contracts.LogStatusPending,
+						},
+					},
+				},
+			},
+		}
+		status := contracts.LogStatusRunning
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeStage,
+			Status:      &status,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, contracts.LogStatusRunning, pipelineRunner.buildLogSteps[0].NestedSteps[0].Status)
+	})
+
+	t.Run("SetStatusForNestedService", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step: "stage-a",
+					Services: []*contracts.BuildLogStep{
+						&contracts.BuildLogStep{
+							Step:   "nested-service-0",
+							Status: contracts.LogStatusPending,
+						},
+					},
+				},
+			},
+		}
+		status := contracts.LogStatusRunning
+		tailLogLine := contracts.TailLogLine{
+			Step:        "nested-service-0",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+			Status:      &status,
+		}
+
+		// act
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		assert.Equal(t, contracts.LogStatusRunning, pipelineRunner.buildLogSteps[0].Services[0].Status)
+	})
+
+	t.Run("NestsParallelStageMessages", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{},
+		}
+
+		statusRunning := contracts.LogStatusRunning
+		statusPending := contracts.LogStatusPending
+		statusSucceeded := contracts.LogStatusSucceeded
+
+		// stage-a start
+		tailLogLine := contracts.TailLogLine{
+			Step:   "stage-a",
+			Type:   contracts.LogTypeStage,
+			Status: &statusRunning,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		// nested-stage-1
+		tailLogLine = contracts.TailLogLine{
+			Step:        "nested-stage-1",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeStage,
+			Status:      &statusPending,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		tailLogLine = contracts.TailLogLine{
+			Step:        "nested-stage-1",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeStage,
+			Status:      &statusRunning,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		tailLogLine = contracts.TailLogLine{
+			Step:        "nested-stage-1",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeStage,
+			Status:      &statusSucceeded,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		// nested-stage-0
+		tailLogLine = contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeStage,
+			Status:      &statusPending,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		tailLogLine = contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeStage,
+			Status:      &statusRunning,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		tailLogLine = contracts.TailLogLine{
+			Step:        "nested-stage-0",
+			ParentStage: "stage-a",
+			Depth:       1,
+			Type:        contracts.LogTypeStage,
+			Status:      &statusSucceeded,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		// stage-a finish
+		tailLogLine = contracts.TailLogLine{
+			Step:   "stage-a",
+			Type:   contracts.LogTypeStage,
+			Status: &statusSucceeded,
+		}
+		pipelineRunner.upsertTailLogLine(tailLogLine)
+
+		if assert.Equal(t, 1, len(pipelineRunner.buildLogSteps)) {
+			assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+			assert.Equal(t, contracts.LogStatusSucceeded, pipelineRunner.buildLogSteps[0].Status)
+
+			assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].NestedSteps))
+
+			assert.Equal(t, "nested-stage-1", pipelineRunner.buildLogSteps[0].NestedSteps[0].Step)
+			assert.Equal(t, contracts.LogStatusSucceeded, pipelineRunner.buildLogSteps[0].NestedSteps[0].Status)
+
+			assert.Equal(t, "nested-stage-0", pipelineRunner.buildLogSteps[0].NestedSteps[1].Step)
+			assert.Equal(t, contracts.LogStatusSucceeded, pipelineRunner.buildLogSteps[0].NestedSteps[1].Status)
+		}
+	})
+}
+
+func TestIsFinalStageComplete(t *testing.T) {
+
+	t.Run("ReturnsFalseIfBuildLogStepsAreEmpty", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		}
+		stages := []*manifest.ZiplineeStage{}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasRunningStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusRunning,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasPendingStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusPending,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsTrueIfLastStepHasSucceededStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.True(t, isComplete)
+	})
+
+	t.Run("ReturnsTrueIfLastStepHasFailedStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusFailed,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.True(t, isComplete)
+	})
+
+	t.Run("ReturnsTrueIfLastStepHasSkippedStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSkipped,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.True(t, isComplete)
+	})
+
+	t.Run("ReturnsTrueIfLastStepHasCanceledStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusCanceled,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.True(t, isComplete)
 	})
 
-	t.Run("ReturnsNilIfDepthIsZero", func(t *testing.T) {
+	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButIsNotTheFinalStage", func(t *testing.T) {
 
 		pipelineRunner := pipelineRunner{
 			buildLogSteps: []*contracts.BuildLogStep{
 				&contracts.BuildLogStep{
-					Step: "stage-a",
+					Step:   "first-stage",
+					Status: contracts.LogStatusSucceeded,
 				},
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Depth:       0,
-			Type:        contracts.LogTypeService,
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "first-stage",
+			},
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
 		}
 
 		// act
-		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
 
-		assert.Nil(t, buildLogStep)
+		assert.False(t, isComplete)
 	})
 
-	t.Run("ReturnsNilIfParentStageExistsButNestedStageDoesNot", func(t *testing.T) {
+	t.Run("ReturnsFalseIfLastStepHasFailedStatusButIsNotTheFinalStage", func(t *testing.T) {
 
 		pipelineRunner := pipelineRunner{
 			buildLogSteps: []*contracts.BuildLogStep{
 				&contracts.BuildLogStep{
-					Step: "stage-a",
-					Services: []*contracts.BuildLogStep{
+					Step:   "first-stage",
+					Status: contracts.LogStatusFailed,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "first-stage",
+			},
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasSkippedStatusButIsNotTheFinalStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "first-stage",
+					Status: contracts.LogStatusSkipped,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "first-stage",
+			},
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasCanceledStatusButIsNotTheFinalStage", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "first-stage",
+					Status: contracts.LogStatusCanceled,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "first-stage",
+			},
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStageHasParallelStagesButLastStepHasNoEqualAmountOfNestedSteps", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+				ParallelStages: []*manifest.ZiplineeStage{
+					&manifest.ZiplineeStage{
+						Name: "nested-stage",
+					},
+				},
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButAnyParallelStagesHavePendingOrRunningStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+					NestedSteps: []*contracts.BuildLogStep{
 						&contracts.BuildLogStep{
-							Step: "nested-service-1",
+							Step:   "nested-stage",
+							Status: contracts.LogStatusRunning,
 						},
 					},
 				},
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeService,
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+				ParallelStages: []*manifest.ZiplineeStage{
+					&manifest.ZiplineeStage{
+						Name: "nested-stage",
+					},
+				},
+			},
 		}
 
 		// act
-		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
 
-		assert.Nil(t, buildLogStep)
+		assert.False(t, isComplete)
 	})
 
-	t.Run("ReturnsNilIfParentStageExistsButNestedStageDoesNotAndServiceWithSameNameExists", func(t *testing.T) {
+	t.Run("ReturnsFalseIfLastStageHasServicesButLastStepHasNoEqualAmountOfServices", func(t *testing.T) {
 
 		pipelineRunner := pipelineRunner{
 			buildLogSteps: []*contracts.BuildLogStep{
 				&contracts.BuildLogStep{
-					Step: "stage-a",
-					NestedSteps: []*contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+				Services: []*manifest.ZiplineeService{
+					&manifest.ZiplineeService{
+						Name: "nested-service",
+					},
+				},
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButAnyServicesHavePendingOrRunningStatus", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+					Services: []*contracts.BuildLogStep{
 						&contracts.BuildLogStep{
-							Step: "nested-service-0",
+							Step:   "nested-service",
+							Status: contracts.LogStatusRunning,
 						},
 					},
+				},
+			},
+		}
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+				Services: []*manifest.ZiplineeService{
+					&manifest.ZiplineeService{
+						Name: "nested-service",
+					},
+				},
+			},
+		}
+
+		// act
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
+
+		assert.False(t, isComplete)
+	})
+
+	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButMultiStageServicesFromPreviousStagesHaveNotFinished", func(t *testing.T) {
+
+		pipelineRunner := pipelineRunner{
+			buildLogSteps: []*contracts.BuildLogStep{
+				&contracts.BuildLogStep{
+					Step:   "earlier-stage",
+					Status: contracts.LogStatusSucceeded,
 					Services: []*contracts.BuildLogStep{
 						&contracts.BuildLogStep{
-							Step: "nested-service-1",
+							Step:   "nested-service-1",
+							Status: contracts.LogStatusRunning,
 						},
 					},
 				},
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+				},
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeService,
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
 		}
 
 		// act
-		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
 
-		assert.Nil(t, buildLogStep)
+		assert.False(t, isComplete)
 	})
 
-	t.Run("ReturnsNestedStepIfParentStageAndNestedStageExist", func(t *testing.T) {
+	t.Run("ReturnsTrueIfLastStepHasSucceededStatusAndAllServicesFromPreviousStagesHaveFinished", func(t *testing.T) {
 
 		pipelineRunner := pipelineRunner{
 			buildLogSteps: []*contracts.BuildLogStep{
 				&contracts.BuildLogStep{
-					Step: "stage-a",
+					Step:   "earlier-stage",
+					Status: contracts.LogStatusSucceeded,
 					Services: []*contracts.BuildLogStep{
 						&contracts.BuildLogStep{
-							Step: "nested-service-0",
+							Step:   "nested-service-1",
+							Status: contracts.LogStatusRunning,
 						},
 					},
 				},
+				&contracts.BuildLogStep{
+					Step:   "last-stage",
+					Status: contracts.LogStatusSucceeded,
+				},
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeService,
+		stages := []*manifest.ZiplineeStage{
+			&manifest.ZiplineeStage{
+				Name: "last-stage",
+			},
 		}
 
 		// act
-		buildLogStep := pipelineRunner.getNestedBuildLogService(tailLogLine)
+		isComplete := pipelineRunner.isFinalStageComplete(stages)
 
-		assert.NotNil(t, buildLogStep)
-		assert.Equal(t, "nested-service-0", buildLogStep.Step)
+		assert.False(t, isComplete)
 	})
 }
 
-func TestUpsertTailLogLine(t *testing.T) {
+func TestEnableLogStreaming(t *testing.T) {
 
-	t.Run("AddsMainStageIfDoesNotExist", func(t *testing.T) {
+	t.Run("WritesLogLinesToWriterAsTheyArriveWhenRunningAsJob", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		reader, writer := io.Pipe()
+		runner.EnableLogStreaming(writer)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+			},
 		}
-		tailLogLine := contracts.TailLogLine{
+		go runner.(*pipelineRunner).tailLogs(context.Background(), make(chan struct{}, 1), stages)
+		lines := bufio.NewReader(reader)
+
+		// act
+		tailLogsChannel <- contracts.TailLogLine{
 			Step: "stage-a",
+			Type: contracts.LogTypeStage,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 1,
+				StreamType: "stdout",
+				Text:       "go build\n",
+			},
 		}
 
+		line, err := lines.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "[stage-a] go build\n", line)
+
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		tailLogsChannel <- contracts.TailLogLine{
+			Step:        "stage-b",
+			ParentStage: "stage-a",
+			Type:        contracts.LogTypeService,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 1,
+				StreamType: "stderr",
+				Text:       "listening on port 5432",
+			},
+		}
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		line, err = lines.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "[stage-a] [stage-b] listening on port 5432\n", line)
 	})
+}
 
-	t.Run("DoesNotReaddMainStageIfAlreadyExists", func(t *testing.T) {
+func TestEnableStageEvents(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-				},
-			},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step: "stage-a",
-		}
+	t.Run("SendsEventWhenStageStartsAndFinishes", func(t *testing.T) {
 
-		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		var mutex sync.Mutex
+		events := []stageEvent{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event stageEvent
+			_ = json.NewDecoder(r.Body).Decode(&event)
+			mutex.Lock()
+			events = append(events, event)
+			mutex.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-	})
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-	t.Run("AddsMainStageIfDoesNotExistWithRunIndex", func(t *testing.T) {
+		endOfLifeHelper := NewEndOfLifeHelper(true, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableStageEvents(server.URL + "/stage-events")
+		runner.EnableStageEvents(endOfLifeHelper)
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:     "stage-a",
-					RunIndex: 0,
-				},
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:     "stage-a",
-			RunIndex: 1,
-		}
+
+		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		_, err := runner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-		assert.Equal(t, 0, pipelineRunner.buildLogSteps[0].RunIndex)
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[1].Step)
-		assert.Equal(t, 1, pipelineRunner.buildLogSteps[1].RunIndex)
+		assert.Nil(t, err)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if assert.Equal(t, 2, len(events)) {
+			assert.Equal(t, "stage-a", events[0].Stage)
+			assert.Equal(t, contracts.LogStatusRunning, events[0].Status)
+			assert.Equal(t, "stage-a", events[1].Stage)
+			assert.Equal(t, contracts.LogStatusSucceeded, events[1].Status)
+			assert.NotNil(t, events[1].Duration)
+		}
 	})
 
-	t.Run("AddsMainStageIfDoesNotExistForNestedStage", func(t *testing.T) {
+	t.Run("SendsQueuedEventsBeforeReturningWhenApiIsSlow", func(t *testing.T) {
+
+		var mutex sync.Mutex
+		events := []stageEvent{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			var event stageEvent
+			_ = json.NewDecoder(r.Body).Decode(&event)
+			mutex.Lock()
+			events = append(events, event)
+			mutex.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeStage,
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		endOfLifeHelper := NewEndOfLifeHelper(true, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableStageEvents(server.URL + "/stage-events")
+		runner.EnableStageEvents(endOfLifeHelper)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
 		}
 
+		setDefaultMockExpectancies(containerRunnerMock)
+
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		_, err := runner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Nil(t, err)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if assert.Equal(t, 4, len(events)) {
+			assert.Equal(t, "stage-b", events[3].Stage)
+			assert.Equal(t, contracts.LogStatusSucceeded, events[3].Status)
+		}
 	})
 
-	t.Run("AddsMainStageIfDoesNotExistForNestedService", func(t *testing.T) {
+	t.Run("DoesNotSendStageEventsWhenNotEnabled", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeService,
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
 		}
 
+		setDefaultMockExpectancies(containerRunnerMock)
+
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		_, err := runner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, requests)
 	})
+}
 
-	t.Run("AddsMainStageWithDepth0IfServiceContainerStatusComesInFirst", func(t *testing.T) {
+func TestEnableIncrementalLogFlushing(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: make([]*contracts.BuildLogStep, 0),
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeService,
-			Depth:       1,
-		}
+	t.Run("SendsLogLinesOfRunningStageAtInterval", func(t *testing.T) {
 
-		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		var mutex sync.Mutex
+		logs := []incrementalLog{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var sentLog incrementalLog
+			_ = json.NewDecoder(r.Body).Decode(&sentLog)
+			mutex.Lock()
+			logs = append(logs, sentLog)
+			mutex.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-		assert.Equal(t, 0, pipelineRunner.buildLogSteps[0].Depth)
-	})
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
-	t.Run("AddsNestedStageIfDoesNotExist", func(t *testing.T) {
+		endOfLifeHelper := NewEndOfLifeHelper(true, getEndOfLifeHelperConfig(server.URL), "pod")
+		endOfLifeHelper.EnableIncrementalLogs(server.URL + "/incremental-logs")
+		runner.EnableIncrementalLogFlushing(endOfLifeHelper, 50*time.Millisecond)
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeStage,
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
 		}
 
+		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), "abc", "", "stage-a", contracts.LogTypeStage, 0, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				tailLogsChannel <- contracts.TailLogLine{Step: stageName, Type: stageType, LogLine: &contracts.BuildLogLine{LineNumber: 1, StreamType: "stdout", Text: "first"}}
+				time.Sleep(200 * time.Millisecond)
+				tailLogsChannel <- contracts.TailLogLine{Step: stageName, Type: stageType, LogLine: &contracts.BuildLogLine{LineNumber: 2, StreamType: "stdout", Text: "second"}}
+				time.Sleep(200 * time.Millisecond)
+				return nil
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
+
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		_, err := runner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].NestedSteps))
-		assert.Equal(t, "nested-stage-0", pipelineRunner.buildLogSteps[0].NestedSteps[0].Step)
+		assert.Nil(t, err)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if assert.Equal(t, 2, len(logs)) {
+			assert.Equal(t, "stage-a", logs[0].Stage)
+			assert.Equal(t, contracts.LogTypeStage, logs[0].Type)
+			if assert.Equal(t, 1, len(logs[0].LogLines)) {
+				assert.Equal(t, "first", logs[0].LogLines[0].Text)
+			}
+			assert.Equal(t, "stage-a", logs[1].Stage)
+			if assert.Equal(t, 1, len(logs[1].LogLines)) {
+				assert.Equal(t, "second", logs[1].LogLines[0].Text)
+			}
+		}
 	})
 
-	t.Run("DoesNotReaddNestedStageIfAlreadyExists", func(t *testing.T) {
+	t.Run("DoesNotSendLogLinesWhenNotEnabled", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					NestedSteps: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step: "nested-stage-0",
-						},
-					},
-				},
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeStage,
-		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), "abc", "", "stage-a", contracts.LogTypeStage, 0, gomock.Any()).
+			DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) (err error) {
+				tailLogsChannel <- contracts.TailLogLine{Step: stageName, Type: stageType, LogLine: &contracts.BuildLogLine{LineNumber: 1, StreamType: "stdout", Text: "first"}}
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			})
+		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		_, err := runner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].NestedSteps))
-		assert.Equal(t, "nested-stage-0", pipelineRunner.buildLogSteps[0].NestedSteps[0].Step)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, requests)
 	})
+}
 
-	t.Run("AddsNestedServiceIfDoesNotExist", func(t *testing.T) {
+func TestBufferIncrementalLogLine(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeService,
+	t.Run("DropsOldestLinesOnceMaximumIsReached", func(t *testing.T) {
+
+		pipelineRunner := &pipelineRunner{}
+		for i := 1; i <= maxPendingLogLines; i++ {
+			pipelineRunner.bufferIncrementalLogLine(contracts.TailLogLine{Step: "stage-a", Type: contracts.LogTypeStage, LogLine: &contracts.BuildLogLine{LineNumber: i, Text: "stage-a"}})
 		}
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		pipelineRunner.bufferIncrementalLogLine(contracts.TailLogLine{Step: "stage-b", Type: contracts.LogTypeStage, LogLine: &contracts.BuildLogLine{LineNumber: 1, Text: "stage-b"}})
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].Services))
-		assert.Equal(t, "nested-service-0", pipelineRunner.buildLogSteps[0].Services[0].Step)
+		assert.Equal(t, maxPendingLogLines, pipelineRunner.countPendingLogLines())
+		assert.Equal(t, 1, pipelineRunner.droppedLogLines)
+		if assert.Equal(t, 2, len(pipelineRunner.pendingLogLines)) {
+			assert.Equal(t, 2, pipelineRunner.pendingLogLines[0].logLines[0].LineNumber)
+			assert.Equal(t, "stage-b", pipelineRunner.pendingLogLines[1].stage)
+		}
 	})
+}
 
-	t.Run("DoesNotReaddNestedServiceIfAlreadyExists", func(t *testing.T) {
+func TestEnableWhenClauseLogging(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					Services: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step: "nested-service-0",
-						},
-					},
-				},
+	t.Run("AddsWhenClauseAndParametersToSkippedStage", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, obfuscator, _, _ := getMocks()
+		pipelineRunner.EnableWhenClauseLogging(obfuscator)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			{
+				Name:           "notify-failure",
+				ContainerImage: "extensions/slack-build-status:stable",
+				When:           "status == 'failed'",
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeService,
-		}
+
+		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps))
-		assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-		assert.Equal(t, 1, len(pipelineRunner.buildLogSteps[0].Services))
-		assert.Equal(t, "nested-service-0", pipelineRunner.buildLogSteps[0].Services[0].Step)
+		assert.Nil(t, err)
+		if assert.Equal(t, 2, len(buildLogSteps)) {
+			assert.Equal(t, 0, len(buildLogSteps[0].LogLines))
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[1].Status)
+			if assert.Equal(t, 1, len(buildLogSteps[1].LogLines)) {
+				assert.Contains(t, buildLogSteps[1].LogLines[0].Text, "when: status == 'failed'")
+				assert.Contains(t, buildLogSteps[1].LogLines[0].Text, "status:succeeded")
+			}
+		}
 	})
 
-	t.Run("AddLogLineToMainStage", func(t *testing.T) {
+	t.Run("AddsWhenClauseAndParametersToSkippedService", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					LogLines: []contracts.BuildLogLine{
-						contracts.BuildLogLine{
-							LineNumber: 1,
-							Text:       "Hi this is the first line",
-						},
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		_, obfuscator, _, _ := getMocks()
+		pipelineRunner.EnableWhenClauseLogging(obfuscator)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+				Services: []*manifest.ZiplineeService{
+					{
+						Name:           "debug-proxy",
+						ContainerImage: "nginx:alpine",
+						When:           "status == 'failed'",
 					},
 				},
 			},
 		}
-		tailLogLine := contracts.TailLogLine{
-			Step: "stage-a",
-			LogLine: &contracts.BuildLogLine{
-				LineNumber: 2,
-				Text:       "Hey I'd like to add a second line",
-			},
-		}
+
+		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).AnyTimes()
+		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].LogLines))
-		assert.Equal(t, 1, pipelineRunner.buildLogSteps[0].LogLines[0].LineNumber)
-		assert.Equal(t, 2, pipelineRunner.buildLogSteps[0].LogLines[1].LineNumber)
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(buildLogSteps)) && assert.Equal(t, 1, len(buildLogSteps[0].Services)) {
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[0].Services[0].Status)
+			if assert.Equal(t, 1, len(buildLogSteps[0].Services[0].LogLines)) {
+				assert.Contains(t, buildLogSteps[0].Services[0].LogLines[0].Text, "when: status == 'failed'")
+				assert.Contains(t, buildLogSteps[0].Services[0].LogLines[0].Text, "status:succeeded")
+			}
+		}
 	})
 
-	t.Run("AddLogLineToNestedStage", func(t *testing.T) {
+	t.Run("DoesNotAddWhenClauseToSkippedStageIfNotEnabled", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					NestedSteps: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step: "nested-stage-0",
-							LogLines: []contracts.BuildLogLine{
-								contracts.BuildLogLine{
-									LineNumber: 1,
-									Text:       "Hi this is the first line",
-								},
-							},
-						},
-					},
-				},
-			},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeStage,
-			LogLine: &contracts.BuildLogLine{
-				LineNumber: 2,
-				Text:       "Hey I'd like to add a second line",
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "notify-failure",
+				ContainerImage: "extensions/slack-build-status:stable",
+				When:           "status == 'failed'",
 			},
 		}
 
+		setDefaultMockExpectancies(containerRunnerMock)
+
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		buildLogSteps, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
 
-		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].NestedSteps[0].LogLines))
-		assert.Equal(t, 1, pipelineRunner.buildLogSteps[0].NestedSteps[0].LogLines[0].LineNumber)
-		assert.Equal(t, 2, pipelineRunner.buildLogSteps[0].NestedSteps[0].LogLines[1].LineNumber)
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(buildLogSteps)) {
+			assert.Equal(t, contracts.LogStatusSkipped, buildLogSteps[0].Status)
+			assert.Equal(t, 0, len(buildLogSteps[0].LogLines))
+		}
 	})
+}
 
-	t.Run("AddLogLineToNestedService", func(t *testing.T) {
+func TestGetSkipReasons(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					Services: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step: "nested-service-0",
-							LogLines: []contracts.BuildLogLine{
-								contracts.BuildLogLine{
-									LineNumber: 1,
-									Text:       "Hi this is the first line",
-								},
-							},
-						},
-					},
-				},
+	t.Run("ReturnsResumePointForStagesBeforeStageToResumeFrom", func(t *testing.T) {
+
+		t.Setenv("ZIPLINEE_RESUME_FROM_STAGE", "stage-b")
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
 			},
-		}
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeService,
-			LogLine: &contracts.BuildLogLine{
-				LineNumber: 2,
-				Text:       "Hey I'd like to add a second line",
+			{
+				Name:           "stage-b",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
 			},
 		}
 
+		setDefaultMockExpectancies(containerRunnerMock)
+		_, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
+		assert.Nil(t, err)
+
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		skipReasons := pipelineRunner.GetSkipReasons()
 
-		assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].Services[0].LogLines))
-		assert.Equal(t, 1, pipelineRunner.buildLogSteps[0].Services[0].LogLines[0].LineNumber)
-		assert.Equal(t, 2, pipelineRunner.buildLogSteps[0].Services[0].LogLines[1].LineNumber)
+		assert.Equal(t, map[string]SkipReason{"stage-a": SkipReasonResumePoint}, skipReasons)
 	})
 
-	t.Run("SetStatusForMainStage", func(t *testing.T) {
+	t.Run("ReturnsWhenClauseFalseForStagesWhoseWhenClauseEvaluatesToFalse", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "stage-a",
-					Status: contracts.LogStatusPending,
-				},
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+			},
+			{
+				Name:           "notify-failure",
+				ContainerImage: "extensions/slack-build-status:stable",
+				When:           "status == 'failed'",
 			},
 		}
-		status := contracts.LogStatusRunning
-		tailLogLine := contracts.TailLogLine{
-			Step:   "stage-a",
-			Status: &status,
-		}
+
+		setDefaultMockExpectancies(containerRunnerMock)
+		_, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
+		assert.Nil(t, err)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		skipReasons := pipelineRunner.GetSkipReasons()
 
-		assert.Equal(t, contracts.LogStatusRunning, pipelineRunner.buildLogSteps[0].Status)
+		assert.Equal(t, map[string]SkipReason{"notify-failure": SkipReasonWhenClauseFalse}, skipReasons)
 	})
 
-	t.Run("SetStatusForNestedStage", func(t *testing.T) {
+	t.Run("ReturnsWhenClauseFalseForParallelStagesKeyedByParentStage", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					NestedSteps: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step:   "nested-stage-0",
-							Status: contracts.LogStatusPending,
-						},
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name: "stage-a",
+				When: "status == 'succeeded'",
+				ParallelStages: []*manifest.ZiplineeStage{
+					{
+						Name:           "nested-stage-0",
+						ContainerImage: "alpine:latest",
+						When:           "status == 'succeeded'",
+					},
+					{
+						Name:           "nested-stage-1",
+						ContainerImage: "alpine:latest",
+						When:           "status == 'failed'",
 					},
 				},
 			},
 		}
-		status := contracts.LogStatusRunning
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeStage,
-			Status:      &status,
-		}
+
+		setDefaultMockExpectancies(containerRunnerMock)
+		_, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
+		assert.Nil(t, err)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		skipReasons := pipelineRunner.GetSkipReasons()
 
-		assert.Equal(t, contracts.LogStatusRunning, pipelineRunner.buildLogSteps[0].NestedSteps[0].Status)
+		assert.Equal(t, map[string]SkipReason{"stage-a/nested-stage-1": SkipReasonWhenClauseFalse}, skipReasons)
 	})
 
-	t.Run("SetStatusForNestedService", func(t *testing.T) {
+	t.Run("ReturnsWhenClauseFalseForServicesKeyedByParentStage", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step: "stage-a",
-					Services: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step:   "nested-service-0",
-							Status: contracts.LogStatusPending,
-						},
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stages := []*manifest.ZiplineeStage{
+			{
+				Name:           "stage-a",
+				ContainerImage: "alpine:latest",
+				When:           "status == 'succeeded'",
+				Services: []*manifest.ZiplineeService{
+					{
+						Name:           "debug-proxy",
+						ContainerImage: "nginx:alpine",
+						When:           "status == 'failed'",
 					},
 				},
 			},
 		}
-		status := contracts.LogStatusRunning
-		tailLogLine := contracts.TailLogLine{
-			Step:        "nested-service-0",
-			ParentStage: "stage-a",
-			Type:        contracts.LogTypeService,
-			Status:      &status,
-		}
+
+		containerRunnerMock.EXPECT().StopSingleStageServiceContainers(gomock.Any(), gomock.Any()).AnyTimes()
+		setDefaultMockExpectancies(containerRunnerMock)
+		_, err := pipelineRunner.RunStages(context.Background(), 0, stages, "/ziplinee-work", map[string]string{})
+		assert.Nil(t, err)
 
 		// act
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		skipReasons := pipelineRunner.GetSkipReasons()
 
-		assert.Equal(t, contracts.LogStatusRunning, pipelineRunner.buildLogSteps[0].Services[0].Status)
+		assert.Equal(t, map[string]SkipReason{"stage-a/debug-proxy": SkipReasonWhenClauseFalse}, skipReasons)
 	})
+}
 
-	t.Run("NestsParallelStageMessages", func(t *testing.T) {
+func TestValidateStageDependencies(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{},
+	t.Run("ReturnsNilForStagesWithoutNeeds", func(t *testing.T) {
+
+		stages := []*manifest.ZiplineeStage{
+			{Name: "build"},
+			{Name: "test"},
 		}
 
-		statusRunning := contracts.LogStatusRunning
-		statusPending := contracts.LogStatusPending
-		statusSucceeded := contracts.LogStatusSucceeded
+		// act
+		err := validateStageDependencies(stages)
 
-		// stage-a start
-		tailLogLine := contracts.TailLogLine{
-			Step:   "stage-a",
-			Type:   contracts.LogTypeStage,
-			Status: &statusRunning,
-		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		assert.Nil(t, err)
+	})
 
-		// nested-stage-1
-		tailLogLine = contracts.TailLogLine{
-			Step:        "nested-stage-1",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeStage,
-			Status:      &statusPending,
-		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+	t.Run("ReturnsNilForValidDependencyGraph", func(t *testing.T) {
 
-		tailLogLine = contracts.TailLogLine{
-			Step:        "nested-stage-1",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeStage,
-			Status:      &statusRunning,
+		stages := []*manifest.ZiplineeStage{
+			{Name: "build"},
+			{Name: "test", CustomProperties: map[string]interface{}{"needs": []interface{}{"build"}}},
+			{Name: "bake", CustomProperties: map[string]interface{}{"needs": []interface{}{"build"}}},
+			{Name: "push", CustomProperties: map[string]interface{}{"needs": []interface{}{"test", "bake"}}},
 		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
 
-		tailLogLine = contracts.TailLogLine{
-			Step:        "nested-stage-1",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeStage,
-			Status:      &statusSucceeded,
-		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		// act
+		err := validateStageDependencies(stages)
 
-		// nested-stage-0
-		tailLogLine = contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeStage,
-			Status:      &statusPending,
-		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+		assert.Nil(t, err)
+	})
 
-		tailLogLine = contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeStage,
-			Status:      &statusRunning,
-		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+	t.Run("ReturnsErrorWithCyclePathForCyclicDependencies", func(t *testing.T) {
 
-		tailLogLine = contracts.TailLogLine{
-			Step:        "nested-stage-0",
-			ParentStage: "stage-a",
-			Depth:       1,
-			Type:        contracts.LogTypeStage,
-			Status:      &statusSucceeded,
+		stages := []*manifest.ZiplineeStage{
+			{Name: "build", CustomProperties: map[string]interface{}{"needs": []interface{}{"push"}}},
+			{Name: "test", CustomProperties: map[string]interface{}{"needs": []interface{}{"build"}}},
+			{Name: "push", CustomProperties: map[string]interface{}{"needs": []interface{}{"test"}}},
 		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
 
-		// stage-a finish
-		tailLogLine = contracts.TailLogLine{
-			Step:   "stage-a",
-			Type:   contracts.LogTypeStage,
-			Status: &statusSucceeded,
+		// act
+		err := validateStageDependencies(stages)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Stage dependencies form a cycle: build -> push -> test -> build", err.Error())
 		}
-		pipelineRunner.upsertTailLogLine(tailLogLine)
+	})
 
-		if assert.Equal(t, 1, len(pipelineRunner.buildLogSteps)) {
-			assert.Equal(t, "stage-a", pipelineRunner.buildLogSteps[0].Step)
-			assert.Equal(t, contracts.LogStatusSucceeded, pipelineRunner.buildLogSteps[0].Status)
+	t.Run("ReturnsErrorForStageNeedingItself", func(t *testing.T) {
 
-			assert.Equal(t, 2, len(pipelineRunner.buildLogSteps[0].NestedSteps))
+		stages := []*manifest.ZiplineeStage{
+			{Name: "build", CustomProperties: map[string]interface{}{"needs": []interface{}{"build"}}},
+		}
 
-			assert.Equal(t, "nested-stage-1", pipelineRunner.buildLogSteps[0].NestedSteps[0].Step)
-			assert.Equal(t, contracts.LogStatusSucceeded, pipelineRunner.buildLogSteps[0].NestedSteps[0].Status)
+		// act
+		err := validateStageDependencies(stages)
 
-			assert.Equal(t, "nested-stage-0", pipelineRunner.buildLogSteps[0].NestedSteps[1].Step)
-			assert.Equal(t, contracts.LogStatusSucceeded, pipelineRunner.buildLogSteps[0].NestedSteps[1].Status)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Stage dependencies form a cycle: build -> build", err.Error())
 		}
 	})
-}
-
-func TestIsFinalStageComplete(t *testing.T) {
 
-	t.Run("ReturnsFalseIfBuildLogStepsAreEmpty", func(t *testing.T) {
+	t.Run("ReturnsErrorForUnknownStage", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: make([]*contracts.BuildLogStep, 0),
+		stages := []*manifest.ZiplineeStage{
+			{Name: "release", CustomProperties: map[string]interface{}{"needs": []interface{}{"build"}}},
 		}
-		stages := []*manifest.ZiplineeStage{}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		err := validateStageDependencies(stages)
 
-		assert.False(t, isComplete)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Stage release needs stage build, which doesn't exist", err.Error())
+		}
 	})
 
-	t.Run("ReturnsFalseIfLastStepHasRunningStatus", func(t *testing.T) {
+	t.Run("ReturnsErrorForStageNeedingStageThatRunsAfterIt", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusRunning,
-				},
-			},
-		}
 		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
+			{Name: "deploy", CustomProperties: map[string]interface{}{"needs": []interface{}{"build"}}},
+			{Name: "build"},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		err := validateStageDependencies(stages)
 
-		assert.False(t, isComplete)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "Stage deploy needs stage build, which runs after it", err.Error())
+		}
 	})
+}
 
-	t.Run("ReturnsFalseIfLastStepHasPendingStatus", func(t *testing.T) {
+func TestGetRerunStageNames(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusPending,
-				},
-			},
-		}
+	t.Run("ReturnsParentStageOfNestedStageToRerun", func(t *testing.T) {
+
+		pipelineRunner := &pipelineRunner{rerunStages: []string{"test-b"}}
 		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
+			{Name: "build"},
+			{
+				Name: "test",
+				ParallelStages: []*manifest.ZiplineeStage{
+					{Name: "test-a"},
+					{Name: "test-b"},
+				},
+				CustomProperties: map[string]interface{}{"needs": "build"},
 			},
+			{Name: "push"},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		rerunStageNames := pipelineRunner.getRerunStageNames(0, stages)
 
-		assert.False(t, isComplete)
+		assert.Equal(t, map[string]bool{"build": true, "test": true}, rerunStageNames)
 	})
 
-	t.Run("ReturnsTrueIfLastStepHasSucceededStatus", func(t *testing.T) {
+	t.Run("ReturnsStagesNeededTransitively", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-				},
-			},
-		}
+		pipelineRunner := &pipelineRunner{rerunStages: []string{"deploy"}}
 		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
+			{Name: "build"},
+			{Name: "push", CustomProperties: map[string]interface{}{"needs": "build"}},
+			{Name: "lint"},
+			{Name: "deploy", CustomProperties: map[string]interface{}{"needs": "push"}},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		rerunStageNames := pipelineRunner.getRerunStageNames(0, stages)
 
-		assert.True(t, isComplete)
+		assert.Equal(t, map[string]bool{"build": true, "push": true, "deploy": true}, rerunStageNames)
 	})
 
-	t.Run("ReturnsTrueIfLastStepHasFailedStatus", func(t *testing.T) {
+	t.Run("ReturnsNilIfNoStagesToRerunAreSet", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusFailed,
-				},
-			},
-		}
+		pipelineRunner := &pipelineRunner{rerunStages: splitStageNames(" , ")}
 		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
+			{Name: "build"},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		rerunStageNames := pipelineRunner.getRerunStageNames(0, stages)
 
-		assert.True(t, isComplete)
+		assert.Nil(t, rerunStageNames)
 	})
 
-	t.Run("ReturnsTrueIfLastStepHasSkippedStatus", func(t *testing.T) {
+	t.Run("ReturnsNilForNestedStages", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSkipped,
-				},
-			},
-		}
+		pipelineRunner := &pipelineRunner{rerunStages: []string{"test-b"}}
 		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
+			{Name: "test-a"},
+			{Name: "test-b"},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		rerunStageNames := pipelineRunner.getRerunStageNames(1, stages)
 
-		assert.True(t, isComplete)
+		assert.Nil(t, rerunStageNames)
 	})
+}
 
-	t.Run("ReturnsTrueIfLastStepHasCanceledStatus", func(t *testing.T) {
+func TestGetShallowCloneWarning(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusCanceled,
+	stages := []*manifest.ZiplineeStage{
+		{
+			Name:           "build",
+			ContainerImage: "golang:1.22",
+			Commands:       []string{"go build"},
+		},
+		{
+			Name: "package",
+			ParallelStages: []*manifest.ZiplineeStage{
+				{
+					Name:           "version",
+					ContainerImage: "alpine/git:latest",
+					Commands:       []string{"git describe --tags > VERSION"},
 				},
 			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
-		}
+		},
+	}
+
+	t.Run("ReturnsWarningForShallowCloneWithGitDescribe", func(t *testing.T) {
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		warning := getShallowCloneWarning("1", stages)
 
-		assert.True(t, isComplete)
+		assert.Contains(t, warning, "Stage version runs git describe")
+		assert.Contains(t, warning, "depth 1")
 	})
 
-	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButIsNotTheFinalStage", func(t *testing.T) {
+	t.Run("ReturnsNoWarningForFullClone", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "first-stage",
-					Status: contracts.LogStatusSucceeded,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "first-stage",
-			},
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
-		}
+		// act
+		warning := getShallowCloneWarning("", stages)
+
+		assert.Equal(t, "", warning)
+	})
+
+	t.Run("ReturnsNoWarningForShallowCloneWithoutGitDescribe", func(t *testing.T) {
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		warning := getShallowCloneWarning("1", stages[:1])
 
-		assert.False(t, isComplete)
+		assert.Equal(t, "", warning)
 	})
+}
 
-	t.Run("ReturnsFalseIfLastStepHasFailedStatusButIsNotTheFinalStage", func(t *testing.T) {
+func TestPrefixParallelStageLogLine(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "first-stage",
-					Status: contracts.LogStatusFailed,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "first-stage",
-			},
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
+	t.Run("PrefixesLogLineOfParallelStageWithStageNameWhenEnabled", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		runner.EnableParallelStageLogPrefixing()
+
+		tailLogLine := contracts.TailLogLine{
+			Step:        "unit-tests",
+			ParentStage: "test",
+			Type:        contracts.LogTypeStage,
+			Depth:       1,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 1,
+				StreamType: "stdout",
+				Text:       "ok  github.com/ziplineeci/ziplinee-ci-builder/pkg/builder",
 			},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		prefixedTailLogLine := runner.(*pipelineRunner).prefixParallelStageLogLine(tailLogLine)
 
-		assert.False(t, isComplete)
+		assert.Equal(t, "[unit-tests] ok  github.com/ziplineeci/ziplinee-ci-builder/pkg/builder", prefixedTailLogLine.LogLine.Text)
+		assert.Equal(t, "unit-tests", prefixedTailLogLine.Step)
+		assert.Equal(t, "test", prefixedTailLogLine.ParentStage)
+		assert.Equal(t, "ok  github.com/ziplineeci/ziplinee-ci-builder/pkg/builder", tailLogLine.LogLine.Text)
 	})
 
-	t.Run("ReturnsFalseIfLastStepHasSkippedStatusButIsNotTheFinalStage", func(t *testing.T) {
+	t.Run("KeepsStoredLogLineOfParallelStageUnprefixed", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		runner.EnableParallelStageLogPrefixing()
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "first-stage",
-					Status: contracts.LogStatusSkipped,
-				},
-			},
-		}
 		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "first-stage",
-			},
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
+			{
+				Name: "test",
+				ParallelStages: []*manifest.ZiplineeStage{
+					{Name: "unit-tests", ContainerImage: "golang:1.22"},
+				},
 			},
 		}
+		tailLogsDone := make(chan struct{}, 1)
+		go runner.(*pipelineRunner).tailLogs(context.Background(), tailLogsDone, stages)
+
+		succeeded := contracts.LogStatusSucceeded
+		duration := time.Second
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		tailLogsChannel <- contracts.TailLogLine{Step: "unit-tests", ParentStage: "test", Type: contracts.LogTypeStage, Depth: 1, LogLine: &contracts.BuildLogLine{LineNumber: 1, StreamType: "stdout", Text: "go test ./..."}}
+		tailLogsChannel <- contracts.TailLogLine{Step: "unit-tests", ParentStage: "test", Type: contracts.LogTypeStage, Depth: 1, Status: &succeeded, Duration: &duration}
+		tailLogsChannel <- contracts.TailLogLine{Step: "test", Type: contracts.LogTypeStage, Status: &succeeded, Duration: &duration}
+		<-tailLogsDone
 
-		assert.False(t, isComplete)
+		buildLogSteps := runner.(*pipelineRunner).getLogs(context.Background())
+		if assert.Equal(t, 1, len(buildLogSteps)) && assert.Equal(t, 1, len(buildLogSteps[0].NestedSteps)) && assert.Equal(t, 1, len(buildLogSteps[0].NestedSteps[0].LogLines)) {
+			assert.Equal(t, "go test ./...", buildLogSteps[0].NestedSteps[0].LogLines[0].Text)
+		}
 	})
 
-	t.Run("ReturnsFalseIfLastStepHasCanceledStatusButIsNotTheFinalStage", func(t *testing.T) {
+	t.Run("DoesNotPrefixLogLineOfSequentialStage", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "first-stage",
-					Status: contracts.LogStatusCanceled,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "first-stage",
-			},
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		runner.EnableParallelStageLogPrefixing()
+
+		tailLogLine := contracts.TailLogLine{
+			Step: "build",
+			Type: contracts.LogTypeStage,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 1,
+				StreamType: "stdout",
+				Text:       "go build",
 			},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		prefixedTailLogLine := runner.(*pipelineRunner).prefixParallelStageLogLine(tailLogLine)
 
-		assert.False(t, isComplete)
+		assert.Equal(t, "go build", prefixedTailLogLine.LogLine.Text)
 	})
 
-	t.Run("ReturnsFalseIfLastStageHasParallelStagesButLastStepHasNoEqualAmountOfNestedSteps", func(t *testing.T) {
+	t.Run("DoesNotPrefixLogLineOfParallelStageWhenNotEnabled", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-				ParallelStages: []*manifest.ZiplineeStage{
-					&manifest.ZiplineeStage{
-						Name: "nested-stage",
-					},
-				},
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, runner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		tailLogLine := contracts.TailLogLine{
+			Step:        "unit-tests",
+			ParentStage: "test",
+			Type:        contracts.LogTypeStage,
+			Depth:       1,
+			LogLine: &contracts.BuildLogLine{
+				LineNumber: 1,
+				StreamType: "stdout",
+				Text:       "go test ./...",
 			},
 		}
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		prefixedTailLogLine := runner.(*pipelineRunner).prefixParallelStageLogLine(tailLogLine)
 
-		assert.False(t, isComplete)
+		assert.Equal(t, "go test ./...", prefixedTailLogLine.LogLine.Text)
 	})
+}
 
-	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButAnyParallelStagesHavePendingOrRunningStatus", func(t *testing.T) {
+func TestStopPipelineOnCancellation(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-					NestedSteps: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step:   "nested-stage",
-							Status: contracts.LogStatusRunning,
-						},
-					},
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-				ParallelStages: []*manifest.ZiplineeStage{
-					&manifest.ZiplineeStage{
-						Name: "nested-stage",
-					},
-				},
-			},
-		}
+	t.Run("MarksPipelineAsCanceledAndStopsAllContainers", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		containerRunnerMock.EXPECT().StopAllContainers(gomock.Any()).Times(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		pipelineRunner.StopPipelineOnCancellation(ctx)
 
-		assert.False(t, isComplete)
+		assert.True(t, pipelineRunner.IsCanceled())
 	})
 
-	t.Run("ReturnsFalseIfLastStageHasServicesButLastStepHasNoEqualAmountOfServices", func(t *testing.T) {
+	t.Run("GivesUpStoppingAllContainersAfterCleanupTimeout", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-				Services: []*manifest.ZiplineeService{
-					&manifest.ZiplineeService{
-						Name: "nested-service",
-					},
-				},
-			},
-		}
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetCleanupTimeout(50 * time.Millisecond)
+
+		unresponsiveDaemon := make(chan struct{})
+		defer close(unresponsiveDaemon)
+		containerRunnerMock.EXPECT().StopAllContainers(gomock.Any()).Do(func(ctx context.Context) {
+			<-unresponsiveDaemon
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		pipelineRunner.StopPipelineOnCancellation(ctx)
 
-		assert.False(t, isComplete)
+		assert.True(t, pipelineRunner.IsCanceled())
+		assert.Less(t, time.Since(start), 5*time.Second)
 	})
 
-	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButAnyServicesHavePendingOrRunningStatus", func(t *testing.T) {
+	t.Run("WaitsForUninterruptibleStageToCompleteBeforeStoppingAllContainers", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-					Services: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step:   "nested-service",
-							Status: contracts.LogStatusRunning,
-						},
-					},
-				},
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		tailLogsChannel, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "terraform-apply",
+			ContainerImage: "hashicorp/terraform:1.8",
+			CustomProperties: map[string]interface{}{
+				"uninterruptible": true,
 			},
 		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-				Services: []*manifest.ZiplineeService{
-					&manifest.ZiplineeService{
-						Name: "nested-service",
-					},
-				},
-			},
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var eventsMutex sync.Mutex
+		events := []string{}
+		addEvent := func(event string) {
+			eventsMutex.Lock()
+			defer eventsMutex.Unlock()
+			events = append(events, event)
 		}
+		stopped := make(chan struct{})
+
+		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) error {
+			// cancel while the stage runs
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+			addEvent("stage-completed")
+			return nil
+		})
+		containerRunnerMock.EXPECT().StopAllContainers(gomock.Any()).Do(func(ctx context.Context) {
+			addEvent("containers-stopped")
+			close(stopped)
+		})
+		setDefaultMockExpectancies(containerRunnerMock)
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		go pipelineRunner.StopPipelineOnCancellation(ctx)
+		err := pipelineRunner.RunStage(ctx, 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+		<-stopped
 
-		assert.False(t, isComplete)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"stage-completed", "containers-stopped"}, events)
+
+		var finalStatusMessage contracts.TailLogLine
+		for len(tailLogsChannel) > 0 {
+			finalStatusMessage = <-tailLogsChannel
+		}
+		if assert.NotNil(t, finalStatusMessage.Status) {
+			assert.Equal(t, contracts.LogStatusSucceeded, *finalStatusMessage.Status)
+		}
 	})
 
-	t.Run("ReturnsFalseIfLastStepHasSucceededStatusButMultiStageServicesFromPreviousStagesHaveNotFinished", func(t *testing.T) {
+	t.Run("StopsAllContainersIfUninterruptibleStageExceedsTimeout", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "earlier-stage",
-					Status: contracts.LogStatusSucceeded,
-					Services: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step:   "nested-service-1",
-							Status: contracts.LogStatusRunning,
-						},
-					},
-				},
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetUninterruptibleStageTimeout(10 * time.Millisecond)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "terraform-apply",
+			ContainerImage: "hashicorp/terraform:1.8",
+			CustomProperties: map[string]interface{}{
+				"uninterruptible": true,
 			},
 		}
 
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+
+		// set mock responses
+		containerRunnerMock.EXPECT().TailContainerLogs(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, containerID, parentStageName, stageName string, stageType contracts.LogType, depth int, multiStage *bool) error {
+			cancel()
+			// the stage only ends once its container gets stopped
+			<-stopped
+			return fmt.Errorf("container got killed")
+		})
+		containerRunnerMock.EXPECT().StopAllContainers(gomock.Any()).Do(func(ctx context.Context) {
+			close(stopped)
+		})
+		setDefaultMockExpectancies(containerRunnerMock)
+
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		go pipelineRunner.StopPipelineOnCancellation(ctx)
+		err := pipelineRunner.RunStage(ctx, 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
 
-		assert.False(t, isComplete)
+		assert.NotNil(t, err)
+		assert.True(t, pipelineRunner.IsCanceled())
 	})
 
-	t.Run("ReturnsTrueIfLastStepHasSucceededStatusAndAllServicesFromPreviousStagesHaveFinished", func(t *testing.T) {
+	t.Run("IsNotCanceledBeforeCancellation", func(t *testing.T) {
 
-		pipelineRunner := pipelineRunner{
-			buildLogSteps: []*contracts.BuildLogStep{
-				&contracts.BuildLogStep{
-					Step:   "earlier-stage",
-					Status: contracts.LogStatusSucceeded,
-					Services: []*contracts.BuildLogStep{
-						&contracts.BuildLogStep{
-							Step:   "nested-service-1",
-							Status: contracts.LogStatusRunning,
-						},
-					},
-				},
-				&contracts.BuildLogStep{
-					Step:   "last-stage",
-					Status: contracts.LogStatusSucceeded,
-				},
-			},
-		}
-		stages := []*manifest.ZiplineeStage{
-			&manifest.ZiplineeStage{
-				Name: "last-stage",
-			},
-		}
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
 
 		// act
-		isComplete := pipelineRunner.isFinalStageComplete(stages)
+		canceled := pipelineRunner.IsCanceled()
 
-		assert.False(t, isComplete)
+		assert.False(t, canceled)
 	})
 }
 
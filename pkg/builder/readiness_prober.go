@@ -3,14 +3,19 @@ package builder
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-func WaitForReadinessHttpGet(ctx context.Context, scheme, host string, port int, path, hostname string, timeoutSeconds int) error {
+// WaitForReadinessHttpGet requests the readiness endpoint until it returns status 200, and a body matching bodyMatch if it's set, or the timeout expires
+func WaitForReadinessHttpGet(ctx context.Context, scheme, host string, port int, path, hostname, bodyMatch string, timeoutSeconds int) error {
 
 	if scheme == "" {
 		return fmt.Errorf("Scheme is empty, should be either http or https")
@@ -30,7 +35,7 @@ func WaitForReadinessHttpGet(ctx context.Context, scheme, host string, port int,
 
 	readinessURL := fmt.Sprintf("%v://%v:%v%v", scheme, host, port, path)
 
-	log.Info().Msgf("Running readiness probe against %v with host header %v", readinessURL, hostname)
+	log.Info().Msgf("Running readiness probe against %v with host header %v", redactURL(readinessURL), hostname)
 
 	// create http client and request
 	var httpClient = &http.Client{
@@ -53,18 +58,18 @@ func WaitForReadinessHttpGet(ctx context.Context, scheme, host string, port int,
 	go func(request *http.Request) {
 
 		// perform request
-		resp, err := httpClient.Do(request)
+		err := probeReadiness(httpClient, request, bodyMatch)
 
 		// keep sending request until it succeeds or the total timeout has send a quit signal
-		for err != nil || resp.StatusCode != http.StatusOK {
-			log.Warn().Err(err).Msgf("Readiness probe against %v failed", request.URL)
+		for err != nil {
+			log.Warn().Err(redactURLsInError(err)).Msgf("Readiness probe against %v failed", redactURL(request.URL.String()))
 			time.Sleep(1 * time.Second)
 
 			select {
 			case <-quit:
 				return
 			default:
-				resp, err = httpClient.Do(request)
+				err = probeReadiness(httpClient, request, bodyMatch)
 			}
 		}
 
@@ -74,11 +79,77 @@ func WaitForReadinessHttpGet(ctx context.Context, scheme, host string, port int,
 
 	select {
 	case <-ready:
-		log.Info().Msgf("Readiness probe against %v with host header %v succeeded in time", readinessURL, hostname)
+		log.Info().Msgf("Readiness probe against %v with host header %v succeeded in time", redactURL(readinessURL), hostname)
 	case <-time.After(time.Duration(timeoutSeconds) * time.Second):
 		quit <- true
-		return fmt.Errorf("Readiness probe against %v with host header %v did not succeed in %vs", readinessURL, hostname, timeoutSeconds)
+		return fmt.Errorf("Readiness probe against %v with host header %v did not succeed in %vs", redactURL(readinessURL), hostname, timeoutSeconds)
 	}
 
 	return nil
 }
+
+func probeReadiness(httpClient *http.Client, request *http.Request, bodyMatch string) error {
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Readiness probe returned status code %v", resp.StatusCode)
+	}
+
+	if bodyMatch == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !matchesReadinessBody(body, bodyMatch) {
+		return fmt.Errorf("Readiness probe response body does not match %v", bodyMatch)
+	}
+
+	return nil
+}
+
+// matchesReadinessBody checks whether the body contains bodyMatch, or if bodyMatch is a json path like $.status=UP, whether the json body has that value at that path; a json path without a value only has to exist
+func matchesReadinessBody(body []byte, bodyMatch string) bool {
+	if !strings.HasPrefix(bodyMatch, "$.") {
+		return strings.Contains(string(body), bodyMatch)
+	}
+
+	path, expectedValue, hasExpectedValue := strings.Cut(strings.TrimPrefix(bodyMatch, "$."), "=")
+
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		return false
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch typedValue := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			value, ok = typedValue[key]
+			if !ok {
+				return false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(typedValue) {
+				return false
+			}
+			value = typedValue[index]
+		default:
+			return false
+		}
+	}
+
+	if !hasExpectedValue {
+		return true
+	}
+
+	return fmt.Sprintf("%v", value) == expectedValue
+}
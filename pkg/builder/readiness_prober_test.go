@@ -0,0 +1,125 @@
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForReadinessHttpGet(t *testing.T) {
+
+	t.Run("ReturnsNoErrorWhenServiceReturnsStatusOK", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"status":"DEGRADED"}`))
+		}))
+		defer server.Close()
+		host, port := getTestServerHostAndPort(t, server)
+
+		// act
+		err := WaitForReadinessHttpGet(context.Background(), "http", host, port, "/readiness", "", "", 5)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsNoErrorWhenBodyMatches", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"status":"UP"}`))
+		}))
+		defer server.Close()
+		host, port := getTestServerHostAndPort(t, server)
+
+		// act
+		err := WaitForReadinessHttpGet(context.Background(), "http", host, port, "/readiness", "", "$.status=UP", 5)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsErrorWhenServiceReturnsStatusOKWithBodyThatDoesNotMatch", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"status":"DEGRADED"}`))
+		}))
+		defer server.Close()
+		host, port := getTestServerHostAndPort(t, server)
+
+		// act
+		err := WaitForReadinessHttpGet(context.Background(), "http", host, port, "/readiness", "", "$.status=UP", 1)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestMatchesReadinessBody(t *testing.T) {
+
+	t.Run("ReturnsTrueIfBodyContainsSubstring", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte("database: ok, cache: ok"), "database: ok")
+
+		assert.True(t, matches)
+	})
+
+	t.Run("ReturnsFalseIfBodyDoesNotContainSubstring", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte("database: degraded"), "database: ok")
+
+		assert.False(t, matches)
+	})
+
+	t.Run("ReturnsTrueIfJSONPathHasExpectedValue", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte(`{"checks":[{"name":"database","status":"UP"}]}`), "$.checks.0.status=UP")
+
+		assert.True(t, matches)
+	})
+
+	t.Run("ReturnsFalseIfJSONPathHasOtherValue", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte(`{"checks":[{"name":"database","status":"DOWN"}]}`), "$.checks.0.status=UP")
+
+		assert.False(t, matches)
+	})
+
+	t.Run("ReturnsTrueIfJSONPathWithoutValueExists", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte(`{"ready":true}`), "$.ready")
+
+		assert.True(t, matches)
+	})
+
+	t.Run("ReturnsFalseIfJSONPathDoesNotExist", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte(`{"status":"UP"}`), "$.ready")
+
+		assert.False(t, matches)
+	})
+
+	t.Run("ReturnsFalseForJSONPathIfBodyIsNotJSON", func(t *testing.T) {
+
+		// act
+		matches := matchesReadinessBody([]byte("UP"), "$.status=UP")
+
+		assert.False(t, matches)
+	})
+}
+
+func getTestServerHostAndPort(t *testing.T, server *httptest.Server) (host string, port int) {
+	serverURL, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	port, err = strconv.Atoi(serverURL.Port())
+	assert.Nil(t, err)
+
+	return serverURL.Hostname(), port
+}
@@ -0,0 +1,219 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// clockTicksPerSecond is the USER_HZ value used by /proc/self/stat, which is 100 on all common linux platforms
+const clockTicksPerSecond = 100
+
+// ResourceUsageSample is a single measurement of the resources used by the builder
+type ResourceUsageSample struct {
+	Time              time.Time
+	MemoryBytes       uint64
+	CPUSeconds        float64
+	CgroupMemoryBytes uint64
+}
+
+// ResourceUsagePeaks holds the peak resource usage of the builder during a build
+type ResourceUsagePeaks struct {
+	MemoryBytes       uint64  `json:"memoryBytes"`
+	CPUCores          float64 `json:"cpuCores"`
+	CgroupMemoryBytes uint64  `json:"cgroupMemoryBytes,omitempty"`
+	Samples           int     `json:"samples"`
+}
+
+// ResourceUsageTracker periodically samples the resources used by the builder and keeps track of the peak values, to help size builder pods
+type ResourceUsageTracker interface {
+	Start(ctx context.Context)
+	Stop() ResourceUsagePeaks
+}
+
+type resourceUsageTracker struct {
+	sample   func() (ResourceUsageSample, error)
+	interval time.Duration
+
+	peaks          ResourceUsagePeaks
+	previousSample *ResourceUsageSample
+	mutex          sync.Mutex
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewResourceUsageTracker returns a new ResourceUsageTracker
+func NewResourceUsageTracker(interval time.Duration) ResourceUsageTracker {
+	return &resourceUsageTracker{
+		sample:   sampleResourceUsage,
+		interval: interval,
+	}
+}
+
+func (rut *resourceUsageTracker) Start(ctx context.Context) {
+	rut.done = make(chan struct{})
+	rut.stopped = make(chan struct{})
+
+	go func() {
+		defer close(rut.stopped)
+
+		ticker := time.NewTicker(rut.interval)
+		defer ticker.Stop()
+
+		rut.takeSample()
+		for {
+			select {
+			case <-ticker.C:
+				rut.takeSample()
+			case <-ctx.Done():
+				return
+			case <-rut.done:
+				return
+			}
+		}
+	}()
+}
+
+func (rut *resourceUsageTracker) Stop() ResourceUsagePeaks {
+	if rut.done != nil {
+		close(rut.done)
+		<-rut.stopped
+		rut.done = nil
+	}
+
+	// take a final sample so short builds get reported as well
+	rut.takeSample()
+
+	rut.mutex.Lock()
+	defer rut.mutex.Unlock()
+
+	return rut.peaks
+}
+
+func (rut *resourceUsageTracker) takeSample() {
+	sample, err := rut.sample()
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed sampling builder resource usage")
+		return
+	}
+
+	rut.addSample(sample)
+}
+
+func (rut *resourceUsageTracker) addSample(sample ResourceUsageSample) {
+	rut.mutex.Lock()
+	defer rut.mutex.Unlock()
+
+	rut.peaks.Samples++
+
+	if sample.MemoryBytes > rut.peaks.MemoryBytes {
+		rut.peaks.MemoryBytes = sample.MemoryBytes
+	}
+	if sample.CgroupMemoryBytes > rut.peaks.CgroupMemoryBytes {
+		rut.peaks.CgroupMemoryBytes = sample.CgroupMemoryBytes
+	}
+
+	// cpu usage is the cpu time spent in between two samples divided by the wall time in between them
+	if rut.previousSample != nil {
+		elapsedSeconds := sample.Time.Sub(rut.previousSample.Time).Seconds()
+		if elapsedSeconds > 0 {
+			cpuCores := (sample.CPUSeconds - rut.previousSample.CPUSeconds) / elapsedSeconds
+			if cpuCores > rut.peaks.CPUCores {
+				rut.peaks.CPUCores = cpuCores
+			}
+		}
+	}
+
+	rut.previousSample = &sample
+}
+
+// sampleResourceUsage reads the usage of the builder process from /proc and of its cgroup (including the docker daemon) from /sys/fs/cgroup if available
+func sampleResourceUsage() (sample ResourceUsageSample, err error) {
+	sample.Time = time.Now()
+
+	statusBytes, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return
+	}
+	sample.MemoryBytes, err = parseProcStatusMemory(string(statusBytes))
+	if err != nil {
+		return
+	}
+
+	statBytes, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return
+	}
+	sample.CPUSeconds, err = parseProcStatCPUSeconds(string(statBytes))
+	if err != nil {
+		return
+	}
+
+	// cgroup v2 and v1 respectively
+	for _, path := range []string{"/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory/memory.usage_in_bytes"} {
+		if cgroupMemoryBytes, cgroupErr := os.ReadFile(path); cgroupErr == nil {
+			if value, parseErr := strconv.ParseUint(strings.TrimSpace(string(cgroupMemoryBytes)), 10, 64); parseErr == nil {
+				sample.CgroupMemoryBytes = value
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// parseProcStatusMemory returns the resident set size from the contents of /proc/self/status in bytes
+func parseProcStatusMemory(status string) (uint64, error) {
+	for _, line := range strings.Split(status, "\n") {
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "VmRSS:"))
+		if len(fields) == 0 {
+			break
+		}
+
+		kiloBytes, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return kiloBytes * 1024, nil
+	}
+
+	return 0, fmt.Errorf("No VmRSS found in /proc/self/status")
+}
+
+// parseProcStatCPUSeconds returns the user and system cpu time from the contents of /proc/self/stat in seconds
+func parseProcStatCPUSeconds(stat string) (float64, error) {
+	// the command name can contain spaces, so start parsing after its closing parenthesis
+	commandEnd := strings.LastIndex(stat, ")")
+	if commandEnd == -1 {
+		return 0, fmt.Errorf("Unexpected format of /proc/self/stat")
+	}
+
+	// utime and stime are fields 14 and 15, which are the 12th and 13th after the command name
+	fields := strings.Fields(stat[commandEnd+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("Unexpected number of fields in /proc/self/stat")
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(utime+stime) / clockTicksPerSecond, nil
+}
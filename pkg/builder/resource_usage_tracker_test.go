@@ -0,0 +1,135 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceUsageTrackerAddSample(t *testing.T) {
+
+	t.Run("TracksPeakMemory", func(t *testing.T) {
+
+		tracker := resourceUsageTracker{}
+		now := time.Now()
+
+		// act
+		tracker.addSample(ResourceUsageSample{Time: now, MemoryBytes: 100, CgroupMemoryBytes: 1000})
+		tracker.addSample(ResourceUsageSample{Time: now.Add(time.Second), MemoryBytes: 300, CgroupMemoryBytes: 800})
+		tracker.addSample(ResourceUsageSample{Time: now.Add(2 * time.Second), MemoryBytes: 200, CgroupMemoryBytes: 1200})
+
+		assert.Equal(t, uint64(300), tracker.peaks.MemoryBytes)
+		assert.Equal(t, uint64(1200), tracker.peaks.CgroupMemoryBytes)
+		assert.Equal(t, 3, tracker.peaks.Samples)
+	})
+
+	t.Run("TracksPeakCPUCoresFromCPUTimeInBetweenSamples", func(t *testing.T) {
+
+		tracker := resourceUsageTracker{}
+		now := time.Now()
+
+		// act
+		tracker.addSample(ResourceUsageSample{Time: now, CPUSeconds: 10})
+		tracker.addSample(ResourceUsageSample{Time: now.Add(2 * time.Second), CPUSeconds: 13})
+		tracker.addSample(ResourceUsageSample{Time: now.Add(4 * time.Second), CPUSeconds: 14})
+
+		assert.Equal(t, 1.5, tracker.peaks.CPUCores)
+	})
+
+	t.Run("DoesNotReportCPUCoresForSingleSample", func(t *testing.T) {
+
+		tracker := resourceUsageTracker{}
+
+		// act
+		tracker.addSample(ResourceUsageSample{Time: time.Now(), CPUSeconds: 10})
+
+		assert.Equal(t, 0.0, tracker.peaks.CPUCores)
+	})
+}
+
+func TestResourceUsageTrackerStartAndStop(t *testing.T) {
+
+	t.Run("ReturnsPeaksOfInjectedSamples", func(t *testing.T) {
+
+		now := time.Now()
+		samples := []ResourceUsageSample{
+			{Time: now, MemoryBytes: 100, CPUSeconds: 1},
+			{Time: now.Add(time.Second), MemoryBytes: 500, CPUSeconds: 3},
+		}
+		tracker := resourceUsageTracker{
+			interval: time.Hour,
+			sample: func() (ResourceUsageSample, error) {
+				sample := samples[0]
+				if len(samples) > 1 {
+					samples = samples[1:]
+				}
+				return sample, nil
+			},
+		}
+
+		tracker.Start(context.Background())
+
+		// act
+		peaks := tracker.Stop()
+
+		assert.Equal(t, uint64(500), peaks.MemoryBytes)
+		assert.Equal(t, 2.0, peaks.CPUCores)
+		assert.Equal(t, 2, peaks.Samples)
+	})
+
+	t.Run("IgnoresFailedSamples", func(t *testing.T) {
+
+		tracker := resourceUsageTracker{
+			interval: time.Hour,
+			sample: func() (ResourceUsageSample, error) {
+				return ResourceUsageSample{}, fmt.Errorf("No proc filesystem")
+			},
+		}
+
+		tracker.Start(context.Background())
+
+		// act
+		peaks := tracker.Stop()
+
+		assert.Equal(t, 0, peaks.Samples)
+	})
+}
+
+func TestParseProcStatusMemory(t *testing.T) {
+
+	t.Run("ReturnsResidentSetSizeInBytes", func(t *testing.T) {
+
+		status := "Name:\tziplinee-ci-builder\nVmPeak:\t  900000 kB\nVmRSS:\t   20480 kB\nThreads:\t12\n"
+
+		// act
+		memoryBytes, err := parseProcStatusMemory(status)
+
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(20480*1024), memoryBytes)
+	})
+
+	t.Run("ReturnsErrorIfVmRSSIsMissing", func(t *testing.T) {
+
+		// act
+		_, err := parseProcStatusMemory("Name:\tziplinee-ci-builder\n")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestParseProcStatCPUSeconds(t *testing.T) {
+
+	t.Run("ReturnsSumOfUserAndSystemTimeInSeconds", func(t *testing.T) {
+
+		stat := "1 (ziplinee ci builder) S 0 1 1 0 -1 4194560 2424 0 0 0 250 130 0 0 20 0 12 0 100 800000000 5000"
+
+		// act
+		cpuSeconds, err := parseProcStatCPUSeconds(stat)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3.8, cpuSeconds)
+	})
+}
@@ -0,0 +1,76 @@
+package builder
+
+import (
+	"time"
+
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+)
+
+// StageDisposition is how a stage or service ended up, as part of a compact summary of the build for pipeline analytics
+type StageDisposition struct {
+	Stage       string            `json:"stage"`
+	ParentStage string            `json:"parentStage,omitempty"`
+	Type        contracts.LogType `json:"type"`
+	Disposition string            `json:"disposition"`
+	Duration    time.Duration     `json:"duration"`
+	ExitCode    int64             `json:"exitCode"`
+	SkipReason  SkipReason        `json:"skipReason,omitempty"`
+}
+
+const (
+	stageDispositionRan      = "ran"
+	stageDispositionSkipped  = "skipped"
+	stageDispositionFailed   = "failed"
+	stageDispositionCanceled = "canceled"
+	stageDispositionUnknown  = "unknown"
+)
+
+// getStageDispositions lists every stage, parallel stage and service of the build log in order with its final disposition and the reason it got skipped
+func getStageDispositions(buildLogSteps []*contracts.BuildLogStep, skipReasons map[string]SkipReason) []StageDisposition {
+	stageDispositions := []StageDisposition{}
+	for _, step := range buildLogSteps {
+		stageDispositions = appendStageDispositions(stageDispositions, step, "", contracts.LogTypeStage, skipReasons)
+	}
+
+	return stageDispositions
+}
+
+func appendStageDispositions(stageDispositions []StageDisposition, step *contracts.BuildLogStep, parentStageName string, stepType contracts.LogType, skipReasons map[string]SkipReason) []StageDisposition {
+	if step == nil {
+		return stageDispositions
+	}
+
+	stageDispositions = append(stageDispositions, StageDisposition{
+		Stage:       step.Step,
+		ParentStage: parentStageName,
+		Type:        stepType,
+		Disposition: getStageDisposition(step.Status),
+		Duration:    step.Duration,
+		ExitCode:    step.ExitCode,
+		SkipReason:  skipReasons[getSkipReasonKey(step.Step, parentStageName)],
+	})
+
+	for _, service := range step.Services {
+		stageDispositions = appendStageDispositions(stageDispositions, service, step.Step, contracts.LogTypeService, skipReasons)
+	}
+	for _, nestedStep := range step.NestedSteps {
+		stageDispositions = appendStageDispositions(stageDispositions, nestedStep, step.Step, contracts.LogTypeStage, skipReasons)
+	}
+
+	return stageDispositions
+}
+
+func getStageDisposition(status contracts.LogStatus) string {
+	switch status {
+	case contracts.LogStatusSucceeded:
+		return stageDispositionRan
+	case contracts.LogStatusSkipped:
+		return stageDispositionSkipped
+	case contracts.LogStatusFailed:
+		return stageDispositionFailed
+	case contracts.LogStatusCanceled:
+		return stageDispositionCanceled
+	}
+
+	return stageDispositionUnknown
+}
@@ -0,0 +1,100 @@
+package builder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+)
+
+func TestGetStageDispositions(t *testing.T) {
+
+	t.Run("ReturnsDispositionOfEveryStageAndServiceOfMixedOutcomeBuild", func(t *testing.T) {
+
+		buildLogSteps := []*contracts.BuildLogStep{
+			{
+				Step:     "build",
+				Status:   contracts.LogStatusSucceeded,
+				Duration: 10 * time.Second,
+			},
+			{
+				Step:     "integration-tests",
+				Status:   contracts.LogStatusFailed,
+				Duration: 25 * time.Second,
+				ExitCode: 1,
+				Services: []*contracts.BuildLogStep{
+					{
+						Step:     "postgres",
+						Depth:    1,
+						Status:   contracts.LogStatusSucceeded,
+						Duration: 30 * time.Second,
+					},
+				},
+			},
+			{
+				Step:   "checks",
+				Status: contracts.LogStatusCanceled,
+				NestedSteps: []*contracts.BuildLogStep{
+					{
+						Step:     "lint",
+						Depth:    1,
+						Status:   contracts.LogStatusCanceled,
+						Duration: 3 * time.Second,
+					},
+					{
+						Step:   "vulnerabilities",
+						Depth:  1,
+						Status: contracts.LogStatusSkipped,
+					},
+				},
+			},
+			{
+				Step:   "deploy",
+				Status: contracts.LogStatusSkipped,
+			},
+		}
+		skipReasons := map[string]SkipReason{
+			"checks/vulnerabilities": SkipReasonWhenClauseFalse,
+			"deploy":                 SkipReasonWhenClauseFalse,
+		}
+
+		// act
+		stageDispositions := getStageDispositions(buildLogSteps, skipReasons)
+
+		assert.Equal(t, []StageDisposition{
+			{Stage: "build", Type: contracts.LogTypeStage, Disposition: "ran", Duration: 10 * time.Second},
+			{Stage: "integration-tests", Type: contracts.LogTypeStage, Disposition: "failed", Duration: 25 * time.Second, ExitCode: 1},
+			{Stage: "postgres", ParentStage: "integration-tests", Type: contracts.LogTypeService, Disposition: "ran", Duration: 30 * time.Second},
+			{Stage: "checks", Type: contracts.LogTypeStage, Disposition: "canceled"},
+			{Stage: "lint", ParentStage: "checks", Type: contracts.LogTypeStage, Disposition: "canceled", Duration: 3 * time.Second},
+			{Stage: "vulnerabilities", ParentStage: "checks", Type: contracts.LogTypeStage, Disposition: "skipped", SkipReason: SkipReasonWhenClauseFalse},
+			{Stage: "deploy", Type: contracts.LogTypeStage, Disposition: "skipped", SkipReason: SkipReasonWhenClauseFalse},
+		}, stageDispositions)
+	})
+
+	t.Run("ReturnsUnknownDispositionForStageWithoutFinalStatus", func(t *testing.T) {
+
+		buildLogSteps := []*contracts.BuildLogStep{
+			{
+				Step:   "build",
+				Status: contracts.LogStatusRunning,
+			},
+		}
+
+		// act
+		stageDispositions := getStageDispositions(buildLogSteps, nil)
+
+		assert.Equal(t, 1, len(stageDispositions))
+		assert.Equal(t, "unknown", stageDispositions[0].Disposition)
+	})
+
+	t.Run("ReturnsEmptySliceForBuildWithoutStages", func(t *testing.T) {
+
+		// act
+		stageDispositions := getStageDispositions(nil, nil)
+
+		assert.NotNil(t, stageDispositions)
+		assert.Equal(t, 0, len(stageDispositions))
+	})
+}
@@ -0,0 +1,75 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultMaxCapturedOutputBytes = 64 * 1024
+
+// stageOutputCapture collects the stdout of a stage - or only the block in between its begin and end marker lines - to pass it to later stages in an envvar
+type stageOutputCapture struct {
+	envvar    string
+	marker    string
+	maxBytes  int
+	capturing bool
+	truncated bool
+	output    strings.Builder
+}
+
+// getStageOutputCapture reads the captureOutput and captureOutputMarker custom properties, returning nil if the stage doesn't capture its output
+func getStageOutputCapture(customProperties map[string]interface{}, maxBytes int) *stageOutputCapture {
+	envvar, ok := getCustomPropertyString(customProperties, "captureOutput")
+	if !ok || envvar == "" {
+		return nil
+	}
+
+	marker, _ := getCustomPropertyString(customProperties, "captureOutputMarker")
+
+	return &stageOutputCapture{
+		envvar:    envvar,
+		marker:    marker,
+		maxBytes:  maxBytes,
+		capturing: marker == "",
+	}
+}
+
+func (c *stageOutputCapture) beginMarker() string {
+	return fmt.Sprintf("::begin-%v::", c.marker)
+}
+
+func (c *stageOutputCapture) endMarker() string {
+	return fmt.Sprintf("::end-%v::", c.marker)
+}
+
+// addLine adds a line of stdout to the captured output, leaving out everything that exceeds the maximum size
+func (c *stageOutputCapture) addLine(line string) {
+	if c.marker != "" {
+		switch strings.TrimSpace(line) {
+		case c.beginMarker():
+			c.capturing = true
+			return
+		case c.endMarker():
+			c.capturing = false
+			return
+		}
+	}
+
+	if !c.capturing || c.truncated {
+		return
+	}
+
+	if c.output.Len()+len(line) > c.maxBytes {
+		// don't cut a multi-byte character in half
+		c.output.WriteString(strings.ToValidUTF8(line[:c.maxBytes-c.output.Len()], ""))
+		c.truncated = true
+		return
+	}
+
+	c.output.WriteString(line)
+}
+
+// value returns the captured output without its trailing newline, the way shells capture command output
+func (c *stageOutputCapture) value() string {
+	return strings.TrimRight(c.output.String(), "\r\n")
+}
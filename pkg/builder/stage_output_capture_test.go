@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetStageOutputCapture(t *testing.T) {
+
+	t.Run("ReturnsNilIfCaptureOutputIsNotSet", func(t *testing.T) {
+
+		customProperties := map[string]interface{}{}
+
+		// act
+		capture := getStageOutputCapture(customProperties, 1024)
+
+		assert.Nil(t, capture)
+	})
+
+	t.Run("ReturnsCaptureForEnvvarAndMarker", func(t *testing.T) {
+
+		customProperties := map[string]interface{}{
+			"captureOutput":       "IMAGE_TAG",
+			"captureOutputMarker": "tag",
+		}
+
+		// act
+		capture := getStageOutputCapture(customProperties, 1024)
+
+		if assert.NotNil(t, capture) {
+			assert.Equal(t, "IMAGE_TAG", capture.envvar)
+			assert.Equal(t, "tag", capture.marker)
+			assert.Equal(t, 1024, capture.maxBytes)
+			assert.False(t, capture.capturing)
+		}
+	})
+}
+
+func TestStageOutputCaptureAddLine(t *testing.T) {
+
+	t.Run("CapturesAllLinesWithoutMarker", func(t *testing.T) {
+
+		capture := &stageOutputCapture{envvar: "IMAGE_TAG", maxBytes: 1024, capturing: true}
+
+		// act
+		capture.addLine("1.0.0\n")
+		capture.addLine("1.0\n")
+
+		assert.Equal(t, "1.0.0\n1.0", capture.value())
+		assert.False(t, capture.truncated)
+	})
+
+	t.Run("CapturesOnlyLinesInBetweenMarkers", func(t *testing.T) {
+
+		capture := &stageOutputCapture{envvar: "IMAGE_TAG", marker: "tag", maxBytes: 1024}
+
+		// act
+		capture.addLine("Computing tag...\n")
+		capture.addLine("::begin-tag::\n")
+		capture.addLine("1.0.0-abc123\n")
+		capture.addLine("::end-tag::\n")
+		capture.addLine("Done\n")
+
+		assert.Equal(t, "1.0.0-abc123", capture.value())
+	})
+
+	t.Run("TruncatesOutputExceedingMaxBytes", func(t *testing.T) {
+
+		capture := &stageOutputCapture{envvar: "IMAGE_TAG", maxBytes: 8, capturing: true}
+
+		// act
+		capture.addLine("12345\n")
+		capture.addLine("67890\n")
+		capture.addLine("abcde\n")
+
+		assert.Equal(t, "12345\n67", capture.value())
+		assert.True(t, capture.truncated)
+	})
+
+	t.Run("DoesNotCutMultiByteCharactersWhenTruncating", func(t *testing.T) {
+
+		capture := &stageOutputCapture{envvar: "GREETING", maxBytes: 4, capturing: true}
+
+		// act
+		capture.addLine("héé\n")
+
+		assert.Equal(t, "hé", capture.value())
+		assert.True(t, capture.truncated)
+	})
+}
@@ -0,0 +1,82 @@
+package builder
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// StageResourceUsage holds the peak resource usage of a stage container, sampled from the docker stats stream
+type StageResourceUsage struct {
+	Stage       string  `json:"stage"`
+	ParentStage string  `json:"parentStage,omitempty"`
+	MemoryBytes uint64  `json:"memoryBytes"`
+	CPUCores    float64 `json:"cpuCores"`
+	Samples     int     `json:"samples"`
+}
+
+// readContainerStatsPeaks reads the docker stats stream until it ends and keeps the peak memory and cpu usage of samples taken at most once per interval
+func readContainerStatsPeaks(stream io.Reader, interval time.Duration, now func() time.Time) (usage StageResourceUsage, err error) {
+
+	var lastSampled time.Time
+
+	decoder := json.NewDecoder(stream)
+	for {
+		var stats types.StatsJSON
+		err = decoder.Decode(&stats)
+		if err == io.EOF {
+			return usage, nil
+		}
+		if err != nil {
+			return usage, err
+		}
+
+		if usage.Samples > 0 && now().Sub(lastSampled) < interval {
+			continue
+		}
+		lastSampled = now()
+		usage.Samples++
+
+		if memoryBytes := getContainerMemoryUsage(stats.MemoryStats); memoryBytes > usage.MemoryBytes {
+			usage.MemoryBytes = memoryBytes
+		}
+		if cpuCores := getContainerCPUUsage(stats.CPUStats, stats.PreCPUStats); cpuCores > usage.CPUCores {
+			usage.CPUCores = cpuCores
+		}
+	}
+}
+
+// getContainerMemoryUsage excludes the inactive page cache from the memory usage, like docker stats does
+func getContainerMemoryUsage(memoryStats types.MemoryStats) uint64 {
+	// cgroup v1 reports total_inactive_file, cgroup v2 inactive_file
+	for _, key := range []string{"total_inactive_file", "inactive_file"} {
+		if inactiveFile, ok := memoryStats.Stats[key]; ok && inactiveFile < memoryStats.Usage {
+			return memoryStats.Usage - inactiveFile
+		}
+	}
+
+	return memoryStats.Usage
+}
+
+// getContainerCPUUsage returns the number of cpu cores used in between the previous and current sample
+func getContainerCPUUsage(cpuStats, preCPUStats types.CPUStats) float64 {
+	// the first sample of the stream has no previous sample to compare with
+	if preCPUStats.SystemUsage == 0 {
+		return 0
+	}
+	if cpuStats.CPUUsage.TotalUsage <= preCPUStats.CPUUsage.TotalUsage || cpuStats.SystemUsage <= preCPUStats.SystemUsage {
+		return 0
+	}
+
+	onlineCPUs := float64(cpuStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(cpuStats.CPUUsage.PercpuUsage))
+	}
+
+	cpuDelta := float64(cpuStats.CPUUsage.TotalUsage - preCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(cpuStats.SystemUsage - preCPUStats.SystemUsage)
+
+	return cpuDelta / systemDelta * onlineCPUs
+}
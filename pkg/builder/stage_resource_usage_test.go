@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadContainerStatsPeaks(t *testing.T) {
+
+	// every call to now advances the clock by a second
+	getFakeClock := func() func() time.Time {
+		clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		return func() time.Time {
+			clock = clock.Add(time.Second)
+			return clock
+		}
+	}
+
+	statsStream := strings.Join([]string{
+		`{"memory_stats":{"usage":1000,"stats":{"inactive_file":200}},"cpu_stats":{"cpu_usage":{"total_usage":100},"system_cpu_usage":1000,"online_cpus":4},"precpu_stats":{}}`,
+		`{"memory_stats":{"usage":5000,"stats":{"inactive_file":1000}},"cpu_stats":{"cpu_usage":{"total_usage":600},"system_cpu_usage":2000,"online_cpus":4},"precpu_stats":{"cpu_usage":{"total_usage":100},"system_cpu_usage":1000,"online_cpus":4}}`,
+		`{"memory_stats":{"usage":3000,"stats":{"inactive_file":1000}},"cpu_stats":{"cpu_usage":{"total_usage":700},"system_cpu_usage":3000,"online_cpus":4},"precpu_stats":{"cpu_usage":{"total_usage":600},"system_cpu_usage":2000,"online_cpus":4}}`,
+	}, "\n")
+
+	t.Run("ReturnsPeakMemoryAndCPUUsage", func(t *testing.T) {
+
+		// act
+		usage, err := readContainerStatsPeaks(strings.NewReader(statsStream), time.Second, getFakeClock())
+
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(4000), usage.MemoryBytes)
+		assert.Equal(t, 2.0, usage.CPUCores)
+		assert.Equal(t, 3, usage.Samples)
+	})
+
+	t.Run("SkipsSamplesWithinInterval", func(t *testing.T) {
+
+		// act
+		usage, err := readContainerStatsPeaks(strings.NewReader(statsStream), time.Minute, getFakeClock())
+
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(800), usage.MemoryBytes)
+		assert.Equal(t, 0.0, usage.CPUCores)
+		assert.Equal(t, 1, usage.Samples)
+	})
+
+	t.Run("UsesPercpuUsageIfOnlineCPUsIsNotSet", func(t *testing.T) {
+
+		stream := `{"memory_stats":{"usage":1000},"cpu_stats":{"cpu_usage":{"total_usage":600,"percpu_usage":[300,300]},"system_cpu_usage":2000},"precpu_stats":{"cpu_usage":{"total_usage":100},"system_cpu_usage":1000}}`
+
+		// act
+		usage, err := readContainerStatsPeaks(strings.NewReader(stream), time.Second, getFakeClock())
+
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1000), usage.MemoryBytes)
+		assert.Equal(t, 1.0, usage.CPUCores)
+	})
+
+	t.Run("ReturnsErrorForInvalidStream", func(t *testing.T) {
+
+		// act
+		_, err := readContainerStatsPeaks(strings.NewReader(`{"memory_stats":`), time.Second, getFakeClock())
+
+		assert.NotNil(t, err)
+	})
+}
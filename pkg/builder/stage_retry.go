@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+)
+
+// containerExitError is returned for a container that exited with a non-zero exit code, so the exit code can decide whether to retry the stage
+type containerExitError struct {
+	exitCode int64
+}
+
+func (e *containerExitError) Error() string {
+	return fmt.Sprintf("Failed with exit code: %v", e.exitCode)
+}
+
+// getContainerExitCode returns the exit code of a failed container if err or any error it wraps holds it
+func getContainerExitCode(err error) (exitCode int64, ok bool) {
+	var exitErr *containerExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.exitCode, true
+	}
+
+	return 0, false
+}
+
+// stageRetryPolicy retries a failed stage up to retries times, either on any non-zero exit code or only on the listed exit codes, like 124 for a timeout
+type stageRetryPolicy struct {
+	retries   int
+	exitCodes []int64
+}
+
+// getStageRetryPolicy reads the retries and retryOnExitCodes properties of a stage
+func getStageRetryPolicy(customProperties map[string]interface{}) stageRetryPolicy {
+	retries, _ := getCustomPropertyInt(customProperties, "retries")
+	exitCodes, _ := getCustomPropertyIntSlice(customProperties, "retryOnExitCodes")
+
+	return stageRetryPolicy{
+		retries:   retries,
+		exitCodes: exitCodes,
+	}
+}
+
+// shouldRetry returns true if the container of a stage exited with an exit code to retry and retries are left after attempt, counting from 0
+func (p stageRetryPolicy) shouldRetry(err error, attempt int) (exitCode int64, retry bool) {
+	if attempt >= p.retries {
+		return 0, false
+	}
+
+	// errors other than a failing container, like failing to tail the logs, aren't retried
+	exitCode, ok := getContainerExitCode(err)
+	if !ok {
+		return 0, false
+	}
+
+	if len(p.exitCodes) == 0 {
+		return exitCode, true
+	}
+	for _, c := range p.exitCodes {
+		if c == exitCode {
+			return exitCode, true
+		}
+	}
+
+	return exitCode, false
+}
@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetStageRetryPolicy(t *testing.T) {
+
+	t.Run("ReadsRetriesAndExitCodesFromYamlValues", func(t *testing.T) {
+
+		customProperties := map[string]interface{}{
+			"retries":          3,
+			"retryOnExitCodes": []interface{}{124, 137},
+		}
+
+		// act
+		retryPolicy := getStageRetryPolicy(customProperties)
+
+		assert.Equal(t, 3, retryPolicy.retries)
+		assert.Equal(t, []int64{124, 137}, retryPolicy.exitCodes)
+	})
+
+	t.Run("ReadsRetriesAndSingleExitCodeFromJSONValues", func(t *testing.T) {
+
+		customProperties := map[string]interface{}{
+			"retries":          float64(1),
+			"retryOnExitCodes": float64(124),
+		}
+
+		// act
+		retryPolicy := getStageRetryPolicy(customProperties)
+
+		assert.Equal(t, 1, retryPolicy.retries)
+		assert.Equal(t, []int64{124}, retryPolicy.exitCodes)
+	})
+
+	t.Run("ReturnsPolicyWithoutRetriesIfPropertiesAreNotSet", func(t *testing.T) {
+
+		// act
+		retryPolicy := getStageRetryPolicy(nil)
+
+		assert.Equal(t, 0, retryPolicy.retries)
+		assert.Nil(t, retryPolicy.exitCodes)
+	})
+}
+
+func TestStageRetryPolicyShouldRetry(t *testing.T) {
+
+	t.Run("ReturnsTrueForMatchingExitCode", func(t *testing.T) {
+
+		retryPolicy := stageRetryPolicy{retries: 2, exitCodes: []int64{124}}
+
+		// act
+		exitCode, retry := retryPolicy.shouldRetry(&containerExitError{exitCode: 124}, 0)
+
+		assert.True(t, retry)
+		assert.Equal(t, int64(124), exitCode)
+	})
+
+	t.Run("ReturnsFalseForExitCodeThatDoesNotMatch", func(t *testing.T) {
+
+		retryPolicy := stageRetryPolicy{retries: 2, exitCodes: []int64{124}}
+
+		// act
+		_, retry := retryPolicy.shouldRetry(&containerExitError{exitCode: 1}, 0)
+
+		assert.False(t, retry)
+	})
+
+	t.Run("ReturnsTrueForAnyExitCodeIfNoExitCodesAreSet", func(t *testing.T) {
+
+		retryPolicy := stageRetryPolicy{retries: 1}
+
+		// act
+		_, retry := retryPolicy.shouldRetry(&containerExitError{exitCode: 1}, 0)
+
+		assert.True(t, retry)
+	})
+
+	t.Run("ReturnsFalseIfRetriesAreExhausted", func(t *testing.T) {
+
+		retryPolicy := stageRetryPolicy{retries: 2, exitCodes: []int64{124}}
+
+		// act
+		_, retry := retryPolicy.shouldRetry(&containerExitError{exitCode: 124}, 2)
+
+		assert.False(t, retry)
+	})
+
+	t.Run("ReturnsFalseForErrorWithoutExitCode", func(t *testing.T) {
+
+		retryPolicy := stageRetryPolicy{retries: 2}
+
+		// act
+		_, retry := retryPolicy.shouldRetry(fmt.Errorf("Failed tailing container logs"), 0)
+
+		assert.False(t, retry)
+	})
+
+	t.Run("ReturnsTrueForWrappedExitError", func(t *testing.T) {
+
+		retryPolicy := stageRetryPolicy{retries: 2, exitCodes: []int64{124}}
+
+		// act
+		_, retry := retryPolicy.shouldRetry(fmt.Errorf("Stage failed: %w", &containerExitError{exitCode: 124}), 0)
+
+		assert.True(t, retry)
+	})
+}
@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"fmt"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+// getTraceContext returns the w3c traceparent and trace id of the span, for tools inside stage containers to emit child spans of it; spans of a disabled or unknown tracer return ok false
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func getTraceContext(span opentracing.Span) (traceParent, traceID string, ok bool) {
+	if span == nil {
+		return "", "", false
+	}
+
+	switch spanContext := span.Context().(type) {
+	case jaeger.SpanContext:
+		if !spanContext.IsValid() {
+			return "", "", false
+		}
+		traceID = fmt.Sprintf("%016x%016x", spanContext.TraceID().High, spanContext.TraceID().Low)
+		traceParent = fmt.Sprintf("00-%v-%016x-%v", traceID, uint64(spanContext.SpanID()), getTraceFlags(spanContext.IsSampled()))
+		return traceParent, traceID, true
+
+	case otelSpanContext:
+		if !spanContext.spanContext.IsValid() {
+			return "", "", false
+		}
+		traceID = spanContext.spanContext.TraceID().String()
+		traceParent = fmt.Sprintf("00-%v-%v-%v", traceID, spanContext.spanContext.SpanID().String(), getTraceFlags(spanContext.spanContext.IsSampled()))
+		return traceParent, traceID, true
+	}
+
+	return "", "", false
+}
+
+func getTraceFlags(sampled bool) string {
+	if sampled {
+		return "01"
+	}
+	return "00"
+}
@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestGetTraceContext(t *testing.T) {
+
+	t.Run("ReturnsTraceContextOfJaegerSpan", func(t *testing.T) {
+
+		tracer, closer := jaeger.NewTracer("ziplinee-ci-builder", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+		defer closer.Close()
+		span := tracer.StartSpan("RunStage")
+		defer span.Finish()
+		spanContext := span.Context().(jaeger.SpanContext)
+
+		// act
+		traceParent, traceID, ok := getTraceContext(span)
+
+		assert.True(t, ok)
+		assert.Len(t, traceID, 32)
+		assert.Equal(t, "00-"+traceID+"-"+spanContext.SpanID().String()+"-01", traceParent)
+	})
+
+	t.Run("ReturnsTraceContextOfOpenTelemetrySpan", func(t *testing.T) {
+
+		tracer := newOtelTracer(sdktrace.NewTracerProvider().Tracer("ziplinee-ci-builder"))
+		span := tracer.StartSpan("RunStage")
+		defer span.Finish()
+		spanContext := span.Context().(otelSpanContext).spanContext
+
+		// act
+		traceParent, traceID, ok := getTraceContext(span)
+
+		assert.True(t, ok)
+		assert.Equal(t, spanContext.TraceID().String(), traceID)
+		assert.Equal(t, "00-"+spanContext.TraceID().String()+"-"+spanContext.SpanID().String()+"-01", traceParent)
+	})
+
+	t.Run("ReturnsNotOkForSpanOfNoopTracer", func(t *testing.T) {
+
+		span := opentracing.NoopTracer{}.StartSpan("RunStage")
+
+		// act
+		_, _, ok := getTraceContext(span)
+
+		assert.False(t, ok)
+	})
+
+	t.Run("ReturnsNotOkWithoutSpan", func(t *testing.T) {
+
+		// act
+		_, _, ok := getTraceContext(nil)
+
+		assert.False(t, ok)
+	})
+}
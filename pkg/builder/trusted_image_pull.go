@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	contracts "github.com/ziplineeci/ziplinee-ci-contracts"
+)
+
+// imagePullFailureReason tells why pulling an image failed, to point at what needs fixing
+type imagePullFailureReason string
+
+const (
+	imagePullFailureReasonRegistryAuth imagePullFailureReason = "registry-auth"
+	imagePullFailureReasonNetwork      imagePullFailureReason = "network"
+	imagePullFailureReasonUnknown      imagePullFailureReason = "unknown"
+)
+
+var (
+	// registryAuthErrorMessages are parts of the errors the docker daemon returns when a registry denies pulling an image
+	registryAuthErrorMessages = []string{"unauthorized", "authentication required", "pull access denied", "denied:", "forbidden", "incorrect username or password"}
+
+	// networkErrorMessages are parts of the errors the docker daemon returns when a registry can't be reached
+	networkErrorMessages = []string{"dial tcp", "no such host", "connection refused", "connection reset", "i/o timeout", "tls handshake timeout", "network is unreachable", "request canceled while waiting for connection", "client.timeout exceeded"}
+)
+
+// trustedImagePullError is returned when pulling a trusted image fails, with an actionable message depending on whether the registry denied access or couldn't be reached
+type trustedImagePullError struct {
+	containerImage string
+	reason         imagePullFailureReason
+	err            error
+}
+
+func (e *trustedImagePullError) Error() string {
+	registry := getContainerImageRegistry(e.containerImage)
+
+	switch e.reason {
+	case imagePullFailureReasonRegistryAuth:
+		return fmt.Sprintf("Pulling trusted image %v failed because registry %v denied access, check the credentials configured for it: %v", e.containerImage, registry, e.err)
+	case imagePullFailureReasonNetwork:
+		return fmt.Sprintf("Pulling trusted image %v failed because registry %v can't be reached, check the network connection to it or configure a trusted image mirror: %v", e.containerImage, registry, e.err)
+	}
+
+	return fmt.Sprintf("Pulling trusted image %v failed: %v", e.containerImage, e.err)
+}
+
+func (e *trustedImagePullError) Unwrap() error {
+	return e.err
+}
+
+// getImagePullFailureReason classifies an image pull error by the network error it wraps or by the message of the docker daemon
+func getImagePullFailureReason(err error) imagePullFailureReason {
+	message := strings.ToLower(err.Error())
+	for _, authMessage := range registryAuthErrorMessages {
+		if strings.Contains(message, authMessage) {
+			return imagePullFailureReasonRegistryAuth
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return imagePullFailureReasonNetwork
+	}
+	for _, networkMessage := range networkErrorMessages {
+		if strings.Contains(message, networkMessage) {
+			return imagePullFailureReasonNetwork
+		}
+	}
+
+	return imagePullFailureReasonUnknown
+}
+
+// getMirrorContainerImage returns the image at the same path in the mirror, like mirror.gcr.io/library/golang:1.22 for golang:1.22 and mirror gcr.io
+func getMirrorContainerImage(containerImage, mirror string) string {
+	imagePath := containerImage
+	registry := getContainerImageRegistry(containerImage)
+	if strings.HasPrefix(imagePath, registry+"/") {
+		imagePath = strings.TrimPrefix(imagePath, registry+"/")
+	} else if !strings.Contains(imagePath, "/") {
+		// official docker hub images live in the library namespace
+		imagePath = "library/" + imagePath
+	}
+
+	return strings.TrimSuffix(mirror, "/") + "/" + imagePath
+}
+
+// pullTrustedImage pulls a trusted image, falling back to pulling it from the trusted image mirror, if configured, and tagging it with its original name; the fallback gets added as a warning
+func (pr *pipelineRunner) pullTrustedImage(ctx context.Context, stageName, parentStageName, containerImage string, containerType contracts.LogType, depth int) (err error) {
+	err = pr.containerRunner.PullImage(ctx, stageName, parentStageName, containerImage)
+	if err == nil || pr.isCanceled(ctx) {
+		return
+	}
+
+	pullErr := &trustedImagePullError{
+		containerImage: containerImage,
+		reason:         getImagePullFailureReason(err),
+		err:            err,
+	}
+	if pr.trustedImageMirror == "" {
+		return pullErr
+	}
+
+	mirrorImage := getMirrorContainerImage(containerImage, pr.trustedImageMirror)
+	err = pr.containerRunner.PullImage(ctx, stageName, parentStageName, mirrorImage)
+	if err != nil {
+		return fmt.Errorf("%w; pulling it from mirror as %v failed as well: %v", pullErr, mirrorImage, err)
+	}
+
+	err = pr.containerRunner.TagImage(ctx, mirrorImage, containerImage)
+	if err != nil {
+		return
+	}
+
+	pr.addWarning(stageName, parentStageName, containerType, depth, fmt.Sprintf("%v, pulled it from mirror as %v instead", pullErr.Error(), mirrorImage))
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	manifest "github.com/ziplineeci/ziplinee-ci-manifest"
+)
+
+func TestGetImagePullFailureReason(t *testing.T) {
+
+	t.Run("ReturnsRegistryAuthForDeniedPull", func(t *testing.T) {
+
+		err := errors.New("Error response from daemon: pull access denied for ziplinee/ziplinee-extension-docker, repository does not exist or may require 'docker login': denied: requested access to the resource is denied")
+
+		// act
+		reason := getImagePullFailureReason(err)
+
+		assert.Equal(t, imagePullFailureReasonRegistryAuth, reason)
+	})
+
+	t.Run("ReturnsRegistryAuthForIncorrectCredentials", func(t *testing.T) {
+
+		err := errors.New("Error response from daemon: Get \"https://registry-1.docker.io/v2/\": unauthorized: incorrect username or password")
+
+		// act
+		reason := getImagePullFailureReason(err)
+
+		assert.Equal(t, imagePullFailureReasonRegistryAuth, reason)
+	})
+
+	t.Run("ReturnsNetworkForWrappedNetworkError", func(t *testing.T) {
+
+		err := fmt.Errorf("pulling image failed: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+
+		// act
+		reason := getImagePullFailureReason(err)
+
+		assert.Equal(t, imagePullFailureReasonNetwork, reason)
+	})
+
+	t.Run("ReturnsNetworkForUnreachableRegistryReportedByDaemon", func(t *testing.T) {
+
+		err := errors.New("Error response from daemon: Get \"https://registry-1.docker.io/v2/\": dial tcp: lookup registry-1.docker.io: no such host")
+
+		// act
+		reason := getImagePullFailureReason(err)
+
+		assert.Equal(t, imagePullFailureReasonNetwork, reason)
+	})
+
+	t.Run("ReturnsUnknownForOtherErrors", func(t *testing.T) {
+
+		err := errors.New("Error response from daemon: manifest for ziplinee/ziplinee-extension-docker:0.0.0 not found: manifest unknown")
+
+		// act
+		reason := getImagePullFailureReason(err)
+
+		assert.Equal(t, imagePullFailureReasonUnknown, reason)
+	})
+}
+
+func TestGetMirrorContainerImage(t *testing.T) {
+
+	t.Run("ReturnsImageInLibraryNamespaceForOfficialDockerHubImage", func(t *testing.T) {
+
+		// act
+		mirrorImage := getMirrorContainerImage("golang:1.22", "mirror.gcr.io")
+
+		assert.Equal(t, "mirror.gcr.io/library/golang:1.22", mirrorImage)
+	})
+
+	t.Run("ReturnsImageAtSamePathForDockerHubImage", func(t *testing.T) {
+
+		// act
+		mirrorImage := getMirrorContainerImage("ziplinee/ziplinee-extension-docker:stable", "mirror.gcr.io/")
+
+		assert.Equal(t, "mirror.gcr.io/ziplinee/ziplinee-extension-docker:stable", mirrorImage)
+	})
+
+	t.Run("ReturnsImageAtSamePathWithoutRegistryHost", func(t *testing.T) {
+
+		// act
+		mirrorImage := getMirrorContainerImage("gcr.io/ziplinee/ziplinee-extension-gke:stable", "registry.example.com:5000/gcr")
+
+		assert.Equal(t, "registry.example.com:5000/gcr/ziplinee/ziplinee-extension-gke:stable", mirrorImage)
+	})
+}
+
+func TestPullTrustedImage(t *testing.T) {
+
+	t.Run("ReturnsRegistryAuthErrorIfPullingTrustedImageIsDenied", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "ziplinee/ziplinee-extension-docker:stable",
+		}
+		pullErr := errors.New("Error response from daemon: pull access denied for ziplinee/ziplinee-extension-docker, repository does not exist or may require 'docker login': denied: requested access to the resource is denied")
+
+		// set mock responses
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), "ziplinee/ziplinee-extension-docker:stable").Return(true)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), "stage-a", "", "ziplinee/ziplinee-extension-docker:stable").Return(pullErr)
+		containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		var trustedErr *trustedImagePullError
+		if assert.True(t, errors.As(err, &trustedErr)) {
+			assert.Equal(t, imagePullFailureReasonRegistryAuth, trustedErr.reason)
+			assert.Contains(t, err.Error(), "registry docker.io denied access")
+		}
+		assert.True(t, errors.Is(err, pullErr))
+		assert.True(t, isInfrastructureError(err))
+	})
+
+	t.Run("ReturnsNetworkErrorIfRegistryOfTrustedImageCannotBeReached", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "gcr.io/ziplinee/ziplinee-extension-gke:stable",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("Error response from daemon: Get \"https://gcr.io/v2/\": net/http: TLS handshake timeout"))
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "registry gcr.io can't be reached")
+		}
+	})
+
+	t.Run("ReturnsPullErrorWithoutClassificationForUntrustedImage", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetTrustedImageMirror("mirror.gcr.io")
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "alpine:latest",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), "alpine:latest").Return(errors.New("Error response from daemon: pull access denied for alpine"))
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), "mirror.gcr.io/library/alpine:latest").Times(0)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		var trustedErr *trustedImagePullError
+		assert.NotNil(t, err)
+		assert.False(t, errors.As(err, &trustedErr))
+	})
+
+	t.Run("FallsBackToMirrorIfPullingTrustedImageFails", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetTrustedImageMirror("mirror.gcr.io")
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "ziplinee/ziplinee-extension-docker:stable",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(true)
+		gomock.InOrder(
+			containerRunnerMock.EXPECT().PullImage(gomock.Any(), "stage-a", "", "ziplinee/ziplinee-extension-docker:stable").Return(errors.New("Error response from daemon: Get \"https://registry-1.docker.io/v2/\": dial tcp: i/o timeout")),
+			containerRunnerMock.EXPECT().PullImage(gomock.Any(), "stage-a", "", "mirror.gcr.io/ziplinee/ziplinee-extension-docker:stable").Return(nil),
+			containerRunnerMock.EXPECT().TagImage(gomock.Any(), "mirror.gcr.io/ziplinee/ziplinee-extension-docker:stable", "ziplinee/ziplinee-extension-docker:stable").Return(nil),
+			containerRunnerMock.EXPECT().StartStageContainer(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return("abc", nil),
+		)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		assert.Nil(t, err)
+		warnings := pipelineRunner.GetWarnings()
+		if assert.Equal(t, 1, len(warnings)) {
+			assert.Contains(t, warnings[0].Text, "mirror.gcr.io/ziplinee/ziplinee-extension-docker:stable")
+		}
+	})
+
+	t.Run("ReturnsErrorIfPullingTrustedImageFromMirrorFailsAsWell", func(t *testing.T) {
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		containerRunnerMock := NewMockContainerRunner(ctrl)
+		_, pipelineRunner := getPipelineRunnerAndMocks(ctrl, containerRunnerMock)
+		pipelineRunner.SetTrustedImageMirror("mirror.gcr.io")
+
+		stage := manifest.ZiplineeStage{
+			Name:           "stage-a",
+			ContainerImage: "ziplinee/ziplinee-extension-docker:stable",
+		}
+
+		// set mock responses
+		containerRunnerMock.EXPECT().IsTrustedImage(gomock.Any(), gomock.Any()).Return(true)
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), "ziplinee/ziplinee-extension-docker:stable").Return(errors.New("Error response from daemon: dial tcp: connection refused"))
+		containerRunnerMock.EXPECT().PullImage(gomock.Any(), gomock.Any(), gomock.Any(), "mirror.gcr.io/ziplinee/ziplinee-extension-docker:stable").Return(errors.New("Error response from daemon: manifest unknown"))
+		containerRunnerMock.EXPECT().TagImage(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+		setDefaultMockExpectancies(containerRunnerMock)
+
+		// act
+		err := pipelineRunner.RunStage(context.Background(), 0, "/ziplinee-work", map[string]string{}, nil, stage, 0)
+
+		var trustedErr *trustedImagePullError
+		if assert.True(t, errors.As(err, &trustedErr)) {
+			assert.Equal(t, imagePullFailureReasonNetwork, trustedErr.reason)
+			assert.Contains(t, err.Error(), "mirror.gcr.io/ziplinee/ziplinee-extension-docker:stable failed as well")
+		}
+	})
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/Knetic/govaluate"
 	"github.com/rs/zerolog/log"
@@ -14,10 +17,17 @@ type WhenEvaluator interface {
 	Evaluate(pipelineName, input string, parameters map[string]interface{}) (bool, error)
 	Describe(input string, parameters map[string]interface{}) string
 	GetParameters() map[string]interface{}
+	SetDefaultBranch(branch string)
+	SetParams(params map[string]interface{})
 }
 
 type whenEvaluator struct {
 	envvarHelper EnvvarHelper
+
+	defaultBranch            string
+	defaultBranchWarningOnce sync.Once
+
+	params map[string]interface{}
 }
 
 // NewWhenEvaluator returns a new WhenEvaluator
@@ -38,6 +48,10 @@ func (we *whenEvaluator) Evaluate(pipelineName, input string, parameters map[str
 	// replace ziplinee envvars in when clause
 	input = os.Expand(input, we.envvarHelper.getZiplineeEnv)
 
+	// govaluate doesn't allow dots in variable names unless they're bracketed
+	input, referencedParams := bracketParamsReferences(input)
+	parameters = withReferencedParams(parameters, referencedParams)
+
 	expression, err := govaluate.NewEvaluableExpression(input)
 	if err != nil {
 		return
@@ -61,11 +75,106 @@ func (we *whenEvaluator) Describe(input string, parameters map[string]interface{
 func (we *whenEvaluator) GetParameters() map[string]interface{} {
 
 	parameters := make(map[string]interface{}, 3)
-	parameters["branch"] = we.envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_BRANCH")
+	parameters["branch"] = we.getBranch()
 	parameters["trigger"] = we.envvarHelper.getZiplineeEnv("ZIPLINEE_TRIGGER")
 	parameters["status"] = we.envvarHelper.getZiplineeEnv("ZIPLINEE_BUILD_STATUS")
 	parameters["action"] = we.envvarHelper.getZiplineeEnv("ZIPLINEE_RELEASE_ACTION")
 	parameters["server"] = we.envvarHelper.GetCiServer()
+	for key, value := range we.params {
+		parameters[paramsPrefix+key] = value
+	}
 
 	return parameters
 }
+
+// SetParams sets the release or build parameters from the builder config, to be used in when clauses like params.deployDatabase == true
+func (we *whenEvaluator) SetParams(params map[string]interface{}) {
+	we.params = params
+}
+
+const paramsPrefix = "params."
+
+// bracketParamsReferences puts references like params.deployDatabase outside of string literals in brackets, so govaluate accepts them as variable names
+func bracketParamsReferences(input string) (output string, referencedParams []string) {
+
+	var builder strings.Builder
+	var quote rune
+	for i := 0; i < len(input); {
+		character := rune(input[i])
+
+		if quote != 0 {
+			if character == quote {
+				quote = 0
+			}
+			builder.WriteByte(input[i])
+			i++
+			continue
+		}
+
+		if character == '\'' || character == '"' {
+			quote = character
+			builder.WriteByte(input[i])
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(input[i:], paramsPrefix) && (i == 0 || !isParamsReferenceCharacter(rune(input[i-1]))) {
+			end := i + len(paramsPrefix)
+			for end < len(input) && isParamsReferenceCharacter(rune(input[end])) {
+				end++
+			}
+			if end > i+len(paramsPrefix) {
+				builder.WriteString("[" + input[i:end] + "]")
+				referencedParams = append(referencedParams, input[i:end])
+				i = end
+				continue
+			}
+		}
+
+		builder.WriteByte(input[i])
+		i++
+	}
+
+	return builder.String(), referencedParams
+}
+
+func isParamsReferenceCharacter(character rune) bool {
+	return unicode.IsLetter(character) || unicode.IsDigit(character) || character == '_' || character == '[' || character == '.'
+}
+
+// withReferencedParams returns a copy of the parameters in which params that aren't set are nil, so when clauses for optional params evaluate instead of failing the build
+func withReferencedParams(parameters map[string]interface{}, referencedParams []string) map[string]interface{} {
+	if len(referencedParams) == 0 {
+		return parameters
+	}
+
+	withParams := make(map[string]interface{}, len(parameters)+len(referencedParams))
+	for key, value := range parameters {
+		withParams[key] = value
+	}
+	for _, param := range referencedParams {
+		if _, ok := withParams[param]; !ok {
+			withParams[param] = nil
+		}
+	}
+
+	return withParams
+}
+
+// SetDefaultBranch sets the branch to use in when clauses if ZIPLINEE_GIT_BRANCH is empty, like for detached head checkouts
+func (we *whenEvaluator) SetDefaultBranch(branch string) {
+	we.defaultBranch = branch
+}
+
+func (we *whenEvaluator) getBranch() string {
+	branch := we.envvarHelper.getZiplineeEnv("ZIPLINEE_GIT_BRANCH")
+	if branch != "" || we.defaultBranch == "" {
+		return branch
+	}
+
+	we.defaultBranchWarningOnce.Do(func() {
+		log.Warn().Msgf("ZIPLINEE_GIT_BRANCH is empty, using default branch %v in when clauses", we.defaultBranch)
+	})
+
+	return we.defaultBranch
+}
@@ -74,6 +74,46 @@ func TestWhenEvaluator(t *testing.T) {
 		assert.NotNil(t, err)
 		assert.False(t, result)
 	})
+
+	t.Run("ReturnsTrueIfParamsReferenceEvaluatesToTrue", func(t *testing.T) {
+
+		_, _, _, whenEvaluator := getMocks()
+		parameters := map[string]interface{}{
+			"action":                "deploy",
+			"params.deployDatabase": true,
+		}
+
+		// act
+		result, err := whenEvaluator.Evaluate("name", "action == 'deploy' && params.deployDatabase == true", parameters)
+
+		assert.Nil(t, err)
+		assert.True(t, result)
+	})
+
+	t.Run("ReturnsFalseIfParamsReferenceIsNotSet", func(t *testing.T) {
+
+		_, _, _, whenEvaluator := getMocks()
+
+		// act
+		result, err := whenEvaluator.Evaluate("name", "params.deployDatabase == true", make(map[string]interface{}))
+
+		assert.Nil(t, err)
+		assert.False(t, result)
+	})
+
+	t.Run("LeavesParamsInStringLiteralsUntouched", func(t *testing.T) {
+
+		_, _, _, whenEvaluator := getMocks()
+		parameters := map[string]interface{}{
+			"branch": "params.x",
+		}
+
+		// act
+		result, err := whenEvaluator.Evaluate("name", "branch == 'params.x'", parameters)
+
+		assert.Nil(t, err)
+		assert.True(t, result)
+	})
 }
 
 func TestWhenParameters(t *testing.T) {
@@ -119,4 +159,71 @@ func TestWhenParameters(t *testing.T) {
 
 		assert.Equal(t, "succeeded", parameters["status"])
 	})
+	t.Run("ReturnsMapWithDefaultBranchIfBranchEnvvarIsUnset", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		envvarHelper.UnsetZiplineeEnvvars()
+		whenEvaluator.SetDefaultBranch("main")
+
+		// act
+		parameters := whenEvaluator.GetParameters()
+
+		assert.Equal(t, "main", parameters["branch"])
+	})
+
+	t.Run("ReturnsMapWithBranchFromEnvvarOverDefaultBranch", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		err := envvarHelper.setZiplineeEnv("ZIPLINEE_GIT_BRANCH", "feature-x")
+		assert.Nil(t, err)
+		defer envvarHelper.UnsetZiplineeEnvvars()
+		whenEvaluator.SetDefaultBranch("main")
+
+		// act
+		parameters := whenEvaluator.GetParameters()
+
+		assert.Equal(t, "feature-x", parameters["branch"])
+	})
+
+	t.Run("ReturnsMapWithParamsUnderParamsNamespace", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		envvarHelper.UnsetZiplineeEnvvars()
+		whenEvaluator.SetParams(map[string]interface{}{
+			"deployDatabase": true,
+			"region":         "europe-west1",
+		})
+
+		// act
+		parameters := whenEvaluator.GetParameters()
+
+		assert.Equal(t, true, parameters["params.deployDatabase"])
+		assert.Equal(t, "europe-west1", parameters["params.region"])
+	})
+
+	t.Run("ReturnsMapWithParamsUsableInWhenClause", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		envvarHelper.UnsetZiplineeEnvvars()
+		whenEvaluator.SetParams(map[string]interface{}{
+			"deployDatabase": true,
+		})
+
+		// act
+		result, err := whenEvaluator.Evaluate("name", "params.deployDatabase == true", whenEvaluator.GetParameters())
+
+		assert.Nil(t, err)
+		assert.True(t, result)
+	})
+
+	t.Run("ReturnsMapWithEmptyBranchIfBranchEnvvarIsUnsetWithoutDefaultBranch", func(t *testing.T) {
+
+		_, _, envvarHelper, whenEvaluator := getMocks()
+		envvarHelper.UnsetZiplineeEnvvars()
+
+		// act
+		parameters := whenEvaluator.GetParameters()
+
+		assert.Equal(t, "", parameters["branch"])
+	})
 }
@@ -0,0 +1,177 @@
+package builder
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ziplineeIgnoreFileName = ".ziplineeignore"
+
+// ZiplineeIgnore holds the rules from a .ziplineeignore file, which uses gitignore syntax to exclude generated files and directories from file lists
+type ZiplineeIgnore interface {
+	IsIgnored(filePath string, isDir bool) bool
+	Filter(filePaths []string) []string
+}
+
+type ziplineeIgnore struct {
+	rules []ziplineeIgnoreRule
+}
+
+type ziplineeIgnoreRule struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ReadZiplineeIgnore reads the .ziplineeignore file in dir; when it doesn't exist nothing gets ignored
+func ReadZiplineeIgnore(dir string) (ZiplineeIgnore, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ziplineeIgnoreFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewZiplineeIgnore([]string{}), nil
+		}
+		return nil, err
+	}
+
+	return NewZiplineeIgnore(strings.Split(string(data), "\n")), nil
+}
+
+// NewZiplineeIgnore returns a ZiplineeIgnore for the lines of a .ziplineeignore file
+func NewZiplineeIgnore(lines []string) ZiplineeIgnore {
+	zi := &ziplineeIgnore{
+		rules: []ziplineeIgnoreRule{},
+	}
+
+	for _, line := range lines {
+		if rule, ok := parseZiplineeIgnoreLine(line); ok {
+			zi.rules = append(zi.rules, rule)
+		}
+	}
+
+	return zi
+}
+
+func (zi *ziplineeIgnore) IsIgnored(filePath string, isDir bool) bool {
+	filePath = strings.Trim(path.Clean(filepath.ToSlash(filePath)), "/")
+	if filePath == "" || filePath == "." {
+		return false
+	}
+
+	// a file can't be re-included if one of its parent directories is ignored
+	parts := strings.Split(filePath, "/")
+	for i := 1; i < len(parts); i++ {
+		if zi.matchRules(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return zi.matchRules(filePath, isDir)
+}
+
+func (zi *ziplineeIgnore) Filter(filePaths []string) []string {
+	filtered := []string{}
+	for _, filePath := range filePaths {
+		isDir := strings.HasSuffix(filepath.ToSlash(filePath), "/")
+		if !zi.IsIgnored(filePath, isDir) {
+			filtered = append(filtered, filePath)
+		}
+	}
+
+	return filtered
+}
+
+// matchRules applies all rules in order, so the last matching rule decides whether the path is ignored
+func (zi *ziplineeIgnore) matchRules(filePath string, isDir bool) (ignored bool) {
+	for _, rule := range zi.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.regex.MatchString(filePath) {
+			ignored = !rule.negate
+		}
+	}
+
+	return
+}
+
+func parseZiplineeIgnoreLine(line string) (rule ziplineeIgnoreRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// patterns with a slash at the start or in the middle are relative to the root, others match at any level
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule, false
+	}
+
+	pattern := globToRegex(line)
+	if !anchored {
+		pattern = "(.*/)?" + pattern
+	}
+
+	regex, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return rule, false
+	}
+	rule.regex = regex
+
+	return rule, true
+}
+
+// globToRegex converts a gitignore glob into a regular expression, supporting *, ?, character classes and ** for any number of directories
+func globToRegex(glob string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob) && (i == 0 || glob[i-1] == '/'):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end == -1 {
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,110 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZiplineeIgnoreFilter(t *testing.T) {
+
+	t.Run("FiltersPathsMatchingIgnoreFile", func(t *testing.T) {
+
+		ziplineeIgnore := NewZiplineeIgnore([]string{
+			"# generated files",
+			"node_modules/",
+			"/dist",
+			"*.log",
+			"!important.log",
+			"build/**/*.tmp",
+			"",
+		})
+		paths := []string{
+			"main.go",
+			"node_modules/left-pad/index.js",
+			"web/node_modules/react/index.js",
+			"dist/app.js",
+			"web/dist/app.js",
+			"debug.log",
+			"logs/server.log",
+			"logs/important.log",
+			"build/a/b/c.tmp",
+			"build/c.tmp",
+			"build/output.bin",
+		}
+
+		// act
+		filtered := ziplineeIgnore.Filter(paths)
+
+		assert.Equal(t, []string{
+			"main.go",
+			"web/dist/app.js",
+			"logs/important.log",
+			"build/output.bin",
+		}, filtered)
+	})
+
+	t.Run("DoesNotReincludeFilesInIgnoredDirectory", func(t *testing.T) {
+
+		ziplineeIgnore := NewZiplineeIgnore([]string{
+			"vendor/",
+			"!vendor/modules.txt",
+		})
+
+		// act
+		filtered := ziplineeIgnore.Filter([]string{"vendor/modules.txt", "go.mod"})
+
+		assert.Equal(t, []string{"go.mod"}, filtered)
+	})
+
+	t.Run("OnlyMatchesDirectoriesForPatternsWithTrailingSlash", func(t *testing.T) {
+
+		ziplineeIgnore := NewZiplineeIgnore([]string{
+			"coverage/",
+		})
+
+		assert.True(t, ziplineeIgnore.IsIgnored("coverage", true))
+		assert.False(t, ziplineeIgnore.IsIgnored("coverage", false))
+		assert.True(t, ziplineeIgnore.IsIgnored("pkg/coverage/index.html", false))
+	})
+
+	t.Run("SupportsCharacterClassesAndSingleCharacterWildcard", func(t *testing.T) {
+
+		ziplineeIgnore := NewZiplineeIgnore([]string{
+			"file[0-9].txt",
+			"tmp?",
+		})
+
+		// act
+		filtered := ziplineeIgnore.Filter([]string{"file1.txt", "fileA.txt", "tmp1", "tmp12"})
+
+		assert.Equal(t, []string{"fileA.txt", "tmp12"}, filtered)
+	})
+}
+
+func TestReadZiplineeIgnore(t *testing.T) {
+
+	t.Run("ReadsIgnoreFileFromDirectory", func(t *testing.T) {
+
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, ".ziplineeignore"), []byte("target/\n*.class\n"), 0644)
+		assert.Nil(t, err)
+
+		// act
+		ziplineeIgnore, err := ReadZiplineeIgnore(dir)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"pom.xml"}, ziplineeIgnore.Filter([]string{"pom.xml", "target/app.jar", "Main.class"}))
+	})
+
+	t.Run("IgnoresNothingWhenFileDoesNotExist", func(t *testing.T) {
+
+		// act
+		ziplineeIgnore, err := ReadZiplineeIgnore(t.TempDir())
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"pom.xml", "target/app.jar"}, ziplineeIgnore.Filter([]string{"pom.xml", "target/app.jar"}))
+	})
+}